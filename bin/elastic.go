@@ -47,6 +47,27 @@ var (
 	elastic_command_dump_sort = elastic_command_dump.Flag(
 		"sort", "A field to sort by (default 'timestamp')").
 		Default("timestamp").String()
+
+	elastic_command_migrate = elastic_command.Command(
+		"migrate_org", "Move an org to another OpenSearch cluster while it is in use")
+
+	elastic_command_migrate_org_id = elastic_command_migrate.Arg(
+		"org_id", "The OrgID to migrate").Required().String()
+
+	elastic_command_migrate_cluster = elastic_command_migrate.Arg(
+		"cluster", "The name of the cluster to migrate the org to").String()
+
+	elastic_command_migrate_abort = elastic_command_migrate.Flag(
+		"abort", "Abort a failed migration and remove the copied data").Bool()
+
+	elastic_command_schema = elastic_command.Command(
+		"migrate", "Update the index templates and migrate existing indexes to the current schema")
+
+	elastic_command_schema_dry_run = elastic_command_schema.Flag(
+		"dry_run", "Only show the pending migration steps").Bool()
+
+	elastic_command_schema_org_id = elastic_command_schema.Flag(
+		"org_id", "Only migrate this OrgID (templates are always updated)").String()
 )
 
 func doResetElastic() error {
@@ -152,6 +173,98 @@ func doDumpElastic() error {
 	return nil
 }
 
+func doMigrateOrg() error {
+	config_obj, err := loadConfig(makeDefaultConfigLoader())
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+
+	ctx, cancel := install_sig_handler()
+	defer cancel()
+
+	err = services.StartElasticSearchService(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
+	org_id := *elastic_command_migrate_org_id
+
+	// Stop writing to the target and remove the partial copy.
+	if *elastic_command_migrate_abort {
+		target, err := services.AbortOrgMigration(ctx, org_id)
+		if err != nil {
+			return err
+		}
+		return schema.DeleteFromCluster(ctx, config_obj.VeloConf(),
+			org_id, target)
+	}
+
+	if *elastic_command_migrate_cluster == "" {
+		return fmt.Errorf("A target cluster is required")
+	}
+
+	// Make sure the target cluster can hold the org's data.
+	err = schema.InstallIndexTemplates(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
+	source, err := services.MigrateOrg(ctx, config_obj.VeloConf(),
+		org_id, *elastic_command_migrate_cluster)
+	if err != nil {
+		return err
+	}
+
+	// The org is now served from the target so the source copy can
+	// go.
+	return schema.DeleteFromCluster(ctx, config_obj.VeloConf(),
+		org_id, source)
+}
+
+func doMigrateSchema() error {
+	config_obj, err := loadConfig(makeDefaultConfigLoader())
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+
+	ctx, cancel := install_sig_handler()
+	defer cancel()
+
+	err = services.StartElasticSearchService(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
+	if *elastic_command_schema_dry_run {
+		pending, err := schema.PlanMigrations(ctx, config_obj)
+		if err != nil {
+			return err
+		}
+
+		for _, step := range pending {
+			if *elastic_command_schema_org_id != "" &&
+				step.Kind != schema.MIGRATION_TEMPLATE &&
+				step.OrgId != *elastic_command_schema_org_id {
+				continue
+			}
+			fmt.Println(string(json.MustMarshalIndent(step)))
+		}
+		return nil
+	}
+
+	if *elastic_command_schema_org_id == "" {
+		return schema.RunMigrations(ctx, config_obj)
+	}
+
+	err = schema.InstallIndexTemplates(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
+	return schema.MigrateOrgSchema(ctx, config_obj,
+		*elastic_command_schema_org_id)
+}
+
 func init() {
 	command_handlers = append(command_handlers, func(command string) bool {
 		if command == elastic_command_reset.FullCommand() {
@@ -164,6 +277,16 @@ func init() {
 			return true
 		}
 
+		if command == elastic_command_migrate.FullCommand() {
+			FatalIfError(elastic_command_migrate, doMigrateOrg)
+			return true
+		}
+
+		if command == elastic_command_schema.FullCommand() {
+			FatalIfError(elastic_command_schema, doMigrateSchema)
+			return true
+		}
+
 		return false
 	})
 }
@@ -14,6 +14,10 @@ import (
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/logging"
 
+	// Register the embedded backend so it can be selected by
+	// the backend setting in the config.
+	_ "www.velocidex.com/golang/cloudvelo/services/embedded"
+
 	// Import all vql plugins.
 	_ "www.velocidex.com/golang/velociraptor/vql_plugins"
 )
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"archive/zip"
 	"fmt"
+	"os"
 
+	"www.velocidex.com/golang/cloudvelo/services/orgs"
 	"www.velocidex.com/golang/cloudvelo/services/users"
 	"www.velocidex.com/golang/cloudvelo/startup"
 	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
@@ -21,6 +24,24 @@ var (
 				Required().String()
 	orgs_user_add_user = orgs_user_add.Arg("username", "Username to add").
 				Required().String()
+
+	orgs_export     = orgs_command.Command("export", "Export an org to an archive")
+	orgs_export_org = orgs_export.Arg("org_id", "Org ID to export").
+			Required().String()
+	orgs_export_file = orgs_export.Arg("output", "Path of the archive to write").
+				Required().String()
+	orgs_export_transient = orgs_export.Flag("transient",
+		"Also export the org's result sets, logs and events").Bool()
+
+	orgs_import      = orgs_command.Command("import", "Create a new org from an archive")
+	orgs_import_file = orgs_import.Arg("archive", "Path of the archive to import").
+				Required().ExistingFile()
+	orgs_import_org = orgs_import.Flag("org_id",
+		"Org ID for the new org (default a new random ID)").String()
+	orgs_import_name = orgs_import.Flag("name",
+		"Name for the new org (default the exported org's name)").String()
+	orgs_import_new_nonce = orgs_import.Flag("new_nonce",
+		"Give the org a new nonce. Existing clients will not be able to connect").Bool()
 )
 
 func doOrgUserAdd() error {
@@ -62,12 +83,97 @@ func doOrgUserAdd() error {
 	return user_manager.SetUser(ctx, record)
 }
 
+func doOrgExport() error {
+	config_obj, err := loadConfig(makeDefaultConfigLoader().
+		WithRequiredFrontend().
+		WithRequiredLogging())
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+
+	ctx, cancel := install_sig_handler()
+	defer cancel()
+
+	sm, err := startup.StartToolServices(ctx, config_obj)
+	defer sm.Close()
+
+	if err != nil {
+		return err
+	}
+
+	fd, err := os.OpenFile(*orgs_export_file,
+		os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	err = orgs.ExportOrg(ctx, config_obj.VeloConf(),
+		*orgs_export_org, fd, *orgs_export_transient)
+	if err != nil {
+		return err
+	}
+
+	return fd.Close()
+}
+
+func doOrgImport() error {
+	config_obj, err := loadConfig(makeDefaultConfigLoader().
+		WithRequiredFrontend().
+		WithRequiredUser().
+		WithRequiredLogging())
+	if err != nil {
+		return fmt.Errorf("loading config file: %w", err)
+	}
+
+	ctx, cancel := install_sig_handler()
+	defer cancel()
+
+	sm, err := startup.StartToolServices(ctx, config_obj)
+	defer sm.Close()
+
+	if err != nil {
+		return err
+	}
+
+	err = users.StartUserManager(sm.Ctx, sm.Wg, config_obj)
+	if err != nil {
+		return err
+	}
+
+	archive, err := zip.OpenReader(*orgs_import_file)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	record, err := orgs.ImportOrg(ctx, config_obj.VeloConf(),
+		&archive.Reader, orgs.OrgImportOptions{
+			OrgId:    *orgs_import_org,
+			Name:     *orgs_import_name,
+			NewNonce: *orgs_import_new_nonce,
+		})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Imported org %v (%v) with nonce %v\n",
+		record.Id, record.Name, record.Nonce)
+	return nil
+}
+
 func init() {
 	command_handlers = append(command_handlers, func(command string) bool {
 		switch command {
 		case orgs_user_add.FullCommand():
 			FatalIfError(orgs_user_add, doOrgUserAdd)
 
+		case orgs_export.FullCommand():
+			FatalIfError(orgs_export, doOrgExport)
+
+		case orgs_import.FullCommand():
+			FatalIfError(orgs_import, doOrgImport)
+
 		default:
 			return false
 		}
@@ -18,7 +18,29 @@ type Tool struct {
 	URL  string `json:"url"`
 }
 
+type Cluster struct {
+	Name      string   `json:"name"`
+	Addresses []string `json:"addresses"`
+}
+
+// How long transient data is kept. Ages use the OpenSearch time
+// units, e.g. "12h" or "90d".
+type RetentionPolicy struct {
+	// Start a new backing index after this age.
+	RolloverAge string `json:"rollover_age"`
+
+	// Delete backing indexes after this age.
+	DeleteAge string `json:"delete_age"`
+}
+
 type ElasticConfiguration struct {
+	// Where documents are stored: "opensearch" (the default) or
+	// "embedded" which keeps them in a local SQLite database at
+	// EmbeddedDatabase (in memory if not set). The embedded backend
+	// is meant for small single node deployments and testing.
+	Backend          string `json:"backend"`
+	EmbeddedDatabase string `json:"embedded_database"`
+
 	Username           string   `json:"username"`
 	Password           string   `json:"password"`
 	APIKey             string   `json:"api_key"`
@@ -29,6 +51,13 @@ type ElasticConfiguration struct {
 	DisableSSLSecurity bool     `json:"disable_ssl_security"`
 	RootCerts          string   `json:"root_cert"`
 
+	// Any number of additional named OpenSearch clusters. The
+	// cluster each org lives on is recorded in the placement
+	// table. New orgs are placed on the default cluster (default
+	// primary).
+	Clusters       []Cluster `json:"clusters"`
+	DefaultCluster string    `json:"default_cluster"`
+
 	// The name of the index we should use (default velociraptor)
 	Index string `json:"index"`
 
@@ -43,6 +72,8 @@ type ElasticConfiguration struct {
 
 	ForemanIntervalSeconds int `json:"foreman_interval_seconds"`
 
+	// Only these tools may be added to the inventory. If a URL is
+	// given the tool is always downloaded from there.
 	ApprovedTools       []Tool   `json:"approved_tools"`
 	DedicatedForeman    bool     `json:"dedicated_foreman"`
 	DedicatedForemanOrg string   `json:"dedicated_foreman_org"`
@@ -55,6 +86,42 @@ type ElasticConfiguration struct {
 
 	// Minimum amount of time we cache flow indexes (Default 1)
 	MinFlowCacheTimeMin int64 `json:"min_flow_cache_time_min"`
+
+	// How long tasks queued for clients remain valid. Clients that
+	// check in after this time will not receive the task. Hunt tasks
+	// expire with the hunt instead (Default 0 - tasks do not expire).
+	TaskExpiryHours int64 `json:"task_expiry_hours"`
+
+	// Bulk index items that can not be delivered to OpenSearch are
+	// spooled and replayed when the cluster recovers. The spool is
+	// either a local directory or a prefix in the bucket (the
+	// directory is preferred if both are set). If neither is set
+	// undeliverable items are dropped.
+	SpoolDirectory string `json:"spool_directory"`
+	SpoolS3Prefix  string `json:"spool_s3_prefix"`
+
+	// Requests that fail because OpenSearch is overloaded or
+	// unavailable are retried (Default 5 attempts). After
+	// CircuitBreakerThreshold consecutive failures (Default 10)
+	// requests to the cluster fail immediately for
+	// CircuitBreakerResetSeconds (Default 30).
+	RetryAttempts              int `json:"retry_attempts"`
+	CircuitBreakerThreshold    int `json:"circuit_breaker_threshold"`
+	CircuitBreakerResetSeconds int `json:"circuit_breaker_reset_seconds"`
+
+	// Retention of transient data by data class: transient,
+	// transient_collections, transient_events, transient_logs and
+	// transient_tasks (Default rollover after 5d and delete after
+	// 15d). Orgs may override the retention of any class.
+	Retention    map[string]RetentionPolicy            `json:"retention"`
+	OrgRetention map[string]map[string]RetentionPolicy `json:"org_retention"`
+
+	// The foreman backs up each org's persisted index into the
+	// bucket every BackupPeriodSeconds (Default 86400 - daily, a
+	// negative value disables backups) and keeps the last
+	// BackupRetention backups (Default 7).
+	BackupPeriodSeconds int64 `json:"backup_period_seconds"`
+	BackupRetention     int   `json:"backup_retention"`
 }
 
 // Create a new cloud config object which contains the original
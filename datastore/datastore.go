@@ -103,6 +103,10 @@ func (self ElasticDatastore) GetSubject(
 	path api.DSPathSpec,
 	message proto.Message) error {
 
+	if isSecretPath(path) {
+		return self.getSecret(config_obj, path, message)
+	}
+
 	id := services.MakeId(path.AsClientPath())
 
 	hits, _, err := services.QueryElasticRaw(self.ctx, config_obj.OrgId,
@@ -136,6 +140,10 @@ func (self ElasticDatastore) SetSubject(
 	path api.DSPathSpec,
 	message proto.Message) error {
 
+	if isSecretPath(path) {
+		return self.setSecret(config_obj, path, message)
+	}
+
 	serialized, err := json.Marshal(message)
 	if err != nil {
 		return err
@@ -167,6 +175,10 @@ func (self ElasticDatastore) DeleteSubject(
 	config_obj *config_proto.Config,
 	urn api.DSPathSpec) error {
 
+	if isSecretPath(urn) {
+		return self.deleteSecret(config_obj, urn, services.SyncDelete)
+	}
+
 	id := services.MakeId(urn.AsClientPath())
 	return services.DeleteDocumentByQuery(
 		self.ctx, config_obj.OrgId, "transient", json.Format(delete_datastore_doc_query, id), services.SyncDelete)
@@ -175,6 +187,10 @@ func (self ElasticDatastore) DeleteSubject(
 func (self ElasticDatastore) DeleteSubjectWithCompletion(
 	config_obj *config_proto.Config,
 	urn api.DSPathSpec, completion func()) error {
+	if isSecretPath(urn) {
+		return self.deleteSecret(config_obj, urn, services.AsyncDelete)
+	}
+
 	id := services.MakeId(urn.AsClientPath())
 	return services.DeleteDocumentByQuery(
 		self.ctx, config_obj.OrgId, "transient", json.Format(delete_datastore_doc_query, id), services.AsyncDelete)
@@ -184,6 +200,10 @@ func (self ElasticDatastore) ListChildren(
 	config_obj *config_proto.Config,
 	urn api.DSPathSpec) ([]api.DSPathSpec, error) {
 
+	if isSecretPath(urn) {
+		return self.listSecrets(config_obj, urn)
+	}
+
 	db, err := datastore.GetDB(config_obj)
 	if err != nil {
 		return nil, err
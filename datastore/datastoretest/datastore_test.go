@@ -9,6 +9,8 @@ import (
 	"www.velocidex.com/golang/cloudvelo/datastore"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/cloudvelo/testsuite"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
 	"www.velocidex.com/golang/velociraptor/json"
 	"www.velocidex.com/golang/velociraptor/utils"
 )
@@ -81,10 +83,50 @@ func (self *DatastoreTest) TestDownloadQueriesOnTransientIndex() {
 	assert.NoError(self.T(), err)
 	assert.Equal(self.T(), 1, len(result))
 }
+
+func (self *DatastoreTest) TestSecretsAreEncrypted() {
+	config_obj := self.ConfigObj.VeloConf()
+	db := datastore.NewElasticDatastore(self.Ctx, self.ConfigObj)
+
+	secret_path := path_specs.NewUnsafeDatastorePath(
+		datastore.SECRETS_ROOT, "HTTP Secrets", "MySecret")
+	err := db.SetSubject(config_obj, secret_path, &api_proto.Hunt{
+		HuntDescription: "Very secret",
+	})
+	assert.NoError(self.T(), err)
+
+	// Read it back
+	secret := &api_proto.Hunt{}
+	err = db.GetSubject(config_obj, secret_path, secret)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), "Very secret", secret.HuntDescription)
+
+	// The secret is not stored in the clear.
+	err = cvelo_services.FlushIndex(self.Ctx, "test", "persisted")
+	assert.NoError(self.T(), err)
+
+	hits, _, err := cvelo_services.QueryElasticRaw(self.Ctx, "test",
+		"persisted", `{"query": {"match": {"doc_type": "secret"}}}`)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(hits))
+	assert.NotContains(self.T(), string(hits[0]), "Very secret")
+
+	children, err := db.ListChildren(config_obj, secret_path.Dir())
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(children))
+	assert.Equal(self.T(), secret_path.AsClientPath(), children[0].AsClientPath())
+
+	err = db.DeleteSubject(config_obj, secret_path)
+	assert.NoError(self.T(), err)
+
+	err = db.GetSubject(config_obj, secret_path, secret)
+	assert.Error(self.T(), err)
+}
+
 func TestDataStore(t *testing.T) {
 	suite.Run(t, &DatastoreTest{
 		CloudTestSuite: &testsuite.CloudTestSuite{
-			Indexes: []string{"transient"},
+			Indexes: []string{"transient", "persisted"},
 		},
 	})
 }
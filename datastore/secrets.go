@@ -0,0 +1,250 @@
+package datastore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"io"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"www.velocidex.com/golang/cloudvelo/services"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// Secrets are managed by the secrets service which keeps them in the
+// datastore below this directory. Unlike other datastore records
+// secrets must never expire so they are kept in the persisted index,
+// encrypted with a per org key derived from the frontend private
+// key.
+const SECRETS_ROOT = "secrets"
+
+const list_secrets_query = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"term": {"type": %q}},
+         {"match": {"doc_type": "secret"}}
+      ]}
+  }
+}
+`
+
+type SecretRecord struct {
+	Name string `json:"name"`
+
+	// The directory containing the secret. Used to list secrets.
+	Type string `json:"type"`
+
+	// The encrypted serialized record.
+	JSONData  string `json:"data"`
+	DocType   string `json:"doc_type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func isSecretPath(path api.DSPathSpec) bool {
+	components := path.Components()
+	return len(components) > 0 && components[0] == SECRETS_ROOT
+}
+
+func secretDocId(path api.DSPathSpec) string {
+	return services.MakeId("secret:" + path.AsClientPath())
+}
+
+func (self ElasticDatastore) getSecret(
+	config_obj *config_proto.Config,
+	path api.DSPathSpec,
+	message proto.Message) error {
+
+	serialized, err := services.GetElasticRecord(self.ctx,
+		config_obj.OrgId, services.PERSISTED, secretDocId(path))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return utils.NotFoundError
+		}
+		return err
+	}
+
+	record := &SecretRecord{}
+	err = json.Unmarshal(serialized, record)
+	if err != nil {
+		return err
+	}
+
+	plain_text, err := decryptSecret(config_obj, record.JSONData)
+	if err != nil {
+		return err
+	}
+
+	return protojson.Unmarshal(plain_text, message)
+}
+
+func (self ElasticDatastore) setSecret(
+	config_obj *config_proto.Config,
+	path api.DSPathSpec,
+	message proto.Message) error {
+
+	serialized, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := encryptSecret(config_obj, serialized)
+	if err != nil {
+		return err
+	}
+
+	components := path.Components()
+	return services.SetElasticIndex(self.ctx,
+		config_obj.OrgId, services.PERSISTED, secretDocId(path),
+		&SecretRecord{
+			Name:      components[len(components)-1],
+			Type:      path.Dir().AsClientPath(),
+			JSONData:  encrypted,
+			DocType:   "secret",
+			Timestamp: utils.GetTime().Now().UnixNano(),
+		})
+}
+
+func (self ElasticDatastore) deleteSecret(
+	config_obj *config_proto.Config,
+	path api.DSPathSpec, sync bool) error {
+	return services.DeleteDocument(self.ctx, config_obj.OrgId,
+		services.PERSISTED, secretDocId(path), sync)
+}
+
+func (self ElasticDatastore) listSecrets(
+	config_obj *config_proto.Config,
+	path api.DSPathSpec) ([]api.DSPathSpec, error) {
+
+	hits, err := services.QueryChan(self.ctx, config_obj, 1000,
+		config_obj.OrgId, services.PERSISTED,
+		json.Format(list_secrets_query, path.AsClientPath()), "name")
+	if err != nil {
+		return nil, err
+	}
+
+	var results []api.DSPathSpec
+	for hit := range hits {
+		record := &SecretRecord{}
+		err = json.Unmarshal(hit, record)
+		if err != nil {
+			continue
+		}
+
+		results = append(results, path.AddUnsafeChild(record.Name))
+	}
+
+	return results, nil
+}
+
+// Org archives carry the secrets decrypted since the key of the org
+// they are imported into is different. The record is returned with
+// the secret in plain text.
+func DecryptSecretRecord(config_obj *config_proto.Config,
+	serialized json.RawMessage) (json.RawMessage, error) {
+	record := &SecretRecord{}
+	err := json.Unmarshal(serialized, record)
+	if err != nil {
+		return nil, err
+	}
+
+	plain_text, err := decryptSecret(config_obj, record.JSONData)
+	if err != nil {
+		return nil, err
+	}
+	record.JSONData = string(plain_text)
+
+	return json.Marshal(record)
+}
+
+// Encrypt a record decrypted with DecryptSecretRecord() with the
+// org's key.
+func EncryptSecretRecord(config_obj *config_proto.Config,
+	serialized json.RawMessage) (json.RawMessage, error) {
+	record := &SecretRecord{}
+	err := json.Unmarshal(serialized, record)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted, err := encryptSecret(config_obj, []byte(record.JSONData))
+	if err != nil {
+		return nil, err
+	}
+	record.JSONData = encrypted
+
+	return json.Marshal(record)
+}
+
+// Each org gets its own key so secrets can not be moved between orgs.
+func getSecretsKey(config_obj *config_proto.Config) ([]byte, error) {
+	if config_obj.Frontend == nil || config_obj.Frontend.PrivateKey == "" {
+		return nil, errors.New("No frontend private key to derive the secrets key from")
+	}
+
+	mac := hmac.New(sha256.New, []byte(config_obj.Frontend.PrivateKey))
+	mac.Write([]byte("secrets:" + utils.GetOrgId(config_obj)))
+	return mac.Sum(nil), nil
+}
+
+func getSecretsCipher(config_obj *config_proto.Config) (cipher.AEAD, error) {
+	key, err := getSecretsKey(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func encryptSecret(
+	config_obj *config_proto.Config, plain_text []byte) (string, error) {
+	aead, err := getSecretsCipher(config_obj)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	_, err = io.ReadFull(rand.Reader, nonce)
+	if err != nil {
+		return "", err
+	}
+
+	// The nonce is stored in front of the cipher text.
+	cipher_text := aead.Seal(nonce, nonce, plain_text, nil)
+	return base64.StdEncoding.EncodeToString(cipher_text), nil
+}
+
+func decryptSecret(
+	config_obj *config_proto.Config, encoded string) ([]byte, error) {
+	aead, err := getSecretsCipher(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	cipher_text, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(cipher_text) < aead.NonceSize() {
+		return nil, errors.New("Secret is too short")
+	}
+
+	nonce := cipher_text[:aead.NonceSize()]
+	return aead.Open(nil, nonce, cipher_text[aead.NonceSize():], nil)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"crypto/tls"
 	"errors"
+	"fmt"
+	"io"
 	"net/http"
 	"strings"
 	"time"
@@ -115,6 +117,157 @@ func (self S3Filestore) Delete(filename api.FSPathSpec) error {
 	return err
 }
 
+// Remove all the objects below the directory. The callback is
+// called for each key as it is removed. If really_do_it is not set,
+// the keys are only reported.
+func (self S3Filestore) DeleteDirectory(
+	ctx context.Context, dirname api.FSPathSpec,
+	really_do_it bool, cb func(key string, err error)) error {
+
+	prefix := PathspecToKey(self.config_obj,
+		dirname.SetType(api.PATH_TYPE_DATASTORE_DIRECTORY)) + "/"
+
+	return self.DeletePrefix(ctx, prefix, really_do_it, cb)
+}
+
+// Remove all objects with the specified key prefix. Objects are
+// listed and removed one page at a time so this works for very large
+// prefixes.
+func (self S3Filestore) DeletePrefix(
+	ctx context.Context, prefix string,
+	really_do_it bool, cb func(key string, err error)) error {
+
+	defer Instrument("S3Filestore.DeletePrefix")()
+
+	svc := s3.New(self.session)
+
+	var delete_err error
+	err := svc.ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(self.bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, last_page bool) bool {
+			if len(page.Contents) == 0 {
+				return true
+			}
+
+			if !really_do_it {
+				for _, object := range page.Contents {
+					cb(*object.Key, nil)
+				}
+				return true
+			}
+
+			// Pages are at most 1000 objects which is also the
+			// limit on DeleteObjects.
+			objects := make([]*s3.ObjectIdentifier, 0, len(page.Contents))
+			for _, object := range page.Contents {
+				objects = append(objects, &s3.ObjectIdentifier{
+					Key: object.Key,
+				})
+			}
+
+			resp, err := svc.DeleteObjectsWithContext(ctx,
+				&s3.DeleteObjectsInput{
+					Bucket: aws.String(self.bucket),
+					Delete: &s3.Delete{
+						Objects: objects,
+						Quiet:   aws.Bool(true),
+					},
+				})
+			if err != nil {
+				delete_err = err
+				return false
+			}
+
+			failed := make(map[string]error)
+			for _, e := range resp.Errors {
+				failed[aws.StringValue(e.Key)] = fmt.Errorf(
+					"%v: %v", aws.StringValue(e.Code),
+					aws.StringValue(e.Message))
+			}
+
+			for _, object := range page.Contents {
+				cb(*object.Key, failed[*object.Key])
+			}
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	return delete_err
+}
+
+// Call the callback for each object with the key prefix. Objects are
+// listed one page at a time.
+func (self S3Filestore) ListPrefix(
+	ctx context.Context, prefix string,
+	cb func(key string, size int64) error) error {
+
+	defer Instrument("S3Filestore.ListPrefix")()
+
+	svc := s3.New(self.session)
+
+	var cb_err error
+	err := svc.ListObjectsV2PagesWithContext(ctx,
+		&s3.ListObjectsV2Input{
+			Bucket: aws.String(self.bucket),
+			Prefix: aws.String(prefix),
+		}, func(page *s3.ListObjectsV2Output, last_page bool) bool {
+			for _, object := range page.Contents {
+				cb_err = cb(aws.StringValue(object.Key),
+					aws.Int64Value(object.Size))
+				if cb_err != nil {
+					return false
+				}
+			}
+			return true
+		})
+	if err != nil {
+		return err
+	}
+	return cb_err
+}
+
+// Read the object with the raw key. The caller must close the reader.
+func (self S3Filestore) GetObject(
+	ctx context.Context, key string) (io.ReadCloser, error) {
+	svc := s3.New(self.session)
+	resp, err := svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// Write the object with the raw key. Large objects are uploaded in
+// parts.
+func (self S3Filestore) PutObject(
+	ctx context.Context, key string, reader io.Reader) error {
+	uploader := s3manager.NewUploader(self.session)
+	_, err := uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(key),
+		Body:   reader,
+	})
+	return err
+}
+
+// Get a time limited URL that allows the object to be downloaded
+// directly from the bucket without credentials.
+func (self S3Filestore) GetPresignedURL(
+	filename api.FSPathSpec, expiry time.Duration) (string, error) {
+	svc := s3.New(self.session)
+	req, _ := svc.GetObjectRequest(&s3.GetObjectInput{
+		Bucket: aws.String(self.bucket),
+		Key:    aws.String(PathspecToKey(self.config_obj, filename)),
+	})
+	return req.Presign(expiry)
+}
+
 func (self S3Filestore) Move(src, dest api.FSPathSpec) error {
 	return errors.New("S3Filestore.Move is not implemented")
 }
@@ -1,8 +1,13 @@
 package filestore
 
 import (
+	"context"
+	"io"
+	"time"
+
 	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/utils"
 )
 
 func GetOrgId(file_store_obj api.FileStore) string {
@@ -23,3 +28,86 @@ func GetConfigObj(file_store_obj api.FileStore) *config.Config {
 		return nil
 	}
 }
+
+// Remove all the files below the directory in the filestore.
+func DeleteDirectory(ctx context.Context,
+	file_store_obj api.FileStore, dirname api.FSPathSpec,
+	really_do_it bool, cb func(key string, err error)) error {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.DeleteDirectory(ctx, dirname, really_do_it, cb)
+	case S3Filestore:
+		return t.DeleteDirectory(ctx, dirname, really_do_it, cb)
+	default:
+		return utils.NotImplementedError
+	}
+}
+
+// Remove all the objects with the key prefix in the filestore.
+func DeletePrefix(ctx context.Context,
+	file_store_obj api.FileStore, prefix string,
+	really_do_it bool, cb func(key string, err error)) error {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.DeletePrefix(ctx, prefix, really_do_it, cb)
+	case S3Filestore:
+		return t.DeletePrefix(ctx, prefix, really_do_it, cb)
+	default:
+		return utils.NotImplementedError
+	}
+}
+
+// List the objects with the key prefix in the filestore.
+func ListPrefix(ctx context.Context,
+	file_store_obj api.FileStore, prefix string,
+	cb func(key string, size int64) error) error {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.ListPrefix(ctx, prefix, cb)
+	case S3Filestore:
+		return t.ListPrefix(ctx, prefix, cb)
+	default:
+		return utils.NotImplementedError
+	}
+}
+
+// Read an object by its raw key rather than a path spec.
+func GetObject(ctx context.Context,
+	file_store_obj api.FileStore, key string) (io.ReadCloser, error) {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.GetObject(ctx, key)
+	case S3Filestore:
+		return t.GetObject(ctx, key)
+	default:
+		return nil, utils.NotImplementedError
+	}
+}
+
+// Write an object by its raw key rather than a path spec.
+func PutObject(ctx context.Context,
+	file_store_obj api.FileStore, key string, reader io.Reader) error {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.PutObject(ctx, key, reader)
+	case S3Filestore:
+		return t.PutObject(ctx, key, reader)
+	default:
+		return utils.NotImplementedError
+	}
+}
+
+// Get a URL that can be used to download the file without
+// credentials.
+func GetPresignedURL(
+	file_store_obj api.FileStore, filename api.FSPathSpec,
+	expiry time.Duration) (string, error) {
+	switch t := file_store_obj.(type) {
+	case *S3Filestore:
+		return t.GetPresignedURL(filename, expiry)
+	case S3Filestore:
+		return t.GetPresignedURL(filename, expiry)
+	default:
+		return "", utils.NotImplementedError
+	}
+}
@@ -6,6 +6,7 @@ package foreman
 
 import (
 	"context"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +16,7 @@ import (
 	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
 	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/json"
@@ -59,17 +61,44 @@ type Foreman struct {
 	next_run_time time.Time
 }
 
+// Stop the hunt and cancel its outstanding tasks.
 func (self Foreman) stopHunt(
 	ctx context.Context,
 	org_config_obj *config_proto.Config, hunt *api_proto.Hunt) error {
-	stopHuntQuery := `
+	err := self.setHuntStopped(ctx, org_config_obj, hunt)
+	if err != nil {
+		return err
+	}
+
+	return hunt_dispatcher.CancelHuntTasks(ctx, org_config_obj, hunt.HuntId)
+}
+
+const (
+	stop_hunt_painless = "ctx._source.state='STOPPED';"
+)
+
+func setStopped(doc, params map[string]interface{}) error {
+	doc["state"] = "STOPPED"
+	return nil
+}
+
+func init() {
+	cvelo_services.RegisterUpdateScript(stop_hunt_painless, setStopped)
+}
+
+func (self Foreman) setHuntStopped(
+	ctx context.Context,
+	org_config_obj *config_proto.Config, hunt *api_proto.Hunt) error {
+	stopHuntQuery := json.Format(`
 {
   "script": {
-     "source": "ctx._source.state='STOPPED';",
+     "source": %q,
      "lang": "painless"
   }
 }
-`
+`, stop_hunt_painless)
+
+	hunt_limiter.Forget(org_config_obj.OrgId, hunt.HuntId)
 
 	return cvelo_services.UpdateIndex(
 		ctx, org_config_obj.OrgId, "persisted", hunt.HuntId, stopHuntQuery)
@@ -237,7 +266,7 @@ func (self Foreman) planHuntForClient(
 
 	// Hunt is unconditional, assign it.
 	if hunt.Condition == nil {
-		plan.assignClientToHunt(client_info, hunt)
+		self.assignClientToHunt(ctx, org_config_obj, client_info, hunt, plan)
 		return
 	}
 
@@ -279,7 +308,34 @@ func (self Foreman) planHuntForClient(
 	}
 
 	// If we get here we assign the hunt to the client
-	plan.assignClientToHunt(client_info, hunt)
+	self.assignClientToHunt(ctx, org_config_obj, client_info, hunt, plan)
+}
+
+// Assign the client to the hunt unless the hunt has already reached
+// its client limit. Full hunts are stopped on the next foreman run.
+func (self Foreman) assignClientToHunt(
+	ctx context.Context,
+	org_config_obj *config_proto.Config,
+	client_info *api.ClientRecord,
+	hunt *api_proto.Hunt,
+	plan *Plan) {
+
+	// The client already holds a slot in this plan.
+	if huntsContain(plan.ClientIdToHunts[client_info.ClientId], hunt.HuntId) {
+		return
+	}
+
+	ok, err := hunt_limiter.Reserve(ctx, org_config_obj, hunt)
+	if err != nil {
+		logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+		logger.Error("Foreman: Unable to get client count for hunt %v: %v",
+			hunt.HuntId, err)
+		return
+	}
+
+	if ok {
+		plan.assignClientToHunt(client_info, hunt)
+	}
 }
 
 // Find clients that polled back up to 3 hours and schedule them for
@@ -326,6 +382,7 @@ func (self Foreman) scheduleClientsWithBacklog(
 			seen_hunts, err := self.getClientHuntMembership(
 				ctx, org_config_obj, client_id, hunt_ids)
 			if err != nil {
+				new_plan.releaseHuntSlots(org_config_obj.OrgId, nil)
 				return
 			}
 
@@ -568,6 +625,31 @@ func (self Foreman) GetActiveHunts(
 				return nil
 			}
 
+			// Stop the hunt once it was assigned to as many clients
+			// as it is allowed.
+			exhausted, err := hunt_limiter.IsExhausted(
+				ctx, org_config_obj, hunt)
+			if err != nil {
+				// Skip the hunt this time but keep scheduling
+				// the others.
+				logger := logging.GetLogger(
+					org_config_obj, &logging.FrontendComponent)
+				logger.Error("Foreman: Unable to get client count for hunt %v: %v",
+					hunt.HuntId, err)
+				return nil
+			}
+
+			if exhausted {
+				logger := logging.GetLogger(
+					org_config_obj, &logging.FrontendComponent)
+				logger.Info("Foreman: Hunt %v reached its client limit of %v, stopping.",
+					hunt.HuntId, hunt.ClientLimit)
+
+				// Clients assigned so far count towards the limit
+				// so they should still run the hunt.
+				return self.setHuntStopped(ctx, org_config_obj, hunt)
+			}
+
 			result = append(result, hunt)
 			return nil
 		})
@@ -598,6 +680,7 @@ func (self Foreman) UpdatePlan(
 	logger.Info("calculated updates")
 	if err != nil {
 		logger.Error("Unable to calculate updates: %v", err)
+		plan.releaseHuntSlots(org_config_obj.OrgId, nil)
 		return err
 	}
 
@@ -635,6 +718,8 @@ func (self Foreman) RunOnce(
 		return err
 	}
 
+	var result error
+
 	// Only list orgs that have active hunts
 	if config_obj.Cloud.DedicatedForeman {
 		org, err := org_manager.GetOrg(config_obj.Cloud.DedicatedForemanOrg)
@@ -653,26 +738,61 @@ func (self Foreman) RunOnce(
 	} else {
 		orgs := org_manager.ListOrgs()
 		orgCountGauge.Set(float64(len(orgs)))
+
+		// Orgs are processed cluster by cluster so a problem with one
+		// cluster does not hold up orgs on the others.
+		orgs_by_cluster := make(map[string][]*api_proto.OrgRecord)
 		for _, org := range orgs {
 			if sliceContainsKey(config_obj.Cloud.ForemanExcludedOrgs, org.OrgId) {
 				continue
 			}
-			err := self.runForOrg(ctx, org_manager, org, logger, wg)
-			if err != nil {
-				return err
-			}
+			cluster, err := cvelo_services.GetOrgCluster(ctx, org.OrgId)
 			if err != nil {
 				if logger != nil {
 					logger.Error("UpdatePlan, orgId=%v: %v", org.OrgId, err)
 				}
 				continue
 			}
+			orgs_by_cluster[cluster] = append(orgs_by_cluster[cluster], org)
+		}
+
+		for _, cluster := range cvelo_services.ListClusters() {
+			err := self.runForCluster(ctx, org_manager,
+				orgs_by_cluster[cluster], logger, wg)
+			if err != nil {
+				if logger != nil {
+					logger.Error("UpdatePlan, cluster=%v: %v", cluster, err)
+				}
+				if result == nil {
+					result = err
+				}
+			}
 		}
 	}
 
 	// Make sure to flush out any outstanding writes so the data is
 	// fresh.
-	return cvelo_services.FlushBulkIndexer()
+	err = cvelo_services.FlushBulkIndexer()
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// Stop processing a cluster's orgs on the first error since the
+// cluster is probably unhealthy.
+func (self Foreman) runForCluster(ctx context.Context,
+	org_manager services.OrgManager,
+	orgs []*api_proto.OrgRecord,
+	logger *logging.LogContext,
+	wg *sync.WaitGroup) error {
+	for _, org := range orgs {
+		err := self.runForOrg(ctx, org_manager, org, logger, wg)
+		if err != nil {
+			return fmt.Errorf("orgId=%v: %w", org.OrgId, err)
+		}
+	}
+	return nil
 }
 
 func sliceContainsKey(slice []string, key string) bool {
@@ -703,10 +823,34 @@ func (self Foreman) runForOrg(ctx context.Context,
 		return err
 	}
 	result := self.UpdatePlan(ctx, wg, org_config_obj, plan)
+
+	err = self.purgeExpiredTasks(ctx, org_config_obj)
+	if err != nil {
+		logger.Error("Foreman: Unable to purge expired tasks, org: %v: %v",
+			org_config_obj.OrgId, err)
+	}
+
 	logger.Debug("Foreman run completed, org: %v", org_config_obj.OrgId)
 	return result
 }
 
+// Tasks that were never picked up by their clients are removed once
+// they expire.
+func (self Foreman) purgeExpiredTasks(
+	ctx context.Context, org_config_obj *config_proto.Config) error {
+	client_info_manager, err := services.GetClientInfoManager(org_config_obj)
+	if err != nil {
+		return err
+	}
+
+	revoker, ok := client_info_manager.(cvelo_services.TaskRevoker)
+	if !ok {
+		return nil
+	}
+
+	return revoker.PurgeExpiredTasks(ctx)
+}
+
 func (self *Foreman) Start(
 	ctx context.Context,
 	wg *sync.WaitGroup,
@@ -852,10 +852,396 @@ func (self *ForemanTestSuite) checkAssignedHunts(clientId string, expectedHunts
 	}
 }
 
+// Compile the hunt's request and store it directly in the database.
+func (self *ForemanTestSuite) setHunt(hunt *api_proto.Hunt) {
+	config_obj := self.ConfigObj.VeloConf()
+
+	hunt_service, err := services.GetHuntDispatcher(config_obj)
+	assert.NoError(self.T(), err)
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository, err := manager.GetGlobalRepository(config_obj)
+	assert.NoError(self.T(), err)
+
+	compiled, err := launcher.CompileCollectorArgs(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, services.CompilerOptions{},
+		hunt.StartRequest)
+	assert.NoError(self.T(), err)
+	hunt.StartRequest.CompiledCollectorArgs = compiled
+
+	err = hunt_service.(*hunt_dispatcher.HuntDispatcher).Store.SetHunt(self.Ctx, hunt)
+	assert.NoError(self.T(), err)
+}
+
+func (self *ForemanTestSuite) getHunt(hunt_id string) *api_proto.Hunt {
+	config_obj := self.ConfigObj.VeloConf()
+
+	hunt_service, err := services.GetHuntDispatcher(config_obj)
+	assert.NoError(self.T(), err)
+
+	hunt_obj, err := hunt_service.(*hunt_dispatcher.HuntDispatcher).
+		Store.GetHunt(self.Ctx, hunt_id)
+	assert.NoError(self.T(), err)
+
+	return hunt_obj
+}
+
+// Mark the clients as currently connected.
+func (self *ForemanTestSuite) pingClients(client_ids ...string) {
+	config_obj := self.ConfigObj.VeloConf()
+
+	for _, client_id := range client_ids {
+		err := cvelo_services.SetElasticIndex(
+			self.Ctx, config_obj.OrgId, "persisted", client_id+"_ping",
+			&api.ClientRecord{
+				ClientId: client_id,
+				Ping:     uint64(utils.GetTime().Now().UnixNano()),
+				DocType:  "clients",
+			})
+		assert.NoError(self.T(), err)
+	}
+}
+
+func (self *ForemanTestSuite) TestHuntClientLimit() {
+	cancel := utils.MockTime(utils.NewMockClock(time.Unix(1661391000, 0)))
+	defer cancel()
+
+	config_obj := self.ConfigObj.VeloConf()
+
+	hunt := &api_proto.Hunt{
+		HuntId: "H.ClientLimit",
+		StartRequest: &flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Generic.Client.Info"},
+		},
+		CreateTime:  uint64(utils.GetTime().Now().UnixNano() / 1000),
+		StartTime:   uint64(utils.GetTime().Now().UnixNano() / 1000),
+		State:       api_proto.Hunt_RUNNING,
+		Expires:     uint64(utils.GetTime().Now().Add(24*time.Hour).UnixNano() / 1000),
+		ClientLimit: 2,
+	}
+
+	hunt_service, err := services.GetHuntDispatcher(config_obj)
+	assert.NoError(self.T(), err)
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository, err := manager.GetGlobalRepository(config_obj)
+	assert.NoError(self.T(), err)
+
+	compiled, err := launcher.CompileCollectorArgs(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, services.CompilerOptions{},
+		hunt.StartRequest)
+	assert.NoError(self.T(), err)
+	hunt.StartRequest.CompiledCollectorArgs = compiled
+
+	err = hunt_service.(*hunt_dispatcher.HuntDispatcher).Store.SetHunt(self.Ctx, hunt)
+	assert.NoError(self.T(), err)
+
+	// Four connected clients but the hunt is limited to two.
+	for _, client_id := range []string{"C.1", "C.2", "C.3", "C.4"} {
+		err := cvelo_services.SetElasticIndex(
+			self.Ctx, config_obj.OrgId, "persisted", client_id+"_ping",
+			&api.ClientRecord{
+				ClientId: client_id,
+				Ping:     uint64(utils.GetTime().Now().UnixNano()),
+				DocType:  "clients",
+			})
+		assert.NoError(self.T(), err)
+	}
+
+	foreman_service := NewForeman()
+	foreman_service.last_run_time = utils.GetTime().Now().Add(-10 * time.Minute)
+
+	plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	wg := &sync.WaitGroup{}
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	assigned := 0
+	for _, client_id := range []string{"C.1", "C.2", "C.3", "C.4"} {
+		client := self.getClientRecord(client_id)
+		if utils.InString(client.AssignedHunts, "H.ClientLimit") {
+			assigned++
+		}
+	}
+	assert.Equal(self.T(), 2, assigned)
+
+	// The next run stops the hunt because it is full.
+	new_plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, new_plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	assert.Equal(self.T(), 0, len(new_plan.ClientIdToHunts))
+
+	hunt_obj, err := hunt_service.(*hunt_dispatcher.HuntDispatcher).
+		Store.GetHunt(self.Ctx, "H.ClientLimit")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), api_proto.Hunt_STOPPED, hunt_obj.State)
+}
+
+// Slots reserved by a plan which was never executed are given back.
+func (self *ForemanTestSuite) TestHuntClientLimitRelease() {
+	cancel := utils.MockTime(utils.NewMockClock(time.Unix(1661391000, 0)))
+	defer cancel()
+
+	config_obj := self.ConfigObj.VeloConf()
+
+	self.setHunt(&api_proto.Hunt{
+		HuntId: "H.ClientLimitRelease",
+		StartRequest: &flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Generic.Client.Info"},
+		},
+		State:       api_proto.Hunt_RUNNING,
+		Expires:     uint64(utils.GetTime().Now().Add(24*time.Hour).UnixNano() / 1000),
+		ClientLimit: 1,
+	})
+	hunt := self.getHunt("H.ClientLimitRelease")
+
+	foreman_service := NewForeman()
+
+	plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	foreman_service.assignClientToHunt(self.Ctx, config_obj,
+		&api.ClientRecord{ClientId: "C.1"}, hunt, plan)
+	foreman_service.assignClientToHunt(self.Ctx, config_obj,
+		&api.ClientRecord{ClientId: "C.2"}, hunt, plan)
+
+	// The hunt is full after the first client.
+	self.checkPlannedHunts(plan, "C.1", []string{"H.ClientLimitRelease"})
+	self.checkPlannedHunts(plan, "C.2", []string{})
+
+	// The plan failed so its slot is released.
+	plan.releaseHuntSlots(config_obj.OrgId, nil)
+
+	new_plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	foreman_service.assignClientToHunt(self.Ctx, config_obj,
+		&api.ClientRecord{ClientId: "C.2"}, hunt, new_plan)
+	self.checkPlannedHunts(new_plan, "C.2", []string{"H.ClientLimitRelease"})
+}
+
+func (self *ForemanTestSuite) TestHuntPauseResume() {
+	cancel := utils.MockTime(utils.NewMockClock(time.Unix(1661391000, 0)))
+	defer cancel()
+
+	config_obj := self.ConfigObj.VeloConf()
+
+	self.setHunt(&api_proto.Hunt{
+		HuntId: "H.Paused",
+		StartRequest: &flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Generic.Client.Info"},
+			FlowId:    utils.CreateFlowIdFromHuntId("H.Paused"),
+		},
+		CreateTime: uint64(utils.GetTime().Now().UnixNano() / 1000),
+		StartTime:  uint64(utils.GetTime().Now().UnixNano() / 1000),
+		State:      api_proto.Hunt_RUNNING,
+		Expires:    uint64(utils.GetTime().Now().Add(24*time.Hour).UnixNano() / 1000),
+	})
+
+	self.pingClients("C.BeforePause", "C.Waiting")
+
+	foreman_service := NewForeman()
+	foreman_service.last_run_time = utils.GetTime().Now().Add(-10 * time.Minute)
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	self.checkAssignedHunts("C.BeforePause", []string{"H.Paused"})
+	self.checkAssignedHunts("C.Waiting", []string{"H.Paused"})
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	// C.BeforePause picks up its task, C.Waiting does not.
+	tasks, err := client_info_manager.GetClientTasks(self.Ctx, "C.BeforePause")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+
+	// Pause the hunt - it should not be stopped.
+	hunt_service, err := services.GetHuntDispatcher(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = hunt_service.ModifyHunt(self.Ctx, config_obj, &api_proto.Hunt{
+		HuntId: "H.Paused",
+		State:  api_proto.Hunt_PAUSED,
+	}, "admin")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), api_proto.Hunt_PAUSED,
+		self.getHunt("H.Paused").State)
+
+	// The waiting client does not receive the paused hunt.
+	tasks, err = client_info_manager.PeekClientTasks(self.Ctx, "C.Waiting")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(tasks))
+	client := self.getClientRecord("C.Waiting")
+	assert.Equal(self.T(), 0, len(client.AssignedHunts))
+
+	// A new client appears while the hunt is paused. It is not
+	// scheduled.
+	self.pingClients("C.DuringPause")
+
+	plan, err = NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	assert.Equal(self.T(), 0, len(plan.ClientIdToHunts))
+	client = self.getClientRecord("C.DuringPause")
+	assert.Equal(self.T(), 0, len(client.AssignedHunts))
+
+	// Resuming the hunt only schedules the clients that did not
+	// pick it up yet.
+	err = hunt_service.ModifyHunt(self.Ctx, config_obj, &api_proto.Hunt{
+		HuntId: "H.Paused",
+		State:  api_proto.Hunt_RUNNING,
+	}, "admin")
+	assert.NoError(self.T(), err)
+
+	self.pingClients("C.BeforePause", "C.Waiting", "C.DuringPause")
+
+	plan, err = NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	assert.True(self.T(),
+		!huntPresent("H.Paused", plan.ClientIdToHunts["C.BeforePause"]))
+	self.checkAssignedHunts("C.BeforePause", []string{"H.Paused"})
+	self.checkAssignedHunts("C.Waiting", []string{"H.Paused"})
+	self.checkAssignedHunts("C.DuringPause", []string{"H.Paused"})
+
+	tasks, err = client_info_manager.PeekClientTasks(self.Ctx, "C.Waiting")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+}
+
+func (self *ForemanTestSuite) TestHuntStopCancelsTasks() {
+	cancel := utils.MockTime(utils.NewMockClock(time.Unix(1661391000, 0)))
+	defer cancel()
+
+	config_obj := self.ConfigObj.VeloConf()
+
+	self.setHunt(&api_proto.Hunt{
+		HuntId: "H.Stopped",
+		StartRequest: &flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Generic.Client.Info"},
+			FlowId:    utils.CreateFlowIdFromHuntId("H.Stopped"),
+		},
+		CreateTime: uint64(utils.GetTime().Now().UnixNano() / 1000),
+		StartTime:  uint64(utils.GetTime().Now().UnixNano() / 1000),
+		State:      api_proto.Hunt_RUNNING,
+		Expires:    uint64(utils.GetTime().Now().Add(24*time.Hour).UnixNano() / 1000),
+	})
+
+	self.pingClients("C.Online", "C.Offline", "C.Done")
+
+	foreman_service := NewForeman()
+	foreman_service.last_run_time = utils.GetTime().Now().Add(-10 * time.Minute)
+
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+
+	plan, err := NewPlan(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = foreman_service.UpdatePlan(self.Ctx, wg, config_obj, plan)
+	assert.NoError(self.T(), err)
+	wg.Wait()
+
+	self.checkAssignedHunts("C.Online", []string{"H.Stopped"})
+	self.checkAssignedHunts("C.Offline", []string{"H.Stopped"})
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	// C.Online picks up its task and starts the hunt. C.Done
+	// already finished it.
+	for client_id, statuses := range map[string][]string{
+		"C.Online": {"started"},
+		"C.Done":   {"started", "updated"},
+	} {
+		tasks, err := client_info_manager.GetClientTasks(self.Ctx, client_id)
+		assert.NoError(self.T(), err)
+		assert.Equal(self.T(), 1, len(tasks))
+
+		for _, status := range statuses {
+			err = cvelo_services.SetElasticIndex(self.Ctx, config_obj.OrgId,
+				cvelo_services.TRANSIENT, cvelo_services.DocIdRandom,
+				&hunt_dispatcher.HuntFlowEntry{
+					HuntId:    "H.Stopped",
+					ClientId:  client_id,
+					FlowId:    utils.CreateFlowIdFromHuntId("H.Stopped"),
+					Timestamp: utils.GetTime().Now().Unix(),
+					Status:    status,
+					DocType:   "hunt_flow",
+				})
+			assert.NoError(self.T(), err)
+		}
+	}
+
+	hunt_service, err := services.GetHuntDispatcher(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = hunt_service.ModifyHunt(self.Ctx, config_obj, &api_proto.Hunt{
+		HuntId: "H.Stopped",
+		State:  api_proto.Hunt_STOPPED,
+	}, "admin")
+	assert.NoError(self.T(), err)
+
+	// The offline client will never see the hunt and the finished
+	// client has nothing to cancel.
+	for _, client_id := range []string{"C.Offline", "C.Done"} {
+		tasks, err := client_info_manager.PeekClientTasks(self.Ctx, client_id)
+		assert.NoError(self.T(), err)
+		assert.Equal(self.T(), 0, len(tasks))
+	}
+
+	// The online client is told to cancel the collection.
+	tasks, err := client_info_manager.PeekClientTasks(self.Ctx, "C.Online")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+	assert.NotNil(self.T(), tasks[0].Cancel)
+	assert.Equal(self.T(), utils.CreateFlowIdFromHuntId("H.Stopped"),
+		tasks[0].SessionId)
+}
+
 func TestForeman(t *testing.T) {
 	suite.Run(t, &ForemanTestSuite{
 		CloudTestSuite: &testsuite.CloudTestSuite{
-			Indexes: []string{"persisted"},
+			Indexes: []string{"persisted", "transient"},
 		},
 	})
 }
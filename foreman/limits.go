@@ -0,0 +1,207 @@
+package foreman
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+// Hunts may specify a client limit - the maximum number of clients
+// the hunt will be scheduled on. The foreman keeps count of how many
+// clients were assigned to each limited hunt. Since hunts are
+// scheduled from multiple goroutines at the same time (see
+// scheduleClientsWithBacklog) the counts are shared between all
+// plans.
+
+const (
+	countAssignedClientsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+        {
+          "term": {
+            "assigned_hunts": %q
+          }
+        },
+        {
+          "match": {
+            "doc_type": "clients"
+          }
+        }
+      ]
+    }
+  }
+}
+`
+)
+
+var (
+	hunt_limiter = newHuntLimiter()
+)
+
+type huntLimiter struct {
+	mu sync.Mutex
+
+	// Key is org id, hunt id and start time, value is the number of
+	// clients assigned to the hunt so far. Resuming a paused hunt
+	// resets its start time so the assigned clients are counted
+	// again - pausing removes the clients which did not pick up the
+	// hunt yet.
+	assigned map[string]uint64
+}
+
+func limiterPrefix(org_id, hunt_id string) string {
+	return org_id + "/" + hunt_id + "/"
+}
+
+func limiterKey(org_id string, hunt *api_proto.Hunt) string {
+	return fmt.Sprintf("%s%d", limiterPrefix(org_id, hunt.HuntId), hunt.StartTime)
+}
+
+// Make sure the count of the hunt's assigned clients is loaded. The
+// count query goes to the backend so it must not run with the lock
+// held.
+func (self *huntLimiter) load(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	hunt *api_proto.Hunt) (string, error) {
+
+	key := limiterKey(config_obj.OrgId, hunt)
+
+	self.mu.Lock()
+	_, pres := self.assigned[key]
+	self.mu.Unlock()
+
+	if pres {
+		return key, nil
+	}
+
+	// First time we see this hunt - count the clients that were
+	// already assigned to it.
+	total, err := cvelo_services.QueryCountAPI(ctx, config_obj.OrgId,
+		cvelo_services.PERSISTED,
+		json.Format(countAssignedClientsQuery, hunt.HuntId))
+	if err != nil {
+		return "", err
+	}
+
+	count := uint64(total)
+
+	// The hunt's scheduled counter is updated when the clients
+	// actually start the hunt so it might be behind, but it can not
+	// be ahead of the real number of assigned clients.
+	scheduled := hunt.GetStats().GetTotalClientsScheduled()
+	if scheduled > count {
+		count = scheduled
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// Another plan may have loaded the count in the meantime and
+	// already reserved slots against it.
+	_, pres = self.assigned[key]
+	if !pres {
+		self.assigned[key] = count
+	}
+
+	return key, nil
+}
+
+// Reserve a slot in the hunt for another client. Returns false if
+// the hunt already reached its client limit.
+func (self *huntLimiter) Reserve(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	hunt *api_proto.Hunt) (bool, error) {
+
+	if hunt.ClientLimit == 0 {
+		return true, nil
+	}
+
+	key, err := self.load(ctx, config_obj, hunt)
+	if err != nil {
+		return false, err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// The hunt was stopped while we were loading the count.
+	count, pres := self.assigned[key]
+	if !pres || count >= hunt.ClientLimit {
+		return false, nil
+	}
+
+	self.assigned[key] = count + 1
+	return true, nil
+}
+
+// Give back slots which were reserved by a plan that failed to
+// schedule the hunt.
+func (self *huntLimiter) Release(
+	org_id string, hunt *api_proto.Hunt, slots uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	key := limiterKey(org_id, hunt)
+	count, pres := self.assigned[key]
+	if !pres {
+		return
+	}
+
+	if slots > count {
+		slots = count
+	}
+	self.assigned[key] = count - slots
+}
+
+// Returns true when the hunt can not be assigned to any more
+// clients.
+func (self *huntLimiter) IsExhausted(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	hunt *api_proto.Hunt) (bool, error) {
+
+	if hunt.ClientLimit == 0 {
+		return false, nil
+	}
+
+	key, err := self.load(ctx, config_obj, hunt)
+	if err != nil {
+		return false, err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	count, pres := self.assigned[key]
+	return pres && count >= hunt.ClientLimit, nil
+}
+
+// Forget about the hunt once it is stopped. If the hunt is restarted
+// we count the assigned clients again.
+func (self *huntLimiter) Forget(org_id, hunt_id string) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	prefix := limiterPrefix(org_id, hunt_id)
+	for key := range self.assigned {
+		if strings.HasPrefix(key, prefix) {
+			delete(self.assigned, key)
+		}
+	}
+}
+
+func newHuntLimiter() *huntLimiter {
+	return &huntLimiter{
+		assigned: make(map[string]uint64),
+	}
+}
@@ -3,6 +3,7 @@ package foreman
 import (
 	"context"
 	"errors"
+	"time"
 
 	"google.golang.org/protobuf/proto"
 	"www.velocidex.com/golang/cloudvelo/schema/api"
@@ -61,10 +62,12 @@ func (self *Plan) assignClientToHunt(
 	self.ClientIdToClientRecords[client_id] = client_info
 }
 
+// Tasks are only valid until the expires time.
 func (self *Plan) scheduleRequestOnClients(
 	ctx context.Context,
 	org_config_obj *config_proto.Config,
-	request *flows_proto.ArtifactCollectorArgs, clients []string) error {
+	request *flows_proto.ArtifactCollectorArgs, clients []string,
+	expires time.Time) error {
 	// Try to schedule the hunt efficiently
 	launcher_manager, err := services.GetLauncher(org_config_obj)
 	if err != nil {
@@ -96,6 +99,13 @@ func (self *Plan) scheduleRequestOnClients(
 					return
 				}
 
+				queuer, ok := client_manager.(cvelo_services.ExpiringMessageQueuer)
+				if ok {
+					queuer.QueueMessageForClientWithExpiry(
+						ctx, client_id, task, expires)
+					return
+				}
+
 				client_manager.QueueMessageForClient(
 					ctx, client_id, task,
 					services.NOTIFY_CLIENT, utils.BackgroundWriter)
@@ -194,6 +204,9 @@ func (self *Plan) ExecuteHuntUpdate(
 		}
 	}
 
+	scheduled := make(map[string]bool)
+	defer self.releaseHuntSlots(org_config_obj.OrgId, scheduled)
+
 	for hunt_id, clients := range self.HuntsToClients {
 		if len(clients) == 0 {
 			continue
@@ -211,11 +224,18 @@ func (self *Plan) ExecuteHuntUpdate(
 		logger.Info("Scheduling hunt %v on %v clients: %v", hunt.HuntId,
 			len(clients), slice(clients, 10))
 
+		// Clients that do not pick up the hunt before it expires
+		// should not run it.
+		var expires time.Time
+		if hunt.Expires > 0 {
+			expires = time.Unix(0, int64(hunt.Expires)*1000)
+		}
 		err := self.scheduleRequestOnClients(
-			ctx, org_config_obj, hunt.StartRequest, clients)
+			ctx, org_config_obj, hunt.StartRequest, clients, expires)
 		if err != nil {
 			return err
 		}
+		scheduled[hunt_id] = true
 
 		// Write a new AssignedHunts record to indicate this hunt ran
 		// on this client.
@@ -236,6 +256,25 @@ func (self *Plan) ExecuteHuntUpdate(
 	return nil
 }
 
+// Hunts with a client limit reserved a slot for each planned
+// client. Slots of hunts that were not scheduled are given back so
+// the hunt can be scheduled on other clients later.
+func (self *Plan) releaseHuntSlots(
+	org_id string, scheduled map[string]bool) {
+	slots := make(map[*api_proto.Hunt]uint64)
+	for _, hunts := range self.ClientIdToHunts {
+		for _, h := range hunts {
+			if !scheduled[h.HuntId] {
+				slots[h]++
+			}
+		}
+	}
+
+	for hunt, count := range slots {
+		hunt_limiter.Release(org_id, hunt, count)
+	}
+}
+
 // Update all affected clients' timestamp to ensure next query we do
 // not select them again.
 func (self *Plan) closePlan(ctx context.Context,
@@ -3,6 +3,7 @@ package ingestion
 import (
 	"context"
 
+	"github.com/Velocidex/ordereddict"
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	"www.velocidex.com/golang/cloudvelo/services"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
@@ -27,7 +28,8 @@ func (self Ingestor) HandleEnrolment(
 		return err
 	}
 
-	return nil
+	return writeServerEvent(config_obj, "Server.Internal.Enrollment",
+		services.DocIdRandom, ordereddict.NewDict().Set("ClientId", client_id))
 }
 
 const (
@@ -44,6 +46,17 @@ const (
 `
 )
 
+func setLastInterrogate(doc, params map[string]interface{}) error {
+	doc["last_interrogate"] = params["last_interrogate"]
+	return nil
+}
+
+func init() {
+	services.RegisterUpdateScript(
+		"ctx._source.last_interrogate = params.last_interrogate",
+		setLastInterrogate)
+}
+
 func (self Ingestor) HandleInterrogation(
 	ctx context.Context, config_obj *config_proto.Config,
 	message *crypto_proto.VeloMessage) error {
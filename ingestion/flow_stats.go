@@ -65,6 +65,13 @@ func (self Ingestor) HandleFlowStats(
 		return err
 	}
 
+	if completed {
+		err = self.writeFlowCompletion(ctx, config_obj, collector_context)
+		if err != nil {
+			return err
+		}
+	}
+
 	return self.maybeHandleHuntFlowStats(
 		ctx, config_obj, collector_context, failed, completed)
 }
@@ -13,10 +13,8 @@ import (
 	"fmt"
 	"os"
 
-	"github.com/opensearch-project/opensearch-go/v2"
 	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/cloudvelo/crypto/server"
-	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/velociraptor/constants"
 	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
 	"www.velocidex.com/golang/velociraptor/json"
@@ -33,8 +31,6 @@ type IngestorInterface interface {
 
 // Responsible for inserting VeloMessage objects into elastic.
 type Ingestor struct {
-	client *opensearch.Client
-
 	crypto_manager *server.ServerCryptoManager
 
 	index string
@@ -118,14 +114,7 @@ func NewIngestor(
 	config_obj *config.Config,
 	crypto_manager *server.ServerCryptoManager) (*Ingestor, error) {
 
-	client, err := cvelo_services.GetElasticClientByType(
-		cvelo_services.PrimaryOpenSearch)
-	if err != nil {
-		return nil, err
-	}
-
 	return &Ingestor{
-		client:         client,
 		crypto_manager: crypto_manager,
 	}, nil
 }
@@ -15,6 +15,7 @@ import (
 	"www.velocidex.com/golang/cloudvelo/ingestion/testdata"
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	cvelo_vfs_service "www.velocidex.com/golang/cloudvelo/services/vfs_service"
 	"www.velocidex.com/golang/cloudvelo/testsuite"
 	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
 	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
@@ -127,11 +128,12 @@ func (self *IngestionTestSuite) TestEnrollment() {
 	assert.NoError(self.T(), err)
 	self.golden.Set("ClientRecord", result[0])
 
-	// Record results in monitoring data.
+	// Record results in monitoring data and the enrollment server
+	// event.
 	records, _, err := cvelo_services.QueryElasticRaw(self.ctx,
 		"test", "transient", getAllItemsQuery)
 	assert.NoError(self.T(), err)
-	assert.Equal(self.T(), 1, len(records))
+	assert.Equal(self.T(), 2, len(records))
 
 	goldie.Assert(self.T(), "TestEnrollment",
 		json.MustMarshalIndent(self.golden))
@@ -195,12 +197,8 @@ func (self *IngestionTestSuite) TestListDirectory() {
 		json.MustMarshalIndent(self.golden))
 }
 
-func (self *IngestionTestSuite) TestVFSDownload() {
-
-	// Replay the ListDirectory artifact messages to the ingestor.
-	client_id := "C.77ad4285690698d9"
-	list_flow_id := "F.CEV6I8LHAT83O"
-
+// Replay a directory listing followed by a download of a file in it.
+func (self *IngestionTestSuite) ingestVFSDownload(client_id, list_flow_id string) {
 	// Add a VFS.DownloadFile collection and replay messages.
 	err := cvelo_services.SetElasticIndex(self.ctx, "test",
 		"transient", "", api.ArtifactCollectorRecordFromProto(
@@ -231,6 +229,15 @@ func (self *IngestionTestSuite) TestVFSDownload() {
 
 	err = cvelo_services.FlushBulkIndexer()
 	assert.NoError(self.T(), err)
+}
+
+func (self *IngestionTestSuite) TestVFSDownload() {
+
+	// Replay the ListDirectory artifact messages to the ingestor.
+	client_id := "C.77ad4285690698d9"
+	list_flow_id := "F.CEV6I8LHAT83O"
+
+	self.ingestVFSDownload(client_id, list_flow_id)
 
 	config_obj := self.ConfigObj.VeloConf()
 
@@ -251,6 +258,30 @@ func (self *IngestionTestSuite) TestVFSDownload() {
 	goldie.Assert(self.T(), "TestVFSDownload", json.MustMarshalIndent(table))
 }
 
+func (self *IngestionTestSuite) TestVFSDownloadProgress() {
+	client_id := "C.77ad4285690698d9"
+
+	// The download collection is a subtree download.
+	err := cvelo_services.SetElasticIndex(self.Ctx, "test",
+		"persisted", "subtree_download_F.CEV7IE8TURDBS",
+		&cvelo_vfs_service.SubtreeDownloadRecord{
+			ClientId:   client_id,
+			FlowId:     "F.CEV7IE8TURDBS",
+			Components: []string{"auto", "test"},
+			DocType:    "subtree_download",
+		})
+	assert.NoError(self.T(), err)
+
+	self.ingestVFSDownload(client_id, "F.CEV6I8LHAT83O")
+
+	// The uploaded file counts as complete.
+	stats, err := cvelo_vfs_service.SubtreeDownloadProgress(self.Ctx,
+		self.ConfigObj.VeloConf(), client_id, "F.CEV7IE8TURDBS")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), &cvelo_vfs_service.SubtreeDownloadStats{
+		Total: 1, Complete: 1}, stats)
+}
+
 func (self *IngestionTestSuite) TestClientEventMonitoring() {
 
 	// Get Client Event Monitoring Clear the results so we get a clean
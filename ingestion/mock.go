@@ -48,6 +48,20 @@ const (
 `
 )
 
+func incrementField(field string) services.UpdateScript {
+	return func(doc, params map[string]interface{}) error {
+		doc[field] = services.ScriptInt(doc[field]) + 1
+		return nil
+	}
+}
+
+func init() {
+	for _, field := range []string{"completed", "errors", "scheduled"} {
+		services.RegisterUpdateScript(
+			"ctx._source."+field+" ++ ;", incrementField(field))
+	}
+}
+
 type Script struct {
 	Type     string            `json:"type"`
 	IdOrCode string            `json:"idOrCode"`
@@ -86,7 +100,7 @@ func (self *HTTPIngestor) Execute(
 	case "OVERWRITE", "NEW":
 		fmt.Printf("%v: %v\n", plan.Type, plan.DocId)
 
-		client, err := services.GetElasticClientByType(services.PrimaryOpenSearch)
+		client, err := services.GetElasticClientByName(services.PRIMARY_CLUSTER)
 		if err != nil {
 			return err
 		}
@@ -114,7 +128,7 @@ func (self *HTTPIngestor) Execute(
 			return nil
 		}
 
-		return makeElasticError(data)
+		return services.MakeElasticError(res.StatusCode, data)
 
 	case "SCRIPT":
 		if plan.Script == nil {
@@ -219,19 +233,3 @@ func NewHTTPIngestor(config_obj *config.Config) (*HTTPIngestor, error) {
 		incoming_url: "http://localhost:8080/v1/velociraptor/ingest",
 	}, nil
 }
-
-func makeElasticError(data []byte) error {
-	response := ordereddict.NewDict()
-	err := response.UnmarshalJSON(data)
-	if err != nil {
-		return fmt.Errorf("Elastic Error: %v", string(data))
-	}
-
-	err_type := utils.GetString(response, "error.type")
-	err_reason := utils.GetString(response, "error.reason")
-	if false && err_type != "" && err_reason != "" {
-		return fmt.Errorf("Elastic Error: %v: %v", err_type, err_reason)
-	}
-
-	return fmt.Errorf("Elastic Error: %v", response)
-}
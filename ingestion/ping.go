@@ -2,7 +2,8 @@ package ingestion
 
 import (
 	"context"
-	"strings"
+	"errors"
+	"os"
 
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	"www.velocidex.com/golang/cloudvelo/services"
@@ -26,8 +27,7 @@ func (self Ingestor) HandlePing(
 			DocType:   "clients",
 			Timestamp: uint64(utils.GetTime().Now().Unix()),
 		})
-	if err == nil ||
-		strings.Contains(err.Error(), "document_missing_exception") {
+	if err == nil || errors.Is(err, os.ErrNotExist) {
 		return nil
 	}
 	return err
@@ -0,0 +1,60 @@
+package ingestion
+
+import (
+	"context"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/result_sets/timed"
+	"www.velocidex.com/golang/cloudvelo/services"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/paths"
+	artifact_paths "www.velocidex.com/golang/velociraptor/paths/artifacts"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// Server events are written to the server's timed result sets where
+// the server monitoring queries on the foreman can watch them. Each
+// event is stored in its own document. Events with a fixed doc_id
+// are only stored once, even if the ingestor sees them again.
+func writeServerEvent(
+	config_obj *config_proto.Config,
+	artifact, doc_id string, row *ordereddict.Dict) error {
+
+	path_manager := artifact_paths.NewArtifactPathManagerWithMode(
+		config_obj, "server", "", artifact, paths.MODE_SERVER_EVENT)
+
+	serialized, err := json.MarshalWithOptions(row, json.DefaultEncOpts())
+	if err != nil {
+		return err
+	}
+
+	record := timed.NewTimedResultSetRecord(path_manager)
+	record.JSONData = string(json.AppendJsonlItem(
+		append(serialized, '\n'), "_ts", record.Timestamp/1000000))
+
+	return services.SetElasticIndexAsync(
+		config_obj.OrgId, services.TRANSIENT_EVENTS, doc_id,
+		services.BulkUpdateCreate, record)
+}
+
+// The client may send the final flow stats more than once so the
+// completion event has a fixed id. The event carries the stats of
+// the collection as received - loading the full collection here
+// would slow down ingestion.
+func (self Ingestor) writeFlowCompletion(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	collection_context *flows_proto.ArtifactCollectorContext) error {
+
+	doc_id := collection_context.ClientId + "_" +
+		collection_context.SessionId + "_completion"
+
+	return writeServerEvent(config_obj, "System.Flow.Completion", doc_id,
+		ordereddict.NewDict().
+			Set("Timestamp", utils.GetTime().Now().UTC().Unix()).
+			Set("Flow", collection_context).
+			Set("FlowId", collection_context.SessionId).
+			Set("ClientId", collection_context.ClientId))
+}
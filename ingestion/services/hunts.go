@@ -109,6 +109,18 @@ ctx._source.errors += params.errors ;
 `
 )
 
+func updateHuntStats(doc, params map[string]interface{}) error {
+	for _, field := range []string{"scheduled", "completed", "errors"} {
+		doc[field] = services.ScriptInt(doc[field]) +
+			services.ScriptInt(params[field])
+	}
+	return nil
+}
+
+func init() {
+	services.RegisterUpdateScript(updatedPainlessQuery, updateHuntStats)
+}
+
 func (self *HuntStatsUpdater) Flush(ctx context.Context) error {
 
 	// Kepp the lock tight because elastic call can take a while.
@@ -134,6 +146,17 @@ func (self *HuntStatsUpdater) Flush(ctx context.Context) error {
 	return nil
 }
 
+// Count a hunt collection which failed before the client started
+// it. This happens outside the ingestor so it can not go through the
+// HuntStatsManager.
+func IncHuntFailedBeforeStart(
+	ctx context.Context,
+	config_obj *config_proto.Config, hunt_id string) error {
+	query := json.Format(updateQuery, updatedPainlessQuery, 1, 0, 1)
+	return services.UpdateIndex(
+		ctx, config_obj.OrgId, "persisted", hunt_id, query)
+}
+
 func StartHuntStatsUpdater(
 	ctx context.Context,
 	wg *sync.WaitGroup,
@@ -17,6 +17,11 @@ import (
 	"www.velocidex.com/golang/velociraptor/utils"
 )
 
+// Write a VFS record for each directory listed in the response. A
+// recursive listing has a Stats row for every directory it visited so
+// this fans out into a record per directory. The records are written
+// through the bulk indexer so large recursive listings do not issue a
+// request per directory.
 func (self Ingestor) HandleSystemVfsListDirectory(
 	ctx context.Context,
 	config_obj *config_proto.Config,
@@ -26,6 +31,11 @@ func (self Ingestor) HandleSystemVfsListDirectory(
 		return nil
 	}
 
+	// Only the last listing of each directory in the response is
+	// kept.
+	var ids []string
+	records := make(map[string]*cvelo_vfs_service.VFSRecord)
+
 	reader := strings.NewReader(message.VQLResponse.JSONLResponse)
 	scanner := bufio.NewScanner(reader)
 	buf := make([]byte, len(message.VQLResponse.JSONLResponse))
@@ -68,10 +78,18 @@ func (self Ingestor) HandleSystemVfsListDirectory(
 			Timestamp:  utils.GetTime().Now().UnixNano(),
 		}
 
-		err = cvelo_services.SetElasticIndexAsync(
+		_, pres := records[id]
+		if !pres {
+			ids = append(ids, id)
+		}
+		records[id] = record
+	}
+
+	for _, id := range ids {
+		err := cvelo_services.SetElasticIndexAsync(
 			config_obj.OrgId,
 			"transient", cvelo_services.DocIdRandom,
-			cvelo_services.BulkUpdateCreate, record)
+			cvelo_services.BulkUpdateCreate, records[id])
 
 		if err != nil {
 			return err
@@ -95,6 +113,11 @@ func (self Ingestor) HandleSystemVfsUpload(
 	buf := make([]byte, len(message.VQLResponse.JSONLResponse))
 	scanner.Buffer(buf, len(message.VQLResponse.JSONLResponse))
 
+	// Files uploaded in this response for the progress of subtree
+	// downloads.
+	complete := 0
+	failed := 0
+
 	for scanner.Scan() {
 		serialized := scanner.Text()
 		row := &cvelo_vfs_service.DownloadRow{
@@ -149,7 +172,15 @@ func (self Ingestor) HandleSystemVfsUpload(
 				config_obj.OrgId,
 				"transient", cvelo_services.DocIdRandom,
 				cvelo_services.BulkUpdateCreate, stats)
+
+			if row.Sha256 != "" {
+				complete++
+			} else {
+				failed++
+			}
 		}
 	}
-	return nil
+
+	return cvelo_vfs_service.UpdateSubtreeDownloadProgress(
+		ctx, config_obj, message.SessionId, complete, failed)
 }
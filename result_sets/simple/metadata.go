@@ -87,5 +87,5 @@ func SetResultSetMetadata(
 
 	md.Timestamp = utils.GetTime().Now().UnixNano()
 	return cvelo_services.SetElasticIndex(ctx, utils.GetOrgId(config_obj),
-		"transient", services.DocIdRandom, md)
+		dataClassForPath(log_path), services.DocIdRandom, md)
 }
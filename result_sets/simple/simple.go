@@ -1,6 +1,7 @@
 package simple
 
 import (
+	"www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/velociraptor/file_store/api"
 )
 
@@ -36,3 +37,12 @@ func NewSimpleResultSetRecord(
 		ID:      id,
 	}
 }
+
+// Flow logs are stored separately from the results so they can have a
+// different retention.
+func dataClassForPath(log_path api.FSPathSpec) string {
+	if log_path.Base() == "logs" {
+		return services.TRANSIENT_LOGS
+	}
+	return services.TRANSIENT_COLLECTIONS
+}
@@ -87,7 +87,7 @@ func (self *ElasticSimpleResultSetWriter) writeJSONL(
 
 	if self.sync {
 		err := services.SetElasticIndex(
-			self.ctx, self.org_id, "transient",
+			self.ctx, self.org_id, dataClassForPath(self.log_path),
 			services.DocIdRandom, record)
 		if err != nil {
 			self.Abort()
@@ -96,7 +96,7 @@ func (self *ElasticSimpleResultSetWriter) writeJSONL(
 	}
 
 	services.SetElasticIndexAsync(
-		self.org_id, "transient", services.DocIdRandom,
+		self.org_id, dataClassForPath(self.log_path), services.DocIdRandom,
 		cvelo_services.BulkUpdateCreate, record)
 }
 
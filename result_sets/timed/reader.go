@@ -12,6 +12,7 @@ import (
 	"www.velocidex.com/golang/velociraptor/file_store/api"
 	"www.velocidex.com/golang/velociraptor/json"
 	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/utils"
 )
 
 type TimedResultSetReader struct {
@@ -78,6 +79,10 @@ func (self *TimedResultSetReader) Rows(
 			start = time.Unix(0, 0)
 		}
 
+		// Records are timestamped with their first row but may hold
+		// rows written up to FLUSH_PERIOD later.
+		query_start := start.Add(-FLUSH_PERIOD)
+
 		// Client event artifacts always come from the monitoring
 		// flow.
 		if record.ClientId != "server" {
@@ -88,7 +93,7 @@ func (self *TimedResultSetReader) Rows(
 			record.FlowId,
 			record.Artifact,
 			record.Type,
-			start.UnixNano(),
+			query_start.UnixNano(),
 			end.UnixNano(),
 		)
 		subctx, cancel := context.WithCancel(ctx)
@@ -129,12 +134,24 @@ func (self *TimedResultSetReader) Rows(
 					continue
 				}
 
+				// Older records do not have a per row timestamp.
+				ts_any, pres := row.Get("_ts")
+				ts, ok := utils.ToInt64(ts_any)
+				if !pres || !ok {
+					row.Set("_ts", record.Timestamp/1000000)
+
+				} else {
+					row_time := time.Unix(0, ts*1000000)
+					if row_time.Before(start) || !row_time.Before(end) {
+						continue
+					}
+				}
+
 				select {
 				case <-ctx.Done():
 					return
 
-				case output_chan <- row.Set(
-					"_ts", record.Timestamp/1000000):
+				case output_chan <- row:
 				}
 			}
 		}
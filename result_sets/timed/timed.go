@@ -2,11 +2,14 @@ package timed
 
 import (
 	"context"
+	"sync"
 	"time"
 
 	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/filestore"
 	"www.velocidex.com/golang/cloudvelo/services"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
 	"www.velocidex.com/golang/velociraptor/file_store/api"
 	"www.velocidex.com/golang/velociraptor/json"
 	"www.velocidex.com/golang/velociraptor/paths/artifacts"
@@ -14,6 +17,11 @@ import (
 	"www.velocidex.com/golang/velociraptor/utils"
 )
 
+const (
+	// Buffered rows are written at least this often.
+	FLUSH_PERIOD = 10 * time.Second
+)
+
 // This is the record we store in the elastic datastore. Timed Results
 // are usually written from event artifacts.
 type TimedResultSetRecord struct {
@@ -71,39 +79,135 @@ func NewTimedResultSetRecord(
 	}
 }
 
+// Rows are buffered and written into a single document to avoid a
+// round trip per row. Each row carries its own _ts so the reader can
+// still report when the row was written.
 type ElasticTimedResultSetWriter struct {
+	mu sync.Mutex
+
 	config_obj   *config_proto.Config
 	path_manager api.PathManager
 	opts         *json.EncOpts
 	ctx          context.Context
+
+	buff          []byte
+	buffered_rows int
+
+	// The record timestamp is the time of the first buffered row.
+	first_row_time time.Time
+
+	// Flushes the buffer if no more rows arrive.
+	timer *time.Timer
+
+	// If this is set writes will be syncrounous
+	sync       bool
+	completion func()
+
+	// Tracks the asynchronous writes which were not confirmed yet.
+	pending sync.WaitGroup
+
+	rows_per_result_set uint64
+	max_size_per_packet uint64
 }
 
-func (self ElasticTimedResultSetWriter) WriteJSONL(
+func (self *ElasticTimedResultSetWriter) WriteJSONL(
 	serialized []byte, total_rows int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
-	record := NewTimedResultSetRecord(self.path_manager)
-	record.JSONData = string(serialized)
+	now := utils.GetTime().Now()
+
+	// Valid JSONL should be followed by \n already
+	self.buff = append(self.buff, json.AppendJsonlItem(
+		serialized, "_ts", now.UnixNano()/1000000)...)
+	self.buffered_rows += total_rows
 
-	services.SetElasticIndex(self.ctx,
-		utils.GetOrgId(self.config_obj),
-		"transient", services.DocIdRandom, record)
+	self.maybeFlush(now)
 }
 
-func (self ElasticTimedResultSetWriter) Write(row *ordereddict.Dict) {
+func (self *ElasticTimedResultSetWriter) Write(row *ordereddict.Dict) {
 	serialized, err := json.MarshalWithOptions(row, self.opts)
 	if err != nil {
 		return
 	}
 
-	self.WriteJSONL(serialized, 1)
+	self.WriteJSONL(append(serialized, '\n'), 1)
+}
+
+// Flush depending on the total size of the buffer. If the rows are
+// large, we try to keep document size under 1mb. Otherwise arm the
+// timer so rows are not held back for too long.
+func (self *ElasticTimedResultSetWriter) maybeFlush(now time.Time) {
+	if self.first_row_time.IsZero() {
+		self.first_row_time = now
+	}
+
+	if uint64(self.buffered_rows) > self.rows_per_result_set ||
+		uint64(len(self.buff)) > self.max_size_per_packet {
+		self.flush()
+		return
+	}
+
+	if self.timer == nil {
+		self.timer = time.AfterFunc(FLUSH_PERIOD, self.Flush)
+	}
+}
+
+func (self *ElasticTimedResultSetWriter) flush() {
+	if self.timer != nil {
+		self.timer.Stop()
+		self.timer = nil
+	}
+
+	if self.buffered_rows == 0 {
+		return
+	}
+
+	record := NewTimedResultSetRecord(self.path_manager)
+	record.JSONData = string(self.buff)
+	record.Timestamp = self.first_row_time.UnixNano()
+	record.Date = self.first_row_time.Truncate(24 * time.Hour).Unix()
+
+	self.buff = nil
+	self.buffered_rows = 0
+	self.first_row_time = time.Time{}
+
+	org_id := utils.GetOrgId(self.config_obj)
+	if self.sync {
+		services.SetElasticIndex(self.ctx,
+			org_id, services.TRANSIENT_EVENTS, services.DocIdRandom, record)
+		return
+	}
+
+	self.pending.Add(1)
+	services.SetElasticIndexAsyncWithCompletion(
+		org_id, services.TRANSIENT_EVENTS, services.DocIdRandom,
+		services.BulkUpdateCreate, record,
+		func(err error) {
+			self.pending.Done()
+		})
 }
 
-func (self ElasticTimedResultSetWriter) Flush() {
+func (self *ElasticTimedResultSetWriter) Flush() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 
+	self.flush()
 }
 
-func (self ElasticTimedResultSetWriter) Close() {
+func (self *ElasticTimedResultSetWriter) Close() {
+	self.Flush()
+
+	if self.completion != nil &&
+		!utils.CompareFuncs(self.completion, utils.SyncCompleter) {
 
+		// Readers notified by the completion must be able to see
+		// the rows so wait for the bulk indexer to write them.
+		go func() {
+			self.pending.Wait()
+			self.completion()
+		}()
+	}
 }
 
 func NewTimedResultSetWriter(
@@ -112,10 +216,30 @@ func NewTimedResultSetWriter(
 	opts *json.EncOpts,
 	completion func()) (result_sets.TimedResultSetWriter, error) {
 
+	rows_per_result_set := uint64(1000)
+	max_size_per_packet := uint64(1024 * 1024)
+
+	file_store_factory := file_store.GetFileStore(config_obj)
+	if file_store_factory != nil {
+		cloud_config_obj := filestore.GetConfigObj(file_store_factory)
+		if cloud_config_obj != nil {
+			if cloud_config_obj.Cloud.RowsPerResultSet > 0 {
+				rows_per_result_set = cloud_config_obj.Cloud.RowsPerResultSet
+			}
+			if cloud_config_obj.Cloud.MaxSizePerPacket > 0 {
+				max_size_per_packet = cloud_config_obj.Cloud.MaxSizePerPacket
+			}
+		}
+	}
+
 	return &ElasticTimedResultSetWriter{
-		config_obj:   config_obj,
-		path_manager: path_manager,
-		opts:         opts,
-		ctx:          context.Background(),
+		config_obj:          config_obj,
+		path_manager:        path_manager,
+		opts:                opts,
+		ctx:                 context.Background(),
+		sync:                utils.CompareFuncs(completion, utils.SyncCompleter),
+		completion:          completion,
+		rows_per_result_set: rows_per_result_set,
+		max_size_per_packet: max_size_per_packet,
 	}, nil
 }
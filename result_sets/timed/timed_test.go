@@ -0,0 +1,64 @@
+package timed_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	"www.velocidex.com/golang/cloudvelo/result_sets/timed"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/paths"
+	artifact_paths "www.velocidex.com/golang/velociraptor/paths/artifacts"
+)
+
+type TimedTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+// Readers notified by the completion must see all the rows.
+func (self *TimedTestSuite) TestCompletionAfterWrite() {
+	config_obj := self.ConfigObj.VeloConf()
+
+	path_manager := artifact_paths.NewArtifactPathManagerWithMode(
+		config_obj, "C.1234", "F.Monitoring", "Test.Events",
+		paths.MODE_CLIENT_EVENT)
+
+	done := make(chan bool)
+	rs_writer, err := timed.NewTimedResultSetWriter(
+		config_obj, path_manager, json.DefaultEncOpts(),
+		func() { close(done) })
+	assert.NoError(self.T(), err)
+
+	rs_writer.Write(ordereddict.NewDict().Set("Foo", 1))
+	rs_writer.Write(ordereddict.NewDict().Set("Foo", 2))
+	rs_writer.Close()
+
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		self.T().Fatalf("Completion was not called")
+	}
+
+	reader, err := timed.TimedFactory{}.NewTimedResultSetReader(
+		self.Ctx, config_obj, path_manager)
+	assert.NoError(self.T(), err)
+	defer reader.Close()
+
+	var rows []*ordereddict.Dict
+	for row := range reader.Rows(self.Ctx) {
+		rows = append(rows, row)
+	}
+
+	assert.Equal(self.T(), 2, len(rows))
+}
+
+func TestTimedResultSets(t *testing.T) {
+	suite.Run(t, &TimedTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"transient"},
+		},
+	})
+}
@@ -0,0 +1,7 @@
+package api
+
+type ToolEntry struct {
+	Name       string `json:"name,omitempty"`
+	Definition string `json:"definition,omitempty"`
+	DocType    string `json:"doc_type"`
+}
@@ -4,16 +4,20 @@ import (
 	"context"
 	"embed"
 	_ "embed"
+	"fmt"
+	"net/http"
 	"os"
 	"path"
 	"strings"
 	"www.velocidex.com/golang/cloudvelo/config"
 
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
 	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
 	"github.com/pkg/errors"
 	"www.velocidex.com/golang/cloudvelo/services"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/utils"
 )
 
 const (
@@ -25,7 +29,6 @@ const (
 
 var TRUE = true
 
-//go:embed policies/*.json
 //go:embed templates/*.json
 var fs embed.FS
 
@@ -33,6 +36,20 @@ var fs embed.FS
 func Delete(ctx context.Context,
 	config_obj *config_proto.Config, org_id, filter string) error {
 
+	// Other backends have no indexes to drop so we just remove the
+	// documents.
+	if !services.UsingOpenSearch() {
+		for _, index := range []string{services.PERSISTED,
+			services.TIMELINES, services.TRANSIENT} {
+			err := services.DeleteByQuery(ctx, org_id, index,
+				`{"query": {"match_all": {}}}`)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
 	client, err := services.GetElasticClient(org_id)
 	if err != nil {
 		return err
@@ -61,10 +78,64 @@ func Delete(ctx context.Context,
 		}
 
 		if strings.Contains(string(data), "data_stream") {
-			_, err = opensearchapi.IndicesDeleteDataStreamRequest{
-				Name: services.GetIndex(org_id, name),
-			}.Do(ctx, client)
-			if err != nil && !errors.Is(err, os.ErrNotExist) {
+			for _, stream := range dataStreams(org_id, name) {
+				_, err = opensearchapi.IndicesDeleteDataStreamRequest{
+					Name: stream,
+				}.Do(ctx, client)
+				if err != nil && !errors.Is(err, os.ErrNotExist) {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Remove the org's indexes from a specific cluster, regardless of
+// where the org is placed. Used to clean up after an org is migrated
+// to another cluster. Only the org's own indexes are removed.
+func DeleteFromCluster(ctx context.Context,
+	config_obj *config_proto.Config, org_id, cluster string) error {
+
+	if utils.IsRootOrg(org_id) {
+		return errors.New("The root org can not be removed from a cluster")
+	}
+
+	client, err := services.GetElasticClientByName(cluster)
+	if err != nil {
+		return err
+	}
+
+	files, err := fs.ReadDir("templates")
+	if err != nil {
+		return err
+	}
+
+	for _, filename := range files {
+		name := strings.Split(filename.Name(), ".")[0]
+		data, err := fs.ReadFile(path.Join("templates", filename.Name()))
+		if err != nil {
+			return err
+		}
+
+		if !strings.Contains(string(data), "data_stream") {
+			err = deleteFromCluster(ctx, client, cluster,
+				opensearchapi.IndicesDeleteRequest{
+					Index: []string{services.GetIndex(org_id, name)},
+				})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		for _, stream := range dataStreams(org_id, name) {
+			err = deleteFromCluster(ctx, client, cluster,
+				opensearchapi.IndicesDeleteDataStreamRequest{
+					Name: stream,
+				})
+			if err != nil {
 				return err
 			}
 		}
@@ -73,15 +144,59 @@ func Delete(ctx context.Context,
 	return nil
 }
 
-func getAllOrgs(ctx context.Context) ([]string, error) {
+func deleteFromCluster(ctx context.Context, client *opensearch.Client,
+	cluster string, req opensearchapi.Request) error {
+	res, err := req.Do(ctx, client)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.IsError() && res.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("Deleting from cluster %v: %v", cluster, res.Status())
+	}
+	return nil
+}
+
+// The transient template covers the data streams of all the transient
+// data classes.
+func dataStreams(org_id, name string) []string {
+	if name != services.TRANSIENT {
+		return []string{services.GetIndex(org_id, name)}
+	}
+
+	var result []string
+	for _, index := range services.TRANSIENT_INDEXES {
+		result = append(result, services.GetIndex(org_id, index))
+	}
+	return result
+}
+
+func getAllOrgs(ctx context.Context,
+	config_obj *config_proto.Config) ([]string, error) {
 	results := []string{"root"}
+	seen := map[string]bool{"root": true}
+
+	// Orgs in the placement table may live on any cluster.
+	placements, err := services.ListOrgPlacements(ctx, config_obj)
+	if err != nil {
+		return nil, err
+	}
+	for org_id := range placements {
+		if !seen[org_id] {
+			seen[org_id] = true
+			results = append(results, org_id)
+		}
+	}
+
 	indexes, err := services.ListIndexes(ctx)
 	if err != nil {
 		return nil, err
 	}
 	for _, index := range indexes {
 		parts := strings.Split(index, "_results")
-		if len(parts) == 2 {
+		if len(parts) == 2 && !seen[parts[0]] {
+			seen[parts[0]] = true
 			results = append(results, parts[0])
 		}
 	}
@@ -90,59 +205,53 @@ func getAllOrgs(ctx context.Context) ([]string, error) {
 
 func DeleteAllOrgs(ctx context.Context,
 	config_obj *config_proto.Config, filter string) error {
-	all_orgs, err := getAllOrgs(ctx)
+	all_orgs, err := getAllOrgs(ctx, config_obj)
 	if err != nil {
 		return err
 	}
-	orgs := append([]string{"root"}, all_orgs...)
-	for _, org_id := range orgs {
+
+	// The root org holds the placement table which tells us where
+	// the other orgs live so it is deleted last.
+	for _, org_id := range all_orgs {
+		if org_id == "root" {
+			continue
+		}
 		err := Delete(ctx, config_obj, org_id, filter)
 		if err != nil {
 			return err
 		}
 	}
 
-	return nil
+	return Delete(ctx, config_obj, "root", filter)
 }
 
+// Install missing templates and update templates that are older than
+// the embedded version on every cluster, since orgs may be placed on
+// any of them.
 func InstallIndexTemplates(
 	ctx context.Context,
 	config_obj *config.Config) error {
 
-	files, err := fs.ReadDir("templates")
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+
+	pending, err := pendingTemplates(ctx)
 	if err != nil {
 		return err
 	}
-	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
 
-	for _, filename := range files {
-		name := strings.Split(filename.Name(), ".")[0]
-
-		// Check if the template is defined.
-		err := services.DoesTemplateExist(ctx, name)
-		if err == nil {
-			continue
-		}
-
-		data, err := fs.ReadFile(path.Join("templates", filename.Name()))
+	for _, template := range pending {
+		data, err := fs.ReadFile(path.Join("templates", template.Index+".json"))
 		if err != nil {
 			return err
 		}
 
-		logger.Info("Creating index template %v\n", name)
-		err = services.PutTemplate(ctx, name, string(data), services.PrimaryOpenSearch)
+		logger.Info("%v %v version %v on cluster %v\n", template.Description,
+			template.Index, template.Version, template.Cluster)
+		err = services.PutTemplate(ctx, template.Index, string(data),
+			template.Cluster)
 		if err != nil {
-			logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
-			logger.Error("While creating index template %v: %v",
-				name, err)
-		}
-		if config_obj.Cloud.SecondaryAddresses != nil {
-			err = services.PutTemplate(ctx, name, string(data), services.SecondaryOpenSearch)
-			if err != nil {
-				logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
-				logger.Error("While creating index template %v: %v",
-					name, err)
-			}
+			logger.Error("While creating index template %v on cluster %v: %v",
+				template.Index, template.Cluster, err)
 		}
 	}
 
@@ -0,0 +1,585 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	"github.com/pkg/errors"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// Schema migrations bring the indexes of existing deployments up to
+// date with the embedded templates.
+//
+// Templates carry a "version" field and are replaced on every
+// cluster when the embedded version is newer (see
+// InstallIndexTemplates). Templates only apply to new indexes so
+// each org also records the schema version its indexes were
+// migrated to. The migration steps below are applied in order to
+// orgs with an older schema version.
+//
+// To change the schema, bump the template's version and append the
+// steps needed to bring existing indexes up to date with a new
+// schema version. Released steps must never be changed or reordered.
+const (
+	// Install or update an index template on a cluster.
+	MIGRATION_TEMPLATE = "template"
+
+	// Apply the template's mappings to the existing index. Only
+	// adding fields is possible this way.
+	MIGRATION_MAPPING = "mapping"
+
+	// Copy the index into a new index created from the current
+	// template. This is needed when existing fields change type. The
+	// org should not be used while its indexes are reindexed.
+	MIGRATION_REINDEX = "reindex"
+
+	// Start a new backing index for a data stream so new data uses
+	// the current template.
+	MIGRATION_ROLLOVER = "rollover"
+
+	// Move the notebook timeline rows out of the expiring transient
+	// data stream into the timelines index.
+	MIGRATION_TIMELINES = "timelines"
+
+	schemaVersionDocId = "schema_version"
+
+	// Marks the temporary copy of a reindexed index as complete.
+	reindexCompleteDocId = "reindex_complete"
+
+	migrationBatchSize = 1000
+
+	legacyTimelinesClause = `{"bool": {"must": [{"match": {"type": "timeline"}}]}}`
+)
+
+type migrationStep struct {
+	Version     int
+	Kind        string
+	Index       string
+	Description string
+}
+
+var migrations = []migrationStep{
+	{
+		Version:     1,
+		Kind:        MIGRATION_MAPPING,
+		Index:       "persisted",
+		Description: "Add fields that were added to the template before it was versioned",
+	},
+	{
+		Version:     1,
+		Kind:        MIGRATION_ROLLOVER,
+		Index:       "transient",
+		Description: "Start using the versioned template for new data",
+	},
+	{
+		Version:     2,
+		Kind:        MIGRATION_TIMELINES,
+		Index:       "timelines",
+		Description: "Move timelines written before they had their own index",
+	},
+}
+
+type SchemaVersionRecord struct {
+	Version   int    `json:"version"`
+	DocType   string `json:"doc_type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// A step that still needs to run.
+type PendingMigration struct {
+	OrgId       string `json:"org_id,omitempty"`
+	Cluster     string `json:"cluster,omitempty"`
+	Version     int    `json:"version"`
+	Kind        string `json:"kind"`
+	Index       string `json:"index"`
+	Description string `json:"description"`
+}
+
+// The schema version of newly created indexes.
+func CurrentSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// Orgs without a recorded version predate schema versioning.
+func GetSchemaVersion(ctx context.Context, org_id string) (int, error) {
+	serialized, err := services.GetElasticRecord(ctx, org_id,
+		"persisted", schemaVersionDocId)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	record := &SchemaVersionRecord{}
+	err = json.Unmarshal(serialized, record)
+	return record.Version, err
+}
+
+func SetSchemaVersion(ctx context.Context, org_id string, version int) error {
+	return services.SetElasticIndex(ctx, org_id, "persisted",
+		schemaVersionDocId, &SchemaVersionRecord{
+			Version:   version,
+			DocType:   "schema_version",
+			Timestamp: utils.GetTime().Now().Unix(),
+		})
+}
+
+// New orgs are created with the current templates so they do not
+// need any migrations.
+func InitializeSchemaVersion(ctx context.Context, org_id string) error {
+	_, err := services.GetElasticRecord(ctx, org_id,
+		"persisted", schemaVersionDocId)
+	if err == nil || !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return SetSchemaVersion(ctx, org_id, CurrentSchemaVersion())
+}
+
+// List all the steps needed to bring the templates and the orgs up
+// to date.
+func PlanMigrations(
+	ctx context.Context, config_obj *config.Config) ([]*PendingMigration, error) {
+	result, err := pendingTemplates(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	all_orgs, err := getAllOrgs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, org_id := range all_orgs {
+		pending, err := pendingOrgMigrations(ctx, org_id)
+		if err != nil {
+			return nil, fmt.Errorf("Org %v: %w", org_id, err)
+		}
+		result = append(result, pending...)
+	}
+
+	return result, nil
+}
+
+func pendingOrgMigrations(
+	ctx context.Context, org_id string) ([]*PendingMigration, error) {
+	version, err := GetSchemaVersion(ctx, org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*PendingMigration
+	for _, step := range migrations {
+		if step.Version <= version {
+			continue
+		}
+		result = append(result, &PendingMigration{
+			OrgId:       org_id,
+			Version:     step.Version,
+			Kind:        step.Kind,
+			Index:       step.Index,
+			Description: step.Description,
+		})
+	}
+	return result, nil
+}
+
+// Templates which are missing or older than the embedded version.
+func pendingTemplates(ctx context.Context) ([]*PendingMigration, error) {
+	files, err := fs.ReadDir("templates")
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*PendingMigration
+	for _, cluster := range services.ListClusters() {
+		for _, filename := range files {
+			name := strings.Split(filename.Name(), ".")[0]
+			data, err := fs.ReadFile(path.Join("templates", filename.Name()))
+			if err != nil {
+				return nil, err
+			}
+
+			version, err := templateVersion(data)
+			if err != nil {
+				return nil, fmt.Errorf("Template %v: %w", name, err)
+			}
+
+			installed, err := services.GetTemplateVersion(ctx, name, cluster)
+			if err == nil && installed >= version {
+				continue
+			}
+
+			description := "Install template"
+			if err == nil {
+				description = fmt.Sprintf(
+					"Update template from version %v", installed)
+			} else if !errors.Is(err, os.ErrNotExist) {
+				return nil, fmt.Errorf("Template %v on cluster %v: %w",
+					name, cluster, err)
+			}
+
+			result = append(result, &PendingMigration{
+				Cluster:     cluster,
+				Version:     version,
+				Kind:        MIGRATION_TEMPLATE,
+				Index:       name,
+				Description: description,
+			})
+		}
+	}
+	return result, nil
+}
+
+func templateVersion(data []byte) (int, error) {
+	template := &struct {
+		Version int `json:"version"`
+	}{}
+	err := json.Unmarshal(data, template)
+	return template.Version, err
+}
+
+// Apply all pending migrations. Templates are updated first so
+// indexes recreated by the migration steps use them.
+func RunMigrations(ctx context.Context, config_obj *config.Config) error {
+	err := InstallIndexTemplates(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
+	all_orgs, err := getAllOrgs(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, org_id := range all_orgs {
+		err := MigrateOrgSchema(ctx, config_obj, org_id)
+		if err != nil {
+			return fmt.Errorf("Org %v: %w", org_id, err)
+		}
+	}
+
+	return nil
+}
+
+// Apply the pending migration steps to the org. The org's schema
+// version is updated once all steps of a version are done so an
+// interrupted migration is resumed from the first step of that
+// version.
+func MigrateOrgSchema(
+	ctx context.Context, config_obj *config.Config, org_id string) error {
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+
+	pending, err := pendingOrgMigrations(ctx, org_id)
+	if err != nil {
+		return err
+	}
+
+	for idx, step := range pending {
+		logger.Info("MigrateOrgSchema: Org %v version %v: %v %v: %v",
+			org_id, step.Version, step.Kind, step.Index, step.Description)
+
+		err := runMigrationStep(ctx, org_id, step)
+		if err != nil {
+			return fmt.Errorf("Version %v %v %v: %w",
+				step.Version, step.Kind, step.Index, err)
+		}
+
+		// Last step of this version.
+		if idx == len(pending)-1 || pending[idx+1].Version != step.Version {
+			err = SetSchemaVersion(ctx, org_id, step.Version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func runMigrationStep(
+	ctx context.Context, org_id string, step *PendingMigration) error {
+	switch step.Kind {
+	case MIGRATION_MAPPING:
+		return updateMapping(ctx, org_id, step.Index)
+
+	case MIGRATION_ROLLOVER:
+		return rollover(ctx, org_id, step.Index)
+
+	case MIGRATION_REINDEX:
+		return reindex(ctx, org_id, step.Index, step.Version)
+
+	case MIGRATION_TIMELINES:
+		return moveLegacyTimelines(ctx, org_id)
+	}
+
+	return fmt.Errorf("Unknown migration step %v", step.Kind)
+}
+
+// Read the properties from the embedded template.
+func templateMappings(name string) (json.RawMessage, error) {
+	data, err := fs.ReadFile(path.Join("templates", name+".json"))
+	if err != nil {
+		return nil, err
+	}
+
+	template := &struct {
+		Template struct {
+			Mappings struct {
+				Properties json.RawMessage `json:"properties"`
+			} `json:"mappings"`
+		} `json:"template"`
+	}{}
+	err = json.Unmarshal(data, template)
+	if err != nil {
+		return nil, err
+	}
+
+	return template.Template.Mappings.Properties, nil
+}
+
+func updateMapping(ctx context.Context, org_id, name string) error {
+	properties, err := templateMappings(name)
+	if err != nil {
+		return err
+	}
+
+	client, err := services.GetElasticClient(org_id)
+	if err != nil {
+		return err
+	}
+
+	res, err := opensearchapi.IndicesPutMappingRequest{
+		Index: []string{services.GetIndex(org_id, name)},
+		Body: strings.NewReader(
+			`{"properties": ` + string(properties) + `}`),
+	}.Do(ctx, client)
+	return checkMigrationResponse(res, err)
+}
+
+func rollover(ctx context.Context, org_id, name string) error {
+	client, err := services.GetElasticClient(org_id)
+	if err != nil {
+		return err
+	}
+
+	res, err := opensearchapi.IndicesRolloverRequest{
+		Alias: services.GetIndex(org_id, name),
+	}.Do(ctx, client)
+	return checkMigrationResponse(res, err)
+}
+
+// Rebuild the index from the current template by copying it to a
+// temporary index and back. Once the copy is complete the temporary
+// index is marked so an interrupted migration never deletes the
+// only complete copy.
+func reindex(ctx context.Context, org_id, name string, version int) error {
+	client, err := services.GetElasticClient(org_id)
+	if err != nil {
+		return err
+	}
+
+	index := services.GetIndex(org_id, name)
+
+	// The temporary index must also match the template.
+	tmp_name := fmt.Sprintf("migrate%d_%s", version, name)
+	tmp_index := services.GetIndex(org_id, tmp_name)
+
+	_, err = services.GetElasticRecord(ctx, org_id,
+		tmp_name, reindexCompleteDocId)
+	copied := err == nil
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if !copied {
+		exists, err := indexExists(ctx, client, index)
+		if err != nil || !exists {
+			return err
+		}
+
+		// Start again from a clean copy.
+		err = deleteIndex(ctx, client, tmp_index)
+		if err != nil {
+			return err
+		}
+
+		err = copyIndex(ctx, client, index, tmp_index, `{"match_all": {}}`)
+		if err != nil {
+			return err
+		}
+
+		err = services.SetElasticIndex(ctx, org_id,
+			tmp_name, reindexCompleteDocId, &SchemaVersionRecord{
+				Version:   version,
+				DocType:   "reindex_complete",
+				Timestamp: utils.GetTime().Now().Unix(),
+			})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = deleteIndex(ctx, client, index)
+	if err != nil {
+		return err
+	}
+
+	err = copyIndex(ctx, client, tmp_index, index, json.Format(
+		`{"bool": {"must_not": [{"ids": {"values": [%q]}}]}}`,
+		reindexCompleteDocId))
+	if err != nil {
+		return err
+	}
+
+	return deleteIndex(ctx, client, tmp_index)
+}
+
+// Copy the timeline rows in the legacy transient stream to the
+// timelines index. Rows keep their ids so an interrupted move can
+// simply be repeated. They are only removed from the transient stream
+// once they are all in the timelines index.
+//
+// Legacy rows only record the component in their vfs_path so the
+// fields used to delete the rows are filled in from it.
+func moveLegacyTimelines(ctx context.Context, org_id string) error {
+	var mu sync.Mutex
+	var write_err error
+
+	wg := &sync.WaitGroup{}
+	err := services.ScanQuery(ctx, org_id, services.TRANSIENT,
+		legacyTimelinesClause, migrationBatchSize,
+		func(id string, doc json.RawMessage) error {
+			row, err := legacyTimelineRow(doc)
+			if err != nil || row == nil {
+				return err
+			}
+
+			wg.Add(1)
+			return services.SetElasticIndexAsyncWithCompletion(org_id,
+				services.TIMELINES, id, services.BulkUpdateIndex, row,
+				func(err error) {
+					defer wg.Done()
+
+					if err != nil {
+						mu.Lock()
+						write_err = err
+						mu.Unlock()
+					}
+				})
+		})
+	wg.Wait()
+
+	if err != nil {
+		return err
+	}
+	if write_err != nil {
+		return write_err
+	}
+
+	err = services.FlushIndex(ctx, org_id, services.TIMELINES)
+	if err != nil {
+		return err
+	}
+
+	return services.DeleteByQuery(ctx, org_id, services.TRANSIENT,
+		json.Format(`{"query": %s}`, legacyTimelinesClause))
+}
+
+// The vfs_path of a timeline row is
+// notebook_id/super_timeline/component/version. Returns nil for rows
+// which can not be moved.
+func legacyTimelineRow(doc json.RawMessage) (json.RawMessage, error) {
+	row := make(map[string]json.RawMessage)
+	err := json.Unmarshal(doc, &row)
+	if err != nil {
+		return nil, err
+	}
+
+	// Rows without a valid path can not be read so they are not
+	// moved.
+	vfs_path := ""
+	_ = json.Unmarshal(row["vfs_path"], &vfs_path)
+	parts := strings.Split(vfs_path, "/")
+	if len(parts) != 4 {
+		return nil, nil
+	}
+
+	for idx, field := range []string{
+		"notebook_id", "super_timeline", "component", "version"} {
+		row[field] = json.RawMessage(json.MustMarshalString(parts[idx]))
+	}
+
+	serialized, err := json.Marshal(row)
+	return json.RawMessage(serialized), err
+}
+
+func copyIndex(ctx context.Context, client *opensearch.Client,
+	source, dest, query string) error {
+	res, err := opensearchapi.ReindexRequest{
+		Body: strings.NewReader(json.Format(
+			`{"source": {"index": %q, "query": `, source) + query +
+			json.Format(`}, "dest": {"index": %q}}`, dest)),
+		WaitForCompletion: &TRUE,
+		Refresh:           &TRUE,
+	}.Do(ctx, client)
+	return checkMigrationResponse(res, err)
+}
+
+func indexExists(ctx context.Context,
+	client *opensearch.Client, index string) (bool, error) {
+	res, err := opensearchapi.IndicesExistsRequest{
+		Index: []string{index},
+	}.Do(ctx, client)
+	if err != nil {
+		return false, err
+	}
+	res.Body.Close()
+
+	return res.StatusCode == http.StatusOK, nil
+}
+
+func deleteIndex(ctx context.Context,
+	client *opensearch.Client, index string) error {
+	res, err := opensearchapi.IndicesDeleteRequest{
+		Index: []string{index},
+	}.Do(ctx, client)
+	return checkMigrationResponse(res, err)
+}
+
+// Indexes which do not exist yet will be created from the current
+// template so there is nothing to migrate.
+func checkMigrationResponse(res *opensearchapi.Response, err error) error {
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if !res.IsError() {
+		return nil
+	}
+
+	err = services.MakeElasticError(res.StatusCode, data)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,133 @@
+package schema_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	"www.velocidex.com/golang/cloudvelo/schema"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/notebook"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+type MigrationsTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *MigrationsTestSuite) pendingForOrg() []*schema.PendingMigration {
+	pending, err := schema.PlanMigrations(self.Ctx, self.ConfigObj)
+	assert.NoError(self.T(), err)
+
+	var result []*schema.PendingMigration
+	for _, step := range pending {
+		// Templates are installed by the test suite.
+		assert.NotEqual(self.T(), schema.MIGRATION_TEMPLATE, step.Kind)
+
+		if step.OrgId == self.ConfigObj.OrgId {
+			result = append(result, step)
+		}
+	}
+	return result
+}
+
+func (self *MigrationsTestSuite) TestMigrateOrgSchema() {
+	org_id := self.ConfigObj.OrgId
+
+	// New orgs start at the current version.
+	version, err := schema.GetSchemaVersion(self.Ctx, org_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), schema.CurrentSchemaVersion(), version)
+	assert.Equal(self.T(), 0, len(self.pendingForOrg()))
+
+	// An org from before schema versioning.
+	err = schema.SetSchemaVersion(self.Ctx, org_id, 0)
+	assert.NoError(self.T(), err)
+
+	pending := self.pendingForOrg()
+	assert.True(self.T(), len(pending) > 0)
+	for _, step := range pending {
+		assert.True(self.T(), step.Version > 0)
+	}
+
+	err = schema.MigrateOrgSchema(self.Ctx, self.ConfigObj, org_id)
+	assert.NoError(self.T(), err)
+
+	version, err = schema.GetSchemaVersion(self.Ctx, org_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), schema.CurrentSchemaVersion(), version)
+	assert.Equal(self.T(), 0, len(self.pendingForOrg()))
+}
+
+func (self *MigrationsTestSuite) TestMoveLegacyTimelines() {
+	org_id := self.ConfigObj.OrgId
+
+	// Timeline rows written before timelines had their own index
+	// only record their component in the vfs_path.
+	for _, id := range []string{"T.1", "T.2"} {
+		err := cvelo_services.SetElasticIndexAsync(org_id,
+			cvelo_services.TRANSIENT, id, cvelo_services.BulkUpdateCreate,
+			&notebook.TimelineRecord{
+				Type:      "timeline",
+				Timestamp: 10,
+				VFSPath:   "N.1/Super/" + id + "/V.1",
+			})
+		assert.NoError(self.T(), err)
+	}
+	assert.NoError(self.T(), cvelo_services.FlushBulkIndexer())
+
+	err := schema.SetSchemaVersion(self.Ctx, org_id, 1)
+	assert.NoError(self.T(), err)
+
+	err = schema.MigrateOrgSchema(self.Ctx, self.ConfigObj, org_id)
+	assert.NoError(self.T(), err)
+
+	serialized, err := cvelo_services.GetElasticRecord(self.Ctx, org_id,
+		cvelo_services.TIMELINES, "T.1")
+	assert.NoError(self.T(), err)
+
+	record := &notebook.TimelineRecord{}
+	assert.NoError(self.T(), json.Unmarshal(serialized, record))
+	assert.Equal(self.T(), &notebook.TimelineRecord{
+		NotebookId:    "N.1",
+		SuperTimeline: "Super",
+		Component:     "T.1",
+		Version:       "V.1",
+		Type:          "timeline",
+		Timestamp:     10,
+		VFSPath:       "N.1/Super/T.1/V.1",
+	}, record)
+
+	var legacy []string
+	err = cvelo_services.ScanIndex(self.Ctx, org_id,
+		cvelo_services.TRANSIENT, 100,
+		func(id string, doc json.RawMessage) error {
+			legacy = append(legacy, id)
+			return nil
+		})
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(legacy))
+
+	// The moved rows are deleted with their component.
+	storer := notebook.NewSuperTimelineStorer(
+		self.ConfigObj.VeloConf()).(*notebook.SuperTimelineStorer)
+	err = storer.DeleteComponent(self.Ctx, "N.1", "Super", "T.1")
+	assert.NoError(self.T(), err)
+
+	_, err = cvelo_services.GetElasticRecord(self.Ctx, org_id,
+		cvelo_services.TIMELINES, "T.1")
+	assert.Error(self.T(), err)
+
+	_, err = cvelo_services.GetElasticRecord(self.Ctx, org_id,
+		cvelo_services.TIMELINES, "T.2")
+	assert.NoError(self.T(), err)
+}
+
+func TestMigrations(t *testing.T) {
+	suite.Run(t, &MigrationsTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted", "timelines", "transient"},
+		},
+	})
+}
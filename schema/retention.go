@@ -0,0 +1,383 @@
+package schema
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+)
+
+// Transient data is expired by Index State Management (ISM)
+// policies. Each transient data class has its own policy, and orgs
+// may override the retention of any class with a policy of their
+// own. ISM applies policies to backing indexes when they are created
+// so changes take effect from the next rollover.
+const (
+	RETENTION_POLICY_PREFIX = "cvelo_retention_"
+
+	DEFAULT_ROLLOVER_AGE = "5d"
+	DEFAULT_DELETE_AGE   = "15d"
+
+	// Higher than the priority of the older rollover_strategy policy
+	// so ours take precedence where it is still installed.
+	defaultRetentionPriority = 400
+	orgRetentionPriority     = 500
+
+	retentionPolicyTemplate = `
+{
+  "policy": {
+    "description": %q,
+    "default_state": "rollover",
+    "states": [
+      {
+        "name": "rollover",
+        "actions": [{"rollover": {"min_index_age": %q}}],
+        "transitions": [
+          {"state_name": "delete", "conditions": {"min_index_age": %q}}
+        ]
+      },
+      {
+        "name": "delete",
+        "actions": [{"delete": {}}],
+        "transitions": []
+      }
+    ],
+    "ism_template": {
+      "index_patterns": [%q],
+      "priority": %q
+    }
+  }
+}
+`
+
+	changePolicyQuery = `{"policy_id": %q}`
+)
+
+var (
+	retentionAgeRegex = regexp.MustCompile(`^[0-9]+(d|h|m|s)$`)
+)
+
+type retentionPolicy struct {
+	config.RetentionPolicy
+
+	id          string
+	description string
+
+	// Matches the backing indexes of the data streams.
+	pattern  string
+	priority int
+}
+
+func (self *retentionPolicy) body() string {
+	return json.Format(retentionPolicyTemplate, self.description,
+		self.RolloverAge, self.DeleteAge, self.pattern, self.priority)
+}
+
+type installedPolicy struct {
+	Id          string `json:"_id"`
+	SeqNo       int64  `json:"_seq_no"`
+	PrimaryTerm int64  `json:"_primary_term"`
+	Policy      struct {
+		Description string          `json:"description"`
+		IsmTemplate json.RawMessage `json:"ism_template"`
+	} `json:"policy"`
+}
+
+type ismTemplate struct {
+	IndexPatterns []string `json:"index_patterns"`
+}
+
+// The backing indexes the policy is applied to. The ISM API returns
+// the templates as a list.
+func (self *installedPolicy) indexPatterns() []string {
+	var templates []*ismTemplate
+	err := json.Unmarshal(self.Policy.IsmTemplate, &templates)
+	if err != nil {
+		template := &ismTemplate{}
+		err = json.Unmarshal(self.Policy.IsmTemplate, template)
+		if err != nil {
+			return nil
+		}
+		templates = append(templates, template)
+	}
+
+	var result []string
+	for _, template := range templates {
+		result = append(result, template.IndexPatterns...)
+	}
+	return result
+}
+
+type policyList struct {
+	Policies []*installedPolicy `json:"policies"`
+}
+
+// Unset fields are inherited from the base policy.
+func mergeRetention(base, override config.RetentionPolicy) (
+	config.RetentionPolicy, error) {
+	if override.RolloverAge != "" {
+		base.RolloverAge = override.RolloverAge
+	}
+
+	if override.DeleteAge != "" {
+		base.DeleteAge = override.DeleteAge
+	}
+
+	for _, age := range []string{base.RolloverAge, base.DeleteAge} {
+		if !retentionAgeRegex.MatchString(age) {
+			return base, fmt.Errorf("Invalid retention age %q", age)
+		}
+	}
+
+	return base, nil
+}
+
+func isTransientIndex(class string) bool {
+	for _, index := range services.TRANSIENT_INDEXES {
+		if index == class {
+			return true
+		}
+	}
+	return false
+}
+
+// The policies we need according to the config.
+func desiredRetentionPolicies(
+	config_obj *config.Config) ([]*retentionPolicy, error) {
+	defaults := make(map[string]config.RetentionPolicy)
+	var result []*retentionPolicy
+
+	for class := range config_obj.Cloud.Retention {
+		if !isTransientIndex(class) {
+			return nil, fmt.Errorf("Retention: Unknown data class %v", class)
+		}
+	}
+
+	for _, class := range services.TRANSIENT_INDEXES {
+		policy, err := mergeRetention(config.RetentionPolicy{
+			RolloverAge: DEFAULT_ROLLOVER_AGE,
+			DeleteAge:   DEFAULT_DELETE_AGE,
+		}, config_obj.Cloud.Retention[class])
+		if err != nil {
+			return nil, fmt.Errorf("Retention for %v: %w", class, err)
+		}
+		defaults[class] = policy
+
+		result = append(result, &retentionPolicy{
+			RetentionPolicy: policy,
+			id:              RETENTION_POLICY_PREFIX + class,
+			description: fmt.Sprintf(
+				"Retention for %v: rollover after %v, delete after %v",
+				class, policy.RolloverAge, policy.DeleteAge),
+			pattern:  ".ds-*" + class + "-*",
+			priority: defaultRetentionPriority,
+		})
+	}
+
+	org_ids := make([]string, 0, len(config_obj.Cloud.OrgRetention))
+	for org_id := range config_obj.Cloud.OrgRetention {
+		org_ids = append(org_ids, org_id)
+	}
+	sort.Strings(org_ids)
+
+	for _, org_id := range org_ids {
+		overrides := config_obj.Cloud.OrgRetention[org_id]
+		classes := make([]string, 0, len(overrides))
+		for class := range overrides {
+			if !isTransientIndex(class) {
+				return nil, fmt.Errorf(
+					"Retention for org %v: Unknown data class %v", org_id, class)
+			}
+			classes = append(classes, class)
+		}
+		sort.Strings(classes)
+
+		for _, class := range classes {
+			policy, err := mergeRetention(defaults[class], overrides[class])
+			if err != nil {
+				return nil, fmt.Errorf("Retention for org %v %v: %w",
+					org_id, class, err)
+			}
+
+			result = append(result, &retentionPolicy{
+				RetentionPolicy: policy,
+				id: RETENTION_POLICY_PREFIX +
+					strings.ToLower(org_id) + "_" + class,
+				description: fmt.Sprintf(
+					"Retention for %v in org %v: rollover after %v, delete after %v",
+					class, org_id, policy.RolloverAge, policy.DeleteAge),
+				pattern:  ".ds-" + services.GetIndex(org_id, class) + "-*",
+				priority: orgRetentionPriority,
+			})
+		}
+	}
+
+	return result, nil
+}
+
+// The class policy which takes over the indexes of a removed org
+// override.
+func defaultRetentionPolicy(id string,
+	desired []*retentionPolicy) *retentionPolicy {
+	var result *retentionPolicy
+	for _, policy := range desired {
+		if policy.priority != defaultRetentionPriority || policy.id == id {
+			continue
+		}
+
+		class := strings.TrimPrefix(policy.id, RETENTION_POLICY_PREFIX)
+		if strings.HasSuffix(id, "_"+class) &&
+			(result == nil || len(policy.id) > len(result.id)) {
+			result = policy
+		}
+	}
+	return result
+}
+
+// Bring the retention policies on all clusters in line with the
+// config. Policies are only written when they changed, and policies
+// for overrides which were removed from the config are deleted.
+func InstallRetentionPolicies(
+	ctx context.Context, config_obj *config.Config) error {
+	desired, err := desiredRetentionPolicies(config_obj)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+
+	for _, cluster := range services.ListClusters() {
+		client, err := services.GetElasticClientByName(cluster)
+		if err != nil {
+			return err
+		}
+
+		err = installRetentionPolicies(ctx, client, desired)
+		if err != nil {
+			logger.Error("While installing retention policies on cluster %v: %v",
+				cluster, err)
+		}
+	}
+
+	return nil
+}
+
+func installRetentionPolicies(ctx context.Context,
+	client *opensearch.Client, desired []*retentionPolicy) error {
+	installed, err := listRetentionPolicies(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	for _, policy := range desired {
+		existing, pres := installed[policy.id]
+		delete(installed, policy.id)
+
+		path := "/_plugins/_ism/policies/" + policy.id
+		if pres {
+			if existing.Policy.Description == policy.description {
+				continue
+			}
+			path += fmt.Sprintf("?if_seq_no=%d&if_primary_term=%d",
+				existing.SeqNo, existing.PrimaryTerm)
+		}
+
+		_, err := ismRequest(ctx, client, "PUT", path, policy.body())
+		if err != nil {
+			return fmt.Errorf("Policy %v: %w", policy.id, err)
+		}
+	}
+
+	for id, existing := range installed {
+		// Indexes already managed by the policy would never expire
+		// once it is gone, so hand them to the class policy first.
+		target := defaultRetentionPolicy(id, desired)
+		if target != nil {
+			for _, pattern := range existing.indexPatterns() {
+				_, err := ismRequest(ctx, client, "POST",
+					"/_plugins/_ism/change_policy/"+pattern,
+					json.Format(changePolicyQuery, target.id))
+				if err != nil {
+					return fmt.Errorf("Policy %v: %w", id, err)
+				}
+			}
+		}
+
+		_, err := ismRequest(ctx, client, "DELETE",
+			"/_plugins/_ism/policies/"+id, "")
+		if err != nil {
+			return fmt.Errorf("Policy %v: %w", id, err)
+		}
+	}
+
+	return nil
+}
+
+// Our policies currently installed on the cluster.
+func listRetentionPolicies(ctx context.Context,
+	client *opensearch.Client) (map[string]*installedPolicy, error) {
+	data, err := ismRequest(ctx, client, "GET",
+		"/_plugins/_ism/policies?size=1000", "")
+	if err != nil {
+		return nil, err
+	}
+
+	policies := &policyList{}
+	err = json.Unmarshal(data, policies)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]*installedPolicy)
+	for _, policy := range policies.Policies {
+		if strings.HasPrefix(policy.Id, RETENTION_POLICY_PREFIX) {
+			result[policy.Id] = policy
+		}
+	}
+	return result, nil
+}
+
+// The client does not support the ISM plugin API.
+func ismRequest(ctx context.Context, client *opensearch.Client,
+	method, path, body string) ([]byte, error) {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, path, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	res, err := client.Perform(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode >= http.StatusMultipleChoices {
+		return nil, services.MakeElasticError(res.StatusCode, data)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,85 @@
+package schema
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	config_obj := &config.Config{}
+	config_obj.Cloud.Retention = map[string]config.RetentionPolicy{
+		"transient_events": {RolloverAge: "1d", DeleteAge: "7d"},
+	}
+	config_obj.Cloud.OrgRetention = map[string]map[string]config.RetentionPolicy{
+		"O123": {
+			"transient_collections": {DeleteAge: "90d"},
+		},
+	}
+
+	policies, err := desiredRetentionPolicies(config_obj)
+	assert.NoError(t, err)
+
+	by_id := make(map[string]*retentionPolicy)
+	for _, policy := range policies {
+		by_id[policy.id] = policy
+
+		// The policy body must be valid JSON.
+		parsed := make(map[string]interface{})
+		assert.NoError(t, json.Unmarshal([]byte(policy.body()), &parsed))
+	}
+
+	// One policy per data class and one per org override.
+	assert.Equal(t, 6, len(policies))
+
+	events := by_id["cvelo_retention_transient_events"]
+	assert.Equal(t, "1d", events.RolloverAge)
+	assert.Equal(t, "7d", events.DeleteAge)
+	assert.Equal(t, ".ds-*transient_events-*", events.pattern)
+
+	// Unset fields come from the class defaults.
+	org := by_id["cvelo_retention_o123_transient_collections"]
+	assert.Equal(t, DEFAULT_ROLLOVER_AGE, org.RolloverAge)
+	assert.Equal(t, "90d", org.DeleteAge)
+	assert.Equal(t, ".ds-o123_transient_collections-*", org.pattern)
+	assert.True(t, org.priority > events.priority)
+
+	// Bad settings are rejected.
+	config_obj.Cloud.Retention["transient_events"] = config.RetentionPolicy{
+		DeleteAge: "a week"}
+	_, err = desiredRetentionPolicies(config_obj)
+	assert.Error(t, err)
+
+	config_obj.Cloud.Retention = map[string]config.RetentionPolicy{
+		"notebooks": {DeleteAge: "7d"}}
+	_, err = desiredRetentionPolicies(config_obj)
+	assert.Error(t, err)
+}
+
+// The indexes of a removed org override go back to the class policy.
+func TestRemovedOrgRetention(t *testing.T) {
+	policies, err := desiredRetentionPolicies(&config.Config{})
+	assert.NoError(t, err)
+
+	target := defaultRetentionPolicy(
+		"cvelo_retention_o123_transient_events", policies)
+	assert.NotNil(t, target)
+	assert.Equal(t, "cvelo_retention_transient_events", target.id)
+
+	// Only overrides are moved.
+	assert.Nil(t, defaultRetentionPolicy(
+		"cvelo_retention_transient_events", policies))
+
+	// The ISM API returns the templates as a list.
+	installed := &installedPolicy{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+  "_id": "cvelo_retention_o123_transient_events",
+  "policy": {
+    "ism_template": [{"index_patterns": [".ds-o123_transient_events-*"]}]
+  }
+}`), installed))
+	assert.Equal(t, []string{".ds-o123_transient_events-*"},
+		installed.indexPatterns())
+}
@@ -0,0 +1,420 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+// All documents are stored in a Backend. Queries are written in the
+// OpenSearch query DSL - backends other than OpenSearch support the
+// subset of the DSL that we use.
+//
+// The package level functions (SetElasticIndex, QueryElasticRaw etc)
+// call the backend selected in the config so services do not need
+// to know which backend is in use.
+const (
+	OPENSEARCH_BACKEND = "opensearch"
+
+	matchAllClause = `{"match_all": {}}`
+
+	scanIndexQuery      = `{"query": %s, "sort": [{"_id": "asc"}], "size": %q}`
+	scanIndexQueryAfter = `{"query": %s, "sort": [{"_id": "asc"}], "size": %q, "search_after": [%q]}`
+)
+
+type Backend interface {
+	// Returns os.ErrNotExist if the document does not exist.
+	Get(ctx context.Context, org_id, index, id string) (json.RawMessage, error)
+
+	// Missing documents have a nil source.
+	MultiGet(ctx context.Context,
+		org_id, index string, ids []string) ([]json.RawMessage, error)
+
+	// Create or replace the document. An empty id lets the backend
+	// pick one.
+	Set(ctx context.Context, org_id, index, id string, record interface{}) error
+
+	// The write may be delayed and batched with other writes. If
+	// completion is not nil it is called exactly once, when the
+	// backend confirmed the write or the write failed.
+	SetAsync(org_id, index, id string,
+		action BulkUpdateType, record interface{},
+		completion func(err error)) error
+
+	// Update the document with a partial document or a script.
+	Update(ctx context.Context, org_id, index, id, query string) error
+
+	Delete(ctx context.Context, org_id, index, id string, sync bool) error
+	DeleteByQuery(ctx context.Context,
+		org_id, index, query string, sync bool) error
+
+	Search(ctx context.Context, org_id, index, query string) (*SearchResult, error)
+	Count(ctx context.Context, org_id, index, query string) (int, error)
+
+	// See QueryChan() below.
+	QueryChan(ctx context.Context,
+		config_obj *config_proto.Config,
+		page_size int,
+		org_id, index, query, sort_field string) (chan json.RawMessage, error)
+
+	// Make recent writes visible to searches.
+	Flush(ctx context.Context, org_id, index string) error
+}
+
+type SearchResult struct {
+	Hits []Result
+
+	// Total number of matching documents, may be more than the hits
+	// returned.
+	Total int
+
+	// The bucket keys of the "genres" aggregation, or its value for
+	// single value aggregations.
+	Aggregations []string
+}
+
+type BackendFactory func(ctx context.Context,
+	config_obj *cloud_velo_config.Config) (Backend, error)
+
+var (
+	backend_mu sync.Mutex
+	backend    Backend = openSearchBackend{}
+
+	backend_factories = map[string]BackendFactory{}
+)
+
+// Other backends register themselves at init time so they are only
+// linked in when their package is imported.
+func RegisterBackend(name string, factory BackendFactory) {
+	backend_mu.Lock()
+	defer backend_mu.Unlock()
+
+	backend_factories[name] = factory
+}
+
+func ListBackends() []string {
+	backend_mu.Lock()
+	defer backend_mu.Unlock()
+
+	result := []string{OPENSEARCH_BACKEND}
+	for name := range backend_factories {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func SetBackend(b Backend) {
+	backend_mu.Lock()
+	defer backend_mu.Unlock()
+
+	backend = b
+}
+
+func GetBackend() Backend {
+	backend_mu.Lock()
+	defer backend_mu.Unlock()
+
+	return backend
+}
+
+// Only the OpenSearch backend has clusters, templates and the other
+// administrative features.
+func UsingOpenSearch() bool {
+	_, ok := GetBackend().(openSearchBackend)
+	return ok
+}
+
+func startBackend(ctx context.Context,
+	config_obj *cloud_velo_config.Config) (Backend, error) {
+	name := config_obj.Cloud.Backend
+	if name == "" || name == OPENSEARCH_BACKEND {
+		return openSearchBackend{}, nil
+	}
+
+	backend_mu.Lock()
+	factory, pres := backend_factories[name]
+	backend_mu.Unlock()
+
+	if !pres {
+		return nil, fmt.Errorf("Unknown backend %v: supported backends are %v",
+			name, ListBackends())
+	}
+
+	return factory(ctx, config_obj)
+}
+
+func DeleteDocument(
+	ctx context.Context, org_id, index string, id string, sync bool) error {
+
+	defer Instrument("DeleteDocument")()
+	defer Debug(DEBUG_ELASTIC, "DeleteDocument %v", id)()
+
+	return GetBackend().Delete(ctx, org_id, index, id, sync)
+}
+
+func DeleteDocumentByQuery(
+	ctx context.Context, org_id, index string, query string, sync bool) error {
+
+	defer Instrument("DeleteDocument")()
+
+	return GetBackend().DeleteByQuery(ctx, org_id, index, query, sync)
+}
+
+func DeleteByQuery(
+	ctx context.Context, org_id, index, query string) error {
+
+	defer Instrument("DeleteByQuery")()
+
+	return GetBackend().DeleteByQuery(ctx, org_id, index, query, SyncDelete)
+}
+
+// Should be called to force the index to synchronize.
+func FlushIndex(
+	ctx context.Context, org_id, index string) error {
+	return GetBackend().Flush(ctx, org_id, index)
+}
+
+func UpdateIndex(
+	ctx context.Context, org_id, index, id string, query string) error {
+	defer Instrument("UpdateIndex")()
+	defer Debug(DEBUG_ELASTIC, "UpdateIndex %v %v", index, id)()
+
+	return GetBackend().Update(ctx, org_id, index, id, query)
+}
+
+func SetElasticIndexAsync(org_id, index, id string,
+	action BulkUpdateType, record interface{}) error {
+
+	defer Debug(DEBUG_ELASTIC, "SetElasticIndexAsync %v %v", index, id)()
+
+	return GetBackend().SetAsync(org_id, index, id, action, record, nil)
+}
+
+// Like SetElasticIndexAsync but calls completion once the write is
+// confirmed or failed. The completion is always called exactly once.
+func SetElasticIndexAsyncWithCompletion(org_id, index, id string,
+	action BulkUpdateType, record interface{},
+	completion func(err error)) error {
+
+	defer Debug(DEBUG_ELASTIC, "SetElasticIndexAsync %v %v", index, id)()
+
+	return GetBackend().SetAsync(org_id, index, id, action, record, completion)
+}
+
+func SetElasticIndex(ctx context.Context,
+	org_id, index, id string, record interface{}) error {
+	defer Instrument("SetElasticIndex")()
+	defer Debug(DEBUG_ELASTIC, "SetElasticIndex %v %v", index, id)()
+
+	return GetBackend().Set(ctx, org_id, index, id, record)
+}
+
+// Gets the first record matching the query.
+func GetElasticRecordByQuery(
+	ctx context.Context, org_id, index_suffix, query string) (json.RawMessage, error) {
+	defer Debug(DEBUG_ELASTIC, "GetElasticRecordByQuery %v %v", index_suffix, query)()
+	defer Instrument("GetElasticRecordByQuery")()
+
+	result, err := GetBackend().Search(ctx, org_id, index_suffix, query)
+	if err != nil || len(result.Hits) == 0 {
+		return nil, err
+	}
+	return result.Hits[0].JSON, nil
+}
+
+// Gets a single elastic record by id.
+func GetElasticRecord(
+	ctx context.Context, org_id, index, id string) (json.RawMessage, error) {
+	defer Debug(DEBUG_ELASTIC, "GetElasticRecord %v %v", index, id)()
+	defer Instrument("GetElasticRecord")()
+
+	return GetBackend().Get(ctx, org_id, index, id)
+}
+
+// Gets multiple records by id.
+func GetMultipleElasticRecords(
+	ctx context.Context,
+	org_id, index string, ids []string) ([]json.RawMessage, error) {
+
+	defer Instrument("GetMultipleElasticRecords")()
+
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	if len(ids) > 4 {
+		defer Debug(DEBUG_ELASTIC, "GetMultipleElasticRecords %v %v ...", index, ids[:4])()
+	} else {
+		defer Debug(DEBUG_ELASTIC, "GetMultipleElasticRecords %v %v", index, ids)()
+	}
+
+	return GetBackend().MultiGet(ctx, org_id, index, ids)
+}
+
+// Automatically take care of paging by returning a channel.  Query
+// should be a JSON query **without** a sorting clause, or "size"
+// clause.
+// This function will modify the query to add a sorting column and
+// automatically apply the search_after to page through the
+// results. Results are read from a point in time snapshot so
+// concurrent writes do not cause rows to be skipped or repeated.
+// Rows are sorted by sort_field (prefix with > for descending) with
+// the document id as a tiebreaker.
+func QueryChan(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	page_size int,
+	org_id, index, query, sort_field string) (
+	chan json.RawMessage, error) {
+
+	defer Debug(DEBUG_ELASTIC, "QueryChan %v", index)()
+
+	return GetBackend().QueryChan(ctx, config_obj, page_size,
+		org_id, index, query, sort_field)
+}
+
+// Call the callback for every document in the index in document id
+// order. Unlike QueryChan() this also gives the document ids.
+// Documents written while the index is scanned may be missed.
+//
+// Scanning the transient index only gives the documents in the legacy
+// transient stream, not those of the transient data classes.
+func ScanIndex(
+	ctx context.Context,
+	org_id, index string, page_size int,
+	cb func(id string, doc json.RawMessage) error) error {
+
+	defer Instrument("ScanIndex")()
+
+	return scanQuery(ctx, org_id, index, matchAllClause, page_size, cb)
+}
+
+// Like ScanIndex() but only for the documents matching the query
+// clause.
+func ScanQuery(
+	ctx context.Context,
+	org_id, index, clause string, page_size int,
+	cb func(id string, doc json.RawMessage) error) error {
+
+	defer Instrument("ScanQuery")()
+
+	return scanQuery(ctx, org_id, index, clause, page_size, cb)
+}
+
+func scanQuery(
+	ctx context.Context,
+	org_id, index, clause string, page_size int,
+	cb func(id string, doc json.RawMessage) error) error {
+
+	query := json.Format(scanIndexQuery, clause, page_size)
+	for {
+		// Indexes which were never written to have no hits.
+		result, err := GetBackend().Search(ctx, org_id, index, query)
+		if err != nil {
+			return err
+		}
+
+		for _, hit := range result.Hits {
+			if index == TRANSIENT &&
+				!IsLegacyTransientIndex(org_id, hit.Index) {
+				continue
+			}
+
+			err = cb(hit.Id, hit.JSON)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(result.Hits) < page_size {
+			return nil
+		}
+
+		query = json.Format(scanIndexQueryAfter, clause, page_size,
+			result.Hits[len(result.Hits)-1].Id)
+	}
+}
+
+func QueryElasticAggregations(
+	ctx context.Context, org_id, index, query string) ([]string, error) {
+
+	defer Instrument("QueryElasticAggregations")()
+	defer Debug(DEBUG_ELASTIC, "QueryElasticAggregations %v", index)()
+
+	result, err := GetBackend().Search(ctx, org_id, index, query)
+	if err != nil {
+		return nil, err
+	}
+	return result.Aggregations, nil
+}
+
+func QueryElasticRaw(
+	ctx context.Context,
+	org_id, index, query string) ([]json.RawMessage, int, error) {
+
+	defer Instrument("QueryElasticRaw")()
+	defer Debug(DEBUG_ELASTIC, "QueryElasticRaw %v", query)()
+
+	result, err := GetBackend().Search(ctx, org_id, index, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []json.RawMessage
+	for _, hit := range result.Hits {
+		results = append(results, hit.JSON)
+	}
+
+	return results, result.Total, nil
+}
+
+// Return only Ids of matching documents.
+// You probably want to add the following to the query:
+// "_source": false
+func QueryElasticIds(
+	ctx context.Context,
+	org_id, index, query string) (ids []string, total int, err error) {
+
+	defer Instrument("QueryElasticIds")()
+
+	result, err := GetBackend().Search(ctx, org_id, index, query)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []string
+	for _, hit := range result.Hits {
+		results = append(results, hit.Id)
+	}
+
+	return results, result.Total, nil
+}
+
+func QueryCountAPI(
+	ctx context.Context,
+	org_id, index, query string) (total int, err error) {
+
+	defer Instrument("QueryCountAPI")()
+
+	return GetBackend().Count(ctx, org_id, index, query)
+}
+
+func QueryElastic(
+	ctx context.Context,
+	org_id, index, query string) ([]Result, error) {
+
+	defer Instrument("QueryElastic")()
+
+	result, err := GetBackend().Search(ctx, org_id, index, query)
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Hits, nil
+}
@@ -0,0 +1,449 @@
+package backup
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/users"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+/*
+  In Velociraptor each service registers a backup provider which
+  dumps its own state from the filestore. In the cloud all of that
+  state (custom artifacts, labels, hunts, ACLs etc) is kept in the
+  org's persisted index so we simply back up the entire index, along
+  with the users that belong to the org (users are stored in the root
+  org).
+
+  A backup is a zip file in the org's part of the bucket:
+
+  persisted.json  - The org's documents (one per line).
+  users.json      - The org's users (one per line).
+*/
+
+const (
+	BACKUP_PERSISTED = "persisted.json"
+	BACKUP_USERS     = "users.json"
+
+	// Documents are read and restored in batches of this size.
+	BACKUP_BATCH_SIZE = 1000
+)
+
+var (
+	BACKUPS_ROOT = path_specs.NewUnsafeFilestorePath("backups").
+		SetType(api.PATH_TYPE_FILESTORE_ANY)
+)
+
+type backupDocument struct {
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+}
+
+type BackupService struct {
+	ctx        context.Context
+	config_obj *config_proto.Config
+}
+
+// All the state is backed up from the persisted index so providers
+// are not needed.
+func (self *BackupService) Register(provider services.BackupProvider) {}
+
+func (self *BackupService) CreateBackup(
+	export_path api.FSPathSpec) ([]services.BackupStat, error) {
+
+	file_store_obj := file_store.GetFileStore(self.config_obj)
+	if file_store_obj == nil {
+		return nil, errors.New("Filestore not configured")
+	}
+
+	writer, err := file_store_obj.WriteFile(export_path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = writer.Truncate()
+	if err != nil {
+		writer.Close()
+		return nil, err
+	}
+
+	archive := zip.NewWriter(writer)
+
+	stats := []services.BackupStat{self.backupIndex(archive)}
+
+	// The root org's persisted index already holds all the users.
+	if !utils.IsRootOrg(self.config_obj.OrgId) {
+		stats = append(stats, self.backupUsers(archive))
+	}
+
+	err = archive.Close()
+	if err != nil {
+		writer.Close()
+		return stats, err
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, statsError(stats)
+}
+
+func statsError(stats []services.BackupStat) error {
+	for _, stat := range stats {
+		if stat.Error != nil {
+			return fmt.Errorf("%v: %w", stat.Name, stat.Error)
+		}
+	}
+	return nil
+}
+
+func (self *BackupService) backupIndex(archive *zip.Writer) services.BackupStat {
+	stat := services.BackupStat{Name: cvelo_services.PERSISTED}
+
+	out, err := archive.Create(BACKUP_PERSISTED)
+	if err != nil {
+		stat.Error = err
+		return stat
+	}
+
+	count := 0
+	stat.Error = cvelo_services.ScanIndex(self.ctx,
+		self.config_obj.OrgId, cvelo_services.PERSISTED, BACKUP_BATCH_SIZE,
+		func(id string, doc json.RawMessage) error {
+			serialized, err := json.Marshal(&backupDocument{
+				Id:  id,
+				Doc: doc,
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = out.Write(append(serialized, '\n'))
+			if err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+
+	stat.Message = fmt.Sprintf("Backed up %v documents", count)
+	return stat
+}
+
+func (self *BackupService) backupUsers(archive *zip.Writer) services.BackupStat {
+	stat := services.BackupStat{Name: "users"}
+
+	org_users, err := users.ListOrgUsers(self.ctx, self.config_obj.OrgId)
+	if err != nil {
+		stat.Error = err
+		return stat
+	}
+
+	out, err := archive.Create(BACKUP_USERS)
+	if err != nil {
+		stat.Error = err
+		return stat
+	}
+
+	for _, user_record := range org_users {
+		// The backup is stored with the org so it must not carry
+		// the password of users who can also log into other orgs.
+		if len(user_record.Orgs) > 1 {
+			user_record.PasswordHash = nil
+			user_record.PasswordSalt = nil
+		}
+
+		serialized, err := protojson.Marshal(user_record)
+		if err != nil {
+			stat.Error = err
+			return stat
+		}
+
+		_, err = out.Write(append(serialized, '\n'))
+		if err != nil {
+			stat.Error = err
+			return stat
+		}
+	}
+
+	stat.Message = fmt.Sprintf("Backed up %v users", len(org_users))
+	return stat
+}
+
+// Merge the backup into the org. Missing documents and users are
+// restored but documents which were changed since the backup was made
+// are kept.
+func (self *BackupService) RestoreBackup(
+	export_path api.FSPathSpec,
+	opts services.BackupRestoreOptions) ([]services.BackupStat, error) {
+
+	file_store_obj := file_store.GetFileStore(self.config_obj)
+	if file_store_obj == nil {
+		return nil, errors.New("Filestore not configured")
+	}
+
+	reader, err := file_store_obj.ReadFile(export_path)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	// Zip files need random access so we make a local copy.
+	tmpfile, err := ioutil.TempFile("", "backup*.zip")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpfile.Name())
+	defer tmpfile.Close()
+
+	size, err := io.Copy(tmpfile, reader)
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := zip.NewReader(tmpfile, size)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := []services.BackupStat{}
+	for _, file := range archive.File {
+		switch file.Name {
+		case BACKUP_PERSISTED:
+			stats = append(stats, self.restoreIndex(file))
+
+		case BACKUP_USERS:
+			stats = append(stats, self.restoreUsers(file))
+		}
+	}
+
+	err = cvelo_services.FlushBulkIndexer()
+	if err != nil {
+		return stats, err
+	}
+
+	return stats, statsError(stats)
+}
+
+func (self *BackupService) restoreIndex(file *zip.File) services.BackupStat {
+	stat := services.BackupStat{Name: cvelo_services.PERSISTED}
+
+	restored := 0
+	kept := 0
+
+	var batch []*backupDocument
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]string, 0, len(batch))
+		for _, document := range batch {
+			ids = append(ids, document.Id)
+		}
+
+		existing, err := cvelo_services.GetMultipleElasticRecords(self.ctx,
+			self.config_obj.OrgId, cvelo_services.PERSISTED, ids)
+		if err != nil {
+			return err
+		}
+
+		for idx, document := range batch {
+			// Missing documents are restored. Existing documents
+			// are only replaced by an older version.
+			if idx < len(existing) && len(existing[idx]) > 0 &&
+				!isNewer(document.Doc, existing[idx]) {
+				kept++
+				continue
+			}
+
+			err = cvelo_services.SetElasticIndexAsync(
+				self.config_obj.OrgId, cvelo_services.PERSISTED,
+				document.Id, cvelo_services.BulkUpdateIndex, document.Doc)
+			if err != nil {
+				return err
+			}
+			restored++
+		}
+
+		batch = nil
+		return nil
+	}
+
+	err := readLines(file, func(line []byte) error {
+		document := &backupDocument{}
+		err := json.Unmarshal(line, document)
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, document)
+		if len(batch) >= BACKUP_BATCH_SIZE {
+			return flush()
+		}
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+
+	stat.Error = err
+	stat.Message = fmt.Sprintf(
+		"Restored %v documents, kept %v documents changed since the backup",
+		restored, kept)
+	return stat
+}
+
+type timestampedDocument struct {
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Only documents with a timestamp can be compared. Documents without
+// one are never replaced.
+func isNewer(doc, existing json.RawMessage) bool {
+	doc_record := &timestampedDocument{}
+	existing_record := &timestampedDocument{}
+
+	if json.Unmarshal(doc, doc_record) != nil ||
+		json.Unmarshal(existing, existing_record) != nil {
+		return false
+	}
+
+	return doc_record.Timestamp > existing_record.Timestamp
+}
+
+func (self *BackupService) restoreUsers(file *zip.File) services.BackupStat {
+	stat := services.BackupStat{Name: "users"}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		stat.Error = err
+		return stat
+	}
+
+	org_record, err := org_manager.GetOrg(self.config_obj.OrgId)
+	if err != nil {
+		stat.Error = err
+		return stat
+	}
+
+	// Users which no longer exist are recreated as members of this
+	// org. Existing users are left alone: those no longer in the org
+	// were removed from it since the backup.
+	count := 0
+	kept := 0
+	stat.Error = readLines(file, func(line []byte) error {
+		user_record := &api_proto.VelociraptorUser{}
+		err := protojson.Unmarshal(line, user_record)
+		if err != nil {
+			return err
+		}
+
+		exists, err := users.UserExists(self.ctx, user_record.Name)
+		if err != nil {
+			return err
+		}
+		if exists {
+			kept++
+			return nil
+		}
+
+		count++
+		return users.AddUserToOrg(self.ctx, user_record, org_record)
+	})
+
+	stat.Message = fmt.Sprintf(
+		"Restored %v users, kept %v existing users", count, kept)
+	return stat
+}
+
+// Call the callback for each line in the archive member.
+func readLines(file *zip.File, cb func(line []byte) error) error {
+	fd, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			cb_err := cb(line)
+			if cb_err != nil {
+				return cb_err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The org's backups, oldest first.
+func (self *BackupService) ListBackups() ([]api.FileInfo, error) {
+	file_store_obj := file_store.GetFileStore(self.config_obj)
+	if file_store_obj == nil {
+		return nil, errors.New("Filestore not configured")
+	}
+
+	backups, err := file_store_obj.ListDirectory(BACKUPS_ROOT)
+	if err != nil {
+		return nil, err
+	}
+
+	// Backup names sort by the time they were made.
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name() < backups[j].Name()
+	})
+
+	return backups, nil
+}
+
+// Remove all but the newest backups.
+func (self *BackupService) PruneBackups(keep int) error {
+	backups, err := self.ListBackups()
+	if err != nil || len(backups) <= keep {
+		return err
+	}
+
+	file_store_obj := file_store.GetFileStore(self.config_obj)
+	for _, backup := range backups[:len(backups)-keep] {
+		err = file_store_obj.Delete(backup.PathSpec())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func NewBackupService(
+	ctx context.Context, config_obj *config_proto.Config) *BackupService {
+	return &BackupService{
+		ctx:        ctx,
+		config_obj: config_obj,
+	}
+}
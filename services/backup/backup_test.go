@@ -0,0 +1,84 @@
+package backup_test
+
+import (
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/backup"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+type BackupTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+type testRecord struct {
+	Name      string `json:"name"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+func (self *BackupTestSuite) getRecord(id string) *testRecord {
+	serialized, err := cvelo_services.GetElasticRecord(self.Ctx,
+		self.ConfigObj.OrgId, cvelo_services.PERSISTED, id)
+	assert.NoError(self.T(), err)
+
+	record := &testRecord{}
+	assert.NoError(self.T(), json.Unmarshal(serialized, record))
+	return record
+}
+
+func (self *BackupTestSuite) TestBackupRestore() {
+	org_id := self.ConfigObj.OrgId
+	for _, id := range []string{"changed", "deleted", "rolled_back"} {
+		err := cvelo_services.SetElasticIndex(self.Ctx, org_id,
+			cvelo_services.PERSISTED, id, &testRecord{Name: "backup", Timestamp: 10})
+		assert.NoError(self.T(), err)
+	}
+
+	org_manager, err := services.GetOrgManager()
+	assert.NoError(self.T(), err)
+
+	org_config_obj, err := org_manager.GetOrgConfig(org_id)
+	assert.NoError(self.T(), err)
+
+	service := backup.NewBackupService(self.Ctx, org_config_obj)
+	export_path := backup.BACKUPS_ROOT.AddChild("test.zip")
+
+	stats, err := service.CreateBackup(export_path)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PERSISTED, stats[0].Name)
+
+	// Change one record after the backup and remove another.
+	err = cvelo_services.SetElasticIndex(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "changed", &testRecord{Name: "newer", Timestamp: 20})
+	assert.NoError(self.T(), err)
+
+	// A record replaced by an older version is restored.
+	err = cvelo_services.SetElasticIndex(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "rolled_back", &testRecord{Name: "older", Timestamp: 5})
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.DeleteDocument(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "deleted", cvelo_services.SyncDelete)
+	assert.NoError(self.T(), err)
+
+	_, err = service.RestoreBackup(export_path, services.BackupRestoreOptions{})
+	assert.NoError(self.T(), err)
+
+	// The newer record is kept and the removed one is restored.
+	assert.Equal(self.T(), "newer", self.getRecord("changed").Name)
+	assert.Equal(self.T(), "backup", self.getRecord("rolled_back").Name)
+	assert.Equal(self.T(), "backup", self.getRecord("deleted").Name)
+}
+
+func TestBackupService(t *testing.T) {
+	suite.Run(t, &BackupTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
@@ -0,0 +1,137 @@
+package backup
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"www.velocidex.com/golang/cloudvelo/config"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+const (
+	DEFAULT_BACKUP_PERIOD    = 24 * time.Hour
+	DEFAULT_BACKUP_RETENTION = 7
+
+	// How often to check for orgs that are due for a backup.
+	BACKUP_CHECK_PERIOD = 10 * time.Minute
+)
+
+// Backs up all orgs periodically. This runs on the foreman only so
+// each org is backed up once in the deployment.
+type BackupScheduler struct {
+	config_obj *config.Config
+	period     time.Duration
+	retention  int
+}
+
+func (self *BackupScheduler) RunOnce(ctx context.Context) error {
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return err
+	}
+
+	for _, org := range org_manager.ListOrgs() {
+		org_config_obj, err := org_manager.GetOrgConfig(org.Id)
+		if err != nil {
+			logger := logging.GetLogger(
+				self.config_obj.VeloConf(), &logging.FrontendComponent)
+			logger.Error("BackupScheduler: org %v: %v", org.Id, err)
+			continue
+		}
+
+		err = self.backupOrg(ctx, org_config_obj)
+		if err != nil {
+			logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+			logger.Error("BackupScheduler: org %v: %v", org.Id, err)
+		}
+	}
+
+	return nil
+}
+
+// Back up the org if its newest backup is older than the period.
+func (self *BackupScheduler) backupOrg(
+	ctx context.Context, org_config_obj *config_proto.Config) error {
+
+	service := NewBackupService(ctx, org_config_obj)
+	backups, err := service.ListBackups()
+	if err != nil {
+		return err
+	}
+
+	now := utils.GetTime().Now()
+	if len(backups) > 0 &&
+		now.Sub(backups[len(backups)-1].ModTime()) < self.period {
+		return nil
+	}
+
+	export_path := BACKUPS_ROOT.AddChild(
+		"backup_" + now.UTC().Format("20060102T150405Z") + ".zip")
+
+	stats, err := service.CreateBackup(export_path)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+	for _, stat := range stats {
+		logger.Info("BackupScheduler: org %v: %v: %v",
+			org_config_obj.OrgId, stat.Name, stat.Message)
+	}
+
+	return service.PruneBackups(self.retention)
+}
+
+func StartBackupScheduler(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *config.Config) error {
+
+	scheduler := &BackupScheduler{
+		config_obj: config_obj,
+		period:     DEFAULT_BACKUP_PERIOD,
+		retention:  DEFAULT_BACKUP_RETENTION,
+	}
+
+	if config_obj.Cloud.BackupPeriodSeconds < 0 {
+		return nil
+	}
+
+	if config_obj.Cloud.BackupPeriodSeconds > 0 {
+		scheduler.period = time.Duration(
+			config_obj.Cloud.BackupPeriodSeconds) * time.Second
+	}
+
+	if config_obj.Cloud.BackupRetention > 0 {
+		scheduler.retention = config_obj.Cloud.BackupRetention
+	}
+
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+	logger.Info("<green>Starting</> Backup Scheduler: backing up every %v",
+		scheduler.period)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			err := scheduler.RunOnce(ctx)
+			if err != nil {
+				logger.Error("BackupScheduler: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(BACKUP_CHECK_PERIOD):
+			}
+		}
+	}()
+
+	return nil
+}
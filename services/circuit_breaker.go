@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// The circuit breaker stops sending requests to a cluster that is
+// down. After enough consecutive failures the circuit opens and
+// requests fail immediately. Once the reset time passes a single
+// request is let through: if it succeeds the circuit closes again,
+// otherwise it stays open for another reset time.
+const (
+	CIRCUIT_CLOSED    = 0
+	CIRCUIT_OPEN      = 1
+	CIRCUIT_HALF_OPEN = 2
+
+	DEFAULT_CIRCUIT_BREAKER_THRESHOLD = 10
+	DEFAULT_CIRCUIT_BREAKER_RESET     = 30 * time.Second
+)
+
+var (
+	CircuitOpenError = errors.New("OpenSearch cluster is unavailable")
+)
+
+type circuitBreaker struct {
+	mu sync.Mutex
+
+	cluster   string
+	threshold int
+	reset     time.Duration
+
+	state    int
+	failures int
+	opened   time.Time
+
+	// In the half open state only one request is allowed through.
+	probing bool
+}
+
+// Returns an error if the request should not be sent.
+func (self *circuitBreaker) Allow() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	switch self.state {
+	case CIRCUIT_OPEN:
+		if utils.GetTime().Now().Sub(self.opened) < self.reset {
+			return self.reject()
+		}
+		self.setState(CIRCUIT_HALF_OPEN)
+		self.probing = true
+		return nil
+
+	case CIRCUIT_HALF_OPEN:
+		if self.probing {
+			return self.reject()
+		}
+		self.probing = true
+		return nil
+	}
+
+	return nil
+}
+
+func (self *circuitBreaker) reject() error {
+	OpensearchCircuitBreakerRejectedCounter.WithLabelValues(self.cluster).Inc()
+	return fmt.Errorf("%w: %v", CircuitOpenError, self.cluster)
+}
+
+// The cluster answered the request.
+func (self *circuitBreaker) Success() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.failures = 0
+	self.probing = false
+	self.setState(CIRCUIT_CLOSED)
+}
+
+// The cluster could not be reached.
+func (self *circuitBreaker) Failure() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.probing = false
+	self.failures++
+
+	if self.state == CIRCUIT_HALF_OPEN || self.failures >= self.threshold {
+		self.opened = utils.GetTime().Now()
+		self.setState(CIRCUIT_OPEN)
+	}
+}
+
+// The request was abandoned without learning anything about the
+// cluster.
+func (self *circuitBreaker) Release() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.probing = false
+}
+
+func (self *circuitBreaker) State() int {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.state
+}
+
+func (self *circuitBreaker) setState(state int) {
+	self.state = state
+	OpensearchCircuitBreakerState.WithLabelValues(self.cluster).Set(
+		float64(state))
+}
+
+func newCircuitBreaker(
+	cluster string, config_obj *cloud_velo_config.Config) *circuitBreaker {
+	result := &circuitBreaker{
+		cluster:   cluster,
+		threshold: DEFAULT_CIRCUIT_BREAKER_THRESHOLD,
+		reset:     DEFAULT_CIRCUIT_BREAKER_RESET,
+	}
+
+	if config_obj.Cloud.CircuitBreakerThreshold > 0 {
+		result.threshold = config_obj.Cloud.CircuitBreakerThreshold
+	}
+
+	if config_obj.Cloud.CircuitBreakerResetSeconds > 0 {
+		result.reset = time.Duration(
+			config_obj.Cloud.CircuitBreakerResetSeconds) * time.Second
+	}
+
+	result.setState(CIRCUIT_CLOSED)
+	return result
+}
@@ -2,6 +2,7 @@ package services
 
 import (
 	"context"
+	"time"
 
 	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
 )
@@ -14,3 +15,27 @@ type MultiClientMessageQueuer interface {
 		req *crypto_proto.VeloMessage,
 		notify bool) error
 }
+
+// Removes tasks that were queued for clients but not yet picked up.
+type TaskRevoker interface {
+	// Remove the tasks queued for the collection. Returns the
+	// number of tasks removed.
+	RevokeFlowTasks(ctx context.Context, client_id, flow_id string) (int, error)
+
+	// Remove the tasks queued for the hunt on all clients. Returns
+	// the clients whose tasks were removed.
+	RevokeHuntTasks(ctx context.Context, hunt_id string) ([]string, error)
+
+	// Remove all the tasks that expired before the clients picked
+	// them up.
+	PurgeExpiredTasks(ctx context.Context) error
+}
+
+// Queue messages that must be delivered before a deadline.
+type ExpiringMessageQueuer interface {
+	QueueMessageForClientWithExpiry(
+		ctx context.Context,
+		client_id string,
+		req *crypto_proto.VeloMessage,
+		expires time.Time) error
+}
@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"regexp"
+	"time"
 
+	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
@@ -32,6 +34,10 @@ type ClientInfoBase struct {
 
 type ClientInfoQueuer struct {
 	config_obj *config_proto.Config
+
+	// Tasks expire if the client does not pick them up within this
+	// time.
+	task_ttl time.Duration
 }
 
 var (
@@ -210,12 +216,6 @@ func (self ClientInfoQueuer) QueueMessageForMultipleClients(
 	return nil
 }
 
-func (self ClientInfoQueuer) UnQueueMessageForClient(
-	ctx context.Context,
-	client_id string, req *crypto_proto.VeloMessage) error {
-	return nil
-}
-
 func (self ClientInfoBase) Flush(ctx context.Context, client_id string) {
 }
 
@@ -223,12 +223,24 @@ func NewClientInfoBase(config_obj *config_proto.Config) ClientInfoBase {
 	return ClientInfoBase{config_obj: config_obj}
 }
 
-func NewClientInfoManager(config_obj *config_proto.Config) (*ClientInfoManager, error) {
+func NewClientInfoManager(
+	config_obj *config_proto.Config,
+	cloud_config *config.ElasticConfiguration) (*ClientInfoManager, error) {
+
+	// Tasks only expire if configured to, or if they are queued with
+	// a deadline (e.g. the hunt's expiry).
+	var task_ttl time.Duration
+	if cloud_config != nil && cloud_config.TaskExpiryHours > 0 {
+		task_ttl = time.Hour * time.Duration(cloud_config.TaskExpiryHours)
+	}
 
 	service := &ClientInfoManager{
-		ClientInfoBase:   NewClientInfoBase(config_obj),
-		ClientInfoQueuer: ClientInfoQueuer{config_obj: config_obj},
-		config_obj:       config_obj,
+		ClientInfoBase: NewClientInfoBase(config_obj),
+		ClientInfoQueuer: ClientInfoQueuer{
+			config_obj: config_obj,
+			task_ttl:   task_ttl,
+		},
+		config_obj: config_obj,
 	}
 	return service, nil
 }
@@ -4,10 +4,15 @@ import (
 	"context"
 	"time"
 
+	"github.com/Velocidex/ordereddict"
 	"google.golang.org/protobuf/encoding/protojson"
+	"www.velocidex.com/golang/cloudvelo/filestore"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
 	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
 	"www.velocidex.com/golang/velociraptor/services"
 	"www.velocidex.com/golang/velociraptor/utils"
 )
@@ -33,21 +38,44 @@ func (self ClientInfoQueuer) QueueMessageForClient(
 	ctx context.Context, client_id string,
 	req *crypto_proto.VeloMessage,
 	notify bool, completion func()) error {
+	// Only collection requests expire. Other messages (e.g. the
+	// client event table updates) must reach the client whenever it
+	// comes back.
+	var expires time.Time
+	if self.task_ttl > 0 && req.FlowRequest != nil {
+		expires = utils.GetTime().Now().Add(self.task_ttl)
+	}
+	return self.QueueMessageForClientWithExpiry(ctx, client_id, req, expires)
+}
+
+// Queue a task which the client must pick up before the expiry
+// time. Expired tasks are never delivered. A zero expiry time means
+// the task never expires.
+func (self ClientInfoQueuer) QueueMessageForClientWithExpiry(
+	ctx context.Context, client_id string,
+	req *crypto_proto.VeloMessage, expires time.Time) error {
 
 	serialized, err := protojson.Marshal(req)
 	if err != nil {
 		return err
 	}
 
-	// This is problematic because there is no way to remove these
-	// from persisted storage.
+	var expires_ns int64
+	if !expires.IsZero() {
+		expires_ns = expires.UnixNano()
+	}
+
+	// Tasks remain in persisted storage until the client picks them
+	// up, they are revoked (see RevokeFlowTasks) or they expire (see
+	// PurgeExpiredTasks).
 	return cvelo_services.SetElasticIndex(ctx,
 		self.config_obj.OrgId,
 		"persisted", cvelo_services.DocIdRandom,
 		&ClientTask{
 			ClientId:  client_id,
 			FlowId:    req.SessionId,
-			Timestamp: time.Now().UnixNano(),
+			Timestamp: utils.GetTime().Now().UnixNano(),
+			Expires:   expires_ns,
 			JSONData:  string(serialized),
 			DocType:   "task",
 		})
@@ -57,8 +85,12 @@ type ClientTask struct {
 	ClientId  string `json:"client_id"`
 	FlowId    string `json:"flow_id"`
 	Timestamp int64  `json:"timestamp"`
-	JSONData  string `json:"data"`
-	DocType   string `json:"doc_type"`
+
+	// Time in nanoseconds after which the task is not delivered. 0
+	// means the task never expires.
+	Expires  int64  `json:"expires"`
+	JSONData string `json:"data"`
+	DocType  string `json:"doc_type"`
 }
 
 // Get the client's tasks and remove them from the queue.
@@ -72,6 +104,7 @@ func (self ClientInfoBase) GetClientTasks(
 		return nil, err
 	}
 
+	now := utils.GetTime().Now().UnixNano()
 	results := []*crypto_proto.VeloMessage{}
 	for _, hit := range hits {
 		err = cvelo_services.DeleteDocument(ctx,
@@ -92,6 +125,13 @@ func (self ClientInfoBase) GetClientTasks(
 		if err != nil {
 			continue
 		}
+
+		// Do not deliver stale tasks.
+		if item.IsExpired(now) {
+			expireTask(ctx, self.config_obj, item, message)
+			continue
+		}
+
 		results = append(results, message)
 	}
 	return results, nil
@@ -126,9 +166,70 @@ func (self ClientInfoBase) PeekClientTasks(
 	return results, nil
 }
 
+// Remove all traces of the client from the datastore and the
+// filestore. If really_do_it is not set we only report what would be
+// removed.
 func (self *ClientInfoBase) DeleteClient(
 	ctx context.Context,
 	client_id, principal string,
 	progress chan services.DeleteFlowResponse, really_do_it bool) error {
-	return utils.NotImplementedError
+
+	err := self.ValidateClientId(client_id)
+	if err != nil {
+		return err
+	}
+
+	r := cvelo_services.NewDeleteReporter(
+		ctx, self.config_obj.OrgId, really_do_it)
+
+	// These documents are keyed by the client id but do not carry
+	// a client_id field.
+	for _, suffix := range []string{"_key", "_notify"} {
+		r.DeleteIndex("ClientRecord", cvelo_services.PERSISTED,
+			"_id", client_id+suffix)
+	}
+
+	// Everything else refers to the client by its client_id: The
+	// client record, labels, ping, metadata, queued tasks and MRU
+	// entries.
+	r.DeleteIndex("ClientRecord", cvelo_services.PERSISTED,
+		"client_id", client_id)
+
+	// Collections, result sets, logs and uploads metadata.
+	r.DeleteIndex("Collections", cvelo_services.TRANSIENT,
+		"client_id", client_id)
+
+	// Now remove all the client's files from the bucket.
+	file_store_factory := file_store.GetFileStore(self.config_obj)
+	err = filestore.DeleteDirectory(ctx, file_store_factory,
+		path_specs.NewUnsafeFilestorePath("clients", client_id),
+		really_do_it, func(key string, err error) {
+			r.Report("Upload", ordereddict.NewDict().
+				Set("key", key), err)
+		})
+	if err != nil {
+		r.Report("Upload", ordereddict.NewDict().
+			Set("client_id", client_id), err)
+	}
+
+	if really_do_it {
+		logger := logging.GetLogger(self.config_obj, &logging.Audit)
+		if logger != nil {
+			logger.Info("Deleted client %v by %v", client_id, principal)
+		}
+	}
+
+	if progress == nil {
+		return nil
+	}
+
+	for _, res := range r.Responses() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case progress <- *res:
+		}
+	}
+
+	return nil
 }
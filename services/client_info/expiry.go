@@ -0,0 +1,138 @@
+package client_info
+
+import (
+	"context"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	ingestor_services "www.velocidex.com/golang/cloudvelo/ingestion/services"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+const (
+	getExpiredTasksQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"range": {"expires": {"gt": 0, "lt": %q}}},
+         {"match": {"doc_type" : "task"}}
+      ]}
+  }
+}
+`
+)
+
+func (self *ClientTask) IsExpired(now int64) bool {
+	return self.Expires > 0 && self.Expires < now
+}
+
+// Remove all the expired tasks from the queue. The collections they
+// belong to are marked as failed.
+func (self ClientInfoQueuer) PurgeExpiredTasks(ctx context.Context) error {
+	query := json.Format(getExpiredTasksQuery, utils.GetTime().Now().UnixNano())
+
+	hits, err := cvelo_services.QueryChan(ctx, self.config_obj, 1000,
+		self.config_obj.OrgId, cvelo_services.PERSISTED, query, "timestamp")
+	if err != nil {
+		return err
+	}
+
+	count := 0
+	for hit := range hits {
+		item := &ClientTask{}
+		err := json.Unmarshal(hit, item)
+		if err != nil {
+			continue
+		}
+
+		message := &crypto_proto.VeloMessage{}
+		err = protojson.Unmarshal([]byte(item.JSONData), message)
+		if err != nil {
+			continue
+		}
+
+		expireTask(ctx, self.config_obj, item, message)
+		count++
+	}
+
+	if count == 0 {
+		return nil
+	}
+
+	cvelo_services.Count("PurgeExpiredTasks")
+
+	return cvelo_services.DeleteByQuery(ctx, self.config_obj.OrgId,
+		cvelo_services.PERSISTED, query)
+}
+
+// The task will never be delivered so the collection will never
+// complete. Mark it as failed so the user knows what happened.
+func expireTask(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	task *ClientTask, message *crypto_proto.VeloMessage) {
+
+	// Only collection requests have a flow to update.
+	if message.FlowRequest == nil {
+		return
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+	logger.Info("Task for collection %v on %v expired before it was delivered",
+		task.FlowId, task.ClientId)
+
+	launcher, err := services.GetLauncher(config_obj)
+	if err != nil {
+		return
+	}
+
+	flow, err := launcher.Storage().LoadCollectionContext(
+		ctx, config_obj, task.ClientId, task.FlowId)
+	if err != nil || flow.SessionId == "" {
+		return
+	}
+
+	flow.State = flows_proto.ArtifactCollectorContext_ERROR
+	flow.Status = "Collection expired before the client received it"
+
+	err = launcher.Storage().WriteFlow(
+		ctx, config_obj, flow, utils.BackgroundWriter)
+	if err != nil {
+		logger.Error("expireTask: %v", err)
+	}
+
+	// The client never started the hunt's collection so the
+	// ingestor will never account for it. Count it as a failed
+	// collection of the hunt.
+	hunt_id, ok := utils.ExtractHuntId(task.FlowId)
+	if !ok {
+		return
+	}
+
+	err = ingestor_services.IncHuntFailedBeforeStart(ctx, config_obj, hunt_id)
+	if err != nil {
+		logger.Error("expireTask: %v", err)
+	}
+
+	err = cvelo_services.SetElasticIndex(ctx,
+		config_obj.OrgId, cvelo_services.TRANSIENT, cvelo_services.DocIdRandom,
+		&hunt_dispatcher.HuntFlowEntry{
+			HuntId:    hunt_id,
+			ClientId:  task.ClientId,
+			FlowId:    task.FlowId,
+			Timestamp: utils.GetTime().Now().Unix(),
+			Status:    "updated",
+			DocType:   "hunt_flow",
+		})
+	if err != nil {
+		logger.Error("expireTask: %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+package client_info
+
+import (
+	"context"
+
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+const (
+	getFlowTasksQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"term": {"client_id" : %q}},
+         {"term": {"flow_id" : %q}},
+         {"match": {"doc_type" : "task"}}
+      ]}
+  }
+}
+`
+	// All the collections of a hunt share the same flow id.
+	getHuntTasksQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"term": {"flow_id" : %q}},
+         {"match": {"doc_type" : "task"}}
+      ]}
+  }
+}
+`
+)
+
+// Tasks stay in the persisted index until the client picks them
+// up. Revoking a task removes it before it is delivered. Tasks that
+// were already delivered need to be cancelled on the client instead.
+func (self ClientInfoQueuer) RevokeFlowTasks(
+	ctx context.Context, client_id, flow_id string) (int, error) {
+	return self.revokeTasks(ctx,
+		json.Format(getFlowTasksQuery, client_id, flow_id), nil)
+}
+
+func (self ClientInfoQueuer) RevokeHuntTasks(
+	ctx context.Context, hunt_id string) ([]string, error) {
+	var client_ids []string
+	seen := make(map[string]bool)
+
+	flow_id := utils.CreateFlowIdFromHuntId(hunt_id)
+	_, err := self.revokeTasks(ctx,
+		json.Format(getHuntTasksQuery, flow_id),
+		func(task *ClientTask) {
+			if !seen[task.ClientId] {
+				seen[task.ClientId] = true
+				client_ids = append(client_ids, task.ClientId)
+			}
+		})
+	return client_ids, err
+}
+
+func (self ClientInfoQueuer) UnQueueMessageForClient(
+	ctx context.Context,
+	client_id string, req *crypto_proto.VeloMessage) error {
+	_, err := self.RevokeFlowTasks(ctx, client_id, req.SessionId)
+	return err
+}
+
+// Remove all the tasks matching the query. The callback is called on
+// each task before it is removed.
+func (self ClientInfoQueuer) revokeTasks(
+	ctx context.Context, query string, cb func(task *ClientTask)) (int, error) {
+
+	hits, err := cvelo_services.QueryChan(ctx, self.config_obj, 1000,
+		self.config_obj.OrgId, cvelo_services.PERSISTED, query, "timestamp")
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for hit := range hits {
+		task := &ClientTask{}
+		err := json.Unmarshal(hit, task)
+		if err != nil {
+			continue
+		}
+
+		count++
+		if cb != nil {
+			cb(task)
+		}
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	cvelo_services.Count("RevokeTasks")
+
+	return count, cvelo_services.DeleteByQuery(ctx, self.config_obj.OrgId,
+		cvelo_services.PERSISTED, query)
+}
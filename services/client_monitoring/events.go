@@ -16,11 +16,21 @@ func (self *ClientMonitoringManager) ListAvailableEventResults(
 	ctx context.Context,
 	in *api_proto.ListAvailableEventResultsRequest) (
 	*api_proto.ListAvailableEventResultsResponse, error) {
+	return ListAvailableEventResults(ctx, self.config_obj, in)
+}
+
+// Shared with the server monitoring service which stores its results
+// in the same way under the "server" client id.
+func ListAvailableEventResults(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	in *api_proto.ListAvailableEventResultsRequest) (
+	*api_proto.ListAvailableEventResultsResponse, error) {
 
 	if in.Artifact == "" {
-		return listAvailableEventArtifacts(ctx, self.config_obj, in)
+		return listAvailableEventArtifacts(ctx, config_obj, in)
 	}
-	return listAvailableEventTimestamps(ctx, self.config_obj, in)
+	return listAvailableEventTimestamps(ctx, config_obj, in)
 }
 
 const (
@@ -82,9 +92,9 @@ func listAvailableEventArtifacts(
 
 	var query string
 	if in.ClientId == "" || in.ClientId == "server" {
-		// Get server artifacts. Although we dont have a server
-		// artifacts runner, it is still possible for server artifacts
-		// to be written by various services (e.g. Audit manager).
+		// Get server artifacts. These are written by the server
+		// monitoring service as well as various other services
+		// (e.g. Audit manager).
 		query = json.Format(getAvailableServerArtifactsQuery,
 			"server", "results", OPENSEARCH_MAX_BUCKETS)
 
@@ -0,0 +1,105 @@
+package services
+
+import (
+	"context"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+const (
+	deletionQuery = `
+{
+  "query": {
+     "bool": {
+       "must": [
+         {"match": {%q: %q}}
+       ]
+     }
+  }
+}
+`
+)
+
+// A DeleteReporter removes documents on behalf of the various delete
+// operations (flows, hunts, clients) and keeps track of what was
+// removed so it can be reported back to the user. When really_do_it
+// is not set, nothing is removed and the matching documents are
+// reported instead.
+type DeleteReporter struct {
+	ctx          context.Context
+	org_id       string
+	really_do_it bool
+	responses    []*services.DeleteFlowResponse
+}
+
+func NewDeleteReporter(
+	ctx context.Context, org_id string, really_do_it bool) *DeleteReporter {
+	return &DeleteReporter{
+		ctx:          ctx,
+		org_id:       org_id,
+		really_do_it: really_do_it,
+	}
+}
+
+func (self *DeleteReporter) Responses() []*services.DeleteFlowResponse {
+	return self.responses
+}
+
+// Record an item that was removed by other means (e.g. a file in the
+// filestore).
+func (self *DeleteReporter) Report(type_ string, data *ordereddict.Dict, err error) {
+	var error_message string
+	if err != nil {
+		error_message = err.Error()
+	}
+
+	self.responses = append(self.responses, &services.DeleteFlowResponse{
+		Type:  type_,
+		Data:  data,
+		Error: error_message,
+	})
+}
+
+// Delete all documents where key matches value exactly.
+func (self *DeleteReporter) DeleteIndex(type_, index, key, value string) {
+	self.DeleteWithQuery(type_, index, json.Format(deletionQuery, key, value),
+		ordereddict.NewDict().
+			Set("index", index).
+			Set(key, value))
+}
+
+// Delete all the documents matching the query. The description is
+// used to report the deletion.
+func (self *DeleteReporter) DeleteWithQuery(
+	type_, index, query string, description *ordereddict.Dict) {
+	if self.really_do_it {
+		err := DeleteByQuery(self.ctx, self.org_id, index, query)
+		self.Report(type_, description, err)
+		return
+	}
+
+	hits, total, err := QueryElasticRaw(self.ctx, self.org_id, index, query)
+	if err != nil {
+		self.Report(type_, description, err)
+		return
+	}
+
+	for _, hit := range hits {
+		source := ordereddict.NewDict()
+		source.UnmarshalJSON(hit)
+		self.Report(type_, source, nil)
+	}
+
+	// Only the first page of hits is shown so let the user know
+	// how many documents will really be removed.
+	if total > len(hits) {
+		summary := ordereddict.NewDict()
+		for _, k := range description.Keys() {
+			v, _ := description.Get(k)
+			summary.Set(k, v)
+		}
+		self.Report(type_, summary.Set("total", total), nil)
+	}
+}
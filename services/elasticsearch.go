@@ -3,11 +3,13 @@ package services
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"regexp"
 	"strings"
@@ -30,8 +32,6 @@ import (
 
 type BulkUpdateType string
 
-type OpenSearchClusterOptions int
-
 const (
 	AsyncDelete = false
 	SyncDelete  = true
@@ -42,9 +42,12 @@ const (
 	BulkUpdateIndex  = "index"  // Create or update existing record.
 	BulkUpdateCreate = "create" // Create new record if no existing record.
 
-	DocIdRandom                                = ""
-	PrimaryOpenSearch OpenSearchClusterOptions = iota + 1
-	SecondaryOpenSearch
+	DocIdRandom = ""
+
+	// How long the point in time used by QueryChan stays open
+	// between pages.
+	QUERY_CHAN_KEEP_ALIVE          = "5m"
+	QUERY_CHAN_KEEP_ALIVE_DURATION = 5 * time.Minute
 
 	// Levels of debug to match with debug_filter regexp.
 	DEBUG_ELASTIC    = "ELASTIC"
@@ -52,10 +55,13 @@ const (
 )
 
 var (
-	mu             sync.Mutex
-	elasticClients = make(map[OpenSearchClusterOptions]*opensearch.Client)
+	mu sync.Mutex
 
-	// A set of orgs that belong to the primary cluster.
+	// OpenSearch clients by cluster name.
+	elasticClients = make(map[string]*opensearch.Client)
+
+	// A set of orgs that belong to the primary cluster. Only used for
+	// orgs that are not in the placement table.
 	primary_orgs = make(map[string]bool)
 
 	TRUE = true
@@ -63,7 +69,9 @@ var (
 	logger_filter *regexp.Regexp
 	logger        *logging.LogContext
 
-	bulk_indexer *BulkIndexer
+	// Each cluster has its own bulk indexer.
+	bulk_indexers = make(map[string]*BulkIndexer)
+	bulk_spool    *Spool
 
 	ElasticConfigurationNotInitializedError = errors.New(
 		"Elastic configuration not initialized")
@@ -93,8 +101,8 @@ type IndexInfo struct {
 func ListIndexes(ctx context.Context) ([]string, error) {
 
 	results := []string{}
-	for _, client := range elasticClients {
-		indexes, err := listIndexes(client, ctx)
+	for _, cluster := range ListClusters() {
+		indexes, err := ListClusterIndexes(ctx, cluster)
 		if err != nil {
 			return nil, err
 		}
@@ -103,6 +111,15 @@ func ListIndexes(ctx context.Context) ([]string, error) {
 	return results, nil
 }
 
+// List the indexes on a single cluster.
+func ListClusterIndexes(ctx context.Context, cluster string) ([]string, error) {
+	client, err := GetElasticClientByName(cluster)
+	if err != nil {
+		return nil, err
+	}
+	return listIndexes(client, ctx)
+}
+
 func listIndexes(client *opensearch.Client, ctx context.Context) ([]string, error) {
 	res, err := opensearchapi.CatIndicesRequest{
 		Format: "json",
@@ -143,64 +160,53 @@ func GetIndex(org_id, index string) string {
 		"%s_%s", strings.ToLower(org_id), index)
 }
 
-func DeleteDocument(
-	ctx context.Context, org_id, index string, id string, sync bool) error {
-
-	defer Instrument("DeleteDocument")()
-
-	defer Debug(DEBUG_ELASTIC, "DeleteDocument %v", id)()
-	client, err := GetElasticClient(org_id)
-	if err != nil {
-		return err
-	}
-
-	res, err := opensearchapi.DeleteRequest{
-		Index:      GetIndex(org_id, index),
-		DocumentID: id,
-	}.Do(ctx, client)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
-
-	if sync {
-		res, err = opensearchapi.IndicesRefreshRequest{
-			Index: []string{GetIndex(org_id, index)},
-		}.Do(ctx, client)
-		defer res.Body.Close()
+// Searching the transient index covers the data streams of all the
+// transient data classes.
+func GetReadIndex(org_id, index string) string {
+	if index == TRANSIENT {
+		return GetIndex(org_id, index) + "*"
 	}
-
-	return err
+	return GetIndex(org_id, index)
 }
 
-func DeleteDocumentByQuery(
-	ctx context.Context, org_id, index string, query string, sync bool) error {
-
-	defer Instrument("DeleteDocument")()
-	expanded_index := GetIndex(org_id, index)
-	client, err := GetElasticClient(org_id)
-	if err != nil {
-		return err
-	}
+// Whether a document read from the transient index came from the
+// legacy transient stream itself rather than one of the data
+// classes. Data streams report their backing index.
+func IsLegacyTransientIndex(org_id, index string) bool {
+	name := GetIndex(org_id, TRANSIENT)
+	return index == name || strings.HasPrefix(index, ".ds-"+name+"-")
+}
 
-	res, err := opensearchapi.DeleteByQueryRequest{Query: query, Index: []string{expanded_index}}.Do(ctx, client)
-	if err != nil {
-		return err
-	}
-	defer res.Body.Close()
+// The OpenSearch backend. Writes go to the cluster the org lives on
+// and, while the org is migrating, also to the cluster it is
+// migrating to.
+type openSearchBackend struct{}
 
-	if sync {
-		res, err = opensearchapi.IndicesRefreshRequest{
-			Index: []string{expanded_index},
+func (self openSearchBackend) Delete(
+	ctx context.Context, org_id, index string, id string, sync bool) error {
+	return forEachWriteClient(org_id, func(
+		client *opensearch.Client, is_migration_target bool) error {
+		res, err := opensearchapi.DeleteRequest{
+			Index:      GetIndex(org_id, index),
+			DocumentID: id,
 		}.Do(ctx, client)
+		if err != nil {
+			return err
+		}
 		defer res.Body.Close()
-	}
 
-	return err
+		if sync {
+			res, err = opensearchapi.IndicesRefreshRequest{
+				Index: []string{GetIndex(org_id, index)},
+			}.Do(ctx, client)
+			defer res.Body.Close()
+		}
+
+		return err
+	})
 }
 
-// Should be called to force the index to synchronize.
-func FlushIndex(
+func (self openSearchBackend) Flush(
 	ctx context.Context, org_id, index string) error {
 	client, err := GetElasticClient(org_id)
 	if err != nil {
@@ -208,7 +214,7 @@ func FlushIndex(
 	}
 
 	res, err := opensearchapi.IndicesRefreshRequest{
-		Index: []string{GetIndex(org_id, index)},
+		Index: []string{GetReadIndex(org_id, index)},
 	}.Do(ctx, client)
 
 	if err != nil {
@@ -220,23 +226,35 @@ func FlushIndex(
 	return err
 }
 
-func UpdateIndex(
+func (self openSearchBackend) Update(
 	ctx context.Context, org_id, index, id string, query string) error {
-	defer Instrument("UpdateIndex")()
-	defer Debug(DEBUG_ELASTIC, "UpdateIndex %v %v", index, id)()
-	return retry(func() error {
-		err := _UpdateIndex(ctx, org_id, index, id, query)
+	return forEachWriteClient(org_id, func(
+		client *opensearch.Client, is_migration_target bool) error {
+		err := retry(ctx, func() error {
+			return _UpdateIndex(ctx, client, org_id, index, id, query)
+		})
+
+		// The org's migration has not copied this document yet. The
+		// copy may already have read the old document so copy the
+		// updated one from the org's cluster now. A later copy of
+		// the old document will not replace it.
+		if is_migration_target && errors.Is(err, os.ErrNotExist) {
+			updated, err := self.Get(ctx, org_id, index, id)
+			if err != nil {
+				return err
+			}
+
+			return retry(ctx, func() error {
+				return _SetElasticIndex(ctx, client, org_id, index, id, updated)
+			})
+		}
 		return err
 	})
 }
 
 func _UpdateIndex(
-	ctx context.Context, org_id, index, id string, query string) error {
-	client, err := GetElasticClient(org_id)
-	if err != nil {
-		return err
-	}
-
+	ctx context.Context, client *opensearch.Client,
+	org_id, index, id string, query string) error {
 	es_req := opensearchapi.UpdateRequest{
 		Index:      GetIndex(org_id, index),
 		DocumentID: id,
@@ -260,62 +278,75 @@ func _UpdateIndex(
 		return nil
 	}
 
-	return makeElasticError(data)
+	// A missing document is os.ErrNotExist.
+	return makeElasticError(res.StatusCode, data)
 }
 
-func DoesTemplateExist(ctx context.Context, name string) error {
-	for _, client := range elasticClients {
-		err := doesTemplateExist(client, ctx, name)
-		if err != nil {
-			return err
-		}
-	}
-	return nil
+type _IndexTemplates struct {
+	IndexTemplates []struct {
+		IndexTemplate struct {
+			Version int `json:"version"`
+		} `json:"index_template"`
+	} `json:"index_templates"`
 }
 
-func doesTemplateExist(client *opensearch.Client, ctx context.Context, name string) error {
-	resp, err := opensearchapi.IndicesExistsIndexTemplateRequest{
-		Name: name,
+// Get the version of the installed template. Returns os.ErrNotExist
+// if the template is not installed.
+func GetTemplateVersion(ctx context.Context, name, cluster string) (int, error) {
+	client, err := GetElasticClientByName(cluster)
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := opensearchapi.IndicesGetIndexTemplateRequest{
+		Name: []string{name},
 	}.Do(ctx, client)
-	defer resp.Body.Close()
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
 
+	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	data, err := ioutil.ReadAll(resp.Body)
+	if res.IsError() {
+		return 0, makeElasticError(res.StatusCode, data)
+	}
+
+	parsed := &_IndexTemplates{}
+	err = json.Unmarshal(data, parsed)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
-	// All is well we dont need to parse the results
-	if !resp.IsError() {
-		return nil
+	if len(parsed.IndexTemplates) == 0 {
+		return 0, os.ErrNotExist
 	}
 
-	return makeElasticError(data)
+	return parsed.IndexTemplates[0].IndexTemplate.Version, nil
 }
 
 func PutTemplate(
-	ctx context.Context, name, template string, instance_type OpenSearchClusterOptions) error {
+	ctx context.Context, name, template, cluster string) error {
 
 	defer Instrument("PutTemplate")()
 
-	client, err := GetElasticClientByType(instance_type)
+	client, err := GetElasticClientByName(cluster)
 	if err != nil {
 		return err
 	}
 
+	// Replaces any older version of the template.
 	resp, err := opensearchapi.IndicesPutIndexTemplateRequest{
-		Name:   name,
-		Create: &TRUE,
-		Body:   strings.NewReader(template),
+		Name: name,
+		Body: strings.NewReader(template),
 	}.Do(ctx, client)
-	defer resp.Body.Close()
-
 	if err != nil {
 		return err
 	}
+	defer resp.Body.Close()
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
@@ -327,56 +358,123 @@ func PutTemplate(
 		return nil
 	}
 
-	return makeElasticError(data)
+	return makeElasticError(resp.StatusCode, data)
 }
 
-func SetElasticIndexAsync(org_id, index, id string,
-	action BulkUpdateType, record interface{}) error {
-
-	defer Debug(DEBUG_ELASTIC, "SetElasticIndexAsync %v %v", index, id)()
-
-	mu.Lock()
-	l_bulk_indexer := bulk_indexer
-	mu.Unlock()
-
+func (self openSearchBackend) SetAsync(org_id, index, id string,
+	action BulkUpdateType, record interface{},
+	completion func(err error)) error {
 	serialized := json.MustMarshalString(record)
 
-	// Add with background context which might outlive our caller.
-	return l_bulk_indexer.Add(context.Background(),
-		opensearchutil.BulkIndexerItem{
-			Index:      GetIndex(org_id, index),
+	indexers, err := getBulkIndexers(org_id)
+	if err != nil {
+		// We do not know where the item goes right now so spool it
+		// for later. The spool is only available once the bulk
+		// indexer service is started.
+		mu.Lock()
+		spool := bulk_spool
+		mu.Unlock()
+
+		if spool != nil && spool.Add(&SpoolItem{
+			OrgId:      org_id,
+			Index:      index,
 			Action:     string(action),
 			DocumentID: id,
-			Body:       strings.NewReader(serialized),
-			OnFailure: func(ctx context.Context,
-				item opensearchutil.BulkIndexerItem,
-				res opensearchutil.BulkIndexerResponseItem, err error) {
-				logger := logging.GetLogger(l_bulk_indexer.config_obj,
-					&logging.FrontendComponent)
-				logger.Error("BulkIndexer Error %v during: %v", res.Error.Reason,
-					json.MustMarshalString(record))
-			},
-		})
+			Body:       serialized,
+		}) {
+			// The item is pending replay.
+			if completion != nil {
+				completion(nil)
+			}
+			return nil
+		}
+
+		if completion != nil {
+			completion(err)
+		}
+		return err
+	}
+
+	// While the org is migrating the document is written to both
+	// clusters. They must agree on the id so the migration does not
+	// copy the document again.
+	if id == DocIdRandom && len(indexers) > 1 {
+		id = newDocId()
+	}
+
+	// The write is complete once all the clusters reported on it.
+	var item_completion func(err error)
+	if completion != nil {
+		item_completion = newMultiCompletion(len(indexers), completion)
+	}
+
+	for i, l_bulk_indexer := range indexers {
+		err = l_bulk_indexer.addItem(
+			org_id, index, id, action, serialized, item_completion)
+		if err != nil {
+			// The remaining clusters will never see the item.
+			if item_completion != nil {
+				for j := i + 1; j < len(indexers); j++ {
+					item_completion(err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
 }
 
-func SetElasticIndex(ctx context.Context,
-	org_id, index, id string, record interface{}) error {
-	defer Instrument("SetElasticIndex")()
-	defer Debug(DEBUG_ELASTIC, "SetElasticIndex %v %v", index, id)()
+// Returns a completion which calls completion with the first error
+// after it was called count times.
+func newMultiCompletion(count int, completion func(err error)) func(err error) {
+	var mu sync.Mutex
+	var first_err error
 
-	return retry(func() error {
-		return _SetElasticIndex(ctx, org_id, index, id, record)
-	})
+	return func(err error) {
+		mu.Lock()
+		if err != nil && first_err == nil {
+			first_err = err
+		}
+		count--
+		done := count == 0
+		mu.Unlock()
+
+		if done {
+			completion(first_err)
+		}
+	}
 }
 
-func _SetElasticIndex(
-	ctx context.Context, org_id, index, id string, record interface{}) error {
-	serialized := json.MustMarshalIndent(record)
-	client, err := GetElasticClient(org_id)
+func (self openSearchBackend) Set(ctx context.Context,
+	org_id, index, id string, record interface{}) error {
+	clients, err := getWriteClients(org_id)
 	if err != nil {
 		return err
 	}
 
+	// While the org is migrating the document is written to both
+	// clusters. They must agree on the id so the migration does not
+	// copy the document again.
+	if id == DocIdRandom && len(clients) > 1 {
+		id = newDocId()
+	}
+
+	for _, client := range clients {
+		err = retry(ctx, func() error {
+			return _SetElasticIndex(ctx, client, org_id, index, id, record)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func _SetElasticIndex(
+	ctx context.Context, client *opensearch.Client,
+	org_id, index, id string, record interface{}) error {
+	serialized := json.MustMarshalIndent(record)
+
 	es_req := opensearchapi.IndexRequest{
 		Index:      GetIndex(org_id, index),
 		DocumentID: id,
@@ -400,7 +498,7 @@ func _SetElasticIndex(
 		return nil
 	}
 
-	return makeElasticError(data)
+	return makeElasticError(res.StatusCode, data)
 }
 
 type _ElasticTotal struct {
@@ -442,65 +540,8 @@ type _ElasticResponse struct {
 	Aggregations _ElasticAgg  `json:"aggregations"`
 }
 
-// Gets a single elastic record by id.
-func GetElasticRecordByQuery(
-	ctx context.Context, org_id, index_suffix, query string) (json.RawMessage, error) {
-	defer Debug(DEBUG_ELASTIC, "GetElasticRecordByQuery %v %v", index_suffix, query)()
-	defer Instrument("GetElasticRecordByQuery")()
-
-	client, err := GetElasticClient(org_id)
-	if err != nil {
-		return nil, err
-	}
-	index := GetIndex(org_id, index_suffix)
-	res, err := opensearchapi.SearchRequest{
-		Index: []string{index},
-		Body:  strings.NewReader(query),
-	}.Do(ctx, client)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// All is well we don't need to parse the results
-	if !res.IsError() {
-		hit := &_ElasticResponse{}
-		err := json.Unmarshal(data, hit)
-		if hit.Hits.Total.Value > 0 {
-			return hit.Hits.Hits[0].Source, err
-		} else {
-			return nil, err
-		}
-	}
-
-	response := ordereddict.NewDict()
-	err = response.UnmarshalJSON(data)
-	if err != nil {
-		return nil, makeReadElasticError(data)
-	}
-
-	found_any, pres := response.Get("found")
-	if pres {
-		found, ok := found_any.(bool)
-		if ok && !found {
-			return nil, os.ErrNotExist
-		}
-	}
-
-	return nil, makeReadElasticError(data)
-}
-
-// Gets a single elastic record by id.
-func GetElasticRecord(
+func (self openSearchBackend) Get(
 	ctx context.Context, org_id, index, id string) (json.RawMessage, error) {
-	defer Debug(DEBUG_ELASTIC, "GetElasticRecord %v %v", index, id)()
-	defer Instrument("GetElasticRecord")()
-
 	client, err := GetElasticClient(org_id)
 	if err != nil {
 		return nil, err
@@ -530,7 +571,7 @@ func GetElasticRecord(
 	response := ordereddict.NewDict()
 	err = response.UnmarshalJSON(data)
 	if err != nil {
-		return nil, makeReadElasticError(data)
+		return nil, makeReadElasticError(res.StatusCode, data)
 	}
 
 	found_any, pres := response.Get("found")
@@ -542,7 +583,7 @@ func GetElasticRecord(
 	}
 
 	// If the index is not yet created this is a not exists error.
-	err = makeReadElasticError(data)
+	err = makeReadElasticError(res.StatusCode, data)
 	if err == nil {
 		return nil, os.ErrNotExist
 	}
@@ -559,23 +600,9 @@ type docs struct {
 	Docs []doc_id `json:"docs"`
 }
 
-// Gets a single elastic record by id.
-func GetMultipleElasticRecords(
+func (self openSearchBackend) MultiGet(
 	ctx context.Context,
 	org_id, index string, ids []string) ([]json.RawMessage, error) {
-
-	defer Instrument("GetMultipleElasticRecords")()
-
-	if len(ids) == 0 {
-		return nil, nil
-	}
-
-	if len(ids) > 4 {
-		defer Debug(DEBUG_ELASTIC, "GetMultipleElasticRecords %v %v ...", index, ids[:4])()
-	} else {
-		defer Debug(DEBUG_ELASTIC, "GetMultipleElasticRecords %v %v", index, ids)()
-	}
-
 	client, err := GetElasticClient(org_id)
 	if err != nil {
 		return nil, err
@@ -619,7 +646,7 @@ func GetMultipleElasticRecords(
 	response := ordereddict.NewDict()
 	err = response.UnmarshalJSON(data)
 	if err != nil {
-		return nil, makeReadElasticError(data)
+		return nil, makeReadElasticError(res.StatusCode, data)
 	}
 
 	found_any, pres := response.Get("found")
@@ -630,100 +657,89 @@ func GetMultipleElasticRecords(
 		}
 	}
 
-	return nil, makeReadElasticError(data)
+	return nil, makeReadElasticError(res.StatusCode, data)
 }
 
-// Automatically take care of paging by returning a channel.  Query
-// should be a JSON query **without** a sorting clause, or "size"
-// clause.
-// This function will modify the query to add a sorting column and
-// automatically apply the search_after to page through the
-// results. Currently we do not take a point in time snapshot so
-// results are approximate.
-func QueryChan(
+// Pages through a point in time with search_after.
+func (self openSearchBackend) QueryChan(
 	ctx context.Context,
 	config_obj *config_proto.Config,
 	page_size int,
 	org_id, index, query, sort_field string) (
 	chan json.RawMessage, error) {
 
-	defer Debug(DEBUG_ELASTIC, "QueryChan %v", index)()
-
 	output_chan := make(chan json.RawMessage)
 
-	query = strings.TrimSpace(query)
-	var part_query string
-	if sort_field != "" {
-		sense := "asc"
-		if sort_field[0] == '>' {
-			sense = "desc"
-			sort_field = sort_field[1:]
-		}
+	client, err := GetElasticClient(org_id)
+	if err != nil {
+		close(output_chan)
+		return output_chan, err
+	}
 
-		part_query = json.Format(`{"sort":[{%q: %q}], "size":%q,`,
-			sort_field, sense, page_size)
-	} else {
-		part_query = json.Format(`{"size":%q,`, page_size)
+	sense := "asc"
+	if sort_field != "" && sort_field[0] == '>' {
+		sense = "desc"
+		sort_field = sort_field[1:]
+	}
+
+	sort := json.Format(`[{"_id": %q}]`, sense)
+	if sort_field != "" {
+		sort = json.Format(`[{%q: %q}, {"_id": %q}]`,
+			sort_field, sense, sense)
 	}
-	part_query += query[1:]
 
-	part, _, err := QueryElasticRaw(ctx, org_id, index, part_query)
+	pit_id, err := openPointInTime(ctx, client, GetReadIndex(org_id, index))
 	if err != nil {
 		close(output_chan)
 		return output_chan, err
 	}
 
-	var search_after interface{}
-	var pres bool
+	// The index does not exist yet so there is nothing to return.
+	if pit_id == "" {
+		close(output_chan)
+		return output_chan, nil
+	}
+
+	query = strings.TrimSpace(query)
+	part, err := queryPointInTime(ctx, client, &pit_id,
+		pitQuery(pit_id, sort, page_size, nil, query))
+	if err != nil {
+		closePointInTime(client, pit_id)
+		close(output_chan)
+		return output_chan, err
+	}
 
 	go func() {
 		defer close(output_chan)
 
+		// Release the PIT even when our caller goes away.
+		defer func() {
+			closePointInTime(client, pit_id)
+		}()
+
 		for {
 			if len(part) == 0 {
 				return
 			}
-			for idx, p := range part {
+
+			for _, hit := range part {
 				select {
 				case <-ctx.Done():
 					return
-				case output_chan <- p:
-				}
-
-				// On the last row we look at the result so we can get
-				// the next part.
-				if idx == len(part)-1 {
-					row := ordereddict.NewDict()
-					err := row.UnmarshalJSON(p)
-					if err != nil {
-						logger := logging.GetLogger(config_obj,
-							&logging.FrontendComponent)
-						logger.Error("QueryChan: %v", err)
-						return
-					}
-
-					search_after, pres = row.Get(sort_field)
-					if !pres {
-						logger := logging.GetLogger(config_obj,
-							&logging.FrontendComponent)
-						logger.Error("QueryChan: Row does not contain sorting column %v", sort_field)
-						return
-					}
+				case output_chan <- hit.Source:
 				}
 			}
 
 			// The last page is short so this means it is the last
 			// page.
 			if len(part) < page_size {
-				break
+				return
 			}
 
-			// Form the next query using the search_after value.
-			part_query := json.Format(`
-{"sort":[{%q: "asc"}], "size":%q,"search_after": [%q],`,
-				sort_field, page_size, search_after) + query[1:]
-
-			part, _, err = QueryElasticRaw(ctx, org_id, index, part_query)
+			// Continue after the sort values of the last row.
+			search_after := part[len(part)-1].Sort
+			part, err = queryPointInTime(ctx, client, &pit_id,
+				pitQuery(pit_id, sort, page_size, search_after, query))
 			if err != nil {
 				logger := logging.GetLogger(config_obj,
 					&logging.FrontendComponent)
@@ -736,55 +752,87 @@ func QueryChan(
 	return output_chan, nil
 }
 
-func DeleteByQuery(
-	ctx context.Context, org_id, index, query string) error {
+type _PITHit struct {
+	Source json.RawMessage `json:"_source"`
+
+	// Kept raw so large numbers are passed back exactly.
+	Sort json.RawMessage `json:"sort"`
+}
 
-	defer Instrument("DeleteByQuery")()
+type _PITResponse struct {
+	PitId string `json:"pit_id"`
+	Hits  struct {
+		Hits []_PITHit `json:"hits"`
+	} `json:"hits"`
+}
 
-	client, err := GetElasticClient(org_id)
-	if err != nil {
-		return err
-	}
+// Returns an empty id if the index does not exist.
+func openPointInTime(
+	ctx context.Context, client *opensearch.Client, index string) (string, error) {
+	defer Instrument("OpenPointInTime")()
 
-	res, err := opensearchapi.DeleteByQueryRequest{
-		Index:   []string{GetIndex(org_id, index)},
-		Body:    strings.NewReader(query),
-		Refresh: &TRUE,
+	res, pit, err := opensearchapi.PointInTimeCreateRequest{
+		Index:     []string{index},
+		KeepAlive: QUERY_CHAN_KEEP_ALIVE_DURATION,
 	}.Do(ctx, client)
+	if res != nil {
+		defer res.Body.Close()
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer res.Body.Close()
 
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return err
+	if res.StatusCode == http.StatusNotFound {
+		return "", nil
 	}
 
-	// All is well we dont need to parse the results
-	if !res.IsError() {
-		return nil
+	if res.IsError() || pit == nil || pit.PitID == "" {
+		return "", fmt.Errorf("Unable to open point in time on %v: %v",
+			index, res.Status())
 	}
 
-	return makeReadElasticError(data)
+	return pit.PitID, nil
 }
 
-func QueryElasticAggregations(
-	ctx context.Context, org_id, index, query string) ([]string, error) {
+func closePointInTime(client *opensearch.Client, pit_id string) {
+	// Our context may already be cancelled.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
 
-	defer Instrument("QueryElasticAggregations")()
-	defer Debug(DEBUG_ELASTIC, "QueryElasticAggregations %v", index)()
+	res, _, err := opensearchapi.PointInTimeDeleteRequest{
+		PitID: []string{pit_id},
+	}.Do(ctx, client)
+	if err == nil {
+		res.Body.Close()
+	}
+}
 
-	es, err := GetElasticClient(org_id)
-	if err != nil {
-		return nil, err
+// Merge the paging parameters into the caller's query.
+func pitQuery(pit_id, sort string, page_size int,
+	search_after json.RawMessage, query string) string {
+	result := json.Format(`{"pit": {"id": %q, "keep_alive": %q},
+"size": %q, "track_total_hits": false, `,
+		pit_id, QUERY_CHAN_KEEP_ALIVE, page_size) + `"sort": ` + sort + `, `
+
+	if len(search_after) > 0 {
+		result += `"search_after": ` + string(search_after) + `, `
 	}
-	res, err := es.Search(
-		es.Search.WithContext(ctx),
-		es.Search.WithIndex(GetIndex(org_id, index)),
-		es.Search.WithBody(strings.NewReader(query)),
-		es.Search.WithPretty(),
-	)
+
+	return result + query[1:]
+}
+
+// The PIT id may change between pages so we always use the latest.
+func queryPointInTime(
+	ctx context.Context, client *opensearch.Client,
+	pit_id *string, query string) ([]_PITHit, error) {
+
+	defer Instrument("QueryChan")()
+	defer Debug(DEBUG_ELASTIC, "QueryChan %v", query)()
+
+	// PIT searches must not specify the index.
+	res, err := opensearchapi.SearchRequest{
+		Body: strings.NewReader(query),
+	}.Do(ctx, client)
 	if err != nil {
 		return nil, err
 	}
@@ -795,146 +843,150 @@ func QueryElasticAggregations(
 		return nil, err
 	}
 
-	// There was an error so we need to relay it
 	if res.IsError() {
-		return nil, makeReadElasticError(data)
+		return nil, makeElasticError(res.StatusCode, data)
 	}
 
-	parsed := &_ElasticResponse{}
-	err = json.Unmarshal(data, &parsed)
+	parsed := &_PITResponse{}
+	err = json.Unmarshal(data, parsed)
 	if err != nil {
-		return nil, makeReadElasticError(data)
-	}
-
-	var results []string
-	// Handle value aggregates
-	if !utils.IsNil(parsed.Aggregations.Results.Value) {
-		results = append(results, to_string(parsed.Aggregations.Results.Value))
-		return results, nil
+		return nil, err
 	}
 
-	for _, hit := range parsed.Aggregations.Results.Buckets {
-		results = append(results, to_string(hit.Key))
+	if parsed.PitId != "" {
+		*pit_id = parsed.PitId
 	}
 
-	return results, nil
+	return parsed.Hits.Hits, nil
 }
 
-func to_string(a interface{}) string {
-	switch t := a.(type) {
-	case string:
-		return t
+func (self openSearchBackend) DeleteByQuery(
+	ctx context.Context, org_id, index, query string, sync bool) error {
+	return forEachWriteClient(org_id, func(
+		client *opensearch.Client, is_migration_target bool) error {
+		res, err := opensearchapi.DeleteByQueryRequest{
+			Index:   []string{GetReadIndex(org_id, index)},
+			Body:    strings.NewReader(query),
+			Refresh: &sync,
+		}.Do(ctx, client)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
 
-	default:
-		return string(json.MustMarshalIndent(a))
-	}
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+
+		// All is well we dont need to parse the results
+		if !res.IsError() {
+			return nil
+		}
+
+		return makeReadElasticError(res.StatusCode, data)
+	})
 }
 
-func QueryElasticRaw(
+func (self openSearchBackend) Search(
 	ctx context.Context,
-	org_id, index, query string) ([]json.RawMessage, int, error) {
-
-	defer Instrument("QueryElasticRaw")()
-	defer Debug(DEBUG_ELASTIC, "QueryElasticRaw %v", query)()
+	org_id, index, query string) (*SearchResult, error) {
 
 	es, err := GetElasticClient(org_id)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	res, err := es.Search(
 		es.Search.WithContext(ctx),
-		es.Search.WithIndex(GetIndex(org_id, index)),
+		es.Search.WithIndex(GetReadIndex(org_id, index)),
 		es.Search.WithBody(strings.NewReader(query)),
 		es.Search.WithPretty(),
 	)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 	defer res.Body.Close()
 
 	data, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
+	result := &SearchResult{}
+
 	// There was an error so we need to relay it
 	if res.IsError() {
-		return nil, 0, makeReadElasticError(data)
+		return result, makeReadElasticError(res.StatusCode, data)
 	}
 
 	parsed := &_ElasticResponse{}
 	err = json.Unmarshal(data, &parsed)
 	if err != nil {
-		return nil, 0, makeReadElasticError(data)
+		return result, makeReadElasticError(res.StatusCode, data)
 	}
 
-	var results []json.RawMessage
 	for _, hit := range parsed.Hits.Hits {
-		results = append(results, hit.Source)
+		result.Hits = append(result.Hits, Result{
+			JSON:  hit.Source,
+			Id:    hit.Id,
+			Index: hit.Index,
+		})
 	}
+	result.Total = parsed.Hits.Total.Value
 
-	return results, parsed.Hits.Total.Value, nil
-}
-
-// Return only Ids of matching documents.
-// You probably want to add the following to the query:
-// "_source": false
-func QueryElasticIds(
-	ctx context.Context,
-	org_id, index, query string) (ids []string, total int, err error) {
-
-	defer Instrument("QueryElasticIds")()
-	es, err := GetElasticClient(org_id)
-	if err != nil {
-		return nil, 0, err
-	}
-	res, err := es.Search(
-		es.Search.WithContext(ctx),
-		es.Search.WithIndex(GetIndex(org_id, index)),
-		es.Search.WithBody(strings.NewReader(query)),
-		es.Search.WithPretty(),
-	)
-	if err != nil {
-		return nil, 0, err
+	// Handle value aggregates
+	if !utils.IsNil(parsed.Aggregations.Results.Value) {
+		result.Aggregations = append(result.Aggregations,
+			to_string(parsed.Aggregations.Results.Value))
+	} else {
+		for _, hit := range parsed.Aggregations.Results.Buckets {
+			result.Aggregations = append(result.Aggregations, to_string(hit.Key))
+		}
 	}
-	defer res.Body.Close()
 
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, 0, err
-	}
+	return result, nil
+}
 
-	// There was an error so we need to relay it
-	if res.IsError() {
-		return nil, 0, makeReadElasticError(data)
-	}
+func to_string(a interface{}) string {
+	switch t := a.(type) {
+	case string:
+		return t
 
-	parsed := &_ElasticResponse{}
-	err = json.Unmarshal(data, &parsed)
-	if err != nil {
-		return nil, 0, makeReadElasticError(data)
+	default:
+		return string(json.MustMarshalIndent(a))
 	}
+}
 
-	var results []string
-	for _, hit := range parsed.Hits.Hits {
-		results = append(results, hit.Id)
+func (self openSearchBackend) Count(
+	ctx context.Context,
+	org_id, index, query string) (total int, err error) {
+	es, err := GetElasticClient(org_id)
+	if err != nil {
+		return 0, err
 	}
-
-	return results, parsed.Hits.Total.Value, nil
+	return queryCount(ctx, es, org_id, index, query)
 }
 
-func QueryCountAPI(
+// Count the org's documents on a specific cluster, regardless of
+// where the org is placed.
+func QueryClusterCountAPI(
 	ctx context.Context,
-	org_id, index, query string) (total int, err error) {
+	cluster, org_id, index, query string) (total int, err error) {
 
 	defer Instrument("QueryCountAPI")()
-	es, err := GetElasticClient(org_id)
+	es, err := GetElasticClientByName(cluster)
 	if err != nil {
 		return 0, err
 	}
+	return queryCount(ctx, es, org_id, index, query)
+}
+
+func queryCount(
+	ctx context.Context, es *opensearch.Client,
+	org_id, index, query string) (total int, err error) {
 	res, err := es.Count(
 		es.Count.WithContext(ctx),
-		es.Count.WithIndex(GetIndex(org_id, index)),
+		es.Count.WithIndex(GetReadIndex(org_id, index)),
 		es.Count.WithBody(strings.NewReader(query)),
 		es.Count.WithPretty(),
 	)
@@ -950,13 +1002,13 @@ func QueryCountAPI(
 
 	// There was an error so we need to relay it
 	if res.IsError() {
-		return 0, makeReadElasticError(data)
+		return 0, makeReadElasticError(res.StatusCode, data)
 	}
 
 	parsed := &_CountResponse{}
 	err = json.Unmarshal(data, &parsed)
 	if err != nil {
-		return 0, makeReadElasticError(data)
+		return 0, makeReadElasticError(res.StatusCode, data)
 	}
 
 	return parsed.Count, nil
@@ -965,106 +1017,25 @@ func QueryCountAPI(
 type Result struct {
 	JSON json.RawMessage
 	Id   string
-}
-
-func QueryElastic(
-	ctx context.Context,
-	org_id, index, query string) ([]Result, error) {
-
-	defer Instrument("QueryElastic")()
-
-	es, err := GetElasticClient(org_id)
-	if err != nil {
-		return nil, err
-	}
-	res, err := es.Search(
-		es.Search.WithContext(ctx),
-		es.Search.WithIndex(GetIndex(org_id, index)),
-		es.Search.WithBody(strings.NewReader(query)),
-		es.Search.WithPretty(),
-	)
-	if err != nil {
-		return nil, err
-	}
-	defer res.Body.Close()
-
-	data, err := ioutil.ReadAll(res.Body)
-	if err != nil {
-		return nil, err
-	}
-
-	// There was an error so we need to relay it
-	if res.IsError() {
-		return nil, makeReadElasticError(data)
-	}
-
-	parsed := &_ElasticResponse{}
-	err = json.Unmarshal(data, &parsed)
-	if err != nil {
-		return nil, makeReadElasticError(data)
-	}
-
-	var results []Result
-	for _, hit := range parsed.Hits.Hits {
-		results = append(results, Result{
-			JSON: hit.Source,
-			Id:   hit.Id,
-		})
-	}
-
-	return results, nil
-}
-
-func GetElasticClientByType(instance_type OpenSearchClusterOptions) (*opensearch.Client, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	switch instance_type {
-	case PrimaryOpenSearch:
-		res, pres := elasticClients[PrimaryOpenSearch]
-		if !pres {
-			return nil, ElasticConfigurationNotInitializedError
-		}
-		return res, nil
-
-	case SecondaryOpenSearch:
-		res, pres := elasticClients[SecondaryOpenSearch]
-		if !pres {
-			return nil, ElasticConfigurationNotInitializedError
-		}
-		return res, nil
 
-	default:
-		return nil, errors.New("invalid opensearch client instance type")
-	}
+	// The index the document was read from.
+	Index string
 }
 
+// Get the client for the cluster the org lives on.
 func GetElasticClient(org_id string) (*opensearch.Client, error) {
-	mu.Lock()
-	defer mu.Unlock()
-
-	// If the config did not specify any primary orgs we always use
-	// the primary client.
-	if len(primary_orgs) == 0 || primary_orgs[org_id] {
-		res, pres := elasticClients[PrimaryOpenSearch]
-		if !pres {
-			return nil, ElasticConfigurationNotInitializedError
-		}
-		return res, nil
-	}
-
-	res, pres := elasticClients[SecondaryOpenSearch]
-	if !pres {
-		return nil, ElasticConfigurationNotInitializedError
+	cluster, err := GetOrgCluster(context.Background(), org_id)
+	if err != nil {
+		return nil, err
 	}
-	return res, nil
+	return GetElasticClientByName(cluster)
 }
 
-func SetElasticClient(clientKey OpenSearchClusterOptions, c *opensearch.Client) {
+func SetElasticClient(cluster string, c *opensearch.Client) {
 	mu.Lock()
 	defer mu.Unlock()
 
-	elasticClients[clientKey] = c
+	elasticClients[cluster] = c
 }
 
 func SetDebugLogger(config_obj *config_proto.Config, filter *regexp.Regexp) {
@@ -1077,52 +1048,89 @@ func SetDebugLogger(config_obj *config_proto.Config, filter *regexp.Regexp) {
 
 func StartElasticSearchService(ctx context.Context, config_obj *cloud_velo_config.Config) error {
 
-	// Initialize the primary_orgs from the config file.
-	primary_orgs = make(map[string]bool)
-	for _, o := range config_obj.Cloud.PrimaryOrgs {
-		primary_orgs[o] = true
+	b, err := startBackend(ctx, config_obj)
+	if err != nil {
+		return err
 	}
+	SetBackend(b)
 
-	primary_config := opensearch.Config{
-		Addresses: config_obj.Cloud.Addresses,
+	// Other backends keep everything on this node.
+	if !UsingOpenSearch() {
+		return nil
 	}
 
-	primary_client, err := createOpenSearchClientFromConfig(
-		ctx, config_obj, primary_config)
-	if err != nil {
-		return err
-	}
+	setRetryPolicy(retryPolicyFromConfig(config_obj))
 
-	// Set the global elastic client
-	SetElasticClient(PrimaryOpenSearch, primary_client)
+	// The addresses in the main config are the primary cluster and
+	// the secondary addresses the secondary cluster. Any number of
+	// other clusters may be configured by name.
+	clusters := []cloud_velo_config.Cluster{{
+		Name:      PRIMARY_CLUSTER,
+		Addresses: config_obj.Cloud.Addresses,
+	}}
 
 	// Secondary Clients are only required in environments big enough
 	// to required multiple OpenSearch clusters
 	if config_obj.Cloud.SecondaryAddresses != nil {
-		secondary_config := opensearch.Config{
+		clusters = append(clusters, cloud_velo_config.Cluster{
+			Name:      SECONDARY_CLUSTER,
 			Addresses: config_obj.Cloud.SecondaryAddresses,
+		})
+	}
+	clusters = append(clusters, config_obj.Cloud.Clusters...)
+
+	for _, cluster := range clusters {
+		if cluster.Name == "" {
+			return errors.New("OpenSearch clusters must have a name")
 		}
 
-		secondary_client, err := createOpenSearchClientFromConfig(
-			ctx, config_obj, secondary_config)
+		client, err := createOpenSearchClientFromConfig(
+			ctx, config_obj, cluster.Name, opensearch.Config{
+				Addresses: cluster.Addresses,
+			})
 		if err != nil {
-			return err
+			return fmt.Errorf("Cluster %v: %w", cluster.Name, err)
 		}
-		SetElasticClient(SecondaryOpenSearch, secondary_client)
+
+		// Set the global elastic client
+		SetElasticClient(cluster.Name, client)
 	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// Initialize the primary_orgs from the config file.
+	primary_orgs = make(map[string]bool)
+	for _, o := range config_obj.Cloud.PrimaryOrgs {
+		primary_orgs[o] = true
+	}
+
+	default_cluster = PRIMARY_CLUSTER
+	if config_obj.Cloud.DefaultCluster != "" {
+		_, pres := elasticClients[config_obj.Cloud.DefaultCluster]
+		if !pres {
+			return fmt.Errorf("%w: %v", ClusterNotConfiguredError,
+				config_obj.Cloud.DefaultCluster)
+		}
+		default_cluster = config_obj.Cloud.DefaultCluster
+	}
+
 	return nil
 }
 
-func createOpenSearchClientFromConfig(ctx context.Context, config_obj *cloud_velo_config.Config, openSearchConfigs opensearch.Config) (*opensearch.Client, error) {
-
-	var err error
+func createOpenSearchClientFromConfig(ctx context.Context, config_obj *cloud_velo_config.Config, cluster string, openSearchConfigs opensearch.Config) (*opensearch.Client, error) {
 
-	openSearchConfigs.Transport, err = networking.GetHttpTransport(
+	transport, err := networking.GetHttpTransport(
 		config_obj.VeloConf().Client, config_obj.Cloud.RootCerts)
 	if err != nil {
 		return nil, err
 	}
 
+	// Retries are handled by our own transport.
+	openSearchConfigs.Transport = newRetryTransport(
+		cluster, transport, config_obj)
+	openSearchConfigs.DisableRetry = true
+
 	if config_obj.Cloud.Username != "" && config_obj.Cloud.Password != "" {
 		openSearchConfigs.Username = config_obj.Cloud.Username
 		openSearchConfigs.Password = config_obj.Cloud.Password
@@ -1153,45 +1161,21 @@ func createOpenSearchClientFromConfig(ctx context.Context, config_obj *cloud_vel
 	return client, nil
 }
 
-func makeElasticError(data []byte) error {
-	response := ordereddict.NewDict()
-	err := response.UnmarshalJSON(data)
-	if err != nil {
-		return fmt.Errorf("Elastic Error: %v", string(data))
-	}
-
-	err_type := utils.GetString(response, "error.type")
-	err_reason := utils.GetString(response, "error.reason")
-	if false && err_type != "" && err_reason != "" {
-		return fmt.Errorf("Elastic Error: %v: %v", err_type, err_reason)
-	}
-
-	return fmt.Errorf("Elastic Error: %v", response)
+func makeElasticError(status int, data []byte) error {
+	return MakeElasticError(status, data)
 }
 
-func makeReadElasticError(data []byte) error {
-	response := ordereddict.NewDict()
-	err := response.UnmarshalJSON(data)
-	if err != nil {
-		return fmt.Errorf("Elastic Error: %v", string(data))
-	}
-
-	err_type := utils.GetString(response, "error.type")
-	if err_type == "index_not_found_exception" {
+func makeReadElasticError(status int, data []byte) error {
+	err := MakeElasticError(status, data)
+	if err.Type == "index_not_found_exception" {
 		// Now that indexes are created from the templates, a missing
 		// index means that it was not written to yet.
-		//return os.ErrNotExist
-		Debug(DEBUG_ELASTIC, "ElasticError: %v\n", response)()
+		Debug(DEBUG_ELASTIC, "ElasticError: %v\n", err)()
 
 		return nil
 	}
 
-	err_reason := utils.GetString(response, "error.reason")
-	if false && err_type != "" && err_reason != "" {
-		return fmt.Errorf("Elastic Error: %v: %v", err_type, err_reason)
-	}
-
-	return fmt.Errorf("Elastic Error: %v", response)
+	return err
 }
 
 // Convert the item into a unique document ID - This is needed when
@@ -1201,13 +1185,23 @@ func MakeId(item string) string {
 	return hex.EncodeToString(hash[:])
 }
 
+// A random document ID for when we can not let OpenSearch pick one.
+func newDocId() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
 type BulkIndexer struct {
 	opensearchutil.BulkIndexer
-	ctx           context.Context
-	config_obj    *config_proto.Config
-	mu            sync.Mutex
-	instance_type OpenSearchClusterOptions
-	indexes       map[string]bool
+	ctx        context.Context
+	config_obj *config_proto.Config
+	mu         sync.Mutex
+	cluster    string
+	indexes    map[string]bool
+
+	// Undelivered items are spooled here.
+	spool *Spool
 }
 
 func (self *BulkIndexer) Add(ctx context.Context, item opensearchutil.BulkIndexerItem) error {
@@ -1218,11 +1212,76 @@ func (self *BulkIndexer) Add(ctx context.Context, item opensearchutil.BulkIndexe
 	return self.BulkIndexer.Add(ctx, item)
 }
 
+func (self *BulkIndexer) addItem(org_id, index, id string,
+	action BulkUpdateType, serialized string,
+	completion func(err error)) error {
+
+	// The item may be spooled while it is still in flight, so it
+	// needs its own id to avoid being stored twice on replay.
+	if id == DocIdRandom {
+		id = newDocId()
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// Keep the item so it can be spooled if it is not delivered.
+	spool := self.spool
+	spool_id := spool.Track(self.BulkIndexer, &SpoolItem{
+		OrgId:      org_id,
+		Index:      index,
+		Action:     string(action),
+		DocumentID: id,
+		Body:       serialized,
+	})
+
+	self.indexes[GetIndex(org_id, index)] = true
+
+	// Add with background context which might outlive our caller.
+	err := self.BulkIndexer.Add(context.Background(),
+		opensearchutil.BulkIndexerItem{
+			Index:      GetIndex(org_id, index),
+			Action:     string(action),
+			DocumentID: id,
+			Body:       strings.NewReader(serialized),
+			OnSuccess: func(ctx context.Context,
+				item opensearchutil.BulkIndexerItem,
+				res opensearchutil.BulkIndexerResponseItem) {
+				spool.Done(spool_id)
+				if completion != nil {
+					completion(nil)
+				}
+			},
+			OnFailure: func(ctx context.Context,
+				item opensearchutil.BulkIndexerItem,
+				res opensearchutil.BulkIndexerResponseItem, err error) {
+				logger := logging.GetLogger(self.config_obj,
+					&logging.FrontendComponent)
+				logger.Error("BulkIndexer Error %v during: %v", res.Error.Reason,
+					serialized)
+				spool.Fail(spool_id, res.Status)
+				if completion != nil {
+					if err == nil {
+						err = fmt.Errorf("BulkIndexer: %v", res.Error.Reason)
+					}
+					completion(err)
+				}
+			},
+		})
+	if err != nil {
+		spool.Fail(spool_id, 0)
+		if completion != nil {
+			completion(err)
+		}
+	}
+	return err
+}
+
 func (self *BulkIndexer) Close() error {
 	self.mu.Lock()
 	defer self.mu.Unlock()
 
-	elastic_client, err := GetElasticClientByType(self.instance_type)
+	elastic_client, err := GetElasticClientByName(self.cluster)
 	if err != nil {
 		return err
 	}
@@ -1234,13 +1293,14 @@ func (self *BulkIndexer) Close() error {
 			FlushInterval: time.Second * 10,
 			OnFlushStart: func(ctx context.Context) context.Context {
 				logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
-				logger.Debug("Flushing bulk indexer.")
+				logger.Debug("Flushing bulk indexer for cluster %v.", self.cluster)
 				return ctx
 			},
 			OnError: func(ctx context.Context, err error) {
 				if err != nil {
 					logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
-					logger.Error("BulkIndexerConfig: %v", err)
+					logger.Error("BulkIndexerConfig: cluster %v: %v",
+						self.cluster, err)
 				}
 			},
 		})
@@ -1249,10 +1309,16 @@ func (self *BulkIndexer) Close() error {
 	}
 
 	ctx := context.Background()
-	err = self.BulkIndexer.Close(ctx)
+	old_bulk_indexer := self.BulkIndexer
+	err = old_bulk_indexer.Close(ctx)
+
+	// The old indexer is closed now so items it did not report on
+	// were lost in a failed flush.
+	self.spool.SpoolUnsent(old_bulk_indexer)
 	if err != nil {
 		return err
 	}
+	self.BulkIndexer = new_bulk_indexer
 
 	indexes := []string{}
 	for i := range self.indexes {
@@ -1267,13 +1333,51 @@ func (self *BulkIndexer) Close() error {
 
 	defer res.Body.Close()
 
-	self.BulkIndexer = new_bulk_indexer
 	return nil
 }
 
+// Get the bulk indexer for the cluster the org lives on, and the
+// cluster it is migrating to.
+func getBulkIndexers(org_id string) ([]*BulkIndexer, error) {
+	placement, err := getOrgPlacement(context.Background(), org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	var result []*BulkIndexer
+	for _, cluster := range []string{placement.cluster, placement.migrating_to} {
+		if cluster == "" {
+			continue
+		}
+
+		indexer, pres := bulk_indexers[cluster]
+		if !pres {
+			return nil, fmt.Errorf("%w: no bulk indexer for %v",
+				ClusterNotConfiguredError, cluster)
+		}
+		result = append(result, indexer)
+	}
+	return result, nil
+}
+
+// Flush the bulk indexers of all clusters.
 func FlushBulkIndexer() error {
+	var result error
+	for _, cluster := range ListClusters() {
+		err := FlushClusterBulkIndexer(cluster)
+		if err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+func FlushClusterBulkIndexer(cluster string) error {
 	mu.Lock()
-	b := bulk_indexer
+	b := bulk_indexers[cluster]
 	mu.Unlock()
 
 	if b != nil {
@@ -1282,14 +1386,13 @@ func FlushBulkIndexer() error {
 	return nil
 }
 
-func StartBulkIndexService(
+func newBulkIndexer(
 	ctx context.Context,
-	wg *sync.WaitGroup,
-	instance OpenSearchClusterOptions,
-	config_obj *cloud_velo_config.Config) error {
-	elastic_client, err := GetElasticClientByType(instance)
+	cluster string,
+	config_obj *cloud_velo_config.Config) (*BulkIndexer, error) {
+	elastic_client, err := GetElasticClientByName(cluster)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	new_bulk_indexer, err := opensearchutil.NewBulkIndexer(
@@ -1299,44 +1402,75 @@ func StartBulkIndexService(
 			OnFlushStart: func(ctx context.Context) context.Context {
 				logger := logging.GetLogger(
 					config_obj.VeloConf(), &logging.FrontendComponent)
-				logger.Debug("Flushing bulk indexer.")
+				logger.Debug("Flushing bulk indexer for cluster %v.", cluster)
 				return ctx
 			},
 			OnError: func(ctx context.Context, err error) {
 				if err != nil {
 					logger := logging.GetLogger(
 						config_obj.VeloConf(), &logging.FrontendComponent)
-					logger.Error("BulkIndexerConfig: %v", err)
+					logger.Error("BulkIndexerConfig: cluster %v: %v",
+						cluster, err)
 				}
 			},
 		})
+	if err != nil {
+		return nil, err
+	}
+
+	return &BulkIndexer{
+		BulkIndexer: new_bulk_indexer,
+		config_obj:  config_obj.VeloConf(),
+		ctx:         ctx,
+		indexes:     make(map[string]bool),
+		cluster:     cluster,
+	}, nil
+}
+
+// Start a bulk indexer for each configured cluster.
+func StartBulkIndexService(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *cloud_velo_config.Config) error {
+
+	indexers := make(map[string]*BulkIndexer)
+	for _, cluster := range ListClusters() {
+		indexer, err := newBulkIndexer(ctx, cluster, config_obj)
+		if err != nil {
+			return err
+		}
+		indexers[cluster] = indexer
+	}
+
+	spool, err := NewSpool(ctx, config_obj)
 	if err != nil {
 		return err
 	}
+	spool.Start(wg)
 
 	mu.Lock()
-	bulk_indexer = &BulkIndexer{
-		BulkIndexer:   new_bulk_indexer,
-		config_obj:    config_obj.VeloConf(),
-		ctx:           ctx,
-		indexes:       make(map[string]bool),
-		instance_type: instance,
+	// All the bulk indexers share the same spool.
+	for _, indexer := range indexers {
+		indexer.spool = spool
 	}
+	bulk_indexers = indexers
+	bulk_spool = spool
 	mu.Unlock()
 
-	// Ensure we flush the indexer before we exit.
+	// Ensure we flush the indexers before we exit. Anything that
+	// could not be delivered is kept in the spool for next time.
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 		<-ctx.Done()
 
 		FlushBulkIndexer()
+		spool.Close()
 	}()
 
-	return err
+	return nil
 }
 
-// There are now only two indexes:
 const (
 	// This index is for information that needs to be deleted and updated
 	PERSISTED = "persisted"
@@ -1344,4 +1478,21 @@ const (
 	// This index will autodelete itself but can not be updated (it is
 	// implemented as a datastream)
 	TRANSIENT = "transient"
+
+	// Transient data is split into a data stream per data class so
+	// each can have its own retention. Reading from TRANSIENT reads
+	// all of them.
+	TRANSIENT_COLLECTIONS = "transient_collections"
+	TRANSIENT_EVENTS      = "transient_events"
+	TRANSIENT_LOGS        = "transient_logs"
+	TRANSIENT_TASKS       = "transient_tasks"
+
+	// Notebook timelines are kept until the notebook or timeline is
+	// deleted so they can not live in the transient data streams.
+	TIMELINES = "timelines"
+)
+
+var (
+	TRANSIENT_INDEXES = []string{TRANSIENT, TRANSIENT_COLLECTIONS,
+		TRANSIENT_EVENTS, TRANSIENT_LOGS, TRANSIENT_TASKS}
 )
@@ -0,0 +1,429 @@
+/*
+  An embedded backend which keeps all documents in a local SQLite
+  database so cloudvelo can run on a single node without OpenSearch.
+
+  Documents are stored as JSON and queries are evaluated in memory
+  (see query.go). The exact matches of a query are also checked in
+  SQL so only candidate documents are read, but queries without them
+  read the whole index. This is fine for small deployments and
+  testing but does not scale like OpenSearch. Transient data is not
+  expired.
+*/
+
+package embedded
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	_ "github.com/mattn/go-sqlite3"
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/services"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+)
+
+const (
+	EMBEDDED_BACKEND = "embedded"
+
+	createTableSQL = `
+CREATE TABLE IF NOT EXISTS documents (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  idx TEXT NOT NULL,
+  id TEXT NOT NULL,
+  doc TEXT NOT NULL,
+  UNIQUE(idx, id)
+)`
+
+	upsertSQL = `
+INSERT INTO documents (idx, id, doc) VALUES (?, ?, ?)
+ON CONFLICT(idx, id) DO UPDATE SET doc = excluded.doc`
+
+	createSQL = `
+INSERT INTO documents (idx, id, doc) VALUES (?, ?, ?)
+ON CONFLICT(idx, id) DO NOTHING`
+)
+
+var (
+	mu sync.Mutex
+
+	// Services may start the backend more than once so we keep one
+	// backend per database.
+	backends = make(map[string]*EmbeddedBackend)
+)
+
+type EmbeddedBackend struct {
+	db *sql.DB
+
+	// Serializes writes with read-modify-write updates.
+	mu sync.Mutex
+}
+
+func (self *EmbeddedBackend) Get(
+	ctx context.Context, org_id, index, id string) (json.RawMessage, error) {
+	var doc string
+	err := self.db.QueryRowContext(ctx,
+		"SELECT doc FROM documents WHERE idx = ? AND id = ?",
+		services.GetIndex(org_id, index), id).Scan(&doc)
+	if err == sql.ErrNoRows {
+		return nil, os.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return json.RawMessage(doc), nil
+}
+
+func (self *EmbeddedBackend) MultiGet(
+	ctx context.Context,
+	org_id, index string, ids []string) ([]json.RawMessage, error) {
+	result := make([]json.RawMessage, 0, len(ids))
+	for _, id := range ids {
+		doc, err := self.Get(ctx, org_id, index, id)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		result = append(result, doc)
+	}
+	return result, nil
+}
+
+func (self *EmbeddedBackend) Set(ctx context.Context,
+	org_id, index, id string, record interface{}) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.write(ctx, upsertSQL, org_id, index, id,
+		json.MustMarshalString(record))
+}
+
+// Writes are cheap so they are done right away.
+func (self *EmbeddedBackend) SetAsync(org_id, index, id string,
+	action services.BulkUpdateType, record interface{},
+	completion func(err error)) error {
+	statement := upsertSQL
+	if action == services.BulkUpdateCreate {
+		statement = createSQL
+	}
+
+	self.mu.Lock()
+	err := self.write(context.Background(), statement, org_id, index, id,
+		json.MustMarshalString(record))
+	self.mu.Unlock()
+
+	if completion != nil {
+		completion(err)
+	}
+	return err
+}
+
+// Must be called under lock.
+func (self *EmbeddedBackend) write(ctx context.Context,
+	statement, org_id, index, id, doc string) error {
+	if id == services.DocIdRandom {
+		id = newDocId()
+	}
+
+	_, err := self.db.ExecContext(ctx, statement,
+		services.GetIndex(org_id, index), id, doc)
+	return err
+}
+
+func (self *EmbeddedBackend) Update(
+	ctx context.Context, org_id, index, id, query string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	var doc map[string]interface{}
+	serialized, err := self.Get(ctx, org_id, index, id)
+	if errors.Is(err, os.ErrNotExist) {
+		// A missing document is created from the upsert as is.
+		doc, err = upsertDocument(query)
+		if err != nil {
+			return err
+		}
+		if doc == nil {
+			return os.ErrNotExist
+		}
+
+	} else if err != nil {
+		return err
+
+	} else {
+		doc, err = decodeObject(string(serialized))
+		if err != nil {
+			return err
+		}
+
+		err = applyUpdate(doc, query)
+		if err != nil {
+			return err
+		}
+	}
+
+	updated, err := encodeObject(doc)
+	if err != nil {
+		return err
+	}
+
+	return self.write(ctx, upsertSQL, org_id, index, id, updated)
+}
+
+func (self *EmbeddedBackend) Delete(
+	ctx context.Context, org_id, index, id string, sync bool) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	_, err := self.db.ExecContext(ctx,
+		"DELETE FROM documents WHERE idx = ? AND id = ?",
+		services.GetIndex(org_id, index), id)
+	return err
+}
+
+func (self *EmbeddedBackend) DeleteByQuery(
+	ctx context.Context, org_id, index, query string, sync bool) error {
+	request, err := parseSearch(query)
+	if err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	docs, err := self.scan(ctx, org_id, index, request.query)
+	if err != nil {
+		return err
+	}
+
+	tx, err := self.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, doc := range docs {
+		matched, err := matchQuery(request.query, doc)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+
+		_, err = tx.ExecContext(ctx,
+			"DELETE FROM documents WHERE idx = ? AND id = ?", doc.index, doc.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (self *EmbeddedBackend) Search(ctx context.Context,
+	org_id, index, query string) (*services.SearchResult, error) {
+	request, err := parseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+
+	docs, err := self.scan(ctx, org_id, index, request.query)
+	if err != nil {
+		return nil, err
+	}
+
+	hits, total, aggregations, err := search(docs, request)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &services.SearchResult{
+		Total:        total,
+		Aggregations: aggregations,
+	}
+	for _, hit := range hits {
+		result.Hits = append(result.Hits, services.Result{
+			JSON:  json.RawMessage(hit.raw),
+			Id:    hit.id,
+			Index: hit.index,
+		})
+	}
+	return result, nil
+}
+
+func (self *EmbeddedBackend) Count(ctx context.Context,
+	org_id, index, query string) (int, error) {
+	result, err := self.Search(ctx, org_id, index, query)
+	if err != nil {
+		return 0, err
+	}
+	return result.Total, nil
+}
+
+// The results are read before the channel is returned so, like the
+// OpenSearch point in time, they are not affected by later writes.
+func (self *EmbeddedBackend) QueryChan(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	page_size int,
+	org_id, index, query, sort_field string) (chan json.RawMessage, error) {
+
+	output_chan := make(chan json.RawMessage)
+
+	request, err := parseSearch(query)
+	if err != nil {
+		close(output_chan)
+		return output_chan, err
+	}
+
+	sort := sortField{field: sort_field}
+	if sort_field != "" && sort_field[0] == '>' {
+		sort = sortField{field: sort_field[1:], desc: true}
+	}
+
+	request.sort = []sortField{{field: "_id", desc: sort.desc}}
+	if sort.field != "" {
+		request.sort = append([]sortField{sort}, request.sort...)
+	}
+	request.size = -1
+
+	docs, err := self.scan(ctx, org_id, index, request.query)
+	if err != nil {
+		close(output_chan)
+		return output_chan, err
+	}
+
+	hits, _, _, err := search(docs, request)
+	if err != nil {
+		close(output_chan)
+		return output_chan, err
+	}
+
+	go func() {
+		defer close(output_chan)
+
+		for _, hit := range hits {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- json.RawMessage(hit.raw):
+			}
+		}
+	}()
+
+	return output_chan, nil
+}
+
+// Writes are visible as soon as they are done.
+func (self *EmbeddedBackend) Flush(
+	ctx context.Context, org_id, index string) error {
+	return nil
+}
+
+// Read the documents in the index which may match the query. Reading
+// the transient index covers all the transient data classes.
+func (self *EmbeddedBackend) scan(
+	ctx context.Context, org_id, index string,
+	query interface{}) ([]*document, error) {
+	read_index := services.GetReadIndex(org_id, index)
+
+	sql_query := "SELECT idx, id, doc FROM documents WHERE idx = ?"
+	if strings.HasSuffix(read_index, "*") {
+		sql_query = "SELECT idx, id, doc FROM documents WHERE idx GLOB ?"
+	}
+	args := []interface{}{read_index}
+
+	condition, condition_args := sqlFilter(query)
+	if condition != "" {
+		sql_query += " AND " + condition
+		args = append(args, condition_args...)
+	}
+	sql_query += " ORDER BY seq"
+
+	rows, err := self.db.QueryContext(ctx, sql_query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []*document
+	for rows.Next() {
+		doc := &document{}
+		err = rows.Scan(&doc.index, &doc.id, &doc.raw)
+		if err != nil {
+			return nil, err
+		}
+
+		doc.source, err = decodeObject(doc.raw)
+		if err != nil {
+			return nil, fmt.Errorf("Document %v in %v: %w",
+				doc.id, doc.index, err)
+		}
+		result = append(result, doc)
+	}
+
+	return result, rows.Err()
+}
+
+func newDocId() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+func NewEmbeddedBackend(ctx context.Context,
+	config_obj *cloud_velo_config.Config) (services.Backend, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	path := config_obj.Cloud.EmbeddedDatabase
+	backend, pres := backends[path]
+	if pres {
+		return backend, nil
+	}
+
+	dsn := "file::memory:"
+	if path != "" {
+		dsn = "file:" + path + "?_journal_mode=WAL&_busy_timeout=5000"
+	}
+
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single connection avoids SQLite lock contention and keeps
+	// an in memory database alive.
+	db.SetMaxOpenConns(1)
+	db.SetConnMaxLifetime(0)
+	db.SetConnMaxIdleTime(0)
+
+	_, err = db.ExecContext(ctx, createTableSQL)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Embedded database %v: %w", path, err)
+	}
+
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+	if path == "" {
+		logger.Info("Using an in memory embedded database")
+	} else {
+		logger.Info("Using embedded database %v", path)
+	}
+
+	backend = &EmbeddedBackend{db: db}
+	backends[path] = backend
+	return backend, nil
+}
+
+func init() {
+	services.RegisterBackend(EMBEDDED_BACKEND, NewEmbeddedBackend)
+}
@@ -0,0 +1,150 @@
+package embedded
+
+import (
+	"strings"
+)
+
+// The query engine is exported so the OpenSearch stand-in in the
+// testsuite searches documents exactly like the embedded backend.
+
+// A document as stored by the caller. The source is decoded once when
+// the document is created.
+type Document struct {
+	Index string
+	Id    string
+	Raw   string
+
+	// Set on the search results when the request is sorted.
+	SortValues []interface{}
+
+	source map[string]interface{}
+}
+
+func NewDocument(index, id, raw string) (*Document, error) {
+	source, err := decodeObject(raw)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Document{
+		Index:  index,
+		Id:     id,
+		Raw:    strings.TrimSpace(raw),
+		source: source,
+	}, nil
+}
+
+type SearchRequest struct {
+	request *searchRequest
+}
+
+func ParseSearch(query string) (*SearchRequest, error) {
+	request, err := parseSearch(query)
+	if err != nil {
+		return nil, err
+	}
+	return &SearchRequest{request: request}, nil
+}
+
+// A negative size returns all the matches.
+func (self *SearchRequest) Size() int {
+	return self.request.size
+}
+
+func (self *SearchRequest) SetSize(size int) {
+	self.request.size = size
+}
+
+// Applies the sort given as a URL parameter, a comma separated list
+// of field:order pairs. A sort in the body takes precedence.
+func (self *SearchRequest) SetURLSort(param string) {
+	if len(self.request.sort) > 0 {
+		return
+	}
+
+	for _, item := range strings.Split(param, ",") {
+		field, order, _ := strings.Cut(strings.TrimSpace(item), ":")
+		if field == "" {
+			continue
+		}
+		self.request.sort = append(self.request.sort, sortField{
+			field: field,
+			desc:  order == "desc",
+		})
+	}
+}
+
+func (self *SearchRequest) Sorted() bool {
+	return len(self.request.sort) > 0
+}
+
+// The kind of the requested aggregation or "" if there is none.
+func (self *SearchRequest) Aggregation() string {
+	if self.request.aggs == nil {
+		return ""
+	}
+	return self.request.aggs.kind
+}
+
+// Returns the page of matching documents, the total number of
+// matches and the aggregation results. The documents passed in are
+// not modified.
+func Search(docs []*Document, request *SearchRequest) (
+	[]*Document, int, []string, error) {
+
+	lookup := make(map[*document]*Document)
+	var internal []*document
+	for _, doc := range docs {
+		item := &document{
+			index:  doc.Index,
+			id:     doc.Id,
+			raw:    doc.Raw,
+			source: doc.source,
+		}
+		lookup[item] = doc
+		internal = append(internal, item)
+	}
+
+	hits, total, aggregations, err := search(internal, request.request)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	var result []*Document
+	for _, hit := range hits {
+		clone := *lookup[hit]
+		clone.SortValues = hit.sort_values
+		result = append(result, &clone)
+	}
+	return result, total, aggregations, nil
+}
+
+// Applies an update request to the raw document and returns the
+// updated document.
+func ApplyUpdate(raw, query string) (string, error) {
+	source, err := decodeObject(raw)
+	if err != nil {
+		return "", err
+	}
+
+	err = applyUpdate(source, query)
+	if err != nil {
+		return "", err
+	}
+
+	return encodeObject(source)
+}
+
+// The document an update request creates when the document does not
+// exist or "" if the request has no upsert.
+func UpsertDocument(query string) (string, error) {
+	upsert, err := upsertDocument(query)
+	if err != nil || upsert == nil {
+		return "", err
+	}
+	return encodeObject(upsert)
+}
+
+func NewDocId() string {
+	return newDocId()
+}
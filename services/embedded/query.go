@@ -0,0 +1,892 @@
+package embedded
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"www.velocidex.com/golang/cloudvelo/services"
+)
+
+// Evaluates the subset of the OpenSearch query DSL that we use
+// against documents in memory.
+//
+// Fields are compared the way OpenSearch compares keyword and numeric
+// fields: match and term are exact, and a field holding a list
+// matches if any of its values match.
+
+const (
+	// The OpenSearch default.
+	DEFAULT_SIZE = 10
+
+	// The name of the only aggregation we support.
+	AGGREGATION_NAME = "genres"
+)
+
+type document struct {
+	index  string
+	id     string
+	raw    string
+	source map[string]interface{}
+
+	// The values of the sort fields, filled in while sorting.
+	sort_values []interface{}
+}
+
+type sortField struct {
+	field string
+	desc  bool
+}
+
+type aggregation struct {
+	kind  string
+	field string
+	size  int
+}
+
+type searchRequest struct {
+	// nil matches all documents.
+	query interface{}
+
+	sort         []sortField
+	size         int
+	from         int
+	search_after []interface{}
+	aggs         *aggregation
+}
+
+// Numbers are kept as json.Number so nanosecond timestamps stay
+// exact.
+func decode(data string) (interface{}, error) {
+	decoder := json.NewDecoder(strings.NewReader(data))
+	decoder.UseNumber()
+
+	var result interface{}
+	err := decoder.Decode(&result)
+	return result, err
+}
+
+func decodeObject(data string) (map[string]interface{}, error) {
+	result, err := decode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	object, ok := result.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Expected a JSON object: %v", data)
+	}
+	return object, nil
+}
+
+func encodeObject(object map[string]interface{}) (string, error) {
+	serialized, err := json.Marshal(object)
+	return string(serialized), err
+}
+
+func parseSearch(query string) (*searchRequest, error) {
+	result := &searchRequest{size: DEFAULT_SIZE}
+	if strings.TrimSpace(query) == "" {
+		return result, nil
+	}
+
+	parsed, err := decodeObject(query)
+	if err != nil {
+		return nil, err
+	}
+
+	result.query = parsed["query"]
+
+	size, pres := parsed["size"]
+	if pres {
+		result.size = int(services.ScriptInt(size))
+	}
+	result.from = int(services.ScriptInt(parsed["from"]))
+	result.search_after = services.ScriptList(parsed["search_after"])
+
+	result.sort, err = parseSort(parsed["sort"])
+	if err != nil {
+		return nil, err
+	}
+
+	aggs, pres := parsed["aggs"]
+	if !pres {
+		aggs = parsed["aggregations"]
+	}
+	if aggs != nil {
+		result.aggs, err = parseAggregation(aggs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// Sort may be a field name, a {field: order} object or a list of
+// either.
+func parseSort(sort_clause interface{}) ([]sortField, error) {
+	var result []sortField
+	for _, item := range services.ScriptList(sort_clause) {
+		switch t := item.(type) {
+		case string:
+			result = append(result, sortField{field: t})
+
+		case map[string]interface{}:
+			for field, order := range t {
+				if options, ok := order.(map[string]interface{}); ok {
+					order = options["order"]
+				}
+				result = append(result, sortField{
+					field: field,
+					desc:  order == "desc",
+				})
+			}
+
+		default:
+			return nil, fmt.Errorf("Unsupported sort clause %v", item)
+		}
+	}
+	return result, nil
+}
+
+func parseAggregation(aggs interface{}) (*aggregation, error) {
+	aggs_map, _ := aggs.(map[string]interface{})
+	genres, ok := aggs_map[AGGREGATION_NAME].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Only the %v aggregation is supported",
+			AGGREGATION_NAME)
+	}
+
+	for kind, options := range genres {
+		options_map, _ := options.(map[string]interface{})
+		result := &aggregation{
+			kind:  kind,
+			field: fmt.Sprintf("%v", options_map["field"]),
+			size:  DEFAULT_SIZE,
+		}
+		size, pres := options_map["size"]
+		if pres {
+			result.size = int(services.ScriptInt(size))
+		}
+
+		switch kind {
+		case "terms", "max", "min", "cardinality", "value_count":
+			return result, nil
+		}
+		return nil, fmt.Errorf("Unsupported aggregation %v", kind)
+	}
+
+	return nil, fmt.Errorf("Empty aggregation")
+}
+
+// All the values of the field. Lists are flattened and nulls are
+// dropped. Dotted field names descend into objects.
+func getField(doc *document, field string) []interface{} {
+	if field == "_id" {
+		return []interface{}{doc.id}
+	}
+	return fieldValues(doc.source, field)
+}
+
+func fieldValues(value interface{}, field string) []interface{} {
+	var result []interface{}
+
+	switch t := value.(type) {
+	case []interface{}:
+		for _, item := range t {
+			result = append(result, fieldValues(item, field)...)
+		}
+		return result
+
+	case map[string]interface{}:
+		if field == "" {
+			return []interface{}{t}
+		}
+
+		member, pres := t[field]
+		if pres {
+			return fieldValues(member, "")
+		}
+
+		for i := range field {
+			if field[i] == '.' {
+				member, pres := t[field[:i]]
+				if pres {
+					result = append(result,
+						fieldValues(member, field[i+1:])...)
+				}
+			}
+		}
+		return result
+
+	case nil:
+		return nil
+	}
+
+	if field == "" {
+		return []interface{}{value}
+	}
+	return nil
+}
+
+func anyValue(values []interface{}, cb func(value interface{}) bool) bool {
+	for _, value := range values {
+		if cb(value) {
+			return true
+		}
+	}
+	return false
+}
+
+func asNumber(value interface{}) (json.Number, bool) {
+	switch t := value.(type) {
+	case json.Number:
+		return t, true
+	case string:
+		_, err := strconv.ParseFloat(t, 64)
+		return json.Number(t), err == nil
+	}
+	return "", false
+}
+
+func asString(value interface{}) string {
+	switch t := value.(type) {
+	case string:
+		return t
+	case json.Number:
+		return t.String()
+	}
+	serialized, _ := json.Marshal(value)
+	return string(serialized)
+}
+
+// Numbers compare as numbers (exactly if they are both integers),
+// everything else compares as strings.
+func compare(a, b interface{}) int {
+	a_number, a_ok := asNumber(a)
+	b_number, b_ok := asNumber(b)
+	_, a_is_string := a.(string)
+	_, b_is_string := b.(string)
+
+	if a_ok && b_ok && !(a_is_string && b_is_string) {
+		a_int, a_err := a_number.Int64()
+		b_int, b_err := b_number.Int64()
+		if a_err == nil && b_err == nil {
+			switch {
+			case a_int < b_int:
+				return -1
+			case a_int > b_int:
+				return 1
+			}
+			return 0
+		}
+
+		a_float, _ := a_number.Float64()
+		b_float, _ := b_number.Float64()
+		switch {
+		case a_float < b_float:
+			return -1
+		case a_float > b_float:
+			return 1
+		}
+		return 0
+	}
+
+	return strings.Compare(asString(a), asString(b))
+}
+
+// Clauses like {"field": value} or {"field": {"value": value, ...}}.
+func fieldClause(clause interface{}, value_key string) (
+	field string, value interface{}, options map[string]interface{}, err error) {
+	clause_map, ok := clause.(map[string]interface{})
+	if !ok || len(clause_map) != 1 {
+		return "", nil, nil, fmt.Errorf("Invalid field clause %v", clause)
+	}
+
+	for field, value = range clause_map {
+		options, ok = value.(map[string]interface{})
+		if ok {
+			value = options[value_key]
+		}
+	}
+	return field, value, options, nil
+}
+
+func isTrue(value interface{}) bool {
+	return value == true || value == "true"
+}
+
+func matchQuery(query interface{}, doc *document) (bool, error) {
+	if query == nil {
+		return true, nil
+	}
+
+	query_map, ok := query.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("Invalid query %v", query)
+	}
+
+	for kind, clause := range query_map {
+		matched, err := matchClause(kind, clause, doc)
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchClause(kind string, clause interface{}, doc *document) (bool, error) {
+	switch kind {
+	case "match_all":
+		return true, nil
+
+	case "match_none":
+		return false, nil
+
+	case "bool":
+		return matchBool(clause, doc)
+
+	case "ids":
+		clause_map, _ := clause.(map[string]interface{})
+		return anyValue(services.ScriptList(clause_map["values"]),
+			func(value interface{}) bool {
+				return value == doc.id
+			}), nil
+
+	case "exists":
+		clause_map, _ := clause.(map[string]interface{})
+		field, _ := clause_map["field"].(string)
+		return len(getField(doc, field)) > 0, nil
+
+	case "match", "match_phrase", "term":
+		value_key := "value"
+		if kind != "term" {
+			value_key = "query"
+		}
+		field, expected, options, err := fieldClause(clause, value_key)
+		if err != nil {
+			return false, err
+		}
+
+		case_insensitive := isTrue(options["case_insensitive"])
+		return anyValue(getField(doc, field), func(value interface{}) bool {
+			if case_insensitive {
+				return strings.EqualFold(asString(value), asString(expected))
+			}
+			return compare(value, expected) == 0
+		}), nil
+
+	case "terms":
+		clause_map, _ := clause.(map[string]interface{})
+		for field, expected := range clause_map {
+			if field == "boost" {
+				continue
+			}
+
+			expected_list := services.ScriptList(expected)
+			return anyValue(getField(doc, field), func(value interface{}) bool {
+				return anyValue(expected_list, func(e interface{}) bool {
+					return compare(value, e) == 0
+				})
+			}), nil
+		}
+		return false, nil
+
+	case "prefix":
+		field, prefix, options, err := fieldClause(clause, "value")
+		if err != nil {
+			return false, err
+		}
+
+		prefix_str := asString(prefix)
+		case_insensitive := isTrue(options["case_insensitive"])
+		if case_insensitive {
+			prefix_str = strings.ToLower(prefix_str)
+		}
+
+		return anyValue(getField(doc, field), func(value interface{}) bool {
+			value_str := asString(value)
+			if case_insensitive {
+				value_str = strings.ToLower(value_str)
+			}
+			return strings.HasPrefix(value_str, prefix_str)
+		}), nil
+
+	case "regexp", "wildcard":
+		field, pattern, options, err := fieldClause(clause, "value")
+		if err != nil {
+			return false, err
+		}
+		if pattern == nil && kind == "wildcard" {
+			pattern = options["wildcard"]
+		}
+
+		re, err := compilePattern(kind, asString(pattern),
+			isTrue(options["case_insensitive"]))
+		if err != nil {
+			return false, err
+		}
+
+		return anyValue(getField(doc, field), func(value interface{}) bool {
+			return re.MatchString(asString(value))
+		}), nil
+
+	case "range":
+		field, _, options, err := fieldClause(clause, "")
+		if err != nil || options == nil {
+			return false, fmt.Errorf("Invalid range clause %v", clause)
+		}
+
+		return anyValue(getField(doc, field), func(value interface{}) bool {
+			return inRange(value, options)
+		}), nil
+	}
+
+	return false, fmt.Errorf("Unsupported query type %v", kind)
+}
+
+// Translate the parts of the query which every match must satisfy
+// into an SQL condition, so SQLite can skip most documents before we
+// decode them. The condition may match more documents than the
+// query, but never fewer - matchQuery() still checks each one.
+//
+// Only exact string values are translated, since compare() treats
+// numeric strings as numbers.
+func sqlFilter(query interface{}) (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+
+	var walk func(query interface{})
+	walk = func(query interface{}) {
+		query_map, ok := query.(map[string]interface{})
+		if !ok {
+			return
+		}
+
+		for kind, clause := range query_map {
+			switch kind {
+			case "bool":
+				clause_map, _ := clause.(map[string]interface{})
+				for _, key := range []string{"must", "filter"} {
+					for _, sub_query := range services.ScriptList(clause_map[key]) {
+						walk(sub_query)
+					}
+				}
+
+			case "ids":
+				clause_map, _ := clause.(map[string]interface{})
+				values, ok := sqlStrings(services.ScriptList(clause_map["values"]))
+				if ok {
+					conditions = append(conditions, "id IN ("+
+						sqlPlaceholders(len(values))+")")
+					args = append(args, values...)
+				}
+
+			case "match", "match_phrase", "term":
+				value_key := "value"
+				if kind != "term" {
+					value_key = "query"
+				}
+				field, expected, options, err := fieldClause(clause, value_key)
+				if err != nil || isTrue(options["case_insensitive"]) {
+					continue
+				}
+				condition, values, ok := sqlFieldCondition(
+					field, []interface{}{expected})
+				if ok {
+					conditions = append(conditions, condition)
+					args = append(args, values...)
+				}
+
+			case "terms":
+				clause_map, _ := clause.(map[string]interface{})
+				if len(clause_map) != 1 {
+					continue
+				}
+				for field, expected := range clause_map {
+					condition, values, ok := sqlFieldCondition(
+						field, services.ScriptList(expected))
+					if ok {
+						conditions = append(conditions, condition)
+						args = append(args, values...)
+					}
+				}
+			}
+		}
+	}
+	walk(query)
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// The field holds one of the values, either directly or in a list.
+func sqlFieldCondition(field string, expected []interface{}) (
+	string, []interface{}, bool) {
+	values, ok := sqlStrings(expected)
+	if !ok || field == "" || strings.ContainsAny(field, `."'`) {
+		return "", nil, false
+	}
+
+	if field == "_id" {
+		return "id IN (" + sqlPlaceholders(len(values)) + ")", values, true
+	}
+
+	condition := fmt.Sprintf(
+		`EXISTS (SELECT 1 FROM json_tree(doc, '$."%s"') WHERE atom IN (%s))`,
+		field, sqlPlaceholders(len(values)))
+	return condition, values, true
+}
+
+// Only non numeric strings compare the same in SQL.
+func sqlStrings(values []interface{}) ([]interface{}, bool) {
+	if len(values) == 0 {
+		return nil, false
+	}
+
+	for _, value := range values {
+		str, ok := value.(string)
+		if !ok {
+			return nil, false
+		}
+
+		_, is_number := asNumber(str)
+		if is_number {
+			return nil, false
+		}
+	}
+	return values, true
+}
+
+func sqlPlaceholders(count int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", count), ",")
+}
+
+func matchBool(clause interface{}, doc *document) (bool, error) {
+	clause_map, ok := clause.(map[string]interface{})
+	if !ok {
+		return false, fmt.Errorf("Invalid bool clause %v", clause)
+	}
+
+	for _, key := range []string{"must", "filter"} {
+		for _, sub_query := range services.ScriptList(clause_map[key]) {
+			matched, err := matchQuery(sub_query, doc)
+			if err != nil || !matched {
+				return false, err
+			}
+		}
+	}
+
+	for _, sub_query := range services.ScriptList(clause_map["must_not"]) {
+		matched, err := matchQuery(sub_query, doc)
+		if err != nil || matched {
+			return false, err
+		}
+	}
+
+	should := services.ScriptList(clause_map["should"])
+	if len(should) == 0 {
+		return true, nil
+	}
+
+	// Should clauses are optional when there are other clauses.
+	minimum := 1
+	if clause_map["must"] != nil || clause_map["filter"] != nil {
+		minimum = 0
+	}
+	if value, pres := clause_map["minimum_should_match"]; pres {
+		minimum = int(services.ScriptInt(value))
+	}
+
+	count := 0
+	for _, sub_query := range should {
+		matched, err := matchQuery(sub_query, doc)
+		if err != nil {
+			return false, err
+		}
+		if matched {
+			count++
+		}
+	}
+
+	return count >= minimum, nil
+}
+
+func inRange(value interface{}, options map[string]interface{}) bool {
+	for op, bound := range options {
+		cmp := compare(value, bound)
+		switch op {
+		case "gt":
+			if cmp <= 0 {
+				return false
+			}
+		case "gte":
+			if cmp < 0 {
+				return false
+			}
+		case "lt":
+			if cmp >= 0 {
+				return false
+			}
+		case "lte":
+			if cmp > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Regexp and wildcard queries must match the whole value.
+func compilePattern(kind, pattern string, case_insensitive bool) (
+	*regexp.Regexp, error) {
+	if kind == "wildcard" {
+		pattern = strings.NewReplacer(`\*`, ".*", `\?`, ".").Replace(
+			regexp.QuoteMeta(pattern))
+	}
+
+	prefix := ""
+	if case_insensitive {
+		prefix = "(?i)"
+	}
+	return regexp.Compile(prefix + "^(?:" + pattern + ")$")
+}
+
+// Lists sort by their smallest value in ascending order and their
+// largest in descending order.
+func sortValue(doc *document, field sortField) interface{} {
+	var result interface{}
+	for _, value := range getField(doc, field.field) {
+		if result == nil {
+			result = value
+			continue
+		}
+
+		cmp := compare(value, result)
+		if (field.desc && cmp > 0) || (!field.desc && cmp < 0) {
+			result = value
+		}
+	}
+	return result
+}
+
+// Documents missing a sort field sort last in either order.
+func compareSortValues(a, b []interface{}, fields []sortField) int {
+	for i, field := range fields {
+		if i >= len(a) || i >= len(b) {
+			break
+		}
+
+		switch {
+		case a[i] == nil && b[i] == nil:
+			continue
+		case a[i] == nil:
+			return 1
+		case b[i] == nil:
+			return -1
+		}
+
+		cmp := compare(a[i], b[i])
+		if field.desc {
+			cmp = -cmp
+		}
+		if cmp != 0 {
+			return cmp
+		}
+	}
+	return 0
+}
+
+// Returns the page of matching documents, the total number of
+// matches and the aggregation results.
+func search(docs []*document, request *searchRequest) (
+	[]*document, int, []string, error) {
+
+	var matches []*document
+	for _, doc := range docs {
+		matched, err := matchQuery(request.query, doc)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		if matched {
+			matches = append(matches, doc)
+		}
+	}
+
+	if len(request.sort) > 0 {
+		for _, doc := range matches {
+			doc.sort_values = doc.sort_values[:0]
+			for _, field := range request.sort {
+				doc.sort_values = append(doc.sort_values, sortValue(doc, field))
+			}
+		}
+
+		sort.SliceStable(matches, func(i, j int) bool {
+			return compareSortValues(matches[i].sort_values,
+				matches[j].sort_values, request.sort) < 0
+		})
+	}
+
+	total := len(matches)
+	aggregations := aggregate(matches, request.aggs)
+
+	page := matches
+	if len(request.search_after) > 0 && len(request.sort) > 0 {
+		start := sort.Search(len(page), func(i int) bool {
+			return compareSortValues(page[i].sort_values,
+				request.search_after, request.sort) > 0
+		})
+		page = page[start:]
+	}
+
+	from := request.from
+	if from > len(page) {
+		from = len(page)
+	}
+	if from > 0 {
+		page = page[from:]
+	}
+
+	if request.size >= 0 && request.size < len(page) {
+		page = page[:request.size]
+	}
+
+	return page, total, aggregations, nil
+}
+
+func aggregate(docs []*document, agg *aggregation) []string {
+	if agg == nil {
+		return nil
+	}
+
+	var values []interface{}
+	for _, doc := range docs {
+		values = append(values, getField(doc, agg.field)...)
+	}
+
+	switch agg.kind {
+	case "max", "min":
+		var result interface{}
+		for _, value := range values {
+			if _, ok := asNumber(value); !ok {
+				continue
+			}
+			cmp := 0
+			if result != nil {
+				cmp = compare(value, result)
+			}
+			if result == nil || (agg.kind == "max" && cmp > 0) ||
+				(agg.kind == "min" && cmp < 0) {
+				result = value
+			}
+		}
+		if result == nil {
+			return nil
+		}
+		return []string{asString(result)}
+
+	case "value_count":
+		return []string{fmt.Sprintf("%d", len(values))}
+
+	case "cardinality":
+		seen := make(map[string]bool)
+		for _, value := range values {
+			seen[asString(value)] = true
+		}
+		return []string{fmt.Sprintf("%d", len(seen))}
+	}
+
+	// Terms buckets are ordered by count then key.
+	counts := make(map[string]int)
+	var keys []string
+	for _, value := range values {
+		key := asString(value)
+		if counts[key] == 0 {
+			keys = append(keys, key)
+		}
+		counts[key]++
+	}
+
+	sort.SliceStable(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+
+	if agg.size < len(keys) {
+		keys = keys[:agg.size]
+	}
+	return keys
+}
+
+// Apply an update request: either a partial document which is merged
+// into the document, or a script.
+func applyUpdate(doc map[string]interface{}, query string) error {
+	update, err := decodeObject(query)
+	if err != nil {
+		return err
+	}
+
+	partial, pres := update["doc"]
+	if pres {
+		partial_map, ok := partial.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("Invalid partial document %v", partial)
+		}
+		mergeObject(doc, partial_map)
+		return nil
+	}
+
+	script, ok := update["script"].(map[string]interface{})
+	if !ok {
+		return fmt.Errorf("Unsupported update %v", query)
+	}
+
+	source, _ := script["source"].(string)
+	cb, err := services.GetUpdateScript(source)
+	if err != nil {
+		return err
+	}
+
+	params, _ := script["params"].(map[string]interface{})
+	if params == nil {
+		params = make(map[string]interface{})
+	}
+	return cb(doc, params)
+}
+
+// The document an update request creates when the document does not
+// exist. Returns nil if the request has no upsert.
+func upsertDocument(query string) (map[string]interface{}, error) {
+	update, err := decodeObject(query)
+	if err != nil {
+		return nil, err
+	}
+
+	upsert, pres := update["upsert"]
+	if !pres {
+		return nil, nil
+	}
+
+	upsert_map, ok := upsert.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Invalid upsert document %v", upsert)
+	}
+	return upsert_map, nil
+}
+
+func mergeObject(doc, partial map[string]interface{}) {
+	for k, v := range partial {
+		v_map, ok := v.(map[string]interface{})
+		existing, existing_ok := doc[k].(map[string]interface{})
+		if ok && existing_ok {
+			mergeObject(existing, v_map)
+			continue
+		}
+		doc[k] = v
+	}
+}
@@ -0,0 +1,209 @@
+package embedded
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"www.velocidex.com/golang/cloudvelo/services"
+)
+
+var (
+	testDocuments = []string{
+		`{"client_id": "C.1", "hostname": "Alpha", "labels": ["web", "prod"], "ping": 1744634710123456789, "doc_type": "clients"}`,
+		`{"client_id": "C.2", "hostname": "beta", "labels": ["db"], "ping": 1744634710123456780, "doc_type": "clients"}`,
+		`{"client_id": "C.3", "hostname": "gamma", "ping": 20, "doc_type": "clients", "info": {"os": "linux"}}`,
+		`{"flow_id": "F.1", "doc_type": "flows", "public": true}`,
+	}
+)
+
+var query_test_cases = []struct {
+	query    string
+	expected []string
+}{
+	{`{"query": {"match_all": {}}}`, []string{"doc0", "doc1", "doc2", "doc3"}},
+	{`{"query": {"match": {"doc_type": "clients"}}}`, []string{"doc0", "doc1", "doc2"}},
+	{`{"query": {"term": {"labels": {"value": "db"}}}}`, []string{"doc1"}},
+	{`{"query": {"terms": {"labels": ["prod", "db"]}}}`, []string{"doc0", "doc1"}},
+	{`{"query": {"match": {"public": true}}}`, []string{"doc3"}},
+	{`{"query": {"prefix": {"hostname": {"value": "al", "case_insensitive": true}}}}`, []string{"doc0"}},
+	{`{"query": {"prefix": {"hostname": "al"}}}`, []string{}},
+	{`{"query": {"range": {"ping": {"gt": 1744634710123456780}}}}`, []string{"doc0"}},
+	{`{"query": {"range": {"ping": {"gte": 20, "lt": 21}}}}`, []string{"doc2"}},
+	{`{"query": {"exists": {"field": "labels"}}}`, []string{"doc0", "doc1"}},
+	{`{"query": {"ids": {"values": ["doc2", "doc3"]}}}`, []string{"doc2", "doc3"}},
+	{`{"query": {"match": {"info.os": "linux"}}}`, []string{"doc2"}},
+	{`{"query": {"regexp": {"client_id": "C\\.[12]"}}}`, []string{"doc0", "doc1"}},
+	{`{"query": {"bool": {"must": [{"match": {"doc_type": "clients"}}],
+                  "must_not": [{"match": {"labels": "web"}}]}}}`, []string{"doc1", "doc2"}},
+	{`{"query": {"bool": {"should": [{"match": {"hostname": "beta"}},
+                                   {"match": {"flow_id": "F.1"}}]}}}`, []string{"doc1", "doc3"}},
+
+	// Should clauses are optional next to a must clause.
+	{`{"query": {"bool": {"must": {"match": {"doc_type": "flows"}},
+                  "should": [{"match": {"hostname": "beta"}}]}}}`, []string{"doc3"}},
+
+	// Numeric strings match numbers.
+	{`{"query": {"match": {"ping": "20"}}}`, []string{"doc2"}},
+	{`{"query": {"term": {"_id": "doc1"}}}`, []string{"doc1"}},
+}
+
+func testDocs(t *testing.T) []*document {
+	var result []*document
+	for i, raw := range testDocuments {
+		source, err := decodeObject(raw)
+		assert.NoError(t, err)
+		result = append(result, &document{
+			id:     fmt.Sprintf("doc%d", i),
+			raw:    raw,
+			source: source,
+		})
+	}
+	return result
+}
+
+func searchIds(t *testing.T, docs []*document, query string) []string {
+	request, err := parseSearch(query)
+	assert.NoError(t, err)
+
+	hits, _, _, err := search(docs, request)
+	assert.NoError(t, err)
+
+	result := []string{}
+	for _, hit := range hits {
+		result = append(result, hit.id)
+	}
+	return result
+}
+
+func TestQueries(t *testing.T) {
+	docs := testDocs(t)
+
+	for _, test_case := range query_test_cases {
+		assert.Equal(t, test_case.expected,
+			searchIds(t, docs, test_case.query), test_case.query)
+	}
+
+	request, err := parseSearch(`{"query": {"geo_shape": {}}}`)
+	assert.NoError(t, err)
+	_, _, _, err = search(docs, request)
+	assert.Error(t, err)
+}
+
+func TestSortAndPaging(t *testing.T) {
+	docs := testDocs(t)
+
+	// Missing values sort last in either order.
+	assert.Equal(t, []string{"doc2", "doc1", "doc0", "doc3"},
+		searchIds(t, docs, `{"sort": [{"ping": "asc"}]}`))
+	assert.Equal(t, []string{"doc0", "doc1", "doc2", "doc3"},
+		searchIds(t, docs, `{"sort": {"ping": {"order": "desc"}}}`))
+
+	assert.Equal(t, []string{"doc1", "doc0"},
+		searchIds(t, docs, `{"sort": [{"ping": "asc"}], "from": 1, "size": 2}`))
+
+	// Large numbers are compared exactly.
+	assert.Equal(t, []string{"doc0", "doc3"},
+		searchIds(t, docs, `{"sort": [{"ping": "asc"}, {"_id": "asc"}],
+            "search_after": [1744634710123456780, "doc1"]}`))
+
+	request, err := parseSearch(`{"query": {"match": {"doc_type": "clients"}}, "size": 1}`)
+	assert.NoError(t, err)
+	hits, total, _, err := search(docs, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(hits))
+	assert.Equal(t, 3, total)
+}
+
+func TestAggregations(t *testing.T) {
+	docs := testDocs(t)
+
+	request, err := parseSearch(`{"aggs": {"genres": {"terms": {"field": "doc_type"}}}, "size": 0}`)
+	assert.NoError(t, err)
+	hits, _, aggs, err := search(docs, request)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(hits))
+	assert.Equal(t, []string{"clients", "flows"}, aggs)
+
+	request, err = parseSearch(`{"aggs": {"genres": {"max": {"field": "ping"}}}}`)
+	assert.NoError(t, err)
+	_, _, aggs, err = search(docs, request)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"1744634710123456789"}, aggs)
+}
+
+func TestUpdate(t *testing.T) {
+	doc, err := decodeObject(`{"state": "RUNNING", "stats": {"scheduled": 1}}`)
+	assert.NoError(t, err)
+
+	err = applyUpdate(doc, `{"doc": {"stats": {"completed": 2}}}`)
+	assert.NoError(t, err)
+
+	services.RegisterUpdateScript("ctx._source.state = params.state;",
+		func(doc, params map[string]interface{}) error {
+			doc["state"] = params["state"]
+			return nil
+		})
+
+	// Whitespace in the script does not matter.
+	err = applyUpdate(doc, `{"script": {"source": "ctx._source.state =  params.state;",
+       "lang": "painless", "params": {"state": "STOPPED"}}}`)
+	assert.NoError(t, err)
+
+	serialized, err := encodeObject(doc)
+	assert.NoError(t, err)
+	assert.Equal(t,
+		`{"state":"STOPPED","stats":{"completed":2,"scheduled":1}}`, serialized)
+
+	err = applyUpdate(doc, `{"script": {"source": "ctx._source.unknown = 1"}}`)
+	assert.Error(t, err)
+}
+
+func TestUpsert(t *testing.T) {
+	upsert, err := upsertDocument(`{"doc": {"state": "RUNNING"}}`)
+	assert.NoError(t, err)
+	assert.Nil(t, upsert)
+
+	upsert, err = upsertDocument(`{"script": {"source": "ctx._source.count += 1"},
+       "upsert": {"count": 1}}`)
+	assert.NoError(t, err)
+
+	serialized, err := encodeObject(upsert)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"count":1}`, serialized)
+}
+
+// The SQL filter must not drop any documents the query matches.
+func TestSQLFilter(t *testing.T) {
+	ctx := context.Background()
+
+	db, err := sql.Open("sqlite3", "file::memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+
+	db.SetMaxOpenConns(1)
+	_, err = db.ExecContext(ctx, createTableSQL)
+	assert.NoError(t, err)
+
+	backend := &EmbeddedBackend{db: db}
+	for i, raw := range testDocuments {
+		err = backend.Set(ctx, "test", services.PERSISTED,
+			fmt.Sprintf("doc%d", i), json.RawMessage(raw))
+		assert.NoError(t, err)
+	}
+
+	for _, test_case := range query_test_cases {
+		result, err := backend.Search(ctx, "test", services.PERSISTED,
+			test_case.query)
+		assert.NoError(t, err, test_case.query)
+
+		ids := []string{}
+		for _, hit := range result.Hits {
+			ids = append(ids, hit.Id)
+		}
+		assert.Equal(t, test_case.expected, ids, test_case.query)
+	}
+}
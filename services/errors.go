@@ -0,0 +1,145 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+// Errors returned by OpenSearch are converted to an ElasticError
+// which may be compared with errors.Is() against these sentinels
+// (and os.ErrNotExist for missing indexes or documents).
+var (
+	VersionConflictError = errors.New("Version conflict")
+	TooManyRequestsError = errors.New("Too many requests")
+	MappingConflictError = errors.New("Mapping conflict")
+	InvalidQueryError    = errors.New("Invalid query")
+)
+
+type ElasticRootCause struct {
+	Type   string `json:"type"`
+	Reason string `json:"reason"`
+	Index  string `json:"index,omitempty"`
+}
+
+type ElasticError struct {
+	StatusCode int
+	Type       string
+	Reason     string
+	Index      string
+	RootCauses []ElasticRootCause
+
+	// The response body when it could not be parsed.
+	Raw string
+}
+
+func (self *ElasticError) Error() string {
+	if self.Type == "" {
+		if self.Raw != "" {
+			return fmt.Sprintf("Elastic Error: %v", self.Raw)
+		}
+		return fmt.Sprintf("Elastic Error: %v", http.StatusText(self.StatusCode))
+	}
+
+	result := fmt.Sprintf("Elastic Error: %v: %v", self.Type, self.Reason)
+	if self.Index != "" {
+		result += fmt.Sprintf(" (index %v)", self.Index)
+	}
+
+	// Root causes often say more than the top level error.
+	for _, cause := range self.RootCauses {
+		if cause.Type == self.Type && cause.Reason == self.Reason {
+			continue
+		}
+		result += fmt.Sprintf(": caused by %v: %v", cause.Type, cause.Reason)
+	}
+
+	return result
+}
+
+func (self *ElasticError) hasType(types ...string) bool {
+	for _, t := range types {
+		if self.Type == t {
+			return true
+		}
+		for _, cause := range self.RootCauses {
+			if cause.Type == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (self *ElasticError) Is(target error) bool {
+	switch target {
+	case os.ErrNotExist:
+		return self.StatusCode == http.StatusNotFound ||
+			self.hasType("index_not_found_exception",
+				"document_missing_exception",
+				"resource_not_found_exception")
+
+	case VersionConflictError:
+		return self.hasType("version_conflict_engine_exception")
+
+	case TooManyRequestsError:
+		return self.StatusCode == http.StatusTooManyRequests ||
+			self.hasType("es_rejected_execution_exception",
+				"circuit_breaking_exception")
+
+	case MappingConflictError:
+		return self.hasType("mapper_parsing_exception",
+			"strict_dynamic_mapping_exception")
+
+	case InvalidQueryError:
+		return self.hasType("parsing_exception",
+			"x_content_parse_exception",
+			"query_shard_exception")
+	}
+	return false
+}
+
+type elasticErrorResponse struct {
+	Error  json.RawMessage `json:"error"`
+	Status int             `json:"status"`
+}
+
+type elasticErrorDetails struct {
+	ElasticRootCause
+	RootCause []ElasticRootCause `json:"root_cause"`
+}
+
+// Parse the body of an error response.
+func MakeElasticError(status int, data []byte) *ElasticError {
+	result := &ElasticError{StatusCode: status}
+
+	response := &elasticErrorResponse{}
+	err := json.Unmarshal(data, response)
+	if err != nil || len(response.Error) == 0 {
+		result.Raw = strings.TrimSpace(string(data))
+		return result
+	}
+
+	if response.Status != 0 {
+		result.StatusCode = response.Status
+	}
+
+	// Some errors are just a string.
+	details := &elasticErrorDetails{}
+	err = json.Unmarshal(response.Error, details)
+	if err != nil {
+		result.Raw = string(response.Error)
+		return result
+	}
+
+	result.Type = details.Type
+	result.Reason = details.Reason
+	result.Index = details.Index
+	result.RootCauses = details.RootCause
+
+	return result
+}
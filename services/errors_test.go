@@ -0,0 +1,59 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert"
+)
+
+func TestElasticErrors(t *testing.T) {
+	err := MakeElasticError(http.StatusNotFound, []byte(`{
+  "error": {
+    "root_cause": [{
+      "type": "document_missing_exception",
+      "reason": "[C.123_labels]: document missing",
+      "index": "persisted"
+    }],
+    "type": "document_missing_exception",
+    "reason": "[C.123_labels]: document missing",
+    "index": "persisted"
+  },
+  "status": 404
+}`))
+	assert.True(t, errors.Is(err, os.ErrNotExist))
+	assert.False(t, errors.Is(err, VersionConflictError))
+	assert.Equal(t, "persisted", err.Index)
+	assert.Equal(t, "Elastic Error: document_missing_exception: "+
+		"[C.123_labels]: document missing (index persisted)", err.Error())
+
+	// Wrapped errors still match.
+	wrapped := fmt.Errorf("Updating labels: %w", err)
+	assert.True(t, errors.Is(wrapped, os.ErrNotExist))
+
+	// Root causes are included.
+	err = MakeElasticError(http.StatusBadRequest, []byte(`{
+  "error": {
+    "root_cause": [{
+      "type": "mapper_parsing_exception",
+      "reason": "failed to parse field [timestamp]"
+    }],
+    "type": "search_phase_execution_exception",
+    "reason": "all shards failed"
+  },
+  "status": 400
+}`))
+	assert.True(t, errors.Is(err, MappingConflictError))
+	assert.Equal(t, 400, err.StatusCode)
+	assert.Equal(t, "Elastic Error: search_phase_execution_exception: "+
+		"all shards failed: caused by mapper_parsing_exception: "+
+		"failed to parse field [timestamp]", err.Error())
+
+	// Responses from proxies are often not JSON.
+	err = MakeElasticError(http.StatusTooManyRequests, []byte("Rate exceeded\n"))
+	assert.True(t, errors.Is(err, TooManyRequestsError))
+	assert.Equal(t, "Elastic Error: Rate exceeded", err.Error())
+}
@@ -0,0 +1,50 @@
+package services
+
+import (
+	"context"
+	"time"
+)
+
+// Helpers for the tests in services_test.
+
+func SetMigrationDelaysForTests(settle, verify time.Duration) func() {
+	old_settle, old_verify := migration_settle_time, migration_verify_delay
+	migration_settle_time, migration_verify_delay = settle, verify
+	return func() {
+		migration_settle_time, migration_verify_delay = old_settle, old_verify
+	}
+}
+
+func SetOrgMigratingForTests(org_id, source, target string) error {
+	return setOrgPlacement(context.Background(), org_id, source, target)
+}
+
+func RemoveElasticClientForTests(cluster string) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	delete(elasticClients, cluster)
+}
+
+// Remove the documents from the target cluster which are no longer
+// on the source as the copy does for the documents it read.
+func RemoveDeletedForTests(ctx context.Context,
+	source, target, org_id, index string, ids []string) (int, error) {
+	source_client, err := GetElasticClientByName(source)
+	if err != nil {
+		return 0, err
+	}
+
+	target_client, err := GetElasticClientByName(target)
+	if err != nil {
+		return 0, err
+	}
+
+	name := GetIndex(org_id, index)
+	hits := []_ElasticHit{}
+	for _, id := range ids {
+		hits = append(hits, _ElasticHit{Index: name, Id: id})
+	}
+
+	return removeDeleted(ctx, source_client, target_client, name, hits)
+}
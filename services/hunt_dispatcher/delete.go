@@ -3,10 +3,174 @@ package hunt_dispatcher
 import (
 	"context"
 
-	"www.velocidex.com/golang/velociraptor/utils"
+	"github.com/Velocidex/ordereddict"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/paths"
+	"www.velocidex.com/golang/velociraptor/services"
 )
 
+const (
+	getHuntRecordForDeletion = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"hunt_id" : %q}},
+         {"match": {"doc_type" : "hunts"}}
+      ]}
+  }
+}
+`
+)
+
+type DeleteHuntOptions struct {
+	// If not set we only report what would be deleted.
+	ReallyDoIt bool
+
+	// Also remove all the collections launched by the hunt together
+	// with their uploads.
+	DeleteCollections bool
+}
+
+// The hunt_flow entries are removed with the hunt so the hunt's
+// collections would be orphaned if they were kept.
 func (self *HuntStorageManagerImpl) DeleteHunt(
 	ctx context.Context, hunt_id string) error {
-	return utils.NotImplementedError
+	_, err := DeleteHunt(ctx, self.config_obj, hunt_id, "",
+		DeleteHuntOptions{
+			ReallyDoIt:        true,
+			DeleteCollections: true,
+		})
+	return err
+}
+
+// Remove the hunt and all its records. Returns a list of all the
+// items that were removed (or would be removed if options.ReallyDoIt
+// is not set).
+func DeleteHunt(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	hunt_id, principal string,
+	options DeleteHuntOptions) ([]*services.DeleteFlowResponse, error) {
+
+	r := cvelo_services.NewDeleteReporter(
+		ctx, config_obj.OrgId, options.ReallyDoIt)
+
+	var responses []*services.DeleteFlowResponse
+
+	// The hunt_flow entries are the only link between the hunt and
+	// its collections so we need to remove the collections first.
+	if options.DeleteCollections {
+		res, err := deleteHuntCollections(
+			ctx, config_obj, hunt_id, principal, options)
+		if err != nil {
+			return nil, err
+		}
+		responses = append(responses, res...)
+	}
+
+	r.DeleteWithQuery("HuntFlow", cvelo_services.TRANSIENT,
+		json.Format(getHuntsFlowsQuery, hunt_id),
+		ordereddict.NewDict().
+			Set("index", cvelo_services.TRANSIENT).
+			Set("hunt_id", hunt_id))
+
+	// Remove the hunt's index of collections.
+	hunt_path_manager := paths.NewHuntPathManager(hunt_id)
+	r.DeleteIndex("HuntIndex", cvelo_services.TRANSIENT, "vfs_path",
+		hunt_path_manager.EnrichedClients().AsClientPath())
+
+	r.DeleteWithQuery("Hunt", cvelo_services.PERSISTED,
+		json.Format(getHuntRecordForDeletion, hunt_id),
+		ordereddict.NewDict().
+			Set("index", cvelo_services.PERSISTED).
+			Set("hunt_id", hunt_id))
+
+	responses = append(responses, r.Responses()...)
+
+	if !options.ReallyDoIt {
+		return responses, nil
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.Audit)
+	if logger != nil {
+		logger.Info("Deleted hunt %v by %v", hunt_id, principal)
+	}
+
+	// Rebuild the hunts index so the GUI no longer shows the hunt.
+	storage := &HuntStorageManagerImpl{
+		ctx:        ctx,
+		config_obj: config_obj,
+	}
+	return responses, storage.FlushIndex(ctx)
+}
+
+func deleteHuntCollections(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	hunt_id, principal string,
+	options DeleteHuntOptions) ([]*services.DeleteFlowResponse, error) {
+
+	launcher, err := services.GetLauncher(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	hits, err := cvelo_services.QueryChan(
+		ctx, config_obj, 1000, config_obj.OrgId,
+		cvelo_services.TRANSIENT,
+		json.Format(getHuntsFlowsQuery, hunt_id), "timestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	// Collect all the flows first so we do not modify the index
+	// while we page through it.
+	var jobs []*job_t
+	seen := make(map[string]bool)
+	for hit := range hits {
+		entry := &HuntFlowEntry{}
+		err = json.Unmarshal(hit, entry)
+		if err != nil {
+			continue
+		}
+
+		key := entry.FlowId + entry.ClientId
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		jobs = append(jobs, &job_t{
+			ClientId: entry.ClientId,
+			FlowId:   entry.FlowId,
+		})
+	}
+
+	var responses []*services.DeleteFlowResponse
+	for _, job := range jobs {
+		res, err := launcher.Storage().DeleteFlow(ctx, config_obj,
+			job.ClientId, job.FlowId, principal,
+			services.DeleteFlowOptions{
+				ReallyDoIt: options.ReallyDoIt,
+			})
+		if err != nil {
+			// Keep going so a single broken collection does not
+			// prevent the hunt from being removed.
+			responses = append(responses, &services.DeleteFlowResponse{
+				Type: "Collection",
+				Data: ordereddict.NewDict().
+					Set("client_id", job.ClientId).
+					Set("flow_id", job.FlowId),
+				Error: err.Error(),
+			})
+			continue
+		}
+		responses = append(responses, res...)
+	}
+
+	return responses, nil
 }
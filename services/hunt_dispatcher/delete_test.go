@@ -0,0 +1,116 @@
+package hunt_dispatcher_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+	"www.velocidex.com/golang/velociraptor/vql/acl_managers"
+	"www.velocidex.com/golang/velociraptor/vtesting"
+)
+
+type HuntDeleteTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *HuntDeleteTestSuite) TestDeleteHunt() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1234"
+	hunt_id := "H.1234"
+
+	closer := utils.SetFlowIdForTests("F.1234")
+	defer closer()
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository_manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository := repository_manager.NewRepository()
+	_, err = repository.LoadYaml(`
+name: TestArtifact
+sources:
+- query: SELECT * FROM info()
+`, services.ArtifactOptions{
+		ValidateArtifact:  true,
+		ArtifactIsBuiltIn: true})
+	assert.NoError(self.T(), err)
+
+	// Schedule the collection the hunt launched on the client.
+	flow_id, err := launcher.ScheduleArtifactCollection(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, &flows_proto.ArtifactCollectorArgs{
+			ClientId:  client_id,
+			Artifacts: []string{"TestArtifact"},
+		}, nil)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	vtesting.WaitUntil(5*time.Second, self.T(), func() bool {
+		_, err := launcher.GetFlowDetails(self.Ctx, config_obj,
+			services.GetFlowOptions{}, client_id, flow_id)
+		return err == nil
+	})
+
+	err = cvelo_services.SetElasticIndex(self.Ctx, config_obj.OrgId,
+		cvelo_services.TRANSIENT, cvelo_services.DocIdRandom,
+		&hunt_dispatcher.HuntFlowEntry{
+			HuntId:    hunt_id,
+			ClientId:  client_id,
+			FlowId:    flow_id,
+			Timestamp: utils.GetTime().Now().Unix(),
+			Status:    "started",
+			DocType:   "hunt_flow",
+		})
+	assert.NoError(self.T(), err)
+
+	storage := hunt_dispatcher.NewHuntStorageManagerImpl(self.Ctx, config_obj)
+	err = storage.SetHunt(self.Ctx, &api_proto.Hunt{
+		HuntId: hunt_id,
+		State:  api_proto.Hunt_STOPPED,
+		StartRequest: &flows_proto.ArtifactCollectorArgs{
+			CompiledCollectorArgs: []*actions_proto.VQLCollectorArgs{{}},
+		},
+	})
+	assert.NoError(self.T(), err)
+
+	err = storage.DeleteHunt(self.Ctx, hunt_id)
+	assert.NoError(self.T(), err)
+
+	// The hunt record is gone.
+	_, err = cvelo_services.GetElasticRecord(self.Ctx,
+		config_obj.OrgId, cvelo_services.PERSISTED, hunt_id)
+	assert.Error(self.T(), err)
+
+	// So are the links to its collections.
+	hits, _, err := cvelo_services.QueryElasticRaw(self.Ctx,
+		config_obj.OrgId, cvelo_services.TRANSIENT,
+		hunt_dispatcher.HuntFlowsQueryForTests(hunt_id))
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(hits))
+
+	// And the collections themselves.
+	_, err = launcher.GetFlowDetails(self.Ctx, config_obj,
+		services.GetFlowOptions{}, client_id, flow_id)
+	assert.Error(self.T(), err)
+}
+
+func TestHuntDelete(t *testing.T) {
+	suite.Run(t, &HuntDeleteTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted", "transient"},
+		},
+	})
+}
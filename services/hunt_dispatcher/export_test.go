@@ -0,0 +1,9 @@
+package hunt_dispatcher
+
+import "www.velocidex.com/golang/velociraptor/json"
+
+// Helpers for the tests in hunt_dispatcher_test.
+
+func HuntFlowsQueryForTests(hunt_id string) string {
+	return json.Format(getHuntsFlowsQuery, hunt_id)
+}
@@ -28,7 +28,7 @@ type job_t struct {
 }
 
 const (
-	getHuntsFlowsQuery = `{ "from": %q,
+	getHuntsFlowsQuery = `{
   "query": {
     "bool": {
       "must": [
@@ -150,7 +150,7 @@ func (self *HuntDispatcher) syncFlowTables(
 	}
 	defer rs_writer.Close()
 
-	query := json.Format(getHuntsFlowsQuery, 0, hunt_id)
+	query := json.Format(getHuntsFlowsQuery, hunt_id)
 	hits, err := cvelo_services.QueryChan(
 		ctx, config_obj, 1000, self.config_obj.OrgId,
 		cvelo_services.TRANSIENT, query, "timestamp")
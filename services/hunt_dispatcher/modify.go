@@ -2,11 +2,30 @@ package hunt_dispatcher
 
 import (
 	"context"
-	"time"
+	"sort"
 
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
+	"www.velocidex.com/golang/velociraptor/json"
 	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+const (
+	getHuntMembershipOfClientsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"term": {"assigned_hunts" : %q}},
+         {"terms": {"client_id" : %q}},
+         {"match": {"doc_type" : "clients"}}
+      ]}
+  }
+}
+`
 )
 
 func (self *HuntDispatcher) ModifyHunt(
@@ -15,6 +34,9 @@ func (self *HuntDispatcher) ModifyHunt(
 	hunt_modification *api_proto.Hunt,
 	user string) error {
 
+	stopped := false
+	paused := false
+
 	self.ModifyHuntObject(ctx, hunt_modification.HuntId,
 		func(hunt *api_proto.Hunt) services.HuntModificationAction {
 
@@ -24,26 +46,180 @@ func (self *HuntDispatcher) ModifyHunt(
 
 			} else if hunt_modification.State == api_proto.Hunt_RUNNING {
 
-				// We allow restarting stopped hunts
-				// but this may not work as intended
-				// because we still have a hunt index
-				// - i.e. clients that already
-				// scheduled the hunt will not
-				// re-schedule (whether they ran it or
-				// not). Usually the most reliable way
-				// to re-do a hunt is to copy it and
+				// Resuming a paused hunt. Clients that already
+				// picked up the hunt keep it in their assigned_hunts
+				// and will not be scheduled again. Resetting the
+				// start time makes the foreman consider all recently
+				// seen clients that were not assigned yet.
+				//
+				// We also allow restarting stopped hunts but this
+				// may not work as intended because the outstanding
+				// tasks were cancelled when the hunt was stopped. The
+				// most reliable way to re-do a hunt is to copy it and
 				// do it again.
 				hunt.State = api_proto.Hunt_RUNNING
-				hunt.StartTime = uint64(time.Now().UnixNano() / 1000)
+				hunt.StartTime = uint64(utils.GetTime().Now().UnixNano() / 1000)
+
+				// A paused hunt is skipped by the foreman but keeps
+				// its membership so it can be resumed later.
+			} else if hunt_modification.State == api_proto.Hunt_PAUSED {
+				hunt.State = api_proto.Hunt_PAUSED
+				paused = true
 
-				// We are trying to pause or stop the hunt.
-			} else if hunt_modification.State == api_proto.Hunt_STOPPED ||
-				hunt_modification.State == api_proto.Hunt_PAUSED {
+			} else if hunt_modification.State == api_proto.Hunt_STOPPED {
 				hunt.State = api_proto.Hunt_STOPPED
+				stopped = true
 			}
 
 			return services.HuntPropagateChanges
 		})
 
+	if stopped {
+		return CancelHuntTasks(ctx, config_obj, hunt_modification.HuntId)
+	}
+
+	if paused {
+		return holdHuntTasks(ctx, config_obj, hunt_modification.HuntId)
+	}
+
+	return nil
+}
+
+// Clients which were assigned the paused hunt but did not pick up
+// their task yet should not run it. Their tasks are revoked and
+// their membership removed so the foreman assigns the hunt to them
+// again when it is resumed.
+func holdHuntTasks(
+	ctx context.Context,
+	config_obj *config_proto.Config, hunt_id string) error {
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	if err != nil {
+		return err
+	}
+
+	revoker, ok := client_info_manager.(cvelo_services.TaskRevoker)
+	if !ok {
+		return nil
+	}
+
+	revoked, err := revoker.RevokeHuntTasks(ctx, hunt_id)
+	if err != nil {
+		return err
+	}
+
+	for len(revoked) > 0 {
+		batch := revoked
+		if len(batch) > 1000 {
+			batch = batch[:1000]
+		}
+		revoked = revoked[len(batch):]
+
+		err = cvelo_services.DeleteByQuery(ctx, config_obj.OrgId,
+			cvelo_services.PERSISTED,
+			json.Format(getHuntMembershipOfClientsQuery, hunt_id, batch))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Revoke the tasks that were queued for the hunt but not yet picked
+// up so offline clients do not run a stopped hunt when they next
+// check in. Clients that are still running the hunt's collection are
+// sent a cancel message instead.
+func CancelHuntTasks(
+	ctx context.Context,
+	config_obj *config_proto.Config, hunt_id string) error {
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	if err != nil {
+		return err
+	}
+
+	revoker, ok := client_info_manager.(cvelo_services.TaskRevoker)
+	if !ok {
+		return nil
+	}
+
+	_, err = revoker.RevokeHuntTasks(ctx, hunt_id)
+	if err != nil {
+		return err
+	}
+
+	in_flight, err := getInFlightHuntClients(ctx, config_obj, hunt_id)
+	if err != nil {
+		return err
+	}
+
+	if len(in_flight) == 0 {
+		return nil
+	}
+
+	message := &crypto_proto.VeloMessage{
+		Cancel:    &crypto_proto.Cancel{},
+		SessionId: utils.CreateFlowIdFromHuntId(hunt_id),
+	}
+
+	queuer, ok := client_info_manager.(cvelo_services.MultiClientMessageQueuer)
+	if ok {
+		return queuer.QueueMessageForMultipleClients(
+			ctx, in_flight, message, true)
+	}
+
+	for _, client_id := range in_flight {
+		err := client_info_manager.QueueMessageForClient(
+			ctx, client_id, message, true, nil)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
+
+// The ingestor writes a "started" hunt_flow entry when the client
+// starts the hunt's collection and an "updated" entry when the
+// collection is done. Returns the clients which started the
+// collection but did not finish it yet.
+func getInFlightHuntClients(
+	ctx context.Context,
+	config_obj *config_proto.Config, hunt_id string) ([]string, error) {
+
+	hits, err := cvelo_services.QueryChan(ctx, config_obj, 1000,
+		config_obj.OrgId, cvelo_services.TRANSIENT,
+		json.Format(getHuntsFlowsQuery, hunt_id), "timestamp")
+	if err != nil {
+		return nil, err
+	}
+
+	started := make(map[string]bool)
+	for hit := range hits {
+		entry := &HuntFlowEntry{}
+		err = json.Unmarshal(hit, entry)
+		if err != nil {
+			continue
+		}
+
+		switch entry.Status {
+		case "started":
+			_, pres := started[entry.ClientId]
+			if !pres {
+				started[entry.ClientId] = true
+			}
+		default:
+			started[entry.ClientId] = false
+		}
+	}
+
+	var result []string
+	for client_id, in_flight := range started {
+		if in_flight {
+			result = append(result, client_id)
+		}
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
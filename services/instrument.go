@@ -34,6 +34,50 @@ var (
 		},
 		[]string{"operation"},
 	)
+
+	// Track bulk index items which could not be delivered.
+	BulkIndexerSpooledCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bulk_indexer_spooled_items",
+			Help: "Count of bulk index items written to the spool.",
+		})
+
+	BulkIndexerReplayedCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bulk_indexer_replayed_items",
+			Help: "Count of spooled bulk index items replayed to OpenSearch.",
+		})
+
+	BulkIndexerDroppedCounter = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "bulk_indexer_dropped_items",
+			Help: "Count of bulk index items that were dropped.",
+		})
+
+	// Retries and the circuit breaker state per cluster.
+	OpensearchRetryCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opensearch_retries",
+			Help: "Count of OpenSearch requests that were retried.",
+		},
+		[]string{"cluster"},
+	)
+
+	OpensearchCircuitBreakerState = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "opensearch_circuit_breaker_state",
+			Help: "Circuit breaker state (0 closed, 1 open, 2 half open).",
+		},
+		[]string{"cluster"},
+	)
+
+	OpensearchCircuitBreakerRejectedCounter = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "opensearch_circuit_breaker_rejected",
+			Help: "Count of OpenSearch requests failed by the circuit breaker.",
+		},
+		[]string{"cluster"},
+	)
 )
 
 func Count(operation string) {
@@ -3,48 +3,290 @@ package inventory
 import (
 	"context"
 	"errors"
+	"fmt"
+	"os"
 	"sync"
+	"time"
 
+	"google.golang.org/protobuf/proto"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/filestore"
+	"www.velocidex.com/golang/cloudvelo/schema/api"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	artifacts_proto "www.velocidex.com/golang/velociraptor/artifacts/proto"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
 	"www.velocidex.com/golang/velociraptor/services"
 )
 
+const (
+	// Clients download tools directly from the bucket using a
+	// presigned URL. This is the longest time S3 allows and matches
+	// the default task expiry.
+	TOOL_URL_EXPIRY = 7 * 24 * time.Hour
+
+	getAllToolsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"doc_type" : "tools"}}
+      ]}
+  }
+}
+`
+)
+
 var (
-	notImplementedError = errors.New("Inventory service not supported")
+	notApprovedError = errors.New("Tool is not approved")
 )
 
-type Dummy struct{}
+// Tool definitions are stored in the persisted index and the binaries
+// in the S3 bucket.
+type InventoryService struct {
+	ctx          context.Context
+	config_obj   *config_proto.Config
+	cloud_config *config.ElasticConfiguration
+}
 
-func (self Dummy) Get() *artifacts_proto.ThirdParty {
-	return nil
+func (self *InventoryService) Get() *artifacts_proto.ThirdParty {
+	result := &artifacts_proto.ThirdParty{}
+
+	hits, err := cvelo_services.QueryChan(self.ctx, self.config_obj, 1000,
+		self.config_obj.OrgId, cvelo_services.PERSISTED,
+		getAllToolsQuery, "name")
+	if err != nil {
+		return result
+	}
+
+	for hit := range hits {
+		tool, err := parseToolEntry(hit)
+		if err != nil {
+			continue
+		}
+		result.Tools = append(result.Tools, tool)
+	}
+
+	return result
 }
 
-func (self Dummy) ProbeToolInfo(
+// Get the tool definition without fetching the binary.
+func (self *InventoryService) ProbeToolInfo(
 	ctx context.Context, config_obj *config_proto.Config,
 	name, version string) (*artifacts_proto.Tool, error) {
-	return nil, notImplementedError
+
+	serialized, err := cvelo_services.GetElasticRecord(ctx,
+		self.config_obj.OrgId, cvelo_services.PERSISTED, toolDocId(name))
+	if err != nil {
+		return nil, err
+	}
+
+	tool, err := parseToolEntry(serialized)
+	if err != nil {
+		return nil, err
+	}
+
+	if version != "" && tool.Version != "" && tool.Version != version {
+		return nil, fmt.Errorf("Tool %v version %v: %w",
+			name, version, os.ErrNotExist)
+	}
+
+	return tool, nil
 }
 
-func (self Dummy) GetToolInfo(ctx context.Context, config_obj *config_proto.Config,
-	tool, version string) (*artifacts_proto.Tool, error) {
-	return nil, notImplementedError
+// Get the tool definition so it can be sent to a client. The binary
+// is fetched into the bucket the first time the tool is used.
+func (self *InventoryService) GetToolInfo(
+	ctx context.Context, config_obj *config_proto.Config,
+	name, version string) (*artifacts_proto.Tool, error) {
+
+	tool, err := self.ProbeToolInfo(ctx, config_obj, name, version)
+	if errors.Is(err, os.ErrNotExist) {
+		// Approved tools do not need to be declared before they
+		// are used.
+		approved, ok := self.getApprovedTool(name)
+		if !ok {
+			return nil, fmt.Errorf("Tool %v is not known: %w", name, err)
+		}
+
+		tool = &artifacts_proto.Tool{
+			Name: name,
+			Url:  approved.URL,
+		}
+		err = self.AddTool(ctx, config_obj, tool, services.ToolOptions{})
+		if err != nil {
+			return nil, err
+		}
+
+		tool, err = self.ProbeToolInfo(ctx, config_obj, name, version)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if tool.Hash == "" {
+		err = self.materializeTool(ctx, config_obj, tool)
+		if err != nil {
+			return nil, err
+		}
+
+		err = self.setTool(ctx, tool)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	tool.ServeUrl, err = filestore.GetPresignedURL(
+		file_store.GetFileStore(config_obj), toolPathSpec(tool),
+		TOOL_URL_EXPIRY)
+	if err != nil {
+		return nil, err
+	}
+
+	return tool, nil
 }
 
-func (self Dummy) AddTool(ctx context.Context, config_obj *config_proto.Config,
-	tool *artifacts_proto.Tool, opts services.ToolOptions) error {
-	return notImplementedError
+func (self *InventoryService) AddTool(
+	ctx context.Context, config_obj *config_proto.Config,
+	tool_request *artifacts_proto.Tool, opts services.ToolOptions) error {
+
+	tool := proto.Clone(tool_request).(*artifacts_proto.Tool)
+
+	err := self.checkApproved(tool)
+	if err != nil {
+		return err
+	}
+
+	// Artifact definitions do not replace the tools set up by the
+	// admin.
+	existing, err := self.ProbeToolInfo(ctx, config_obj, tool.Name, "")
+	if err == nil && existing.AdminOverride && !opts.AdminOverride {
+		return nil
+	}
+
+	// Hashes are always computed on the server.
+	tool.Hash = ""
+	tool.ServeUrl = ""
+	tool.AdminOverride = opts.AdminOverride
+
+	// Binaries uploaded by the admin are already in the bucket and
+	// tools set by the admin are fetched immediately so problems are
+	// reported right away. Otherwise we wait until the tool is used.
+	if opts.AdminOverride || uploadedTool(tool) {
+		err = self.materializeTool(ctx, config_obj, tool)
+		if err != nil {
+			return err
+		}
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+	logger.Info("Inventory: Adding tool %v from %v", tool.Name, tool.Url)
+
+	return self.setTool(ctx, tool)
 }
 
-func (self Dummy) RemoveTool(
+func (self *InventoryService) RemoveTool(
 	config_obj *config_proto.Config, tool_name string) error {
-	return notImplementedError
+
+	tool, err := self.ProbeToolInfo(self.ctx, config_obj, tool_name, "")
+	if err != nil {
+		return err
+	}
+
+	if tool.FilestorePath != "" {
+		file_store_factory := file_store.GetFileStore(config_obj)
+		err = file_store_factory.Delete(toolPathSpec(tool))
+		if err != nil {
+			logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+			logger.Error("Inventory: Unable to remove binary for %v: %v",
+				tool_name, err)
+		}
+	}
+
+	return cvelo_services.DeleteDocument(self.ctx, self.config_obj.OrgId,
+		cvelo_services.PERSISTED, toolDocId(tool_name),
+		cvelo_services.SyncDelete)
+}
+
+func (self *InventoryService) setTool(
+	ctx context.Context, tool *artifacts_proto.Tool) error {
+
+	// The serve URL is only valid for a limited time so we make a
+	// new one each time.
+	tool = proto.Clone(tool).(*artifacts_proto.Tool)
+	tool.ServeUrl = ""
+
+	return cvelo_services.SetElasticIndex(ctx,
+		self.config_obj.OrgId,
+		cvelo_services.PERSISTED, toolDocId(tool.Name),
+		&api.ToolEntry{
+			Name:       tool.Name,
+			Definition: json.MustMarshalString(tool),
+			DocType:    "tools",
+		})
+}
+
+func (self *InventoryService) getApprovedTool(name string) (config.Tool, bool) {
+	if self.cloud_config == nil {
+		return config.Tool{}, false
+	}
+
+	for _, approved := range self.cloud_config.ApprovedTools {
+		if approved.Name == name {
+			return approved, true
+		}
+	}
+	return config.Tool{}, false
+}
+
+// Only tools on the ApprovedTools list may be added. If the approved
+// tool specifies a URL, the binary is always fetched from there.
+func (self *InventoryService) checkApproved(tool *artifacts_proto.Tool) error {
+	approved, ok := self.getApprovedTool(tool.Name)
+	if !ok {
+		return fmt.Errorf("%w: %v", notApprovedError, tool.Name)
+	}
+
+	// Binaries uploaded by the admin do not have a URL.
+	if approved.URL != "" && !uploadedTool(tool) {
+		tool.Url = approved.URL
+		tool.GithubProject = ""
+		tool.GithubAssetRegex = ""
+	}
+
+	return nil
+}
+
+func parseToolEntry(serialized []byte) (*artifacts_proto.Tool, error) {
+	entry := &api.ToolEntry{}
+	err := json.Unmarshal(serialized, entry)
+	if err != nil {
+		return nil, err
+	}
+
+	tool := &artifacts_proto.Tool{}
+	err = json.Unmarshal([]byte(entry.Definition), tool)
+	if err != nil {
+		return nil, err
+	}
+	return tool, nil
+}
+
+func toolDocId(name string) string {
+	return name + "_tool"
 }
 
-func NewInventoryDummyService(
+func NewInventoryService(
 	ctx context.Context,
 	wg *sync.WaitGroup,
-	config_obj *config_proto.Config) (services.Inventory, error) {
+	config_obj *config_proto.Config,
+	cloud_config *config.ElasticConfiguration) (services.Inventory, error) {
 
-	return Dummy{}, nil
+	return &InventoryService{
+		ctx:          ctx,
+		config_obj:   config_obj,
+		cloud_config: cloud_config,
+	}, nil
 }
@@ -0,0 +1,97 @@
+package inventory_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	artifacts_proto "www.velocidex.com/golang/velociraptor/artifacts/proto"
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+const tool_data = "This is the tool binary"
+
+type InventoryTestSuite struct {
+	*testsuite.CloudTestSuite
+
+	server *httptest.Server
+}
+
+func (self *InventoryTestSuite) SetupTest() {
+	self.CloudTestSuite.SetupTest()
+
+	self.server = httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(tool_data))
+		}))
+
+	self.ConfigObj.Cloud.ApprovedTools = []config.Tool{{
+		Name: "ApprovedTool",
+		URL:  self.server.URL + "/approved.exe",
+	}}
+}
+
+func (self *InventoryTestSuite) TearDownTest() {
+	self.server.Close()
+	self.ConfigObj.Cloud.ApprovedTools = nil
+	self.CloudTestSuite.TearDownTest()
+}
+
+func (self *InventoryTestSuite) TestApprovedTools() {
+	config_obj := self.ConfigObj.VeloConf()
+
+	inventory, err := services.GetInventory(config_obj)
+	assert.NoError(self.T(), err)
+
+	// Tools that are not on the allow list are rejected.
+	err = inventory.AddTool(self.Ctx, config_obj, &artifacts_proto.Tool{
+		Name: "UnknownTool",
+		Url:  self.server.URL + "/unknown.exe",
+	}, services.ToolOptions{})
+	assert.Error(self.T(), err)
+
+	// The approved URL replaces the one in the definition.
+	err = inventory.AddTool(self.Ctx, config_obj, &artifacts_proto.Tool{
+		Name: "ApprovedTool",
+		Url:  "https://www.example.com/other.exe",
+		Hash: "deadbeef",
+	}, services.ToolOptions{})
+	assert.NoError(self.T(), err)
+
+	tool, err := inventory.ProbeToolInfo(self.Ctx, config_obj, "ApprovedTool", "")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), self.server.URL+"/approved.exe", tool.Url)
+
+	// The hash is only computed by the server.
+	assert.Equal(self.T(), "", tool.Hash)
+
+	// Getting the tool fetches it into the bucket.
+	tool, err = inventory.GetToolInfo(self.Ctx, config_obj, "ApprovedTool", "")
+	assert.NoError(self.T(), err)
+
+	expected := sha256.Sum256([]byte(tool_data))
+	assert.Equal(self.T(), hex.EncodeToString(expected[:]), tool.Hash)
+	assert.Equal(self.T(), "approved.exe", tool.Filename)
+	assert.True(self.T(), tool.ServeUrl != "")
+
+	// Remove the tool
+	err = inventory.RemoveTool(config_obj, "ApprovedTool")
+	assert.NoError(self.T(), err)
+
+	_, err = inventory.ProbeToolInfo(self.Ctx, config_obj, "ApprovedTool", "")
+	assert.Error(self.T(), err)
+}
+
+func TestInventory(t *testing.T) {
+	suite.Run(t, &InventoryTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
@@ -0,0 +1,172 @@
+package inventory
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	artifacts_proto "www.velocidex.com/golang/velociraptor/artifacts/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/vql/networking"
+)
+
+const (
+	DOWNLOAD_TIMEOUT = 10 * time.Minute
+)
+
+// Binaries uploaded by the admin are already in the bucket.
+func uploadedTool(tool *artifacts_proto.Tool) bool {
+	return tool.Url == "" && tool.FilestorePath != ""
+}
+
+func toolPathSpec(tool *artifacts_proto.Tool) api.FSPathSpec {
+	return path_specs.NewUnsafeFilestorePath("public", tool.FilestorePath).
+		SetType(api.PATH_TYPE_FILESTORE_ANY)
+}
+
+// Make sure the tool's binary is in the bucket and compute its
+// hash. Tools with a URL are downloaded, uploaded tools are read back
+// from the bucket.
+func (self *InventoryService) materializeTool(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	tool *artifacts_proto.Tool) (err error) {
+
+	if tool.FilestorePath == "" {
+		tool.FilestorePath = cvelo_services.MakeId(tool.Name)
+	}
+
+	var hash string
+	if uploadedTool(tool) {
+		hash, err = hashStoredTool(config_obj, tool)
+	} else {
+		hash, err = downloadTool(ctx, config_obj, tool)
+	}
+	if err != nil {
+		return err
+	}
+
+	if tool.ExpectedHash != "" && !strings.EqualFold(tool.ExpectedHash, hash) {
+		return fmt.Errorf("Tool %v: Downloaded hash %v does not match expected hash %v",
+			tool.Name, hash, tool.ExpectedHash)
+	}
+
+	tool.Hash = hash
+	if tool.Filename == "" {
+		tool.Filename = tool.Name
+	}
+
+	return nil
+}
+
+func hashStoredTool(
+	config_obj *config_proto.Config,
+	tool *artifacts_proto.Tool) (string, error) {
+
+	file_store_factory := file_store.GetFileStore(config_obj)
+	reader, err := file_store_factory.ReadFile(toolPathSpec(tool))
+	if err != nil {
+		return "", err
+	}
+	defer reader.Close()
+
+	sha_sum := sha256.New()
+	_, err = io.Copy(sha_sum, reader)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sha_sum.Sum(nil)), nil
+}
+
+// Fetch the binary from the tool's URL into the bucket, hashing it
+// along the way.
+func downloadTool(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	tool *artifacts_proto.Tool) (string, error) {
+
+	if tool.Url == "" {
+		return "", fmt.Errorf("Tool %v has no URL to download from", tool.Name)
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+	logger.Info("Inventory: Downloading tool %v from %v", tool.Name, tool.Url)
+
+	sub_ctx, cancel := context.WithTimeout(ctx, DOWNLOAD_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(sub_ctx, "GET", tool.Url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			Proxy: networking.GetProxy(),
+		},
+	}
+
+	res, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Tool %v: Unable to download %v: %v",
+			tool.Name, tool.Url, res.Status)
+	}
+
+	file_store_factory := file_store.GetFileStore(config_obj)
+	writer, err := file_store_factory.WriteFile(toolPathSpec(tool))
+	if err != nil {
+		return "", err
+	}
+
+	err = writer.Truncate()
+	if err != nil {
+		writer.Close()
+		return "", err
+	}
+
+	sha_sum := sha256.New()
+	n, err := io.Copy(io.MultiWriter(writer, sha_sum), res.Body)
+	if err != nil {
+		writer.Close()
+		return "", err
+	}
+
+	if n == 0 {
+		writer.Close()
+		return "", errors.New("Tool " + tool.Name + ": Downloaded file is empty")
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return "", err
+	}
+
+	if tool.Filename == "" {
+		parsed, err := url.Parse(tool.Url)
+		if err == nil && path.Base(parsed.Path) != "." &&
+			path.Base(parsed.Path) != "/" {
+			tool.Filename = path.Base(parsed.Path)
+		}
+	}
+
+	return hex.EncodeToString(sha_sum.Sum(nil)), nil
+}
@@ -0,0 +1,230 @@
+package journal
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/result_sets/timed"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/paths"
+	artifact_paths "www.velocidex.com/golang/velociraptor/paths/artifacts"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/services/journal"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+const (
+	TAIL_PERIOD = 5 * time.Second
+
+	// Rows are only read once the documents holding them are
+	// certain to be written. The timed result set writer holds rows
+	// for up to FLUSH_PERIOD and the bulk indexer adds a bit more.
+	TAIL_DELAY = timed.FLUSH_PERIOD + 10*time.Second
+)
+
+var (
+	// These events are produced by the ingestors and never reach
+	// the journal of the other nodes. Watchers tail the transient
+	// index for them instead.
+	REPLICATED_EVENTS = []string{
+		"System.Flow.Completion",
+		"Server.Internal.Enrollment",
+	}
+)
+
+type JournalService struct {
+	services.JournalService
+
+	mu sync.Mutex
+
+	ctx        context.Context
+	wg         *sync.WaitGroup
+	config_obj *config_proto.Config
+
+	// One tailer per replicated queue is shared by all its
+	// watchers.
+	tailers map[string]*tailer
+}
+
+type subscriber struct {
+	// Held while sending to output so it is not closed under a
+	// send.
+	mu     sync.Mutex
+	closed bool
+
+	ctx    context.Context
+	output chan *ordereddict.Dict
+}
+
+func (self *subscriber) send(ctx context.Context, row *ordereddict.Dict) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.closed {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+
+	// The subscriber went away.
+	case <-self.ctx.Done():
+
+	case self.output <- row:
+	}
+}
+
+func (self *subscriber) close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.closed = true
+	close(self.output)
+}
+
+type tailer struct {
+	mu sync.Mutex
+
+	cancel      func()
+	subscribers map[*subscriber]bool
+}
+
+// Send the row to all the subscribers. The lock is not held while
+// sending so a slow subscriber does not hold up the others joining or
+// leaving.
+func (self *tailer) broadcast(ctx context.Context, row *ordereddict.Dict) {
+	self.mu.Lock()
+	subscribers := make([]*subscriber, 0, len(self.subscribers))
+	for sub := range self.subscribers {
+		subscribers = append(subscribers, sub)
+	}
+	self.mu.Unlock()
+
+	for _, sub := range subscribers {
+		sub.send(ctx, row)
+	}
+}
+
+func (self *JournalService) Watch(
+	ctx context.Context, queue_name string,
+	watcher_name string) (<-chan *ordereddict.Dict, func()) {
+
+	if !utils.InString(REPLICATED_EVENTS, queue_name) {
+		return self.JournalService.Watch(ctx, queue_name, watcher_name)
+	}
+
+	sub_ctx, cancel := context.WithCancel(ctx)
+	sub := &subscriber{
+		ctx:    sub_ctx,
+		output: make(chan *ordereddict.Dict),
+	}
+
+	self.mu.Lock()
+	t, pres := self.tailers[queue_name]
+	if !pres {
+		tail_ctx, tail_cancel := context.WithCancel(self.ctx)
+		t = &tailer{
+			cancel:      tail_cancel,
+			subscribers: make(map[*subscriber]bool),
+		}
+		self.tailers[queue_name] = t
+
+		self.wg.Add(1)
+		go func() {
+			defer self.wg.Done()
+
+			self.tail(tail_ctx, queue_name, t)
+		}()
+	}
+
+	t.mu.Lock()
+	t.subscribers[sub] = true
+	t.mu.Unlock()
+	self.mu.Unlock()
+
+	// Remove the subscriber when it is cancelled. The last
+	// subscriber stops the tailer.
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+
+		<-sub_ctx.Done()
+
+		self.mu.Lock()
+		t.mu.Lock()
+		delete(t.subscribers, sub)
+		remaining := len(t.subscribers)
+		t.mu.Unlock()
+
+		if remaining == 0 && self.tailers[queue_name] == t {
+			t.cancel()
+			delete(self.tailers, queue_name)
+		}
+		self.mu.Unlock()
+
+		// Waits for a send in progress which returns now that the
+		// subscriber is cancelled.
+		sub.close()
+	}()
+
+	return sub.output, cancel
+}
+
+// Periodically read the rows written to the server's result set since
+// the last read.
+func (self *JournalService) tail(
+	ctx context.Context, queue_name string, t *tailer) {
+
+	path_manager := artifact_paths.NewArtifactPathManagerWithMode(
+		self.config_obj, "server", "", queue_name, paths.MODE_SERVER_EVENT)
+
+	start := utils.GetTime().Now().Add(-TAIL_DELAY)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-utils.GetTime().After(TAIL_PERIOD):
+		}
+
+		end := utils.GetTime().Now().Add(-TAIL_DELAY)
+
+		reader, err := timed.TimedFactory{}.NewTimedResultSetReader(
+			ctx, self.config_obj, path_manager)
+		if err != nil {
+			return
+		}
+
+		reader.SeekToTime(start)
+		reader.SetMaxTime(end)
+
+		for row := range reader.Rows(ctx) {
+			t.broadcast(ctx, row)
+		}
+		reader.Close()
+
+		start = end
+	}
+}
+
+func NewJournalService(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *config_proto.Config) (services.JournalService, error) {
+
+	base, err := journal.NewJournalService(ctx, wg, config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return &JournalService{
+		JournalService: base,
+		ctx:            ctx,
+		wg:             wg,
+		config_obj:     config_obj,
+		tailers:        make(map[string]*tailer),
+	}, nil
+}
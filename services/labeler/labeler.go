@@ -3,6 +3,7 @@ package labeler
 import (
 	"context"
 	"errors"
+	"os"
 	"regexp"
 	"strings"
 	"sync"
@@ -102,7 +103,8 @@ func (self Labeler) SetClientLabel(
 		return nil
 	}
 
-	if !strings.Contains(err.Error(), "document_missing_exception") {
+	// The labels record does not exist yet.
+	if !errors.Is(err, os.ErrNotExist) {
 		return err
 	}
 
@@ -131,6 +133,43 @@ for (int i=ctx._source.lower_labels.length-1; i>=0; i--) {
 `
 )
 
+func addLabel(doc, params map[string]interface{}) error {
+	lower_labels := cvelo_services.ScriptList(doc["lower_labels"])
+	for _, l := range lower_labels {
+		if l == params["lower_label"] {
+			return nil
+		}
+	}
+
+	doc["labels"] = append(cvelo_services.ScriptList(doc["labels"]),
+		params["label"])
+	doc["lower_labels"] = append(lower_labels, params["lower_label"])
+	doc["labels_timestamp"] = params["now"]
+	doc["last_hunt_timestamp"] = 0
+	doc["last_event_table_version"] = 0
+	return nil
+}
+
+func removeLabel(doc, params map[string]interface{}) error {
+	labels := cvelo_services.ScriptList(doc["labels"])
+	lower_labels := cvelo_services.ScriptList(doc["lower_labels"])
+	for i := len(lower_labels) - 1; i >= 0; i-- {
+		if lower_labels[i] == params["lower_label"] && i < len(labels) {
+			labels = append(labels[:i], labels[i+1:]...)
+			lower_labels = append(lower_labels[:i], lower_labels[i+1:]...)
+			doc["labels_timestamp"] = params["now"]
+		}
+	}
+	doc["labels"] = labels
+	doc["lower_labels"] = lower_labels
+	return nil
+}
+
+func init() {
+	cvelo_services.RegisterUpdateScript(all_label_painless, addLabel)
+	cvelo_services.RegisterUpdateScript(remove_label_painless, removeLabel)
+}
+
 // Remove the label from the client.
 func (self Labeler) RemoveClientLabel(
 	ctx context.Context,
@@ -7,6 +7,8 @@ import (
 
 	"github.com/Velocidex/ttlcache/v2"
 	"www.velocidex.com/golang/cloudvelo/config"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/services"
 	"www.velocidex.com/golang/velociraptor/services/launcher"
@@ -17,6 +19,43 @@ type Launcher struct {
 	config_obj *config_proto.Config
 }
 
+// Remove any tasks the client did not pick up yet before cancelling
+// the flow. The base launcher queues a cancel message for the client
+// in case the collection is already running. If the client never saw
+// the collection the message is not needed.
+func (self *Launcher) CancelFlow(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	client_id, flow_id, username string) (*api_proto.StartFlowResponse, error) {
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	revoker, ok := client_info_manager.(cvelo_services.TaskRevoker)
+	if !ok {
+		return self.Launcher.CancelFlow(ctx, config_obj, client_id, flow_id, username)
+	}
+
+	revoked, err := revoker.RevokeFlowTasks(ctx, client_id, flow_id)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := self.Launcher.CancelFlow(ctx, config_obj, client_id, flow_id, username)
+	if err != nil || revoked == 0 {
+		return res, err
+	}
+
+	_, err = revoker.RevokeFlowTasks(ctx, client_id, flow_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
 func NewLauncherService(
 	ctx context.Context,
 	wg *sync.WaitGroup,
@@ -8,9 +8,13 @@ import (
 	"github.com/alecthomas/assert"
 	"github.com/stretchr/testify/suite"
 	"google.golang.org/protobuf/encoding/protojson"
+	"www.velocidex.com/golang/cloudvelo/config"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/cloudvelo/services/client_info"
+	"www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
 	"www.velocidex.com/golang/cloudvelo/testsuite"
+	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	crypto_proto "www.velocidex.com/golang/velociraptor/crypto/proto"
 	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
@@ -25,6 +29,18 @@ import (
 const (
 	getAllItemsQuery = `
 {"query": {"match_all" : {}}}
+`
+
+	getHuntFlowsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"hunt_id" : %q}},
+         {"match": {"doc_type" : "hunt_flow"}}
+      ]}
+  }
+}
 `
 
 	// Query to retrieve all the task queued for a client.
@@ -47,6 +63,12 @@ type LauncherTestSuite struct {
 	*testsuite.CloudTestSuite
 }
 
+func (self *LauncherTestSuite) SetupTest() {
+	// Tasks only expire when configured to.
+	self.ConfigObj.Cloud.TaskExpiryHours = 24
+	self.CloudTestSuite.SetupTest()
+}
+
 func (self *LauncherTestSuite) TestLauncher() {
 	config_obj := self.ConfigObj.VeloConf()
 	client_id := "C.1234"
@@ -133,17 +155,12 @@ sources:
 	err = cvelo_services.FlushBulkIndexer()
 	assert.NoError(self.T(), err)
 
-	// Check the tasks queue - we just add a cancel message but do not
-	// remove the old message.
+	// Check the tasks queue - the old message was never delivered so
+	// it is removed and the client does not need to be told to
+	// cancel it.
 	tasks, err = PeekClientTasks(self.Ctx, config_obj, client_id)
 	assert.NoError(self.T(), err)
-	assert.Equal(self.T(), 2, len(tasks))
-	assert.Equal(self.T(), client_id, tasks[1].ClientId)
-
-	message := &crypto_proto.VeloMessage{}
-	err = protojson.Unmarshal([]byte(tasks[1].JSONData), message)
-	assert.NoError(self.T(), err)
-	assert.NotNil(self.T(), message.Cancel)
+	assert.Equal(self.T(), 0, len(tasks))
 
 	// Make sure the collection is marked as cancelled now.
 	details, err = launcher.GetFlowDetails(self.Ctx, config_obj,
@@ -183,6 +200,252 @@ sources:
 	assert.Equal(self.T(), "F.1234second", flows.Items[0].SessionId)
 }
 
+func (self *LauncherTestSuite) TestTaskExpiry() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1235"
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	closer := utils.SetFlowIdForTests("F.Expired")
+	defer closer()
+
+	repository_manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository := repository_manager.NewRepository()
+	_, err = repository.LoadYaml(`
+name: TestArtifact
+sources:
+- query: SELECT * FROM info()
+`, services.ArtifactOptions{
+		ValidateArtifact:  true,
+		ArtifactIsBuiltIn: true})
+	assert.NoError(self.T(), err)
+
+	flow_id, err := launcher.ScheduleArtifactCollection(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, &flows_proto.ArtifactCollectorArgs{
+			ClientId:  client_id,
+			Artifacts: []string{"TestArtifact"},
+		}, nil)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	tasks, err := PeekClientTasks(self.Ctx, config_obj, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+	assert.True(self.T(), tasks[0].Expires > 0)
+
+	// The client comes back long after the task expired.
+	cancel := utils.MockTime(utils.NewMockClock(
+		time.Unix(0, tasks[0].Expires).Add(time.Hour)))
+	defer cancel()
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	messages, err := client_info_manager.GetClientTasks(self.Ctx, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(messages))
+
+	// The collection is marked as failed.
+	vtesting.WaitUntil(5*time.Second, self.T(), func() bool {
+		cvelo_services.Flush(launcher)
+		details, err := launcher.GetFlowDetails(self.Ctx, config_obj,
+			services.GetFlowOptions{}, client_id, flow_id)
+		return err == nil &&
+			details.Context.State == flows_proto.ArtifactCollectorContext_ERROR
+	})
+}
+
+// Without a configured expiry collection requests are kept until
+// the client comes back.
+func (self *LauncherTestSuite) TestNoDefaultTaskExpiry() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1239"
+
+	client_info_manager, err := client_info.NewClientInfoManager(
+		config_obj, &config.ElasticConfiguration{})
+	assert.NoError(self.T(), err)
+
+	err = client_info_manager.QueueMessageForClient(self.Ctx, client_id,
+		&crypto_proto.VeloMessage{
+			SessionId:   "F.NoExpiry",
+			FlowRequest: &crypto_proto.FlowRequest{},
+		}, true, nil)
+	assert.NoError(self.T(), err)
+
+	tasks, err := PeekClientTasks(self.Ctx, config_obj, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+	assert.Equal(self.T(), int64(0), tasks[0].Expires)
+}
+
+// Only collection requests expire.
+func (self *LauncherTestSuite) TestMessagesDoNotExpire() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1237"
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = client_info_manager.QueueMessageForClient(self.Ctx, client_id,
+		&crypto_proto.VeloMessage{
+			SessionId:        "F.Monitoring",
+			UpdateEventTable: &actions_proto.VQLEventTable{},
+		}, true, nil)
+	assert.NoError(self.T(), err)
+
+	tasks, err := PeekClientTasks(self.Ctx, config_obj, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+	assert.Equal(self.T(), int64(0), tasks[0].Expires)
+}
+
+// An expired hunt task counts as a failed collection of the hunt.
+func (self *LauncherTestSuite) TestHuntTaskExpiry() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1238"
+	hunt_id := "H.Expired"
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository_manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository := repository_manager.NewRepository()
+	_, err = repository.LoadYaml(`
+name: TestArtifact
+sources:
+- query: SELECT * FROM info()
+`, services.ArtifactOptions{
+		ValidateArtifact:  true,
+		ArtifactIsBuiltIn: true})
+	assert.NoError(self.T(), err)
+
+	storage := hunt_dispatcher.NewHuntStorageManagerImpl(self.Ctx, config_obj)
+	err = storage.SetHunt(self.Ctx, &api_proto.Hunt{
+		HuntId: hunt_id,
+		State:  api_proto.Hunt_RUNNING,
+		Stats:  &api_proto.HuntStats{},
+	})
+	assert.NoError(self.T(), err)
+
+	flow_id, err := launcher.ScheduleArtifactCollection(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, &flows_proto.ArtifactCollectorArgs{
+			ClientId:  client_id,
+			FlowId:    utils.CreateFlowIdFromHuntId(hunt_id),
+			Artifacts: []string{"TestArtifact"},
+		}, nil)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	tasks, err := PeekClientTasks(self.Ctx, config_obj, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+
+	cancel := utils.MockTime(utils.NewMockClock(
+		time.Unix(0, tasks[0].Expires).Add(time.Hour)))
+	defer cancel()
+
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	err = client_info_manager.(cvelo_services.TaskRevoker).
+		PurgeExpiredTasks(self.Ctx)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	// The hunt lists the failed collection.
+	hits, _, err := cvelo_services.QueryElasticRaw(self.Ctx,
+		config_obj.OrgId, cvelo_services.TRANSIENT,
+		json.Format(getHuntFlowsQuery, hunt_id))
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(hits))
+
+	entry := &hunt_dispatcher.HuntFlowEntry{}
+	err = json.Unmarshal(hits[0], entry)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), client_id, entry.ClientId)
+	assert.Equal(self.T(), flow_id, entry.FlowId)
+
+	// And counts it as an error.
+	hunt_obj, err := storage.GetHunt(self.Ctx, hunt_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), uint64(1), hunt_obj.Stats.TotalClientsScheduled)
+	assert.Equal(self.T(), uint64(1), hunt_obj.Stats.TotalClientsWithErrors)
+}
+
+func (self *LauncherTestSuite) TestCancelDeliveredFlow() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1236"
+
+	launcher, err := services.GetLauncher(config_obj)
+	assert.NoError(self.T(), err)
+
+	closer := utils.SetFlowIdForTests("F.Delivered")
+	defer closer()
+
+	repository_manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	repository := repository_manager.NewRepository()
+	_, err = repository.LoadYaml(`
+name: TestArtifact
+sources:
+- query: SELECT * FROM info()
+`, services.ArtifactOptions{
+		ValidateArtifact:  true,
+		ArtifactIsBuiltIn: true})
+	assert.NoError(self.T(), err)
+
+	flow_id, err := launcher.ScheduleArtifactCollection(
+		self.Ctx, config_obj, acl_managers.NullACLManager{},
+		repository, &flows_proto.ArtifactCollectorArgs{
+			ClientId:  client_id,
+			Artifacts: []string{"TestArtifact"},
+		}, nil)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	// The client picks up the collection.
+	client_info_manager, err := services.GetClientInfoManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	messages, err := client_info_manager.GetClientTasks(self.Ctx, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(messages))
+
+	_, err = launcher.CancelFlow(
+		self.Ctx, config_obj, client_id, flow_id, "admin")
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	// The running collection is cancelled on the client.
+	tasks, err := PeekClientTasks(self.Ctx, config_obj, client_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(tasks))
+	assert.Equal(self.T(), client_id, tasks[0].ClientId)
+
+	message := &crypto_proto.VeloMessage{}
+	err = protojson.Unmarshal([]byte(tasks[0].JSONData), message)
+	assert.NoError(self.T(), err)
+	assert.NotNil(self.T(), message.Cancel)
+}
+
 func TestLauncher(t *testing.T) {
 	suite.Run(t, &LauncherTestSuite{
 		CloudTestSuite: &testsuite.CloudTestSuite{
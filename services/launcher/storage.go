@@ -128,7 +128,7 @@ func (self *FlowStorageManager) WriteTask(
 		ID:        doc_id,
 	}
 	return cvelo_services.SetElasticIndex(ctx,
-		config_obj.OrgId, "transient",
+		config_obj.OrgId, cvelo_services.TRANSIENT_TASKS,
 		cvelo_services.DocIdRandom, record)
 }
 
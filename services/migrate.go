@@ -0,0 +1,467 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	opensearchapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+)
+
+// Migrating an org to another cluster happens while the org is in
+// use:
+//
+//  1. The org's placement is marked as migrating so all frontends
+//     write to both clusters.
+//  2. Once all frontends have seen the new placement, existing
+//     documents are copied to the target. Documents already written
+//     to the target by the frontends are newer and are not replaced.
+//     Documents deleted from the source after they were read are
+//     removed from the target again.
+//  3. The document counts on both clusters are compared.
+//  4. The org is placed on the target cluster.
+//
+// The caller is responsible for removing the org's indexes from the
+// source cluster after the migration.
+const (
+	// Wait this long for all frontends to pick up the new placement
+	// and flush their bulk indexers.
+	MIGRATION_SETTLE_TIME = PLACEMENT_CACHE_TIME + 15*time.Second
+
+	MIGRATION_BATCH_SIZE      = 1000
+	MIGRATION_VERIFY_ATTEMPTS = 5
+	MIGRATION_VERIFY_DELAY    = 10 * time.Second
+
+	matchAllQuery = `{"query": {"match_all" : {}}}`
+)
+
+var (
+	// Tests do not wait as long.
+	migration_settle_time  = MIGRATION_SETTLE_TIME
+	migration_verify_delay = MIGRATION_VERIFY_DELAY
+
+	// The indexes that hold all of the org's data.
+	MIGRATED_INDEXES = append([]string{PERSISTED, TIMELINES},
+		TRANSIENT_INDEXES...)
+)
+
+type scrollResponse struct {
+	ScrollId string       `json:"_scroll_id"`
+	Hits     _ElasticHits `json:"hits"`
+}
+
+// Migrate the org to the target cluster. Returns the name of the
+// cluster the org was migrated from.
+func MigrateOrg(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	org_id, target string) (string, error) {
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+
+	placement, err := getOrgPlacement(ctx, org_id)
+	if err != nil {
+		return "", err
+	}
+	source := placement.cluster
+
+	if source == target {
+		return "", fmt.Errorf("Org %v already lives on cluster %v",
+			org_id, target)
+	}
+
+	if placement.migrating_to != "" && placement.migrating_to != target {
+		return "", fmt.Errorf("Org %v is already migrating to cluster %v",
+			org_id, placement.migrating_to)
+	}
+
+	source_client, err := GetElasticClientByName(source)
+	if err != nil {
+		return "", err
+	}
+
+	target_client, err := GetElasticClientByName(target)
+	if err != nil {
+		return "", err
+	}
+
+	logger.Info("MigrateOrg: Starting to write org %v to both %v and %v",
+		org_id, source, target)
+	err = setOrgPlacement(ctx, org_id, source, target)
+	if err != nil {
+		return "", err
+	}
+
+	err = copyOrg(ctx, config_obj, org_id, source, target,
+		source_client, target_client)
+	if err != nil {
+		// Do not leave the org writing to both clusters. The context
+		// may be done already.
+		logger.Error("MigrateOrg: Migration of org %v failed, "+
+			"stopping writes to %v: %v", org_id, target, err)
+		err1 := SetOrgPlacement(context.Background(), org_id, source)
+		if err1 != nil {
+			logger.Error("MigrateOrg: Unable to reset placement of org %v: %v",
+				org_id, err1)
+		}
+		return "", err
+	}
+
+	logger.Info("MigrateOrg: Moving org %v to cluster %v", org_id, target)
+
+	// Frontends that have not seen the new placement yet keep
+	// writing to both clusters.
+	err = SetOrgPlacement(ctx, org_id, target)
+	if err != nil {
+		return "", err
+	}
+
+	return source, sleepWithContext(ctx, migration_settle_time)
+}
+
+// Copy the org's documents to the target and check they all made
+// it. The org must be writing to both clusters already.
+func copyOrg(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	org_id, source, target string,
+	source_client, target_client *opensearch.Client) error {
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+
+	err := sleepWithContext(ctx, migration_settle_time)
+	if err != nil {
+		return err
+	}
+
+	for _, index := range MIGRATED_INDEXES {
+		logger.Info("MigrateOrg: Copying %v from %v to %v",
+			GetIndex(org_id, index), source, target)
+		count, err := copyIndex(ctx, source_client, target_client,
+			GetIndex(org_id, index))
+		if err != nil {
+			return err
+		}
+		logger.Info("MigrateOrg: Copied %v documents", count)
+	}
+
+	return verifyMigration(ctx, org_id, source, target)
+}
+
+// Stop writing to the target cluster. The caller should remove any
+// data already copied there.
+func AbortOrgMigration(ctx context.Context, org_id string) (string, error) {
+	placement, err := getOrgPlacement(ctx, org_id)
+	if err != nil {
+		return "", err
+	}
+
+	if placement.migrating_to == "" {
+		return "", fmt.Errorf("Org %v is not migrating", org_id)
+	}
+
+	err = SetOrgPlacement(ctx, org_id, placement.cluster)
+	if err != nil {
+		return "", err
+	}
+
+	return placement.migrating_to, sleepWithContext(ctx, migration_settle_time)
+}
+
+// Copy all documents in the index keeping their ids.
+func copyIndex(
+	ctx context.Context,
+	source_client, target_client *opensearch.Client,
+	index string) (int, error) {
+
+	size := MIGRATION_BATCH_SIZE
+	res, err := opensearchapi.SearchRequest{
+		Index:  []string{index},
+		Body:   strings.NewReader(matchAllQuery),
+		Size:   &size,
+		Sort:   []string{"_doc"},
+		Scroll: time.Minute,
+	}.Do(ctx, source_client)
+	if err != nil {
+		return 0, err
+	}
+
+	total := 0
+	for {
+		data, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return total, err
+		}
+
+		if res.IsError() {
+			err = makeReadElasticError(res.StatusCode, data)
+			// The index was never written to.
+			if err == nil {
+				return total, nil
+			}
+			return total, err
+		}
+
+		parsed := &scrollResponse{}
+		err = json.Unmarshal(data, parsed)
+		if err != nil {
+			return total, err
+		}
+
+		if len(parsed.Hits.Hits) == 0 {
+			clearScroll(ctx, source_client, parsed.ScrollId)
+			return total, nil
+		}
+
+		err = bulkCreate(ctx, target_client, index, parsed.Hits.Hits)
+		if err != nil {
+			clearScroll(ctx, source_client, parsed.ScrollId)
+			return total, err
+		}
+
+		deleted, err := removeDeleted(ctx, source_client, target_client,
+			index, parsed.Hits.Hits)
+		if err != nil {
+			clearScroll(ctx, source_client, parsed.ScrollId)
+			return total, err
+		}
+		total += len(parsed.Hits.Hits) - deleted
+
+		res, err = opensearchapi.ScrollRequest{
+			ScrollID: parsed.ScrollId,
+			Scroll:   time.Minute,
+		}.Do(ctx, source_client)
+		if err != nil {
+			return total, err
+		}
+	}
+}
+
+func clearScroll(ctx context.Context, client *opensearch.Client, id string) {
+	res, err := opensearchapi.ClearScrollRequest{
+		ScrollID: []string{id},
+	}.Do(ctx, client)
+	if err == nil {
+		res.Body.Close()
+	}
+}
+
+// Create the documents on the target. Documents that already exist
+// were written by the frontends during the migration and are newer.
+func bulkCreate(
+	ctx context.Context, client *opensearch.Client,
+	index string, hits []_ElasticHit) error {
+
+	buf := &bytes.Buffer{}
+	for _, hit := range hits {
+		buf.WriteString(json.MustMarshalString(map[string]interface{}{
+			BulkUpdateCreate: map[string]string{
+				"_index": index,
+				"_id":    hit.Id,
+			}}))
+		buf.WriteString("\n")
+		buf.Write(hit.Source)
+		buf.WriteString("\n")
+	}
+
+	res, err := opensearchapi.BulkRequest{
+		Body: buf,
+	}.Do(ctx, client)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	if res.IsError() {
+		return makeElasticError(res.StatusCode, data)
+	}
+
+	response := &bulkResponse{}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return err
+	}
+
+	for _, result := range response.Items {
+		for _, info := range result {
+			if info.Status >= 300 && info.Status != 409 {
+				return fmt.Errorf("Unable to copy document to %v: %v",
+					index, string(info.Error))
+			}
+		}
+	}
+
+	return nil
+}
+
+type mgetResponse struct {
+	Docs []struct {
+		Id    string `json:"_id"`
+		Found bool   `json:"found"`
+	} `json:"docs"`
+}
+
+// The scroll reads a snapshot of the source so a document may be
+// deleted before it is copied. The delete written to the target then
+// found nothing and the copy brings the document back. Check the
+// copied documents are still on the source and delete those that are
+// gone from the target. Returns the number of documents deleted.
+func removeDeleted(
+	ctx context.Context,
+	source_client, target_client *opensearch.Client,
+	index string, hits []_ElasticHit) (int, error) {
+
+	request := []map[string]string{}
+	for _, hit := range hits {
+		request = append(request, map[string]string{
+			"_index": hit.Index,
+			"_id":    hit.Id,
+		})
+	}
+
+	// Unlike searches, mget sees deletes which are not refreshed
+	// yet.
+	res, err := opensearchapi.MgetRequest{
+		Index: index,
+		Body: strings.NewReader(json.MustMarshalString(
+			map[string]interface{}{"docs": request})),
+	}.Do(ctx, source_client)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if res.IsError() {
+		return 0, makeReadElasticError(res.StatusCode, data)
+	}
+
+	response := &mgetResponse{}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return 0, err
+	}
+
+	var gone []string
+	for _, doc := range response.Docs {
+		if !doc.Found {
+			gone = append(gone, doc.Id)
+		}
+	}
+
+	if len(gone) == 0 {
+		return 0, nil
+	}
+
+	// Data streams can only delete by query.
+	del_res, err := opensearchapi.DeleteByQueryRequest{
+		Index: []string{index},
+		Body: strings.NewReader(json.Format(
+			`{"query": {"ids": {"values": %q}}}`, gone)),
+		Conflicts: "proceed",
+	}.Do(ctx, target_client)
+	if err != nil {
+		return 0, err
+	}
+	defer del_res.Body.Close()
+
+	data, err = ioutil.ReadAll(del_res.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if del_res.IsError() {
+		return 0, makeElasticError(del_res.StatusCode, data)
+	}
+
+	return len(gone), nil
+}
+
+// Both clusters receive the same writes now so the counts should
+// match. Writes in flight may cause temporary differences so we try a
+// few times.
+func verifyMigration(
+	ctx context.Context, org_id, source, target string) (err error) {
+	for i := 0; i < MIGRATION_VERIFY_ATTEMPTS; i++ {
+		if i > 0 {
+			err := sleepWithContext(ctx, migration_verify_delay)
+			if err != nil {
+				return err
+			}
+		}
+
+		err = compareCounts(ctx, org_id, source, target)
+		if err == nil {
+			return nil
+		}
+	}
+
+	return err
+}
+
+func compareCounts(
+	ctx context.Context, org_id, source, target string) error {
+	for _, index := range MIGRATED_INDEXES {
+		for _, cluster := range []string{source, target} {
+			client, err := GetElasticClientByName(cluster)
+			if err != nil {
+				return err
+			}
+
+			res, err := opensearchapi.IndicesRefreshRequest{
+				Index: []string{GetIndex(org_id, index)},
+			}.Do(ctx, client)
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+		}
+
+		// The org still lives on the source cluster.
+		source_count, err := QueryCountAPI(ctx, org_id, index, matchAllQuery)
+		if err != nil {
+			return err
+		}
+
+		target_count, err := QueryClusterCountAPI(
+			ctx, target, org_id, index, matchAllQuery)
+		if err != nil {
+			return err
+		}
+
+		if source_count != target_count {
+			return fmt.Errorf(
+				"Document count mismatch for %v: %v has %v, %v has %v",
+				GetIndex(org_id, index), source, source_count,
+				target, target_count)
+		}
+	}
+
+	return nil
+}
+
+func sleepWithContext(ctx context.Context, delay time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
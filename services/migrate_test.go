@@ -0,0 +1,188 @@
+package services_test
+
+import (
+	"testing"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/alecthomas/assert"
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+const (
+	TARGET_CLUSTER = "target"
+
+	matchAllQuery = `{"query": {"match_all" : {}}}`
+)
+
+type MigrateTestSuite struct {
+	*testsuite.CloudTestSuite
+
+	target *testsuite.OpenSearchServer
+	closer func()
+}
+
+func (self *MigrateTestSuite) SetupTest() {
+	self.CloudTestSuite.SetupTest()
+
+	// Every test starts with an empty target cluster.
+	var err error
+	self.target, err = testsuite.NewOpenSearchServer()
+	assert.NoError(self.T(), err)
+
+	client, err := opensearch.NewClient(opensearch.Config{
+		Addresses: []string{self.target.URL()},
+	})
+	assert.NoError(self.T(), err)
+	cvelo_services.SetElasticClient(TARGET_CLUSTER, client)
+
+	self.closer = cvelo_services.SetMigrationDelaysForTests(0, 0)
+}
+
+func (self *MigrateTestSuite) TearDownTest() {
+	self.closer()
+	cvelo_services.RemoveElasticClientForTests(TARGET_CLUSTER)
+	self.target.Close()
+	self.CloudTestSuite.TearDownTest()
+}
+
+func (self *MigrateTestSuite) setDoc(id string, value int) {
+	err := cvelo_services.SetElasticIndex(self.Ctx, self.ConfigObj.OrgId,
+		cvelo_services.PERSISTED, id, ordereddict.NewDict().
+			Set("doc_type", "migrate_test").
+			Set("scheduled", value))
+	assert.NoError(self.T(), err)
+}
+
+func (self *MigrateTestSuite) targetCount() int {
+	count, err := cvelo_services.QueryClusterCountAPI(self.Ctx,
+		TARGET_CLUSTER, self.ConfigObj.OrgId, cvelo_services.PERSISTED,
+		matchAllQuery)
+	assert.NoError(self.T(), err)
+	return count
+}
+
+func (self *MigrateTestSuite) TestMigrateOrg() {
+	config_obj := self.ConfigObj.VeloConf()
+	org_id := config_obj.OrgId
+
+	self.setDoc("doc1", 1)
+
+	err := cvelo_services.SetOrgMigratingForTests(org_id,
+		cvelo_services.PRIMARY_CLUSTER, TARGET_CLUSTER)
+	assert.NoError(self.T(), err)
+
+	// Random ids are shared by both clusters so the copy does not
+	// duplicate the document.
+	self.setDoc(cvelo_services.DocIdRandom, 2)
+	assert.Equal(self.T(), 1, self.targetCount())
+
+	// Updating a document which was not copied yet copies it.
+	err = cvelo_services.UpdateIndex(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "doc1",
+		`{"doc": {"scheduled": 3}}`)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 2, self.targetCount())
+
+	source, err := cvelo_services.MigrateOrg(self.Ctx, config_obj,
+		org_id, TARGET_CLUSTER)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER, source)
+
+	cluster, err := cvelo_services.GetOrgCluster(self.Ctx, org_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), TARGET_CLUSTER, cluster)
+	assert.Equal(self.T(), 2, self.targetCount())
+
+	// Reads now come from the target.
+	serialized, err := cvelo_services.GetElasticRecord(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "doc1")
+	assert.NoError(self.T(), err)
+
+	doc := ordereddict.NewDict()
+	err = json.Unmarshal(serialized, doc)
+	assert.NoError(self.T(), err)
+
+	scheduled, _ := doc.GetInt64("scheduled")
+	assert.Equal(self.T(), int64(3), scheduled)
+}
+
+// A failed migration stops writing to the target.
+func (self *MigrateTestSuite) TestMigrateOrgFailure() {
+	config_obj := self.ConfigObj.VeloConf()
+	org_id := config_obj.OrgId
+
+	self.setDoc("doc1", 1)
+
+	// A document only on the target makes the verification
+	// fail. Write it to both clusters then delete it from the
+	// source.
+	err := cvelo_services.SetOrgMigratingForTests(org_id,
+		TARGET_CLUSTER, cvelo_services.PRIMARY_CLUSTER)
+	assert.NoError(self.T(), err)
+
+	self.setDoc("extra", 1)
+	err = cvelo_services.SetOrgPlacement(self.Ctx, org_id,
+		cvelo_services.PRIMARY_CLUSTER)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.DeleteDocument(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "extra", cvelo_services.SyncDelete)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, self.targetCount())
+
+	_, err = cvelo_services.MigrateOrg(self.Ctx, config_obj,
+		org_id, TARGET_CLUSTER)
+	assert.Error(self.T(), err)
+
+	cluster, err := cvelo_services.GetOrgCluster(self.Ctx, org_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER, cluster)
+
+	// New documents are no longer written to the target.
+	count := self.targetCount()
+	self.setDoc("doc2", 1)
+	assert.Equal(self.T(), count, self.targetCount())
+}
+
+// Documents deleted from the source after the copy read them are
+// removed from the target.
+func (self *MigrateTestSuite) TestRemoveDeleted() {
+	org_id := self.ConfigObj.OrgId
+
+	err := cvelo_services.SetOrgMigratingForTests(org_id,
+		cvelo_services.PRIMARY_CLUSTER, TARGET_CLUSTER)
+	assert.NoError(self.T(), err)
+
+	self.setDoc("kept", 1)
+	self.setDoc("gone", 1)
+	assert.Equal(self.T(), 2, self.targetCount())
+
+	// The copy read the document before it was deleted from the
+	// source only.
+	err = cvelo_services.SetOrgPlacement(self.Ctx, org_id,
+		cvelo_services.PRIMARY_CLUSTER)
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.DeleteDocument(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "gone", cvelo_services.SyncDelete)
+	assert.NoError(self.T(), err)
+
+	deleted, err := cvelo_services.RemoveDeletedForTests(self.Ctx,
+		cvelo_services.PRIMARY_CLUSTER, TARGET_CLUSTER, org_id,
+		cvelo_services.PERSISTED, []string{"kept", "gone"})
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, deleted)
+	assert.Equal(self.T(), 1, self.targetCount())
+}
+
+func TestMigrate(t *testing.T) {
+	suite.Run(t, &MigrateTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
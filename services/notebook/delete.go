@@ -14,6 +14,11 @@ func (self *NotebookStoreImpl) DeleteNotebook(ctx context.Context,
 	// TODO - recursively delete all the notebook items.
 
 	if really_do_it {
+		err := deleteNotebookRows(ctx, self.config_obj, notebook_id)
+		if err != nil {
+			return err
+		}
+
 		return cvelo_services.DeleteDocument(ctx, self.config_obj.OrgId,
 			"persisted", notebook_id, cvelo_services.SyncDelete)
 	}
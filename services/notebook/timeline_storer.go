@@ -195,7 +195,13 @@ func (self SuperTimelineStorer) DeleteComponent(ctx context.Context,
 
 	supertimeline.Timelines = new_timelines
 
-	return self.Set(ctx, notebook_id, supertimeline)
+	err = self.Set(ctx, notebook_id, supertimeline)
+	if err != nil {
+		return err
+	}
+
+	return deleteComponentRows(ctx, self.config_obj,
+		notebook_id, super_timeline, del_component)
 }
 
 func (self SuperTimelineStorer) GetTimeline(
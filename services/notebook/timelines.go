@@ -6,10 +6,10 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Velocidex/ordereddict"
-	"www.velocidex.com/golang/cloudvelo/result_sets/timed"
 	"www.velocidex.com/golang/cloudvelo/services"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
@@ -21,17 +21,102 @@ import (
 	"www.velocidex.com/golang/velociraptor/utils"
 )
 
+// A single row of a timeline component. Rows are stored in the
+// timelines index so they do not expire with the transient data.
+type TimelineRecord struct {
+	NotebookId    string `json:"notebook_id"`
+	SuperTimeline string `json:"super_timeline"`
+	Component     string `json:"component"`
+	Version       string `json:"version"`
+	Type          string `json:"type"`
+	Timestamp     int64  `json:"timestamp"`
+	VFSPath       string `json:"vfs_path"`
+	JSONData      string `json:"data"`
+}
+
 func NewRecord(
 	notebook_id, supertimeline, component, version string,
-	timestamp time.Time) *timed.TimedResultSetRecord {
-	return &timed.TimedResultSetRecord{
-		Type:      "timeline",
-		Timestamp: timestamp.UnixNano(),
+	timestamp time.Time) *TimelineRecord {
+	return &TimelineRecord{
+		NotebookId:    notebook_id,
+		SuperTimeline: supertimeline,
+		Component:     component,
+		Version:       version,
+		Type:          "timeline",
+		Timestamp:     timestamp.UnixNano(),
 		VFSPath: fmt.Sprintf("%v/%v/%v/%v",
 			notebook_id, supertimeline, component, version),
 	}
 }
 
+const (
+	component_rows_query = `
+{
+  "query": {
+    "bool": {
+      "must": [
+        {"term": {"notebook_id": %q}},
+        {"term": {"super_timeline": %q}},
+        {"term": {"component": %q}}
+      ]}
+  }
+}
+`
+	component_version_rows_query = `
+{
+  "query": {
+    "bool": {
+      "must": [
+        {"term": {"notebook_id": %q}},
+        {"term": {"super_timeline": %q}},
+        {"term": {"component": %q}},
+        {"term": {"version": %q}}
+      ]}
+  }
+}
+`
+	component_old_rows_query = `
+{
+  "query": {
+    "bool": {
+      "must": [
+        {"term": {"notebook_id": %q}},
+        {"term": {"super_timeline": %q}},
+        {"term": {"component": %q}}
+      ],
+      "must_not": [
+        {"term": {"version": %q}}
+      ]}
+  }
+}
+`
+	notebook_rows_query = `
+{
+  "query": {
+    "bool": {
+      "must": [
+        {"term": {"notebook_id": %q}}
+      ]}
+  }
+}
+`
+)
+
+// Remove all the rows of the timeline component.
+func deleteComponentRows(ctx context.Context, config_obj *config_proto.Config,
+	notebook_id, super_timeline, component string) error {
+	return cvelo_services.DeleteByQuery(ctx, utils.GetOrgId(config_obj),
+		cvelo_services.TIMELINES, json.Format(component_rows_query,
+			notebook_id, super_timeline, component))
+}
+
+// Remove the rows of all the timelines in the notebook.
+func deleteNotebookRows(ctx context.Context,
+	config_obj *config_proto.Config, notebook_id string) error {
+	return cvelo_services.DeleteByQuery(ctx, utils.GetOrgId(config_obj),
+		cvelo_services.TIMELINES, json.Format(notebook_rows_query, notebook_id))
+}
+
 type TimelineWriter struct {
 	ctx            context.Context
 	config_obj     *config_proto.Config
@@ -40,6 +125,9 @@ type TimelineWriter struct {
 	super_timeline string
 	timeline       string
 
+	// Rows queued in the bulk indexer but not yet written.
+	pending sync.WaitGroup
+
 	SuperTimelineStorer timelines.ISuperTimelineStorer
 }
 
@@ -77,9 +165,19 @@ func (self *TimelineWriter) WriteBuffer(
 		self.super_timeline, self.timeline, self.stats.Version, timestamp)
 	record.JSONData = string(serialized)
 
-	err := services.SetElasticIndex(self.ctx,
+	self.pending.Add(1)
+	err := services.SetElasticIndexAsyncWithCompletion(
 		utils.GetOrgId(self.config_obj),
-		"transient", services.DocIdRandom, record)
+		services.TIMELINES, services.DocIdRandom,
+		services.BulkUpdateCreate, record,
+		func(err error) {
+			self.pending.Done()
+			if err != nil {
+				logger := logging.GetLogger(
+					self.config_obj, &logging.FrontendComponent)
+				logger.Error("TimelineWriter.WriteBuffer: %v", err)
+			}
+		})
 	if err != nil {
 		return err
 	}
@@ -89,13 +187,61 @@ func (self *TimelineWriter) WriteBuffer(
 	return nil
 }
 
+// Remove the rows written to this version of the component so far.
 func (self *TimelineWriter) Truncate() {
-	// Delete the timeline data
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+	// Rows still queued in the bulk indexer would survive the delete.
+	err := self.waitForRows()
+	if err != nil {
+		logger.Error("TimelineWriter.Truncate: %v", err)
+	}
+
+	err = services.DeleteByQuery(self.ctx, utils.GetOrgId(self.config_obj),
+		services.TIMELINES, json.Format(component_version_rows_query,
+			self.notebook_id, self.super_timeline, self.timeline,
+			self.stats.Version))
+	if err != nil {
+		logger.Error("TimelineWriter.Truncate: %v", err)
+	}
+
+	self.stats.StartTime = 0
+	self.stats.EndTime = 0
 }
 
 func (self *TimelineWriter) Close() {
-	_, _ = self.SuperTimelineStorer.UpdateTimeline(self.ctx,
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+	// Make sure the rows are visible before the new version is
+	// published to readers.
+	err := self.waitForRows()
+	if err != nil {
+		logger.Error("TimelineWriter.Close: %v", err)
+	}
+
+	_, err = self.SuperTimelineStorer.UpdateTimeline(self.ctx,
 		self.notebook_id, self.super_timeline, self.stats)
+	if err != nil {
+		logger.Error("TimelineWriter.Close: %v", err)
+		return
+	}
+
+	// Earlier versions of the component are no longer read.
+	err = services.DeleteByQuery(self.ctx, utils.GetOrgId(self.config_obj),
+		services.TIMELINES, json.Format(component_old_rows_query,
+			self.notebook_id, self.super_timeline, self.timeline,
+			self.stats.Version))
+	if err != nil {
+		logger.Error("TimelineWriter.Close: %v", err)
+	}
+}
+
+// Wait for the bulk indexer to write the rows and make them visible
+// to searches. Only the timelines index is refreshed.
+func (self *TimelineWriter) waitForRows() error {
+	self.pending.Wait()
+	return services.FlushIndex(self.ctx, utils.GetOrgId(self.config_obj),
+		services.TIMELINES)
 }
 
 type SuperTimelineWriter struct {
@@ -110,8 +256,9 @@ func (self *SuperTimelineWriter) AddChild(
 	timeline *timelines_proto.Timeline,
 	completer func()) (timelines.ITimelineWriter, error) {
 
-	// Create a new version for the timeline since we can not delete
-	// it.
+	// Create a new version for the timeline so readers keep seeing
+	// the old version until this one is complete. The old version is
+	// removed when the writer is closed.
 	timeline.Version = fmt.Sprintf("%v", utils.GetGUID())
 
 	res := &TimelineWriter{
@@ -199,21 +346,27 @@ func (self *SuperTimelineReader) Read(ctx context.Context) <-chan timelines.Time
 		query := json.Format(timeline_query,
 			strings.Join(component_query, ",\n"), start)
 
+		org_id := utils.GetOrgId(self.config_obj)
 		hits, err := cvelo_services.QueryChan(ctx, self.config_obj, 1000,
-			utils.GetOrgId(self.config_obj), "transient", query, "timestamp")
+			org_id, cvelo_services.TIMELINES, query, "timestamp")
 		if err != nil {
 			logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
 			logger.Error("SuperTimelineReader.Read: %v", err)
 			return
 		}
 
-		for hit := range hits {
-			record := &timed.TimedResultSetRecord{}
-			err := json.Unmarshal(hit, record)
-			if err != nil {
-				continue
-			}
+		// Timelines written before they had their own index stay
+		// in the transient index until the org's schema is
+		// migrated.
+		legacy_hits, err := cvelo_services.QueryChan(ctx, self.config_obj, 1000,
+			org_id, cvelo_services.TRANSIENT, query, "timestamp")
+		if err != nil {
+			logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+			logger.Error("SuperTimelineReader.Read: %v", err)
+			return
+		}
 
+		for record := range mergeByTimestamp(ctx, hits, legacy_hits) {
 			md, pres := self.metadata[record.VFSPath]
 			if !pres {
 				continue
@@ -225,10 +378,9 @@ func (self *SuperTimelineReader) Read(ctx context.Context) <-chan timelines.Time
 				continue
 			}
 
-			// Because we write data to the transient index it can not
-			// be deleted. Instead we write a deletion event just
-			// before the deleted event and intentionally omit the
-			// event from reading.
+			// Annotations are not deleted from the index. Instead we
+			// write a deletion event just before the deleted event
+			// and intentionally omit the event from reading.
 
 			// Identify the deletion events.
 			_, pres = row.Get("Deletion")
@@ -281,6 +433,52 @@ func (self *SuperTimelineReader) Read(ctx context.Context) <-chan timelines.Time
 	return output_chan
 }
 
+// Merge two streams of records, each sorted by timestamp, into a
+// single sorted stream.
+func mergeByTimestamp(ctx context.Context,
+	a, b <-chan json.RawMessage) <-chan *TimelineRecord {
+	output_chan := make(chan *TimelineRecord)
+
+	// Returns nil when the stream is exhausted.
+	next := func(hits <-chan json.RawMessage) *TimelineRecord {
+		for hit := range hits {
+			record := &TimelineRecord{}
+			err := json.Unmarshal(hit, record)
+			if err == nil {
+				return record
+			}
+		}
+		return nil
+	}
+
+	go func() {
+		defer close(output_chan)
+
+		a_record := next(a)
+		b_record := next(b)
+
+		for a_record != nil || b_record != nil {
+			var record *TimelineRecord
+			if b_record == nil ||
+				(a_record != nil && a_record.Timestamp <= b_record.Timestamp) {
+				record = a_record
+				a_record = next(a)
+			} else {
+				record = b_record
+				b_record = next(b)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- record:
+			}
+		}
+	}()
+
+	return output_chan
+}
+
 func shouldInclude(id string, include_components, exclude_components []string) bool {
 	if len(include_components) > 0 && !utils.InString(include_components, id) {
 		return false
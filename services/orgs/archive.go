@@ -0,0 +1,561 @@
+package orgs
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	"www.velocidex.com/golang/cloudvelo/datastore"
+	"www.velocidex.com/golang/cloudvelo/filestore"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/users"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+/*
+  An org archive is a zip file holding everything needed to recreate
+  the org in another deployment:
+
+  manifest.json             - The OrgArchiveManifest.
+  users.json                - The users who belong to the org (one per line).
+  indexes/<index>.json      - The org's documents (one per line).
+  files/<key>               - The org's objects from the bucket, keyed
+                              relative to orgs/<org_id>/
+
+  Users are global so on import they are added to the new org rather
+  than replaced. ACLs are stored in the org's own persisted index so
+  they come along with the documents. Secrets are encrypted with a key
+  tied to the org, so they are stored decrypted in the archive and
+  encrypted with the new org's key on import. Archives should be
+  handled as carefully as the org's secrets.
+*/
+
+const (
+	// Version 1 archives store the users as UserRecords rather than
+	// VelociraptorUser protobufs.
+	ORG_ARCHIVE_VERSION = 2
+
+	ARCHIVE_MANIFEST = "manifest.json"
+	ARCHIVE_USERS    = "users.json"
+	ARCHIVE_INDEXES  = "indexes/"
+	ARCHIVE_FILES    = "files/"
+
+	ARCHIVE_PAGE_SIZE = 1000
+)
+
+var (
+	// The transient data classes and the legacy transient stream
+	// holding the data written before they were split.
+	exportedTransientIndexes = []string{
+		cvelo_services.TRANSIENT,
+		cvelo_services.TRANSIENT_COLLECTIONS,
+		cvelo_services.TRANSIENT_EVENTS,
+		cvelo_services.TRANSIENT_LOGS,
+		cvelo_services.TRANSIENT_TASKS,
+	}
+)
+
+type OrgArchiveManifest struct {
+	Version   int    `json:"version"`
+	OrgId     string `json:"org_id"`
+	Name      string `json:"name"`
+	Nonce     string `json:"nonce"`
+	Timestamp int64  `json:"timestamp"`
+	Transient bool   `json:"transient"`
+}
+
+type archiveDocument struct {
+	Id  string          `json:"id"`
+	Doc json.RawMessage `json:"doc"`
+
+	// A secret record holding the decrypted secret. Secrets are
+	// encrypted with a key tied to the org so they are encrypted
+	// again with the new org's key on import.
+	Secret bool `json:"secret,omitempty"`
+}
+
+type OrgImportOptions struct {
+	// The id of the new org. A new id is generated if not set.
+	OrgId string
+
+	// Defaults to the name of the exported org.
+	Name string
+
+	// Generate a new nonce rather than keeping the exported one. The
+	// org's existing clients will not be able to connect to it.
+	NewNonce bool
+}
+
+// Write the org's documents, users and uploads into a zip archive. If
+// include_transient is set, the org's result sets are exported too.
+func ExportOrg(ctx context.Context,
+	config_obj *config_proto.Config, org_id string,
+	writer io.Writer, include_transient bool) error {
+
+	if utils.IsRootOrg(org_id) {
+		return errors.New("Can not export the root org.")
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return err
+	}
+
+	record, err := org_manager.GetOrg(org_id)
+	if err != nil {
+		return err
+	}
+
+	// Secrets are decrypted with the org's key.
+	org_config_obj, err := org_manager.GetOrgConfig(org_id)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+
+	archive := zip.NewWriter(writer)
+	defer archive.Close()
+
+	err = writeArchiveJSON(archive, ARCHIVE_MANIFEST, &OrgArchiveManifest{
+		Version:   ORG_ARCHIVE_VERSION,
+		OrgId:     record.Id,
+		Name:      record.Name,
+		Nonce:     record.Nonce,
+		Timestamp: utils.GetTime().Now().Unix(),
+		Transient: include_transient,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = exportOrgUsers(ctx, archive, org_id)
+	if err != nil {
+		return err
+	}
+
+	indexes := []string{cvelo_services.PERSISTED, cvelo_services.TIMELINES}
+	if include_transient {
+		indexes = append(indexes, exportedTransientIndexes...)
+	}
+
+	for _, index := range indexes {
+		count, err := exportOrgIndex(ctx, org_config_obj, archive, index)
+		if err != nil {
+			return fmt.Errorf("Exporting %v: %w", index, err)
+		}
+		logger.Info("ExportOrg: Exported %v documents from %v", count, index)
+	}
+
+	count, err := exportOrgFiles(ctx, config_obj, archive, org_id)
+	if err != nil {
+		return err
+	}
+	logger.Info("ExportOrg: Exported %v files", count)
+
+	return archive.Close()
+}
+
+func writeArchiveJSON(archive *zip.Writer, name string, item interface{}) error {
+	out, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+
+	serialized, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+
+	_, err = out.Write(serialized)
+	return err
+}
+
+func exportOrgUsers(ctx context.Context,
+	archive *zip.Writer, org_id string) error {
+	org_users, err := users.ListOrgUsers(ctx, org_id)
+	if err != nil {
+		return err
+	}
+
+	out, err := archive.Create(ARCHIVE_USERS)
+	if err != nil {
+		return err
+	}
+
+	for _, user_record := range org_users {
+		// Users who can also log into other orgs keep their
+		// password out of the org's archive.
+		if len(user_record.Orgs) > 1 {
+			user_record.PasswordHash = nil
+			user_record.PasswordSalt = nil
+		}
+
+		serialized, err := protojson.Marshal(user_record)
+		if err != nil {
+			return err
+		}
+
+		_, err = out.Write(append(serialized, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Each document is exported with its id.
+func exportOrgIndex(ctx context.Context,
+	org_config_obj *config_proto.Config,
+	archive *zip.Writer, index string) (int, error) {
+	out, err := archive.Create(ARCHIVE_INDEXES + index + ".json")
+	if err != nil {
+		return 0, err
+	}
+
+	logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+
+	count := 0
+	err = cvelo_services.ScanIndex(ctx, org_config_obj.OrgId, index,
+		ARCHIVE_PAGE_SIZE, func(id string, doc json.RawMessage) error {
+			document := &archiveDocument{
+				Id:  id,
+				Doc: doc,
+			}
+
+			if index == cvelo_services.PERSISTED && isSecretRecord(doc) {
+				decrypted, err := datastore.DecryptSecretRecord(
+					org_config_obj, doc)
+				if err != nil {
+					logger.Warn("ExportOrg: Skipping secret %v: %v",
+						id, err)
+					return nil
+				}
+				document.Doc = decrypted
+				document.Secret = true
+			}
+
+			serialized, err := json.Marshal(document)
+			if err != nil {
+				return err
+			}
+
+			_, err = out.Write(append(serialized, '\n'))
+			if err != nil {
+				return err
+			}
+			count++
+			return nil
+		})
+	return count, err
+}
+
+func isSecretRecord(doc json.RawMessage) bool {
+	record := &struct {
+		DocType string `json:"doc_type"`
+	}{}
+	return json.Unmarshal(doc, record) == nil && record.DocType == "secret"
+}
+
+func orgPrefix(org_id string) string {
+	return "orgs/" + utils.NormalizedOrgId(org_id) + "/"
+}
+
+func exportOrgFiles(ctx context.Context,
+	config_obj *config_proto.Config,
+	archive *zip.Writer, org_id string) (int, error) {
+
+	file_store_obj := file_store.GetFileStore(config_obj)
+	if file_store_obj == nil {
+		return 0, errors.New("Filestore not configured")
+	}
+
+	prefix := orgPrefix(org_id)
+	count := 0
+	err := filestore.ListPrefix(ctx, file_store_obj, prefix,
+		func(key string, size int64) error {
+			reader, err := filestore.GetObject(ctx, file_store_obj, key)
+			if err != nil {
+				return err
+			}
+			defer reader.Close()
+
+			out, err := archive.Create(
+				ARCHIVE_FILES + strings.TrimPrefix(key, prefix))
+			if err != nil {
+				return err
+			}
+
+			_, err = io.Copy(out, reader)
+			if err != nil {
+				return fmt.Errorf("Exporting %v: %w", key, err)
+			}
+			count++
+			return nil
+		})
+	return count, err
+}
+
+// Create a new org from the archive. The org gets a new id, and
+// unless the options say otherwise, keeps the exported org's nonce so
+// its clients can connect to this deployment.
+func ImportOrg(ctx context.Context,
+	config_obj *config_proto.Config,
+	archive *zip.Reader, options OrgImportOptions) (*api_proto.OrgRecord, error) {
+
+	manifest := &OrgArchiveManifest{}
+	err := readArchiveJSON(archive, ARCHIVE_MANIFEST, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	if manifest.Version < 1 || manifest.Version > ORG_ARCHIVE_VERSION {
+		return nil, fmt.Errorf("Unsupported org archive version %v",
+			manifest.Version)
+	}
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return nil, err
+	}
+
+	if options.OrgId != "" {
+		_, err := org_manager.GetOrg(options.OrgId)
+		if err == nil {
+			return nil, fmt.Errorf("Org %v already exists", options.OrgId)
+		}
+	}
+
+	name := options.Name
+	if name == "" {
+		name = manifest.Name
+	}
+
+	nonce := manifest.Nonce
+	if options.NewNonce || nonce == "" {
+		nonce = services.RandomNonce
+	} else {
+		existing, err := org_manager.OrgIdByNonce(nonce)
+		if err == nil {
+			return nil, fmt.Errorf(
+				"Nonce is already used by org %v, a new nonce is needed",
+				existing)
+		}
+	}
+
+	record, err := org_manager.CreateNewOrg(name, options.OrgId, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+	logger.Info("ImportOrg: Importing org %v as %v", manifest.OrgId, record.Id)
+
+	err = importOrgContents(ctx, config_obj, archive, record, manifest)
+	if err != nil {
+		// Do not leave a partly imported org behind.
+		logger.Error("ImportOrg: Removing org %v after failed import: %v",
+			record.Id, err)
+		err1 := org_manager.DeleteOrg(ctx,
+			utils.GetSuperuserName(config_obj), record.Id)
+		if err1 != nil {
+			logger.Error("ImportOrg: Unable to remove org %v: %v",
+				record.Id, err1)
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func importOrgContents(ctx context.Context,
+	config_obj *config_proto.Config,
+	archive *zip.Reader, record *api_proto.OrgRecord,
+	manifest *OrgArchiveManifest) error {
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+
+	// Secrets are encrypted with the new org's key.
+	org_config_obj, err := org_manager.GetOrgConfig(record.Id)
+	if err != nil {
+		return err
+	}
+
+	file_store_obj := file_store.GetFileStore(config_obj)
+	files := 0
+
+	for _, file := range archive.File {
+		switch {
+		case strings.HasPrefix(file.Name, ARCHIVE_INDEXES):
+			index := strings.TrimSuffix(
+				strings.TrimPrefix(file.Name, ARCHIVE_INDEXES), ".json")
+			count, err := importOrgIndex(file, org_config_obj, index)
+			if err != nil {
+				return fmt.Errorf("Importing %v: %w", index, err)
+			}
+			logger.Info("ImportOrg: Imported %v documents into %v",
+				count, index)
+
+		case strings.HasPrefix(file.Name, ARCHIVE_FILES):
+			if file_store_obj == nil {
+				return errors.New("Filestore not configured")
+			}
+
+			err := importOrgFile(ctx, file_store_obj, file, record.Id)
+			if err != nil {
+				return err
+			}
+			files++
+
+		case file.Name == ARCHIVE_USERS:
+			err := importOrgUsers(ctx, file, record, manifest.Version)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	logger.Info("ImportOrg: Imported %v files", files)
+
+	return cvelo_services.FlushBulkIndexer()
+}
+
+func readArchiveJSON(archive *zip.Reader, name string, item interface{}) error {
+	fd, err := archive.Open(name)
+	if err != nil {
+		return fmt.Errorf("Invalid org archive: %w", err)
+	}
+	defer fd.Close()
+
+	serialized, err := io.ReadAll(fd)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(serialized, item)
+}
+
+// Call the callback for each line in the archive member.
+func readArchiveLines(file *zip.File, cb func(line []byte) error) error {
+	fd, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	reader := bufio.NewReader(fd)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 1 {
+			cb_err := cb(line)
+			if cb_err != nil {
+				return cb_err
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func importOrgIndex(file *zip.File,
+	org_config_obj *config_proto.Config, index string) (int, error) {
+	// Transient data is stored in data streams which only accept new
+	// documents.
+	action := cvelo_services.BulkUpdateCreate
+	if index == cvelo_services.PERSISTED ||
+		index == cvelo_services.TIMELINES {
+		action = cvelo_services.BulkUpdateIndex
+	}
+
+	logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+
+	count := 0
+	err := readArchiveLines(file, func(line []byte) error {
+		document := &archiveDocument{}
+		err := json.Unmarshal(line, document)
+		if err != nil {
+			return err
+		}
+
+		if document.Secret {
+			document.Doc, err = datastore.EncryptSecretRecord(
+				org_config_obj, document.Doc)
+			if err != nil {
+				logger.Warn("ImportOrg: Skipping secret %v: %v",
+					document.Id, err)
+				return nil
+			}
+
+		} else if index == cvelo_services.PERSISTED &&
+			isSecretRecord(document.Doc) {
+			// Secrets still encrypted with the exported org's key
+			// can not be read here.
+			logger.Warn("ImportOrg: Skipping encrypted secret %v",
+				document.Id)
+			return nil
+		}
+
+		count++
+		return cvelo_services.SetElasticIndexAsync(
+			org_config_obj.OrgId, index, document.Id, action, document.Doc)
+	})
+	return count, err
+}
+
+func importOrgFile(ctx context.Context,
+	file_store_obj api.FileStore, file *zip.File, org_id string) error {
+	fd, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	key := orgPrefix(org_id) + strings.TrimPrefix(file.Name, ARCHIVE_FILES)
+	return filestore.PutObject(ctx, file_store_obj, key, fd)
+}
+
+// Add the new org to each of the exported org's users, creating the
+// users that do not exist here yet.
+func importOrgUsers(ctx context.Context,
+	file *zip.File, org_record *api_proto.OrgRecord, version int) error {
+	return readArchiveLines(file, func(line []byte) error {
+		if version == 1 {
+			record := &users.UserRecord{}
+			err := json.Unmarshal(line, record)
+			if err != nil {
+				return err
+			}
+			line = []byte(record.Record)
+		}
+
+		user_record := &api_proto.VelociraptorUser{}
+		err := protojson.Unmarshal(line, user_record)
+		if err != nil {
+			return err
+		}
+
+		return users.AddUserToOrg(ctx, user_record, org_record)
+	})
+}
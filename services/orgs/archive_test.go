@@ -0,0 +1,149 @@
+package orgs_test
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	"www.velocidex.com/golang/cloudvelo/datastore"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/orgs"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+const IMPORTED_ORG = "O.Imported"
+
+type ArchiveTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *ArchiveTestSuite) scanIndex(org_id, index string) []string {
+	var ids []string
+	err := cvelo_services.ScanIndex(self.Ctx, org_id, index, 100,
+		func(id string, doc json.RawMessage) error {
+			ids = append(ids, id)
+			return nil
+		})
+	assert.NoError(self.T(), err)
+	return ids
+}
+
+func (self *ArchiveTestSuite) TestExportImport() {
+	config_obj := self.ConfigObj.VeloConf()
+	org_id := config_obj.OrgId
+
+	err := cvelo_services.SetElasticIndex(self.Ctx, org_id,
+		cvelo_services.PERSISTED, "doc1", ordereddict.NewDict().
+			Set("doc_type", "archive_test"))
+	assert.NoError(self.T(), err)
+
+	// Data written before the transient data classes were split.
+	err = cvelo_services.SetElasticIndex(self.Ctx, org_id,
+		cvelo_services.TRANSIENT, "legacy", ordereddict.NewDict().
+			Set("doc_type", "archive_test"))
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.SetElasticIndex(self.Ctx, org_id,
+		cvelo_services.TRANSIENT_LOGS, "log", ordereddict.NewDict().
+			Set("doc_type", "archive_test"))
+	assert.NoError(self.T(), err)
+
+	secret_path := path_specs.NewUnsafeDatastorePath(
+		datastore.SECRETS_ROOT, "HTTP Secrets", "MySecret")
+	db := datastore.NewElasticDatastore(self.Ctx, self.ConfigObj)
+	err = db.SetSubject(config_obj, secret_path, &api_proto.Hunt{
+		HuntDescription: "Very secret",
+	})
+	assert.NoError(self.T(), err)
+
+	buffer := &bytes.Buffer{}
+	err = orgs.ExportOrg(self.Ctx, config_obj, org_id, buffer, true)
+	assert.NoError(self.T(), err)
+
+	archive, err := zip.NewReader(
+		bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	assert.NoError(self.T(), err)
+
+	record, err := orgs.ImportOrg(self.Ctx, config_obj, archive,
+		orgs.OrgImportOptions{
+			OrgId:    IMPORTED_ORG,
+			NewNonce: true,
+		})
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), IMPORTED_ORG, record.Id)
+
+	_, err = cvelo_services.GetElasticRecord(self.Ctx, IMPORTED_ORG,
+		cvelo_services.PERSISTED, "doc1")
+	assert.NoError(self.T(), err)
+
+	// Each transient document is imported into its own stream only.
+	assert.Equal(self.T(), []string{"legacy"},
+		self.scanIndex(IMPORTED_ORG, cvelo_services.TRANSIENT))
+	assert.Equal(self.T(), []string{"log"},
+		self.scanIndex(IMPORTED_ORG, cvelo_services.TRANSIENT_LOGS))
+
+	// The secret is encrypted with the new org's key.
+	org_manager, err := services.GetOrgManager()
+	assert.NoError(self.T(), err)
+
+	imported_config_obj, err := org_manager.GetOrgConfig(IMPORTED_ORG)
+	assert.NoError(self.T(), err)
+
+	secret := &api_proto.Hunt{}
+	err = db.GetSubject(imported_config_obj, secret_path, secret)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), "Very secret", secret.HuntDescription)
+}
+
+// A failed import does not leave the new org behind.
+func (self *ArchiveTestSuite) TestImportFailure() {
+	buffer := &bytes.Buffer{}
+	writer := zip.NewWriter(buffer)
+
+	out, err := writer.Create(orgs.ARCHIVE_MANIFEST)
+	assert.NoError(self.T(), err)
+	_, err = out.Write([]byte(json.MustMarshalString(&orgs.OrgArchiveManifest{
+		Version: orgs.ORG_ARCHIVE_VERSION,
+		OrgId:   "O.Exported",
+		Name:    "Broken",
+	})))
+	assert.NoError(self.T(), err)
+
+	out, err = writer.Create(orgs.ARCHIVE_INDEXES + "persisted.json")
+	assert.NoError(self.T(), err)
+	_, err = out.Write([]byte("not json\n"))
+	assert.NoError(self.T(), err)
+	assert.NoError(self.T(), writer.Close())
+
+	archive, err := zip.NewReader(
+		bytes.NewReader(buffer.Bytes()), int64(buffer.Len()))
+	assert.NoError(self.T(), err)
+
+	_, err = orgs.ImportOrg(self.Ctx, self.ConfigObj.VeloConf(), archive,
+		orgs.OrgImportOptions{
+			OrgId:    "O.Broken",
+			NewNonce: true,
+		})
+	assert.Error(self.T(), err)
+
+	org_manager, err := services.GetOrgManager()
+	assert.NoError(self.T(), err)
+
+	_, err = org_manager.GetOrg("O.Broken")
+	assert.Error(self.T(), err)
+}
+
+func TestArchive(t *testing.T) {
+	suite.Run(t, &ArchiveTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted", "transient"},
+		},
+	})
+}
@@ -6,7 +6,6 @@ import (
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
-	"www.velocidex.com/golang/cloudvelo/schema"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/velociraptor/logging"
 	"www.velocidex.com/golang/velociraptor/services"
@@ -22,7 +21,9 @@ var (
 		})
 )
 
-// Remove the org and all its data.
+// Remove the org and all its data. The org is removed from the org
+// list immediately while the rest of its data is torn down in the
+// background (see teardown.go).
 func (self *OrgManager) DeleteOrg(
 	ctx context.Context, principal, org_id string) error {
 
@@ -32,7 +33,7 @@ func (self *OrgManager) DeleteOrg(
 
 	logger := logging.GetLogger(self.config_obj, &logging.Audit)
 	if logger != nil {
-		logger.Info("Deleted organization: %v", org_id)
+		logger.Info("Deleting organization: %v", org_id)
 	}
 
 	err := orgs.RemoveOrgFromUsers(ctx, principal, org_id)
@@ -40,6 +41,21 @@ func (self *OrgManager) DeleteOrg(
 		return err
 	}
 
+	// Record the teardown before the org is removed from the index
+	// so it is resumed if we crash from here on.
+	now := utils.GetTime().Now().Unix()
+	record := &OrgTeardownRecord{
+		OrgId:     org_id,
+		Principal: principal,
+		Stage:     TEARDOWN_FILESTORE,
+		DocType:   "org_teardown",
+		Started:   now,
+	}
+	err = self.setTeardownRecord(ctx, record)
+	if err != nil {
+		return err
+	}
+
 	// Remove the org from the index.
 	err = cvelo_services.DeleteDocument(ctx,
 		services.ROOT_ORG_ID, "persisted",
@@ -55,7 +71,7 @@ func (self *OrgManager) DeleteOrg(
 
 	deleteOrgCounter.Inc()
 
-	// Drop all the org's indexes
-	return schema.Delete(self.ctx, self.config_obj,
-		org_id, services.ROOT_ORG_ID)
+	self.startTeardown(record)
+
+	return nil
 }
@@ -0,0 +1,19 @@
+package orgs
+
+import "context"
+
+// Helpers for the tests in orgs_test.
+
+func (self *OrgManager) SetTeardownRecordForTests(
+	ctx context.Context, record *OrgTeardownRecord) error {
+	return self.setTeardownRecord(ctx, record)
+}
+
+func (self *OrgManager) StaleTeardownsForTests(
+	ctx context.Context) ([]*OrgTeardownRecord, error) {
+	return self.staleTeardowns(ctx)
+}
+
+func (self *OrgManager) ResumeTeardownsForTests(ctx context.Context) error {
+	return self.resumeTeardowns(ctx)
+}
@@ -7,6 +7,7 @@ import (
 
 	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/cloudvelo/services/acl_manager"
+	"www.velocidex.com/golang/cloudvelo/services/backup"
 	"www.velocidex.com/golang/cloudvelo/services/client_info"
 	"www.velocidex.com/golang/cloudvelo/services/client_monitoring"
 	"www.velocidex.com/golang/cloudvelo/services/exports"
@@ -14,17 +15,19 @@ import (
 	"www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
 	"www.velocidex.com/golang/cloudvelo/services/indexing"
 	"www.velocidex.com/golang/cloudvelo/services/inventory"
+	"www.velocidex.com/golang/cloudvelo/services/journal"
 	"www.velocidex.com/golang/cloudvelo/services/labeler"
 	"www.velocidex.com/golang/cloudvelo/services/launcher"
 	"www.velocidex.com/golang/cloudvelo/services/notebook"
 	"www.velocidex.com/golang/cloudvelo/services/notifier"
 	"www.velocidex.com/golang/cloudvelo/services/server_artifacts"
+	"www.velocidex.com/golang/cloudvelo/services/server_monitoring"
 	"www.velocidex.com/golang/cloudvelo/services/vfs_service"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/services"
 	"www.velocidex.com/golang/velociraptor/services/audit_manager"
 	"www.velocidex.com/golang/velociraptor/services/broadcast"
-	"www.velocidex.com/golang/velociraptor/services/journal"
+	"www.velocidex.com/golang/velociraptor/services/secrets"
 )
 
 // A Service container that creates different org services on demand.
@@ -52,6 +55,9 @@ type LazyServiceContainer struct {
 	launcher services.Launcher
 
 	indexer services.Indexer
+
+	// The secrets service keeps the secret definitions in memory.
+	secrets services.SecretsService
 }
 
 func (self *LazyServiceContainer) FrontendManager() (services.FrontendManager, error) {
@@ -63,11 +69,24 @@ func (self *LazyServiceContainer) ExportManager() (services.ExportManager, error
 }
 
 func (self *LazyServiceContainer) BackupService() (services.BackupService, error) {
-	return nil, errors.New("LazyServiceContainer.BackupService is Not implemented")
+	return backup.NewBackupService(self.ctx, self.config_obj), nil
 }
 
-func (self *LazyServiceContainer) SecretsService() (services.SecretsService, error) {
-	return nil, errors.New("LazyServiceContainer.SecretsService is Not implemented")
+// Secrets are stored in the datastore which keeps them encrypted in
+// the persisted index.
+func (self *LazyServiceContainer) SecretsService() (res services.SecretsService, err error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	if self.secrets == nil {
+		self.secrets, err = secrets.NewSecretsService(
+			self.ctx, self.wg, self.config_obj)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return self.secrets, nil
 }
 
 func (self *LazyServiceContainer) AuditManager() (services.AuditManager, error) {
@@ -79,7 +98,7 @@ func (self *LazyServiceContainer) Notifier() (services.Notifier, error) {
 }
 
 func (self *LazyServiceContainer) ServerEventManager() (services.ServerEventManager, error) {
-	return nil, errors.New("LazyServiceContainer.ServerEventManager is Not implemented")
+	return server_monitoring.NewServerMonitoringService(self.ctx, self.wg, self.config_obj)
 }
 
 func (self *LazyServiceContainer) ServerArtifactRunner() (services.ServerArtifactRunner, error) {
@@ -167,7 +186,7 @@ func (self *LazyServiceContainer) ClientInfoManager() (res services.ClientInfoMa
 
 	if self.client_info == nil {
 		self.client_info, err = client_info.NewClientInfoManager(
-			self.config_obj)
+			self.config_obj, self.cloud_config)
 		if err != nil {
 			return nil, err
 		}
@@ -177,7 +196,8 @@ func (self *LazyServiceContainer) ClientInfoManager() (res services.ClientInfoMa
 }
 
 func (self *LazyServiceContainer) Inventory() (services.Inventory, error) {
-	return inventory.NewInventoryDummyService(self.ctx, self.wg, self.config_obj)
+	return inventory.NewInventoryService(
+		self.ctx, self.wg, self.config_obj, self.cloud_config)
 }
 
 func (self *LazyServiceContainer) BroadcastService() (services.BroadcastService, error) {
@@ -50,6 +50,9 @@ type OrgManager struct {
 	orgs            map[string]*OrgContext
 	org_id_by_nonce map[string]string
 
+	// Orgs currently being torn down.
+	teardowns map[string]bool
+
 	root_repo services.RepositoryManager
 }
 
@@ -122,6 +125,19 @@ func (self *OrgManager) CreateNewOrg(name, id, nonce string) (
 		nonce = NewNonce()
 	}
 
+	// Decide which cluster the new org lives on before any of its
+	// services touch it.
+	err := cvelo_services.PlaceNewOrg(self.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	// The org's indexes will be created from the current templates.
+	err = schema.InitializeSchemaVersion(self.ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
 	org_context, err := self.makeNewOrgContext(id, name, nonce)
 	if err != nil {
 		return nil, err
@@ -261,20 +277,11 @@ func (self *OrgManager) Start(
 		return err
 	}
 
-	err = cvelo_services.StartBulkIndexService(self.ctx, self.wg,
-		cvelo_services.PrimaryOpenSearch, config_obj)
+	err = cvelo_services.StartBulkIndexService(self.ctx, self.wg, config_obj)
 	if err != nil {
 		return err
 	}
 
-	if config_obj.Cloud.SecondaryAddresses != nil {
-		err = cvelo_services.StartBulkIndexService(self.ctx, self.wg,
-			cvelo_services.SecondaryOpenSearch, config_obj)
-		if err != nil {
-			return err
-		}
-	}
-
 	// Ensure database is properly initialized
 	// Make sure the database is properly configured
 	err = schema.InstallIndexTemplates(ctx, config_obj)
@@ -282,6 +289,12 @@ func (self *OrgManager) Start(
 		return err
 	}
 
+	// Expire transient data according to the configured retention.
+	err = schema.InstallRetentionPolicies(ctx, config_obj)
+	if err != nil {
+		return err
+	}
+
 	// Install the ElasticDatastore
 	datastore.OverrideDatastoreImplementation(
 		cvelo_datastore.NewElasticDatastore(ctx, config_obj))
@@ -359,6 +372,7 @@ func NewOrgManager(
 		wg:              wg,
 		orgs:            make(map[string]*OrgContext),
 		org_id_by_nonce: make(map[string]string),
+		teardowns:       make(map[string]bool),
 	}
 
 	_, err := services.GetOrgManager()
@@ -390,6 +404,7 @@ func NewClientOrgManager(
 
 		orgs:            make(map[string]*OrgContext),
 		org_id_by_nonce: make(map[string]string),
+		teardowns:       make(map[string]bool),
 	}
 
 	_, err := services.GetOrgManager()
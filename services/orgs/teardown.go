@@ -0,0 +1,345 @@
+package orgs
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/filestore"
+	"www.velocidex.com/golang/cloudvelo/schema"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+/*
+  Removing an org's data takes a long time: the org may have millions
+  of objects in the bucket. The org is therefore removed from the org
+  list immediately and the rest of its data is torn down in the
+  background, one stage at a time:
+
+  1. All the objects under orgs/<org_id>/ are removed from the bucket.
+  2. The org's scheduler jobs and results are removed from the root
+     org's persisted index.
+  3. The org's indexes are dropped.
+  4. The org's placement record is removed. This must come after the
+     indexes since we need it to find the cluster they live on.
+
+  Progress is recorded in a teardown record in the root org's
+  persisted index so if the server is restarted, the teardown resumes
+  from the last stage that was not completed. Every stage may safely
+  be repeated.
+
+  The teardown runs in the process which deleted the org and updates
+  its record as it goes. Interrupted teardowns are picked up by the
+  foreman only (there is a single foreman in the deployment), and
+  only once their record was not updated for TEARDOWN_STALE_TIME, so
+  a teardown is not run by several frontends at once.
+*/
+
+const (
+	TEARDOWN_FILESTORE = "filestore"
+	TEARDOWN_SCHEDULER = "scheduler"
+	TEARDOWN_INDEXES   = "indexes"
+	TEARDOWN_PLACEMENT = "placement"
+	TEARDOWN_DONE      = "done"
+
+	// How long to wait before retrying a failed stage.
+	TEARDOWN_RETRY_TIME = time.Minute
+
+	// A teardown whose record was not updated for this long was
+	// abandoned by the process running it.
+	TEARDOWN_STALE_TIME = 10 * time.Minute
+
+	// How often the foreman looks for abandoned teardowns.
+	TEARDOWN_CHECK_PERIOD = 5 * time.Minute
+
+	pendingTeardownsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"doc_type" : "org_teardown"}}
+      ],
+      "must_not": [
+         {"match": {"state" : "done"}}
+      ]}
+  },
+  "size": 10000
+}
+`
+	schedulerJobsQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"org_id" : %q}},
+         {"terms": {"type" : ["scheduler", "scheduler_result"]}}
+      ]}
+  }
+}
+`
+)
+
+type OrgTeardownRecord struct {
+	OrgId     string `json:"org_id"`
+	Principal string `json:"username"`
+	Stage     string `json:"state"`
+	DocType   string `json:"doc_type"` // "org_teardown"
+	Timestamp int64  `json:"timestamp"`
+	Started   int64  `json:"started"`
+
+	// Number of objects removed from the bucket so far.
+	Objects int `json:"objects"`
+
+	// The last error encountered.
+	Error string `json:"error,omitempty"`
+}
+
+func teardownDocId(org_id string) string {
+	return org_id + "_teardown"
+}
+
+func (self *OrgManager) setTeardownRecord(
+	ctx context.Context, record *OrgTeardownRecord) error {
+	record.Timestamp = utils.GetTime().Now().Unix()
+	return cvelo_services.SetElasticIndex(ctx,
+		services.ROOT_ORG_ID, cvelo_services.PERSISTED,
+		teardownDocId(record.OrgId), record)
+}
+
+// Start tearing down the org's data in the background. Does nothing
+// if the org is already being torn down.
+func (self *OrgManager) startTeardown(record *OrgTeardownRecord) {
+	self.mu.Lock()
+	if self.teardowns[record.OrgId] {
+		self.mu.Unlock()
+		return
+	}
+	self.teardowns[record.OrgId] = true
+	self.mu.Unlock()
+
+	self.wg.Add(1)
+	go func() {
+		defer self.wg.Done()
+		defer func() {
+			self.mu.Lock()
+			delete(self.teardowns, record.OrgId)
+			self.mu.Unlock()
+		}()
+
+		self.runTeardown(self.ctx, record)
+	}()
+}
+
+// Teardowns which are not finished and were not updated for
+// TEARDOWN_STALE_TIME.
+func (self *OrgManager) staleTeardowns(
+	ctx context.Context) ([]*OrgTeardownRecord, error) {
+	hits, _, err := cvelo_services.QueryElasticRaw(ctx,
+		services.ROOT_ORG_ID, cvelo_services.PERSISTED,
+		pendingTeardownsQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := utils.GetTime().Now().Add(-TEARDOWN_STALE_TIME).Unix()
+
+	var result []*OrgTeardownRecord
+	for _, hit := range hits {
+		record := &OrgTeardownRecord{}
+		err = json.Unmarshal(hit, record)
+		if err != nil || record.OrgId == "" ||
+			utils.IsRootOrg(record.OrgId) ||
+			record.Timestamp > cutoff {
+			continue
+		}
+		result = append(result, record)
+	}
+	return result, nil
+}
+
+// Resume any teardowns which were interrupted by a restart.
+func (self *OrgManager) resumeTeardowns(ctx context.Context) error {
+	records, err := self.staleTeardowns(ctx)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+	for _, record := range records {
+		logger.Info("Resuming teardown of org %v from stage %v",
+			record.OrgId, record.Stage)
+		self.startTeardown(record)
+	}
+	return nil
+}
+
+// Runs on the foreman to resume interrupted teardowns.
+func StartOrgTeardownService(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *config.Config) error {
+
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return err
+	}
+
+	manager, ok := org_manager.(*OrgManager)
+	if !ok {
+		return errors.New("StartOrgTeardownService: Unsupported org manager")
+	}
+
+	logger := logging.GetLogger(config_obj.VeloConf(), &logging.FrontendComponent)
+	logger.Info("<green>Starting</> Org Teardown Service")
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			err := manager.resumeTeardowns(ctx)
+			if err != nil {
+				logger.Error("OrgTeardownService: %v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-time.After(TEARDOWN_CHECK_PERIOD):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (self *OrgManager) runTeardown(
+	ctx context.Context, record *OrgTeardownRecord) {
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+	for record.Stage != TEARDOWN_DONE {
+		err := self.runTeardownStage(ctx, record)
+		if err != nil {
+			logger.Error("Teardown of org %v failed in stage %v: %v",
+				record.OrgId, record.Stage, err)
+
+			// Remember the error so it is visible in the record.
+			record.Error = err.Error()
+			_ = self.setTeardownRecord(ctx, record)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(TEARDOWN_RETRY_TIME):
+				continue
+			}
+		}
+
+		record.Error = ""
+		err = self.setTeardownRecord(ctx, record)
+		if err != nil {
+			logger.Error("Teardown of org %v: %v", record.OrgId, err)
+		}
+	}
+
+	logger = logging.GetLogger(self.config_obj, &logging.Audit)
+	if logger != nil {
+		logger.Info("Deleted organization: %v (requested by %v, %v objects removed)",
+			record.OrgId, record.Principal, record.Objects)
+	}
+}
+
+// Run the current stage and advance the record to the next stage.
+func (self *OrgManager) runTeardownStage(
+	ctx context.Context, record *OrgTeardownRecord) error {
+	switch record.Stage {
+	case TEARDOWN_FILESTORE:
+		err := self.deleteOrgFiles(ctx, record)
+		if err != nil {
+			return err
+		}
+		record.Stage = TEARDOWN_SCHEDULER
+
+	case TEARDOWN_SCHEDULER:
+		reporter := cvelo_services.NewDeleteReporter(
+			ctx, services.ROOT_ORG_ID, true)
+		reporter.DeleteWithQuery("SchedulerJobs", cvelo_services.PERSISTED,
+			json.Format(schedulerJobsQuery, record.OrgId),
+			ordereddict.NewDict().Set("org_id", record.OrgId))
+
+		for _, response := range reporter.Responses() {
+			if response.Error != "" {
+				return errors.New(response.Error)
+			}
+		}
+		record.Stage = TEARDOWN_INDEXES
+
+	case TEARDOWN_INDEXES:
+		err := schema.Delete(ctx, self.config_obj,
+			record.OrgId, services.ROOT_ORG_ID)
+		if err != nil {
+			return err
+		}
+		record.Stage = TEARDOWN_PLACEMENT
+
+	case TEARDOWN_PLACEMENT:
+		err := cvelo_services.DeleteOrgPlacement(ctx, record.OrgId)
+		if err != nil {
+			return err
+		}
+		record.Stage = TEARDOWN_DONE
+
+	default:
+		// Unknown stages come from a newer version - start again.
+		record.Stage = TEARDOWN_FILESTORE
+	}
+
+	return nil
+}
+
+// Remove everything under the org's prefix in the bucket. Objects
+// are removed a page at a time and progress is recorded after each
+// page. Nothing is remembered about the pages already done: removed
+// objects simply do not appear again when the prefix is listed.
+func (self *OrgManager) deleteOrgFiles(
+	ctx context.Context, record *OrgTeardownRecord) error {
+
+	file_store_obj := file_store.GetFileStore(self.config_obj)
+	if file_store_obj == nil {
+		return errors.New("Filestore not configured")
+	}
+
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+	prefix := orgPrefix(record.OrgId)
+
+	var delete_err error
+	count := 0
+	err := filestore.DeletePrefix(ctx, file_store_obj, prefix, true,
+		func(key string, err error) {
+			if err != nil {
+				logger.Error("Teardown of org %v: Removing %v: %v",
+					record.OrgId, key, err)
+				delete_err = err
+				return
+			}
+
+			record.Objects++
+			count++
+			if count%1000 == 0 {
+				_ = self.setTeardownRecord(ctx, record)
+			}
+		})
+	if err != nil {
+		return err
+	}
+	return delete_err
+}
@@ -0,0 +1,100 @@
+package orgs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/orgs"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+	"www.velocidex.com/golang/velociraptor/vtesting"
+)
+
+const DELETED_ORG = "O.Deleted"
+
+type TeardownTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *TeardownTestSuite) getTeardownRecord() *orgs.OrgTeardownRecord {
+	serialized, err := cvelo_services.GetElasticRecord(self.Ctx,
+		services.ROOT_ORG_ID, cvelo_services.PERSISTED,
+		DELETED_ORG+"_teardown")
+	assert.NoError(self.T(), err)
+
+	record := &orgs.OrgTeardownRecord{}
+	err = json.Unmarshal(serialized, record)
+	assert.NoError(self.T(), err)
+	return record
+}
+
+func (self *TeardownTestSuite) TestResumeStaleTeardowns() {
+	now := time.Unix(1661391000, 0)
+	closer := utils.MockTime(utils.NewMockClock(now))
+	defer closer()
+
+	org_manager, err := services.GetOrgManager()
+	assert.NoError(self.T(), err)
+
+	manager, ok := org_manager.(*orgs.OrgManager)
+	assert.True(self.T(), ok)
+
+	err = manager.SetTeardownRecordForTests(self.Ctx, &orgs.OrgTeardownRecord{
+		OrgId:   DELETED_ORG,
+		Stage:   orgs.TEARDOWN_PLACEMENT,
+		DocType: "org_teardown",
+		Started: now.Unix(),
+	})
+	assert.NoError(self.T(), err)
+
+	// A teardown which was just updated is still running in the
+	// process which deleted the org so it is left alone.
+	stale, err := manager.StaleTeardownsForTests(self.Ctx)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(stale))
+
+	err = manager.ResumeTeardownsForTests(self.Ctx)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), orgs.TEARDOWN_PLACEMENT,
+		self.getTeardownRecord().Stage)
+
+	// Once the record is not updated for a while the teardown was
+	// abandoned and is resumed.
+	closer = utils.MockTime(utils.NewMockClock(
+		now.Add(orgs.TEARDOWN_STALE_TIME + time.Minute)))
+	defer closer()
+
+	stale, err = manager.StaleTeardownsForTests(self.Ctx)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(stale))
+	assert.Equal(self.T(), DELETED_ORG, stale[0].OrgId)
+
+	err = manager.ResumeTeardownsForTests(self.Ctx)
+	assert.NoError(self.T(), err)
+
+	vtesting.WaitUntil(5*time.Second, self.T(), func() bool {
+		return self.getTeardownRecord().Stage == orgs.TEARDOWN_DONE
+	})
+
+	// Finished teardowns are never resumed.
+	closer = utils.MockTime(utils.NewMockClock(
+		now.Add(2 * (orgs.TEARDOWN_STALE_TIME + time.Minute))))
+	defer closer()
+
+	stale, err = manager.StaleTeardownsForTests(self.Ctx)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(stale))
+}
+
+func TestTeardown(t *testing.T) {
+	suite.Run(t, &TeardownTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
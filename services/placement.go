@@ -0,0 +1,345 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// Orgs may be spread over any number of named OpenSearch clusters.
+// The cluster each org lives on is recorded in the placement table,
+// stored in the root org's persisted index. The root org always
+// lives on the primary cluster.
+const (
+	PRIMARY_CLUSTER   = "primary"
+	SECONDARY_CLUSTER = "secondary"
+
+	// How long we remember an org's placement before checking the
+	// table again.
+	PLACEMENT_CACHE_TIME = time.Minute
+
+	placementQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"doc_type" : "org_placement"}}
+      ]}
+  }
+}
+`
+)
+
+var (
+	placement_mu    sync.Mutex
+	placement_cache = make(map[string]placementCacheEntry)
+
+	// New orgs are placed on this cluster.
+	default_cluster = PRIMARY_CLUSTER
+
+	ClusterNotConfiguredError = errors.New("OpenSearch cluster not configured")
+)
+
+type OrgPlacement struct {
+	OrgId   string `json:"org_id"`
+	Cluster string `json:"cluster"`
+
+	// While the org is migrated to another cluster, writes go to
+	// both clusters.
+	MigratingTo string `json:"migrating_to,omitempty"`
+
+	DocType   string `json:"doc_type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+// Placement records were first written with the org id and cluster
+// in the name and type fields.
+type legacyOrgPlacement struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+func parseOrgPlacement(serialized []byte) (*OrgPlacement, error) {
+	record := &OrgPlacement{}
+	err := json.Unmarshal(serialized, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.OrgId == "" && record.Cluster == "" {
+		legacy := &legacyOrgPlacement{}
+		err = json.Unmarshal(serialized, legacy)
+		if err != nil {
+			return nil, err
+		}
+		record.OrgId = legacy.Name
+		record.Cluster = legacy.Type
+	}
+	return record, nil
+}
+
+type placementCacheEntry struct {
+	cluster      string
+	migrating_to string
+	expires      time.Time
+}
+
+func placementDocId(org_id string) string {
+	return org_id + "_placement"
+}
+
+// Orgs without an entry in the placement table fall back to the
+// static PrimaryOrgs list: orgs not on the list live on the
+// secondary cluster.
+func legacyPlacement(org_id string) string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	_, has_secondary := elasticClients[SECONDARY_CLUSTER]
+	if has_secondary && len(primary_orgs) > 0 && !primary_orgs[org_id] {
+		return SECONDARY_CLUSTER
+	}
+	return default_cluster
+}
+
+// Get the name of the cluster the org lives on.
+func GetOrgCluster(ctx context.Context, org_id string) (string, error) {
+	placement, err := getOrgPlacement(ctx, org_id)
+	if err != nil {
+		return "", err
+	}
+	return placement.cluster, nil
+}
+
+func getOrgPlacement(
+	ctx context.Context, org_id string) (placementCacheEntry, error) {
+	if utils.IsRootOrg(org_id) {
+		return placementCacheEntry{cluster: PRIMARY_CLUSTER}, nil
+	}
+
+	now := utils.GetTime().Now()
+
+	placement_mu.Lock()
+	cached, pres := placement_cache[org_id]
+	placement_mu.Unlock()
+
+	if pres && now.Before(cached.expires) {
+		return cached, nil
+	}
+
+	result := placementCacheEntry{
+		expires: now.Add(PLACEMENT_CACHE_TIME),
+	}
+	serialized, err := GetElasticRecord(ctx, "root", PERSISTED,
+		placementDocId(org_id))
+	switch {
+	case err == nil:
+		record, err := parseOrgPlacement(serialized)
+		if err != nil {
+			return result, err
+		}
+		result.cluster = record.Cluster
+		result.migrating_to = record.MigratingTo
+
+	case errors.Is(err, os.ErrNotExist):
+		result.cluster = legacyPlacement(org_id)
+
+	default:
+		// Keep using the old placement if the table is not
+		// available right now.
+		if pres {
+			return cached, nil
+		}
+		return result, err
+	}
+
+	placement_mu.Lock()
+	placement_cache[org_id] = result
+	placement_mu.Unlock()
+
+	return result, nil
+}
+
+// Record the cluster the org lives on.
+func SetOrgPlacement(ctx context.Context, org_id, cluster string) error {
+	return setOrgPlacement(ctx, org_id, cluster, "")
+}
+
+func setOrgPlacement(
+	ctx context.Context, org_id, cluster, migrating_to string) error {
+	if utils.IsRootOrg(org_id) {
+		return errors.New("The root org always lives on the primary cluster")
+	}
+
+	_, err := GetElasticClientByName(cluster)
+	if err != nil {
+		return err
+	}
+
+	err = SetElasticIndex(ctx, "root", PERSISTED, placementDocId(org_id),
+		&OrgPlacement{
+			OrgId:       org_id,
+			Cluster:     cluster,
+			MigratingTo: migrating_to,
+			DocType:     "org_placement",
+			Timestamp:   utils.GetTime().Now().Unix(),
+		})
+	if err != nil {
+		return err
+	}
+
+	placement_mu.Lock()
+	delete(placement_cache, org_id)
+	placement_mu.Unlock()
+
+	return nil
+}
+
+// Place a new org on the default cluster unless it is already placed.
+func PlaceNewOrg(ctx context.Context, org_id string) error {
+	// Other backends have no clusters to place the org on.
+	if utils.IsRootOrg(org_id) || !UsingOpenSearch() {
+		return nil
+	}
+
+	_, err := GetElasticRecord(ctx, "root", PERSISTED, placementDocId(org_id))
+	if err == nil {
+		return nil
+	}
+
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	return SetOrgPlacement(ctx, org_id, legacyPlacement(org_id))
+}
+
+// Remove the org's placement record. This must only be done once the
+// org's indexes are gone since they can not be found without it.
+func DeleteOrgPlacement(ctx context.Context, org_id string) error {
+	if utils.IsRootOrg(org_id) {
+		return errors.New("The root org always lives on the primary cluster")
+	}
+
+	if !UsingOpenSearch() {
+		return nil
+	}
+
+	err := DeleteDocument(ctx, "root", PERSISTED, placementDocId(org_id),
+		SyncDelete)
+	if err != nil {
+		return err
+	}
+
+	placement_mu.Lock()
+	delete(placement_cache, org_id)
+	placement_mu.Unlock()
+
+	return nil
+}
+
+// Returns a mapping of org id to cluster name for all orgs in the
+// placement table.
+func ListOrgPlacements(
+	ctx context.Context,
+	config_obj *config_proto.Config) (map[string]string, error) {
+	hits, err := QueryChan(ctx, config_obj, 1000, "root", PERSISTED,
+		placementQuery, "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for hit := range hits {
+		record, err := parseOrgPlacement(hit)
+		if err != nil || record.OrgId == "" {
+			continue
+		}
+		result[record.OrgId] = record.Cluster
+	}
+	return result, nil
+}
+
+// While an org is migrating, writes also go to the cluster it is
+// migrating to. Returns nil if the org is not migrating.
+func getMigrationClient(org_id string) (*opensearch.Client, error) {
+	placement, err := getOrgPlacement(context.Background(), org_id)
+	if err != nil || placement.migrating_to == "" {
+		return nil, err
+	}
+	return GetElasticClientByName(placement.migrating_to)
+}
+
+// The clients of the org's cluster and, while the org is migrating,
+// of the cluster it migrates to.
+func getWriteClients(org_id string) ([]*opensearch.Client, error) {
+	client, err := GetElasticClient(org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	migration_client, err := getMigrationClient(org_id)
+	if err != nil {
+		return nil, err
+	}
+
+	if migration_client == nil {
+		return []*opensearch.Client{client}, nil
+	}
+	return []*opensearch.Client{client, migration_client}, nil
+}
+
+// Call the write operation on the org's cluster and, while the org is
+// migrating, on the cluster it migrates to.
+func forEachWriteClient(org_id string,
+	cb func(client *opensearch.Client, is_migration_target bool) error) error {
+	clients, err := getWriteClients(org_id)
+	if err != nil {
+		return err
+	}
+
+	for i, client := range clients {
+		err = cb(client, i > 0)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The names of all configured clusters.
+func ListClusters() []string {
+	mu.Lock()
+	defer mu.Unlock()
+
+	result := make([]string, 0, len(elasticClients))
+	for name := range elasticClients {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func GetElasticClientByName(cluster string) (*opensearch.Client, error) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if len(elasticClients) == 0 {
+		return nil, ElasticConfigurationNotInitializedError
+	}
+
+	res, pres := elasticClients[cluster]
+	if !pres {
+		return nil, fmt.Errorf("%w: %v", ClusterNotConfiguredError, cluster)
+	}
+	return res, nil
+}
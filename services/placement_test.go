@@ -0,0 +1,72 @@
+package services_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Velocidex/ordereddict"
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+)
+
+type PlacementTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *PlacementTestSuite) TestOrgPlacement() {
+	// The root org always lives on the primary cluster.
+	cluster, err := cvelo_services.GetOrgCluster(self.Ctx, "root")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER, cluster)
+
+	// New orgs are placed on the default cluster.
+	placements, err := cvelo_services.ListOrgPlacements(
+		self.Ctx, self.ConfigObj.VeloConf())
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER,
+		placements[self.ConfigObj.OrgId])
+
+	cluster, err = cvelo_services.GetOrgCluster(self.Ctx, self.ConfigObj.OrgId)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER, cluster)
+
+	// Orgs can only be placed on configured clusters.
+	err = cvelo_services.SetOrgPlacement(
+		self.Ctx, self.ConfigObj.OrgId, "nosuchcluster")
+	assert.True(self.T(), errors.Is(err,
+		cvelo_services.ClusterNotConfiguredError))
+}
+
+// Placement records written by older releases are still honoured.
+func (self *PlacementTestSuite) TestLegacyOrgPlacement() {
+	err := cvelo_services.SetElasticIndex(self.Ctx, "root",
+		cvelo_services.PERSISTED, "O.Legacy_placement",
+		ordereddict.NewDict().
+			Set("name", "O.Legacy").
+			Set("type", cvelo_services.PRIMARY_CLUSTER).
+			Set("doc_type", "org_placement"))
+	assert.NoError(self.T(), err)
+
+	placements, err := cvelo_services.ListOrgPlacements(
+		self.Ctx, self.ConfigObj.VeloConf())
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER,
+		placements["O.Legacy"])
+
+	cluster, err := cvelo_services.GetOrgCluster(self.Ctx, "O.Legacy")
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), cvelo_services.PRIMARY_CLUSTER, cluster)
+
+	err = cvelo_services.DeleteOrgPlacement(self.Ctx, "O.Legacy")
+	assert.NoError(self.T(), err)
+}
+
+func TestPlacement(t *testing.T) {
+	suite.Run(t, &PlacementTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
@@ -0,0 +1,88 @@
+package services_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/json"
+)
+
+const queryChanTestQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"doc_type" : "query_chan_test"}}
+      ]}
+  }
+}
+`
+
+type testRecord struct {
+	Name      string `json:"name"`
+	DocType   string `json:"doc_type"`
+	Timestamp int64  `json:"timestamp"`
+}
+
+type QueryChanTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *QueryChanTestSuite) TestPagingWithDuplicateSortValues() {
+	org_id := self.ConfigObj.OrgId
+
+	// Many rows share the same sort value so page boundaries fall
+	// in the middle of a run of equal values.
+	for i := 0; i < 25; i++ {
+		err := cvelo_services.SetElasticIndex(self.Ctx, org_id,
+			cvelo_services.PERSISTED, fmt.Sprintf("query_chan_%02d", i),
+			&testRecord{
+				Name:      fmt.Sprintf("Row%02d", i),
+				DocType:   "query_chan_test",
+				Timestamp: int64(i / 5),
+			})
+		assert.NoError(self.T(), err)
+	}
+
+	for _, sort_field := range []string{"timestamp", ">timestamp"} {
+		hits, err := cvelo_services.QueryChan(self.Ctx,
+			self.ConfigObj.VeloConf(), 10, org_id,
+			cvelo_services.PERSISTED, queryChanTestQuery, sort_field)
+		assert.NoError(self.T(), err)
+
+		seen := make(map[string]bool)
+		var timestamps []int64
+		for hit := range hits {
+			record := &testRecord{}
+			err = json.Unmarshal(hit, record)
+			assert.NoError(self.T(), err)
+
+			assert.False(self.T(), seen[record.Name], "Duplicate %v", record.Name)
+			seen[record.Name] = true
+			timestamps = append(timestamps, record.Timestamp)
+		}
+
+		assert.Equal(self.T(), 25, len(seen))
+
+		// The sort direction is kept across pages.
+		for i := 1; i < len(timestamps); i++ {
+			if sort_field[0] == '>' {
+				assert.True(self.T(), timestamps[i-1] >= timestamps[i])
+			} else {
+				assert.True(self.T(), timestamps[i-1] <= timestamps[i])
+			}
+		}
+	}
+}
+
+func TestQueryChan(t *testing.T) {
+	suite.Run(t, &QueryChanTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted"},
+		},
+	})
+}
@@ -1,29 +1,271 @@
 package services
 
 import (
-	"regexp"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"syscall"
 	"time"
+
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
 )
 
-// Retry calls to the backend
+// Retry calls to the backend.
+//
+// All requests to OpenSearch go through a retryTransport which
+// retries requests that failed because the cluster was overloaded or
+// unavailable, and a circuitBreaker which fails requests fast while
+// the cluster is down. Operations which fail for other reasons
+// (e.g. version conflicts) can be retried with retry().
 
 var (
-	retriableErrors = regexp.MustCompile("version conflict")
+	DefaultRetryPolicy = RetryPolicy{
+		MaxAttempts:  5,
+		InitialDelay: 100 * time.Millisecond,
+		MaxDelay:     10 * time.Second,
+	}
+
+	// The policy used by retry(), set from the config when the
+	// service starts.
+	retry_policy = DefaultRetryPolicy
 )
 
-func retry(cb func() error) (err error) {
-	for i := 0; i < 10; i++ {
+type RetryPolicy struct {
+	// Total number of attempts including the first.
+	MaxAttempts  int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+}
+
+func retryPolicyFromConfig(config_obj *cloud_velo_config.Config) RetryPolicy {
+	policy := DefaultRetryPolicy
+	if config_obj.Cloud.RetryAttempts > 0 {
+		policy.MaxAttempts = config_obj.Cloud.RetryAttempts
+	}
+	return policy
+}
+
+// Full jitter exponential backoff: a random delay up to
+// InitialDelay * 2^attempt, capped at MaxDelay.
+func (self RetryPolicy) Backoff(attempt int) time.Duration {
+	ceiling := self.MaxDelay
+	if attempt < 30 {
+		delay := self.InitialDelay << uint(attempt)
+		if delay > 0 && delay < ceiling {
+			ceiling = delay
+		}
+	}
+
+	if ceiling <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(ceiling))) + 1
+}
+
+// Wait for the backoff delay. Returns false if the context is done
+// or its deadline would pass before the delay is over - there is no
+// point retrying then.
+func (self RetryPolicy) wait(ctx context.Context, attempt int) bool {
+	delay := self.Backoff(attempt)
+
+	deadline, ok := ctx.Deadline()
+	if ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(delay):
+		return true
+	}
+}
+
+func setRetryPolicy(policy RetryPolicy) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	retry_policy = policy
+}
+
+// Retry the operation while it fails with a version conflict.
+func retry(ctx context.Context, cb func() error) (err error) {
+	mu.Lock()
+	policy := retry_policy
+	mu.Unlock()
+
+	for i := 0; i < policy.MaxAttempts; i++ {
+		if i > 0 && !policy.wait(ctx, i-1) {
+			return err
+		}
+
 		err = cb()
 		if err == nil {
 			return err
 		}
 
-		if !retriableErrors.MatchString(err.Error()) {
+		if !errors.Is(err, VersionConflictError) {
 			return err
 		}
-
-		time.Sleep(time.Second)
 	}
 
 	return err
 }
+
+// Status codes that mean the cluster rejected the request without
+// running it, because it is overloaded or not available right
+// now. Other errors will not go away by retrying, and a gateway error
+// does not tell us if the request ran.
+func isRetryableResponse(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests,
+		http.StatusServiceUnavailable:
+		return true
+	}
+	return false
+}
+
+// Only responses indicating the cluster is unreachable count against
+// the circuit breaker. An overloaded cluster is still up.
+func isUnavailableResponse(status int) bool {
+	switch status {
+	case http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func isNetworkError(err error) bool {
+	if errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+
+	var net_err net.Error
+	return errors.As(err, &net_err)
+}
+
+// A network error may happen after the cluster ran the request so
+// only requests which can safely run twice are retried. A refused
+// connection never reached the cluster.
+func isRetryableNetworkError(req *http.Request, err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	return isIdempotentRequest(req) && isNetworkError(err)
+}
+
+// Searches are sent as POST but do not change anything.
+func isIdempotentRequest(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return true
+	case http.MethodPost:
+		for _, suffix := range []string{
+			"/_search", "/_search/scroll", "/_count", "/_mget"} {
+			if strings.HasSuffix(req.URL.Path, suffix) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Wraps the HTTP transport of an OpenSearch client.
+type retryTransport struct {
+	cluster   string
+	transport http.RoundTripper
+	policy    RetryPolicy
+	breaker   *circuitBreaker
+}
+
+func (self *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+
+	for attempt := 0; ; attempt++ {
+		err := self.breaker.Allow()
+		if err != nil {
+			return nil, err
+		}
+
+		// The first attempt consumes the body so we need a fresh
+		// copy to try again. The caller's request must not be
+		// modified.
+		attempt_req := req
+		if attempt > 0 && req.Body != nil && req.Body != http.NoBody {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			attempt_req = req.Clone(ctx)
+			attempt_req.Body = body
+		}
+
+		res, err := self.transport.RoundTrip(attempt_req)
+
+		var retryable bool
+		switch {
+		case err != nil:
+			// The caller gave up - this says nothing about the
+			// cluster.
+			if ctx.Err() != nil {
+				self.breaker.Release()
+				return nil, err
+			}
+			if isNetworkError(err) {
+				self.breaker.Failure()
+			} else {
+				self.breaker.Success()
+			}
+			retryable = isRetryableNetworkError(req, err)
+
+		case isUnavailableResponse(res.StatusCode):
+			retryable = isRetryableResponse(res.StatusCode)
+			self.breaker.Failure()
+
+		default:
+			retryable = isRetryableResponse(res.StatusCode)
+			self.breaker.Success()
+		}
+
+		if !retryable || attempt+1 >= self.policy.MaxAttempts ||
+			!self.canReplay(req) {
+			return res, err
+		}
+
+		if !self.policy.wait(ctx, attempt) {
+			return res, err
+		}
+
+		OpensearchRetryCounter.WithLabelValues(self.cluster).Inc()
+
+		if res != nil {
+			io.Copy(ioutil.Discard, res.Body)
+			res.Body.Close()
+		}
+	}
+}
+
+func (self *retryTransport) canReplay(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+func newRetryTransport(
+	cluster string, transport http.RoundTripper,
+	config_obj *cloud_velo_config.Config) *retryTransport {
+	return &retryTransport{
+		cluster:   cluster,
+		transport: transport,
+		policy:    retryPolicyFromConfig(config_obj),
+		breaker:   newCircuitBreaker(cluster, config_obj),
+	}
+}
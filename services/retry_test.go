@@ -0,0 +1,197 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+type mockRoundTripper struct {
+	statuses []int
+	bodies   []string
+
+	// Returned before the statuses.
+	errors []error
+}
+
+func (self *mockRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		data, _ := ioutil.ReadAll(req.Body)
+		self.bodies = append(self.bodies, string(data))
+	}
+
+	if len(self.errors) > 0 {
+		err := self.errors[0]
+		self.errors = self.errors[1:]
+		return nil, err
+	}
+
+	status := http.StatusOK
+	if len(self.statuses) > 0 {
+		status = self.statuses[0]
+		self.statuses = self.statuses[1:]
+	}
+
+	return &http.Response{
+		StatusCode: status,
+		Body:       ioutil.NopCloser(strings.NewReader("{}")),
+	}, nil
+}
+
+func newTestTransport(mock *mockRoundTripper) *retryTransport {
+	config_obj := &cloud_velo_config.Config{}
+	config_obj.Cloud.CircuitBreakerThreshold = 3
+
+	transport := newRetryTransport("test", mock, config_obj)
+	transport.policy.InitialDelay = time.Millisecond
+	transport.policy.MaxDelay = time.Millisecond
+	return transport
+}
+
+func TestRetryTransport(t *testing.T) {
+	mock := &mockRoundTripper{
+		statuses: []int{http.StatusTooManyRequests,
+			http.StatusServiceUnavailable},
+	}
+	transport := newTestTransport(mock)
+
+	req, err := http.NewRequest("POST", "http://localhost/_doc", strings.NewReader("body"))
+	assert.NoError(t, err)
+	body := req.Body
+
+	// Requests the cluster rejected are retried with the same body.
+	res, err := transport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, []string{"body", "body", "body"}, mock.bodies)
+
+	// The caller's request is not modified.
+	assert.True(t, body == req.Body)
+
+	// Other errors are returned immediately.
+	for _, status := range []int{
+		http.StatusBadRequest, http.StatusBadGateway} {
+		mock.statuses = []int{status}
+		mock.bodies = nil
+		res, err = transport.RoundTrip(req)
+		assert.NoError(t, err)
+		assert.Equal(t, status, res.StatusCode)
+		assert.Equal(t, 1, len(mock.bodies))
+	}
+
+	// We do not retry past the context deadline.
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	mock.statuses = []int{http.StatusServiceUnavailable}
+	res, err = transport.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, http.StatusServiceUnavailable, res.StatusCode)
+}
+
+// The cluster may have run the request before the connection broke
+// so only requests which can run twice are retried.
+func TestRetryNetworkErrors(t *testing.T) {
+	mock := &mockRoundTripper{}
+	transport := newTestTransport(mock)
+
+	req, err := http.NewRequest("POST", "http://localhost/index/_doc",
+		strings.NewReader("body"))
+	assert.NoError(t, err)
+
+	mock.errors = []error{io.ErrUnexpectedEOF}
+	_, err = transport.RoundTrip(req)
+	assert.True(t, errors.Is(err, io.ErrUnexpectedEOF))
+	assert.Equal(t, 1, len(mock.bodies))
+
+	// The connection was refused so the request never ran.
+	mock.errors = []error{syscall.ECONNREFUSED}
+	mock.bodies = nil
+	res, err := transport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, len(mock.bodies))
+
+	// Searches are safe to retry.
+	req, err = http.NewRequest("POST", "http://localhost/index/_search",
+		strings.NewReader("body"))
+	assert.NoError(t, err)
+
+	mock.errors = []error{io.ErrUnexpectedEOF}
+	mock.bodies = nil
+	res, err = transport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, 2, len(mock.bodies))
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	closer := utils.MockTime(utils.NewMockClock(time.Unix(1661391000, 0)))
+	defer closer()
+
+	mock := &mockRoundTripper{}
+	transport := newTestTransport(mock)
+	transport.policy.MaxAttempts = 1
+
+	req, err := http.NewRequest("GET", "http://localhost/", nil)
+	assert.NoError(t, err)
+
+	// Too many requests does not trip the breaker.
+	for i := 0; i < 5; i++ {
+		mock.statuses = []int{http.StatusTooManyRequests}
+		transport.RoundTrip(req)
+	}
+	assert.Equal(t, CIRCUIT_CLOSED, transport.breaker.State())
+
+	// The cluster is down.
+	for i := 0; i < 3; i++ {
+		mock.statuses = []int{http.StatusServiceUnavailable}
+		transport.RoundTrip(req)
+	}
+	assert.Equal(t, CIRCUIT_OPEN, transport.breaker.State())
+
+	// Requests fail fast without reaching the cluster.
+	mock.bodies = nil
+	_, err = transport.RoundTrip(req)
+	assert.True(t, errors.Is(err, CircuitOpenError))
+
+	// After the reset time a probe is let through and closes the
+	// circuit when it succeeds.
+	closer = utils.MockTime(utils.NewMockClock(
+		time.Unix(1661391000, 0).Add(DEFAULT_CIRCUIT_BREAKER_RESET)))
+	defer closer()
+
+	res, err := transport.RoundTrip(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, CIRCUIT_CLOSED, transport.breaker.State())
+}
+
+// Version conflicts are retried as often as the config allows.
+func TestRetryPolicy(t *testing.T) {
+	config_obj := &cloud_velo_config.Config{}
+	config_obj.Cloud.RetryAttempts = 2
+
+	policy := retryPolicyFromConfig(config_obj)
+	policy.InitialDelay = time.Millisecond
+	policy.MaxDelay = time.Millisecond
+	setRetryPolicy(policy)
+	defer setRetryPolicy(DefaultRetryPolicy)
+
+	calls := 0
+	err := retry(context.Background(), func() error {
+		calls++
+		return VersionConflictError
+	})
+	assert.True(t, errors.Is(err, VersionConflictError))
+	assert.Equal(t, 2, calls)
+}
@@ -54,6 +54,9 @@ type SchedulerResponseRecord struct {
 	Type      string `json:"type"` // "scheduler_result"
 	Data      string `json:"data"`
 	Error     string `json:"state"`
+
+	// Kept so the results can be removed with the org.
+	OrgId string `json:"org_id"`
 }
 
 const (
@@ -71,6 +74,21 @@ const (
 }`
 )
 
+const (
+	lease_job_painless = "if (ctx._source.state == 'available') { ctx._source.state = params.id; }"
+)
+
+func leaseJob(doc, params map[string]interface{}) error {
+	if doc["state"] == "available" {
+		doc["state"] = params["id"]
+	}
+	return nil
+}
+
+func init() {
+	cvelo_services.RegisterUpdateScript(lease_job_painless, leaseJob)
+}
+
 type ElasticScheduler struct{}
 
 // Worker loop - check for jobs, then try to lease them
@@ -95,13 +113,13 @@ func (self *ElasticScheduler) getOneJob(ctx context.Context,
 			ctx, org_id, cvelo_services.PERSISTED, doc_id,
 			json.Format(`{
   "script": {
-    "source": "if (ctx._source.state == 'available') { ctx._source.state = params.id; }",
+    "source": %q,
     "lang": "painless",
     "params": {
        "key": %q
     }
   }
-}`, worker_id))
+}`, lease_job_painless, worker_id))
 		// We were unable to lease this id try another.
 		if err != nil {
 			continue
@@ -144,6 +162,7 @@ func (self *ElasticScheduler) jobDone(
 		ID:        request.ID,
 		Type:      "scheduler_result",
 		Data:      result,
+		OrgId:     request.OrgId,
 	}
 
 	if err != nil {
@@ -0,0 +1,81 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Updates are written as painless scripts which only OpenSearch can
+// run. Each script has a Go equivalent, registered next to the
+// script, which other backends run instead. Scripts are looked up by
+// their source so the whitespace does not need to match.
+type UpdateScript func(doc map[string]interface{},
+	params map[string]interface{}) error
+
+var (
+	scripts_mu sync.Mutex
+	scripts    = make(map[string]UpdateScript)
+)
+
+func normalizeScript(source string) string {
+	return strings.Join(strings.Fields(source), " ")
+}
+
+func RegisterUpdateScript(source string, script UpdateScript) {
+	scripts_mu.Lock()
+	defer scripts_mu.Unlock()
+
+	scripts[normalizeScript(source)] = script
+}
+
+func GetUpdateScript(source string) (UpdateScript, error) {
+	scripts_mu.Lock()
+	defer scripts_mu.Unlock()
+
+	script, pres := scripts[normalizeScript(source)]
+	if !pres {
+		return nil, fmt.Errorf("Update script is not supported by this backend: %v",
+			source)
+	}
+	return script, nil
+}
+
+// Documents are decoded with json.Number so large numbers such as
+// nanosecond timestamps stay exact.
+func ScriptInt(value interface{}) int64 {
+	switch t := value.(type) {
+	case json.Number:
+		i, err := t.Int64()
+		if err != nil {
+			f, _ := t.Float64()
+			return int64(f)
+		}
+		return i
+	case float64:
+		return int64(t)
+	case int:
+		return int64(t)
+	case int64:
+		return t
+	case uint64:
+		return int64(t)
+	case string:
+		i, _ := strconv.ParseInt(t, 0, 64)
+		return i
+	}
+	return 0
+}
+
+// A missing field is an empty list.
+func ScriptList(value interface{}) []interface{} {
+	switch t := value.(type) {
+	case []interface{}:
+		return t
+	case nil:
+		return nil
+	}
+	return []interface{}{value}
+}
@@ -0,0 +1,16 @@
+package server_monitoring
+
+// Helpers for the tests in server_monitoring_test.
+
+func (self *ServerMonitoringRunner) TableForTests(
+	org_id string) (*eventTable, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	table, pres := self.tables[org_id]
+	return table, pres
+}
+
+func (self *eventTable) SerializedForTests() string {
+	return self.serialized
+}
@@ -0,0 +1,256 @@
+package server_monitoring
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/config"
+	"www.velocidex.com/golang/cloudvelo/result_sets/timed"
+	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/paths"
+	artifact_paths "www.velocidex.com/golang/velociraptor/paths/artifacts"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+	"www.velocidex.com/golang/velociraptor/vql/acl_managers"
+	"www.velocidex.com/golang/vfilter"
+)
+
+const (
+	// How often to check if the server event tables changed.
+	REFRESH_PERIOD = 30 * time.Second
+)
+
+// The queries of a single org's server event table.
+type eventTable struct {
+	// The serialized table the queries were started from.
+	serialized string
+
+	cancel func()
+	wg     *sync.WaitGroup
+}
+
+func (self *eventTable) Close() {
+	self.cancel()
+	self.wg.Wait()
+}
+
+// Runs the server event artifacts for all orgs. This runs on the
+// foreman only so each query runs exactly once in the deployment.
+type ServerMonitoringRunner struct {
+	mu sync.Mutex
+
+	config_obj *config.Config
+
+	// Keyed by org id
+	tables map[string]*eventTable
+}
+
+func (self *ServerMonitoringRunner) RunOnce(
+	ctx context.Context, wg *sync.WaitGroup) error {
+	org_manager, err := services.GetOrgManager()
+	if err != nil {
+		return err
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for _, org := range org_manager.ListOrgs() {
+		if utils.InString(self.config_obj.Cloud.ForemanExcludedOrgs, org.OrgId) {
+			continue
+		}
+
+		org_config_obj, err := org_manager.GetOrgConfig(org.OrgId)
+		if err != nil {
+			return err
+		}
+
+		err = self.updateOrg(ctx, wg, org_config_obj)
+		if err != nil {
+			logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+			logger.Error("ServerMonitoringRunner: org %v: %v", org.OrgId, err)
+		}
+	}
+
+	return nil
+}
+
+// Restart the org's queries if its event table changed.
+func (self *ServerMonitoringRunner) updateOrg(
+	ctx context.Context, wg *sync.WaitGroup,
+	org_config_obj *config_proto.Config) error {
+
+	table, serialized, err := GetServerMonitoringTable(ctx, org_config_obj)
+	if err != nil {
+		return err
+	}
+
+	existing, pres := self.tables[org_config_obj.OrgId]
+	if pres {
+		if existing.serialized == serialized {
+			return nil
+		}
+		existing.Close()
+		delete(self.tables, org_config_obj.OrgId)
+	}
+
+	compiled, err := compileArtifactCollectorArgs(
+		ctx, org_config_obj, table.Artifacts)
+	if err != nil {
+		return err
+	}
+
+	logger := logging.GetLogger(org_config_obj, &logging.FrontendComponent)
+	logger.Info("ServerMonitoringRunner: Starting server event table for org %v (set by %v): %v",
+		org_config_obj.OrgId, table.Principal, table.Artifacts.Artifacts)
+
+	sub_ctx, cancel := context.WithCancel(ctx)
+	new_table := &eventTable{
+		serialized: serialized,
+		cancel:     cancel,
+		wg:         &sync.WaitGroup{},
+	}
+	self.tables[org_config_obj.OrgId] = new_table
+
+	for _, arg := range compiled {
+		new_table.wg.Add(1)
+		wg.Add(1)
+		go func(arg *actions_proto.VQLCollectorArgs) {
+			defer wg.Done()
+			defer new_table.wg.Done()
+
+			runQuery(sub_ctx, org_config_obj, table.Principal, arg)
+		}(arg)
+	}
+
+	return nil
+}
+
+// Run the event queries with the permissions of the principal who
+// installed them and write their results to the server's timed result
+// sets in the transient index.
+func runQuery(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	principal string,
+	arg *actions_proto.VQLCollectorArgs) {
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+
+	manager, err := services.GetRepositoryManager(config_obj)
+	if err != nil {
+		logger.Error("ServerMonitoringRunner: %v", err)
+		return
+	}
+
+	env := ordereddict.NewDict()
+	for _, env_spec := range arg.Env {
+		env.Set(env_spec.Key, env_spec.Value)
+	}
+
+	builder := services.ScopeBuilder{
+		Config:     config_obj,
+		ACLManager: acl_managers.NewServerACLManager(config_obj, principal),
+		Env:        env,
+		Logger:     logging.NewPlainLogger(config_obj, &logging.FrontendComponent),
+	}
+
+	scope := manager.BuildScope(builder)
+	defer scope.Close()
+
+	for _, query := range arg.Query {
+		vql, err := vfilter.Parse(query.VQL)
+		if err != nil {
+			logger.Error("ServerMonitoringRunner: %v", err)
+			return
+		}
+
+		// Unnamed queries just set up the scope.
+		if query.Name == "" {
+			for range vql.Eval(ctx, scope) {
+			}
+			continue
+		}
+
+		path_manager := artifact_paths.NewArtifactPathManagerWithMode(
+			config_obj, "server", "", query.Name, paths.MODE_SERVER_EVENT)
+
+		rs_writer, err := timed.NewTimedResultSetWriter(
+			config_obj, path_manager, json.DefaultEncOpts(),
+			utils.BackgroundWriter)
+		if err != nil {
+			logger.Error("ServerMonitoringRunner: %v", err)
+			return
+		}
+
+		for row := range vql.Eval(ctx, scope) {
+			rs_writer.Write(vfilter.RowToDict(ctx, scope, row))
+		}
+		rs_writer.Close()
+	}
+}
+
+func (self *ServerMonitoringRunner) Close() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for org_id, table := range self.tables {
+		table.Close()
+		delete(self.tables, org_id)
+	}
+}
+
+func (self *ServerMonitoringRunner) Start(
+	ctx context.Context, wg *sync.WaitGroup) error {
+
+	// Run once inline to trap any errors.
+	err := self.RunOnce(ctx, wg)
+	if err != nil {
+		return err
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer self.Close()
+
+		logger := logging.GetLogger(
+			self.config_obj.VeloConf(), &logging.FrontendComponent)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+
+			case <-utils.GetTime().After(REFRESH_PERIOD):
+				err := self.RunOnce(ctx, wg)
+				if err != nil {
+					logger.Error("ServerMonitoringRunner: %v", err)
+				}
+			}
+		}
+	}()
+
+	return nil
+}
+
+func NewServerMonitoringRunner(
+	config_obj *config.Config) *ServerMonitoringRunner {
+	return &ServerMonitoringRunner{
+		config_obj: config_obj,
+		tables:     make(map[string]*eventTable),
+	}
+}
+
+func StartServerMonitoringService(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *config.Config) error {
+
+	return NewServerMonitoringRunner(config_obj).Start(ctx, wg)
+}
@@ -0,0 +1,182 @@
+package server_monitoring
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+
+	"google.golang.org/protobuf/proto"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/client_monitoring"
+	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/vql/acl_managers"
+)
+
+const (
+	SERVER_MONITORING_DOC_ID = "server_monitoring"
+)
+
+// The server event table is stored in the persisted index. The
+// principal who last updated it is kept alongside so the runner can
+// record who is responsible for the queries.
+type ServerMonitoringTable struct {
+	Principal string                             `json:"principal"`
+	Artifacts *flows_proto.ArtifactCollectorArgs `json:"artifacts"`
+}
+
+// The ServerEventManager only manages the configuration. The queries
+// themselves are run by the ServerMonitoringRunner on the foreman.
+type ServerMonitoringManager struct {
+	config_obj *config_proto.Config
+}
+
+func (self *ServerMonitoringManager) Get() *flows_proto.ArtifactCollectorArgs {
+	table, _, err := GetServerMonitoringTable(
+		context.Background(), self.config_obj)
+	if err != nil {
+		return makeDefaultServerMonitoringTable(self.config_obj).Artifacts
+	}
+	return table.Artifacts
+}
+
+func (self *ServerMonitoringManager) Update(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	principal string,
+	args *flows_proto.ArtifactCollectorArgs) error {
+
+	args = proto.Clone(args).(*flows_proto.ArtifactCollectorArgs)
+
+	// Make sure the artifacts compile before we store them so the
+	// runner does not pick up a broken table.
+	_, err := compileArtifactCollectorArgs(ctx, config_obj, args)
+	if err != nil {
+		return err
+	}
+	args.CompiledCollectorArgs = nil
+
+	logger := logging.GetLogger(config_obj, &logging.FrontendComponent)
+	logger.Info("Server monitoring table updated by %v: %v",
+		principal, args.Artifacts)
+
+	return cvelo_services.SetElasticIndex(ctx,
+		config_obj.OrgId,
+		cvelo_services.PERSISTED, SERVER_MONITORING_DOC_ID,
+		&client_monitoring.ConfigEntry{
+			Type: "server_monitoring",
+			Data: json.MustMarshalString(&ServerMonitoringTable{
+				Principal: principal,
+				Artifacts: args,
+			}),
+			DocType: "config",
+		})
+}
+
+func (self *ServerMonitoringManager) ListAvailableEventResults(
+	ctx context.Context,
+	in *api_proto.ListAvailableEventResultsRequest) (
+	*api_proto.ListAvailableEventResultsResponse, error) {
+
+	// Server event results are always written under the server
+	// client id.
+	in = proto.Clone(in).(*api_proto.ListAvailableEventResultsRequest)
+	in.ClientId = "server"
+
+	return client_monitoring.ListAvailableEventResults(
+		ctx, self.config_obj, in)
+}
+
+func (self *ServerMonitoringManager) Close() {}
+
+func makeDefaultServerMonitoringTable(
+	config_obj *config_proto.Config) *ServerMonitoringTable {
+	result := &ServerMonitoringTable{
+		Artifacts: &flows_proto.ArtifactCollectorArgs{},
+	}
+
+	if config_obj.Frontend != nil {
+		result.Artifacts.Artifacts = append(result.Artifacts.Artifacts,
+			config_obj.Frontend.DefaultServerMonitoringArtifacts...)
+	}
+	return result
+}
+
+// Get the server event table for the org. Also returns the serialized
+// table so callers can cheaply tell if it changed.
+func GetServerMonitoringTable(
+	ctx context.Context,
+	config_obj *config_proto.Config) (*ServerMonitoringTable, string, error) {
+
+	serialized, err := cvelo_services.GetElasticRecord(
+		ctx, config_obj.OrgId, cvelo_services.PERSISTED,
+		SERVER_MONITORING_DOC_ID)
+	if err != nil {
+		// The table was never set - use the defaults.
+		if errors.Is(err, os.ErrNotExist) {
+			table := makeDefaultServerMonitoringTable(config_obj)
+			return table, json.MustMarshalString(table), nil
+		}
+		return nil, "", err
+	}
+
+	entry := &client_monitoring.ConfigEntry{}
+	err = json.Unmarshal(serialized, entry)
+	if err != nil {
+		return nil, "", err
+	}
+
+	result := &ServerMonitoringTable{}
+	err = json.Unmarshal([]byte(entry.Data), result)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if result.Artifacts == nil {
+		result.Artifacts = &flows_proto.ArtifactCollectorArgs{}
+	}
+
+	return result, entry.Data, nil
+}
+
+func compileArtifactCollectorArgs(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	args *flows_proto.ArtifactCollectorArgs) (
+	[]*actions_proto.VQLCollectorArgs, error) {
+
+	launcher, err := services.GetLauncher(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := services.GetRepositoryManager(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	repository, err := manager.GetGlobalRepository(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	return launcher.CompileCollectorArgs(
+		ctx, config_obj, acl_managers.NullACLManager{},
+		repository, services.CompilerOptions{}, args)
+}
+
+func NewServerMonitoringService(
+	ctx context.Context,
+	wg *sync.WaitGroup,
+	config_obj *config_proto.Config) (services.ServerEventManager, error) {
+
+	return &ServerMonitoringManager{
+		config_obj: config_obj,
+	}, nil
+}
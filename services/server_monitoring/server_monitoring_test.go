@@ -0,0 +1,155 @@
+package server_monitoring_test
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/server_monitoring"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/vtesting"
+)
+
+var artifact_definitions = []string{`
+name: Server.Test.Events
+type: SERVER_EVENT
+sources:
+- query: SELECT 1 AS Foo FROM scope()
+`, `
+name: Server.Test.OtherEvents
+type: SERVER_EVENT
+sources:
+- query: SELECT 2 AS Foo FROM scope()
+`}
+
+type ServerMonitoringTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *ServerMonitoringTestSuite) SetupTest() {
+	self.CloudTestSuite.SetupTest()
+
+	config_obj := self.ConfigObj.VeloConf()
+
+	repository_manager, err := services.GetRepositoryManager(config_obj)
+	assert.NoError(self.T(), err)
+
+	for _, definition := range artifact_definitions {
+		_, err = repository_manager.SetArtifactFile(
+			self.Ctx, config_obj, "admin", definition, "")
+		assert.NoError(self.T(), err)
+	}
+}
+
+func (self *ServerMonitoringTestSuite) TestUpdate() {
+	config_obj := self.ConfigObj.VeloConf()
+
+	manager, err := server_monitoring.NewServerMonitoringService(
+		self.Ctx, &sync.WaitGroup{}, config_obj)
+	assert.NoError(self.T(), err)
+
+	// Without a stored table we get the defaults.
+	table, _, err := server_monitoring.GetServerMonitoringTable(
+		self.Ctx, config_obj)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), "", table.Principal)
+	assert.Equal(self.T(), 0, len(table.Artifacts.Artifacts))
+
+	// Artifacts which do not compile are rejected.
+	err = manager.Update(self.Ctx, config_obj, "admin",
+		&flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Server.Test.DoesNotExist"},
+		})
+	assert.Error(self.T(), err)
+
+	err = manager.Update(self.Ctx, config_obj, "admin",
+		&flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Server.Test.Events"},
+		})
+	assert.NoError(self.T(), err)
+
+	assert.Equal(self.T(), []string{"Server.Test.Events"},
+		manager.Get().Artifacts)
+
+	// The principal is recorded and the compiled queries are not
+	// stored.
+	table, _, err = server_monitoring.GetServerMonitoringTable(
+		self.Ctx, config_obj)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), "admin", table.Principal)
+	assert.Equal(self.T(), 0, len(table.Artifacts.CompiledCollectorArgs))
+}
+
+func (self *ServerMonitoringTestSuite) TestRunner() {
+	config_obj := self.ConfigObj.VeloConf()
+	org_id := config_obj.OrgId
+
+	manager, err := server_monitoring.NewServerMonitoringService(
+		self.Ctx, &sync.WaitGroup{}, config_obj)
+	assert.NoError(self.T(), err)
+
+	err = manager.Update(self.Ctx, config_obj, "admin",
+		&flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Server.Test.Events"},
+		})
+	assert.NoError(self.T(), err)
+
+	wg := &sync.WaitGroup{}
+	runner := server_monitoring.NewServerMonitoringRunner(self.ConfigObj)
+	defer wg.Wait()
+	defer runner.Close()
+
+	err = runner.RunOnce(self.Ctx, wg)
+	assert.NoError(self.T(), err)
+
+	table, pres := runner.TableForTests(org_id)
+	assert.True(self.T(), pres)
+
+	// The results are written under the server client id.
+	vtesting.WaitUntil(20*time.Second, self.T(), func() bool {
+		err := cvelo_services.FlushBulkIndexer()
+		assert.NoError(self.T(), err)
+
+		available, err := manager.ListAvailableEventResults(self.Ctx,
+			&api_proto.ListAvailableEventResultsRequest{})
+		assert.NoError(self.T(), err)
+		return len(available.Logs) == 1 &&
+			available.Logs[0].Artifact == "Server.Test.Events"
+	})
+
+	// Nothing changed so the queries are left running.
+	err = runner.RunOnce(self.Ctx, wg)
+	assert.NoError(self.T(), err)
+	same_table, _ := runner.TableForTests(org_id)
+	assert.True(self.T(), table == same_table)
+
+	// Changing the table restarts the queries.
+	err = manager.Update(self.Ctx, config_obj, "admin",
+		&flows_proto.ArtifactCollectorArgs{
+			Artifacts: []string{"Server.Test.OtherEvents"},
+		})
+	assert.NoError(self.T(), err)
+
+	err = runner.RunOnce(self.Ctx, wg)
+	assert.NoError(self.T(), err)
+
+	new_table, pres := runner.TableForTests(org_id)
+	assert.True(self.T(), pres)
+	assert.True(self.T(), table != new_table)
+	assert.NotEqual(self.T(), table.SerializedForTests(),
+		new_table.SerializedForTests())
+}
+
+func TestServerMonitoring(t *testing.T) {
+	suite.Run(t, &ServerMonitoringTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted", "transient"},
+		},
+	})
+}
@@ -0,0 +1,703 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	opensearchapi "github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/api"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/logging"
+	"www.velocidex.com/golang/velociraptor/utils"
+)
+
+// When OpenSearch is unavailable the bulk indexer can not deliver its
+// items. Rather than dropping them, undelivered items are written to
+// a spool (a local directory or a prefix in the bucket) and replayed
+// once the cluster is healthy again.
+const (
+	// How often pending items are written to the spool.
+	SPOOL_FLUSH_PERIOD = time.Second
+
+	// Replay backs off exponentially between these limits while the
+	// cluster is unhealthy.
+	SPOOL_MIN_BACKOFF = 5 * time.Second
+	SPOOL_MAX_BACKOFF = 5 * time.Minute
+
+	// The bulk indexer does not report items lost in a failed flush,
+	// so items that were not acknowledged within this time are
+	// spooled.
+	SPOOL_UNSENT_TIMEOUT = 2 * time.Minute
+
+	// Items that could not be replayed for this long are dropped.
+	SPOOL_MAX_AGE = 7 * 24 * time.Hour
+
+	// If the spool can not be written we keep this many items in
+	// memory before dropping new ones.
+	SPOOL_MAX_PENDING = 100000
+
+	SPOOL_REPLAY_BATCH = 500
+)
+
+type SpoolItem struct {
+	OrgId      string `json:"org_id"`
+	Index      string `json:"index"`
+	Action     string `json:"action"`
+	DocumentID string `json:"id,omitempty"`
+	Body       string `json:"body"`
+
+	// When the item was first spooled.
+	Timestamp int64 `json:"timestamp"`
+}
+
+// Items are stored in segments - each segment is a JSONL file of
+// items, named so they sort in the order they were written.
+type spoolStore interface {
+	WriteSegment(name string, data []byte) error
+	ListSegments() ([]string, error)
+	ReadSegment(name string) ([]byte, error)
+	DeleteSegment(name string) error
+}
+
+type directorySpoolStore struct {
+	path string
+}
+
+func (self directorySpoolStore) filename(name string) string {
+	return filepath.Join(self.path, name+".jsonl")
+}
+
+// Write to a temporary file and rename it so a partially written
+// segment is never replayed.
+func (self directorySpoolStore) WriteSegment(name string, data []byte) error {
+	tmp_name := self.filename(name) + ".tmp"
+	err := ioutil.WriteFile(tmp_name, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp_name, self.filename(name))
+}
+
+func (self directorySpoolStore) ListSegments() ([]string, error) {
+	entries, err := os.ReadDir(self.path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasSuffix(name, ".jsonl") {
+			result = append(result, strings.TrimSuffix(name, ".jsonl"))
+		}
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (self directorySpoolStore) ReadSegment(name string) ([]byte, error) {
+	return ioutil.ReadFile(self.filename(name))
+}
+
+func (self directorySpoolStore) DeleteSegment(name string) error {
+	return os.Remove(self.filename(name))
+}
+
+// Segments stored in the bucket. The filestore is installed after
+// the bulk indexer starts so it is looked up on each call.
+type filestoreSpoolStore struct {
+	config_obj *config_proto.Config
+	prefix     api.FSPathSpec
+}
+
+func (self filestoreSpoolStore) getFileStore() (api.FileStore, error) {
+	file_store_factory := file_store.GetFileStore(self.config_obj)
+	if file_store_factory == nil {
+		return nil, fmt.Errorf("Filestore not initialized")
+	}
+	return file_store_factory, nil
+}
+
+func (self filestoreSpoolStore) pathSpec(name string) api.FSPathSpec {
+	return self.prefix.AddUnsafeChild(name).SetType(api.PATH_TYPE_FILESTORE_JSON)
+}
+
+func (self filestoreSpoolStore) WriteSegment(name string, data []byte) error {
+	file_store_factory, err := self.getFileStore()
+	if err != nil {
+		return err
+	}
+
+	writer, err := file_store_factory.WriteFile(self.pathSpec(name))
+	if err != nil {
+		return err
+	}
+
+	err = writer.Truncate()
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	_, err = writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return err
+	}
+
+	return writer.Close()
+}
+
+func (self filestoreSpoolStore) ListSegments() ([]string, error) {
+	file_store_factory, err := self.getFileStore()
+	if err != nil {
+		return nil, err
+	}
+
+	children, err := file_store_factory.ListDirectory(self.prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, child := range children {
+		result = append(result, child.Name())
+	}
+	sort.Strings(result)
+	return result, nil
+}
+
+func (self filestoreSpoolStore) ReadSegment(name string) ([]byte, error) {
+	file_store_factory, err := self.getFileStore()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := file_store_factory.ReadFile(self.pathSpec(name))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	return ioutil.ReadAll(reader)
+}
+
+func (self filestoreSpoolStore) DeleteSegment(name string) error {
+	file_store_factory, err := self.getFileStore()
+	if err != nil {
+		return err
+	}
+	return file_store_factory.Delete(self.pathSpec(name))
+}
+
+type inFlightItem struct {
+	item *SpoolItem
+	sent time.Time
+
+	// The bulk indexer the item was handed to.
+	owner interface{}
+}
+
+type Spool struct {
+	mu         sync.Mutex
+	ctx        context.Context
+	config_obj *config_proto.Config
+
+	// If no spool is configured, undelivered items are dropped.
+	store spoolStore
+
+	// Items waiting to be written to the store.
+	pending []*SpoolItem
+
+	// Items handed to the bulk indexer which were not acknowledged
+	// yet.
+	in_flight map[uint64]*inFlightItem
+	next_id   uint64
+}
+
+// Remember the item until the bulk indexer reports on it. Items
+// which may be replayed while the original is still in flight must
+// carry their own DocumentID so the replay does not duplicate them.
+func (self *Spool) Track(owner interface{}, item *SpoolItem) uint64 {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	self.next_id++
+	self.in_flight[self.next_id] = &inFlightItem{
+		item:  item,
+		sent:  utils.GetTime().Now(),
+		owner: owner,
+	}
+	return self.next_id
+}
+
+func (self *Spool) Done(id uint64) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	delete(self.in_flight, id)
+}
+
+// The item failed with the given status. Status 0 means the item was
+// never sent.
+func (self *Spool) Fail(id uint64, status int) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	entry, pres := self.in_flight[id]
+	if !pres {
+		return
+	}
+	delete(self.in_flight, id)
+
+	// The cluster rejected the item itself (e.g. a mapping error) so
+	// replaying it will not help.
+	if !isRetryableStatus(status) {
+		BulkIndexerDroppedCounter.Inc()
+		return
+	}
+
+	self.spool(entry.item)
+}
+
+// Spool all items handed to the owner which were not acknowledged.
+// Called when the owner is closed, after which no more
+// acknowledgements will arrive. Items of other bulk indexers may
+// still be delivered so they are left alone.
+func (self *Spool) SpoolUnsent(owner interface{}) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	for id, entry := range self.in_flight {
+		if entry.owner != owner {
+			continue
+		}
+		delete(self.in_flight, id)
+		self.spool(entry.item)
+	}
+}
+
+// The item may still be delivered after it was spooled, but it has a
+// DocumentID so the replay will not duplicate it.
+func (self *Spool) spoolExpired() {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	now := utils.GetTime().Now()
+	for id, entry := range self.in_flight {
+		if now.Sub(entry.sent) > SPOOL_UNSENT_TIMEOUT {
+			delete(self.in_flight, id)
+			self.spool(entry.item)
+		}
+	}
+}
+
+// Spool an item which could not be handed to a bulk indexer.
+// Returns false if the item was dropped instead.
+func (self *Spool) Add(item *SpoolItem) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	return self.spool(item)
+}
+
+// Must be called under lock.
+func (self *Spool) spool(item *SpoolItem) bool {
+	if self.store == nil || len(self.pending) >= SPOOL_MAX_PENDING {
+		BulkIndexerDroppedCounter.Inc()
+		return false
+	}
+
+	if item.Timestamp == 0 {
+		item.Timestamp = utils.GetTime().Now().Unix()
+	}
+	self.pending = append(self.pending, item)
+	BulkIndexerSpooledCounter.Inc()
+	return true
+}
+
+// Write the pending items into a new segment.
+func (self *Spool) flush() error {
+	self.mu.Lock()
+	pending := self.pending
+	self.pending = nil
+	self.mu.Unlock()
+
+	if len(pending) == 0 || self.store == nil {
+		return nil
+	}
+
+	err := self.store.WriteSegment(newSegmentName(), encodeSpoolItems(pending))
+	if err != nil {
+		// Keep them in memory and try again later.
+		self.mu.Lock()
+		self.pending = append(pending, self.pending...)
+		self.mu.Unlock()
+	}
+	return err
+}
+
+// Replay all the segments in the spool. Returns an error if the
+// cluster is not ready so the caller can back off.
+func (self *Spool) replay(ctx context.Context) error {
+	if self.store == nil {
+		return nil
+	}
+
+	segments, err := self.store.ListSegments()
+	if err != nil {
+		return err
+	}
+
+	healthy := make(map[*opensearch.Client]bool)
+	for _, segment := range segments {
+		data, err := self.store.ReadSegment(segment)
+		if err != nil {
+			return err
+		}
+
+		items := self.dropExpired(decodeSpoolItems(data))
+		remaining, err := self.replayItems(ctx, healthy, items)
+
+		// Only remove the segment once the remaining items are safe.
+		if len(remaining) > 0 {
+			err1 := self.store.WriteSegment(segment, encodeSpoolItems(remaining))
+			if err1 != nil {
+				return err1
+			}
+		} else {
+			err1 := self.store.DeleteSegment(segment)
+			if err1 != nil {
+				return err1
+			}
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (self *Spool) dropExpired(items []*SpoolItem) []*SpoolItem {
+	var result []*SpoolItem
+	now := utils.GetTime().Now()
+	for _, item := range items {
+		if now.Sub(time.Unix(item.Timestamp, 0)) > SPOOL_MAX_AGE {
+			BulkIndexerDroppedCounter.Inc()
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// Returns the items which still need to be replayed.
+func (self *Spool) replayItems(
+	ctx context.Context,
+	healthy map[*opensearch.Client]bool,
+	items []*SpoolItem) ([]*SpoolItem, error) {
+
+	for len(items) > 0 {
+		batch := items
+		if len(batch) > SPOOL_REPLAY_BATCH {
+			batch = batch[:SPOOL_REPLAY_BATCH]
+		}
+
+		// Orgs may live on different clusters.
+		by_client := make(map[*opensearch.Client][]*SpoolItem)
+		for _, item := range batch {
+			client, err := GetElasticClient(item.OrgId)
+			if err != nil {
+				return items, err
+			}
+			by_client[client] = append(by_client[client], item)
+		}
+
+		var retry []*SpoolItem
+		for client, client_items := range by_client {
+			is_healthy, pres := healthy[client]
+			if !pres {
+				is_healthy = isClusterHealthy(ctx, client)
+				healthy[client] = is_healthy
+			}
+
+			if !is_healthy {
+				retry = append(retry, client_items...)
+				continue
+			}
+
+			failed, err := self.sendBulk(ctx, client, client_items)
+			if err != nil {
+				healthy[client] = false
+			}
+			retry = append(retry, failed...)
+		}
+
+		items = items[len(batch):]
+		if len(retry) > 0 {
+			return append(retry, items...), fmt.Errorf(
+				"Spool: %v items could not be replayed", len(retry))
+		}
+	}
+
+	return nil, nil
+}
+
+type bulkResponseItem struct {
+	Status int             `json:"status"`
+	Error  json.RawMessage `json:"error"`
+}
+
+type bulkResponse struct {
+	Items []map[string]bulkResponseItem `json:"items"`
+}
+
+// Send the items to the cluster returning the items that should be
+// retried later.
+func (self *Spool) sendBulk(
+	ctx context.Context,
+	client *opensearch.Client,
+	items []*SpoolItem) ([]*SpoolItem, error) {
+
+	buf := &bytes.Buffer{}
+	for _, item := range items {
+		meta := map[string]string{"_index": GetIndex(item.OrgId, item.Index)}
+		if item.DocumentID != "" {
+			meta["_id"] = item.DocumentID
+		}
+		buf.WriteString(json.MustMarshalString(
+			map[string]interface{}{item.Action: meta}))
+		buf.WriteString("\n")
+		buf.WriteString(item.Body)
+		buf.WriteString("\n")
+	}
+
+	res, err := opensearchapi.BulkRequest{
+		Body: buf,
+	}.Do(ctx, client)
+	if err != nil {
+		return items, err
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return items, err
+	}
+
+	if res.IsError() {
+		return items, makeElasticError(res.StatusCode, data)
+	}
+
+	response := &bulkResponse{}
+	err = json.Unmarshal(data, response)
+	if err != nil {
+		return items, err
+	}
+
+	if len(response.Items) != len(items) {
+		return items, fmt.Errorf("Spool: Bulk response has %v items, expected %v",
+			len(response.Items), len(items))
+	}
+
+	logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+	var retry []*SpoolItem
+	for idx, result := range response.Items {
+		for action, info := range result {
+			switch {
+			// A create that conflicts was already delivered.
+			case info.Status < 300 ||
+				(action == BulkUpdateCreate && info.Status == 409):
+				BulkIndexerReplayedCounter.Inc()
+
+			case isRetryableStatus(info.Status):
+				retry = append(retry, items[idx])
+
+			default:
+				logger.Error("Spool: Dropping item for %v: %v",
+					items[idx].Index, string(info.Error))
+				BulkIndexerDroppedCounter.Inc()
+			}
+		}
+	}
+
+	return retry, nil
+}
+
+func (self *Spool) Start(wg *sync.WaitGroup) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+
+		backoff := SPOOL_MIN_BACKOFF
+		next_replay := utils.GetTime().Now()
+
+		for {
+			select {
+			case <-self.ctx.Done():
+				return
+
+			case <-time.After(SPOOL_FLUSH_PERIOD):
+			}
+
+			self.spoolExpired()
+			err := self.flush()
+			if err != nil {
+				logger.Error("Spool: Unable to write spool: %v", err)
+			}
+
+			now := utils.GetTime().Now()
+			if now.Before(next_replay) {
+				continue
+			}
+
+			err = self.replay(self.ctx)
+			if err != nil {
+				logger.Debug("Spool: Replay failed, retrying in %v: %v",
+					backoff, err)
+				next_replay = now.Add(backoff)
+				backoff *= 2
+				if backoff > SPOOL_MAX_BACKOFF {
+					backoff = SPOOL_MAX_BACKOFF
+				}
+				continue
+			}
+
+			backoff = SPOOL_MIN_BACKOFF
+			next_replay = now.Add(SPOOL_MIN_BACKOFF)
+		}
+	}()
+}
+
+// Keep whatever could not be delivered for next time. All the bulk
+// indexers are closed by now.
+func (self *Spool) Close() {
+	self.mu.Lock()
+	for id, entry := range self.in_flight {
+		delete(self.in_flight, id)
+		self.spool(entry.item)
+	}
+	self.mu.Unlock()
+
+	err := self.flush()
+	if err != nil {
+		logger := logging.GetLogger(self.config_obj, &logging.FrontendComponent)
+		logger.Error("Spool: Unable to write spool: %v", err)
+	}
+}
+
+func isRetryableStatus(status int) bool {
+	return status == 0 || status == 429 || status >= 500
+}
+
+func isClusterHealthy(ctx context.Context, client *opensearch.Client) bool {
+	res, err := opensearchapi.ClusterHealthRequest{}.Do(ctx, client)
+	if err != nil {
+		return false
+	}
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil || res.IsError() {
+		return false
+	}
+
+	health := &struct {
+		Status string `json:"status"`
+	}{}
+	err = json.Unmarshal(data, health)
+	return err == nil && health.Status != "red"
+}
+
+func newSegmentName() string {
+	nonce := make([]byte, 4)
+	_, _ = rand.Read(nonce)
+	return fmt.Sprintf("%020d_%s",
+		utils.GetTime().Now().UnixNano(), hex.EncodeToString(nonce))
+}
+
+func encodeSpoolItems(items []*SpoolItem) []byte {
+	buf := &bytes.Buffer{}
+	for _, item := range items {
+		buf.WriteString(json.MustMarshalString(item))
+		buf.WriteString("\n")
+	}
+	return buf.Bytes()
+}
+
+func decodeSpoolItems(data []byte) []*SpoolItem {
+	var result []*SpoolItem
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 0, 64*1024), 100*1024*1024)
+	for scanner.Scan() {
+		item := &SpoolItem{}
+		err := json.Unmarshal(scanner.Bytes(), item)
+		if err != nil {
+			BulkIndexerDroppedCounter.Inc()
+			continue
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// Each frontend replays its own spool. Spools in the bucket are kept
+// under the host name so frontends do not replay each other's items.
+func NewSpool(
+	ctx context.Context,
+	config_obj *cloud_velo_config.Config) (*Spool, error) {
+
+	result := &Spool{
+		ctx:        ctx,
+		config_obj: config_obj.VeloConf(),
+		in_flight:  make(map[uint64]*inFlightItem),
+	}
+
+	switch {
+	case config_obj.Cloud.SpoolDirectory != "":
+		err := os.MkdirAll(config_obj.Cloud.SpoolDirectory, 0700)
+		if err != nil {
+			return nil, err
+		}
+		result.store = directorySpoolStore{
+			path: config_obj.Cloud.SpoolDirectory,
+		}
+
+	case config_obj.Cloud.SpoolS3Prefix != "":
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+
+		components := utils.SplitComponents(config_obj.Cloud.SpoolS3Prefix)
+		result.store = filestoreSpoolStore{
+			config_obj: config_obj.VeloConf(),
+			prefix: path_specs.NewUnsafeFilestorePath(
+				append(components, hostname)...),
+		}
+	}
+
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package services
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	cloud_velo_config "www.velocidex.com/golang/cloudvelo/config"
+)
+
+func TestSpoolFailedItems(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config_obj := &cloud_velo_config.Config{}
+	config_obj.Cloud.SpoolDirectory = dir
+
+	spool, err := NewSpool(context.Background(), config_obj)
+	assert.NoError(t, err)
+
+	// Rejected by the cluster - replaying will not help.
+	id := spool.Track(nil, &SpoolItem{Index: "persisted", DocumentID: "1"})
+	spool.Fail(id, 400)
+
+	// The cluster was overloaded.
+	id = spool.Track(nil, &SpoolItem{Index: "persisted", DocumentID: "2"})
+	spool.Fail(id, 429)
+
+	// Acknowledged items are forgotten.
+	id = spool.Track(nil, &SpoolItem{Index: "persisted", DocumentID: "3"})
+	spool.Done(id)
+
+	// Never acknowledged before the indexer closed.
+	spool.Track(nil, &SpoolItem{Index: "transient", Action: "create"})
+
+	spool.Close()
+
+	store := directorySpoolStore{path: dir}
+	segments, err := store.ListSegments()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(segments))
+
+	data, err := store.ReadSegment(segments[0])
+	assert.NoError(t, err)
+
+	items := decodeSpoolItems(data)
+	assert.Equal(t, 2, len(items))
+	for _, item := range items {
+		assert.True(t, item.Timestamp > 0)
+		assert.True(t, item.DocumentID != "1" && item.DocumentID != "3")
+	}
+}
+
+// Closing one bulk indexer must not spool the items another one may
+// still deliver.
+func TestSpoolUnsentOwner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config_obj := &cloud_velo_config.Config{}
+	config_obj.Cloud.SpoolDirectory = dir
+
+	spool, err := NewSpool(context.Background(), config_obj)
+	assert.NoError(t, err)
+
+	closed := &BulkIndexer{}
+	running := &BulkIndexer{}
+
+	spool.Track(closed, &SpoolItem{Index: "transient", DocumentID: "1"})
+	running_id := spool.Track(running,
+		&SpoolItem{Index: "transient", DocumentID: "2"})
+
+	spool.SpoolUnsent(closed)
+	assert.Equal(t, 1, len(spool.pending))
+	assert.Equal(t, "1", spool.pending[0].DocumentID)
+
+	// The other indexer delivered its item.
+	spool.Done(running_id)
+	spool.Close()
+
+	store := directorySpoolStore{path: dir}
+	segments, err := store.ListSegments()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(segments))
+
+	data, err := store.ReadSegment(segments[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(decodeSpoolItems(data)))
+}
+
+// Before the bulk indexer service starts there is nowhere to send or
+// spool the item so the write fails.
+func TestSetAsyncWithoutSpool(t *testing.T) {
+	var completion_err error
+	err := openSearchBackend{}.SetAsync("root", "persisted", "1",
+		BulkUpdateIndex, map[string]interface{}{"id": "1"},
+		func(err error) {
+			completion_err = err
+		})
+	assert.Error(t, err)
+	assert.Equal(t, err, completion_err)
+}
+
+// Items which can not be sent yet are kept for replay.
+func TestSpoolAdd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spool")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	config_obj := &cloud_velo_config.Config{}
+	config_obj.Cloud.SpoolDirectory = dir
+
+	spool, err := NewSpool(context.Background(), config_obj)
+	assert.NoError(t, err)
+	defer spool.Close()
+
+	assert.True(t, spool.Add(&SpoolItem{Index: "persisted", DocumentID: "1"}))
+	assert.Equal(t, 1, len(spool.pending))
+
+	// A spool without a store drops the item.
+	assert.False(t, (&Spool{}).Add(&SpoolItem{Index: "persisted"}))
+}
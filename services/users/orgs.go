@@ -0,0 +1,102 @@
+package users
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"google.golang.org/protobuf/encoding/protojson"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	api_proto "www.velocidex.com/golang/velociraptor/api/proto"
+	"www.velocidex.com/golang/velociraptor/constants"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+)
+
+const usersQuery = `
+{
+  "query": {
+    "bool": {
+      "must": [
+         {"match": {"doc_type" : "users"}}
+      ]}
+  },
+  "size": 10000
+}
+`
+
+// Users are global so the users of an org are those which list the
+// org in their record. The records include the password hashes.
+func ListOrgUsers(ctx context.Context, org_id string) (
+	[]*api_proto.VelociraptorUser, error) {
+	hits, _, err := cvelo_services.QueryElasticRaw(ctx,
+		services.ROOT_ORG_ID, cvelo_services.PERSISTED, usersQuery)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []*api_proto.VelociraptorUser
+	for _, hit := range hits {
+		record := &UserRecord{}
+		err = json.Unmarshal(hit, record)
+		if err != nil {
+			continue
+		}
+
+		user_record := &api_proto.VelociraptorUser{}
+		err = protojson.Unmarshal([]byte(record.Record), user_record)
+		if err == nil && userInOrg(user_record, org_id) {
+			result = append(result, user_record)
+		}
+	}
+
+	return result, nil
+}
+
+// Add the user to the org. If the user does not exist yet, the user
+// is created as a member of this org only, otherwise the existing
+// record is kept and only gains the org.
+func AddUserToOrg(ctx context.Context,
+	user_record *api_proto.VelociraptorUser, org *api_proto.OrgRecord) error {
+	user_manager := services.GetUserManager()
+
+	existing, err := user_manager.GetUserWithHashes(
+		ctx, constants.PinnedServerName, user_record.Name)
+	if err == nil {
+		user_record = existing
+	} else {
+		// The user's other orgs do not exist here.
+		user_record.Orgs = nil
+	}
+
+	if userInOrg(user_record, org.Id) {
+		return nil
+	}
+
+	user_record.Orgs = append(user_record.Orgs, &api_proto.OrgRecord{
+		Name: org.Name,
+		Id:   org.Id,
+	})
+
+	return user_manager.SetUser(ctx, user_record)
+}
+
+// Whether the user still exists. Users are stored in the root org
+// under their name.
+func UserExists(ctx context.Context, username string) (bool, error) {
+	_, err := cvelo_services.GetElasticRecord(ctx,
+		services.ROOT_ORG_ID, cvelo_services.PERSISTED, username)
+	if errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func userInOrg(user_record *api_proto.VelociraptorUser, org_id string) bool {
+	for _, org := range user_record.Orgs {
+		if org.Id == org_id {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,248 @@
+package vfs_service
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/Velocidex/ordereddict"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	actions_proto "www.velocidex.com/golang/velociraptor/actions/proto"
+	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
+	flows_proto "www.velocidex.com/golang/velociraptor/flows/proto"
+	"www.velocidex.com/golang/velociraptor/json"
+	"www.velocidex.com/golang/velociraptor/services"
+	"www.velocidex.com/golang/velociraptor/utils"
+	"www.velocidex.com/golang/velociraptor/vql/acl_managers"
+)
+
+/*
+  Downloading a subtree schedules a single recursive
+  System.VFS.DownloadFile collection on the client. The files below
+  the directory are only known to the client so the progress of the
+  download is kept in a single record per collection.
+
+  As the client uploads each file the ingestor writes its download
+  record (which is no longer in flight) and adds the file to the
+  counters of the collection's progress record. Reading the progress
+  therefore costs a single request no matter how large the subtree
+  is.
+
+  The client may upload files before the collection's details are
+  written so both writes create the record if it is missing.
+*/
+
+type SubtreeDownloadStats struct {
+	// The number of files the client has uploaded or failed to
+	// upload so far.
+	Total    int `json:"total"`
+	Complete int `json:"complete"`
+	Failed   int `json:"failed"`
+
+	// Whether the client is still uploading files.
+	InFlight bool `json:"in_flight"`
+}
+
+// Stored in the persisted index (see
+// schema/templates/persisted.json).
+type SubtreeDownloadRecord struct {
+	ClientId   string   `json:"client_id,omitempty"`
+	FlowId     string   `json:"flow_id"`
+	Components []string `json:"components,omitempty"`
+	Complete   int      `json:"complete"`
+	Failed     int      `json:"failed"`
+	DocType    string   `json:"doc_type"`
+	Timestamp  int64    `json:"timestamp,omitempty"`
+}
+
+const (
+	updateSubtreeDownloadPainless = `
+ctx._source.complete += params.complete ;
+ctx._source.failed += params.failed ;
+`
+
+	updateSubtreeDownloadQuery = `
+{
+  "script" : {
+    "source": %q,
+    "lang": "painless",
+    "params": {
+      "complete": %q,
+      "failed": %q
+    }
+  },
+  "upsert": %q
+}
+`
+
+	// Keeps the counters of an existing record.
+	setSubtreeDownloadQuery = `
+{
+  "doc": %q,
+  "upsert": %q
+}
+`
+)
+
+func updateSubtreeDownload(doc, params map[string]interface{}) error {
+	for _, field := range []string{"complete", "failed"} {
+		doc[field] = cvelo_services.ScriptInt(doc[field]) +
+			cvelo_services.ScriptInt(params[field])
+	}
+	return nil
+}
+
+func init() {
+	cvelo_services.RegisterUpdateScript(
+		updateSubtreeDownloadPainless, updateSubtreeDownload)
+}
+
+func subtreeDownloadId(flow_id string) string {
+	return "subtree_download_" + flow_id
+}
+
+// Schedule a download of all the files below the directory. The
+// components start with the accessor as in the GUI.
+func DownloadSubtree(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	principal, client_id string,
+	components []string) (string, error) {
+
+	if len(components) == 0 {
+		return "", errors.New("DownloadSubtree: No accessor specified")
+	}
+
+	accessor := components[0]
+	client_components := components[1:]
+
+	launcher, err := services.GetLauncher(config_obj)
+	if err != nil {
+		return "", err
+	}
+
+	manager, err := services.GetRepositoryManager(config_obj)
+	if err != nil {
+		return "", err
+	}
+
+	repository, err := manager.GetGlobalRepository(config_obj)
+	if err != nil {
+		return "", err
+	}
+
+	flow_id, err := launcher.ScheduleArtifactCollection(ctx, config_obj,
+		acl_managers.NewServerACLManager(config_obj, principal),
+		repository, &flows_proto.ArtifactCollectorArgs{
+			Creator:   principal,
+			ClientId:  client_id,
+			Urgent:    true,
+			Artifacts: []string{"System.VFS.DownloadFile"},
+			Specs: []*flows_proto.ArtifactSpec{{
+				Artifact: "System.VFS.DownloadFile",
+				Parameters: &flows_proto.ArtifactParameters{
+					Env: []*actions_proto.VQLEnv{
+						{Key: "Components",
+							Value: json.MustMarshalString(client_components)},
+						{Key: "Accessor", Value: accessor},
+						{Key: "Recursively", Value: "Y"},
+					},
+				},
+			}},
+		}, nil)
+	if err != nil {
+		return "", err
+	}
+
+	record := &SubtreeDownloadRecord{
+		ClientId:   client_id,
+		FlowId:     flow_id,
+		Components: components,
+		DocType:    "subtree_download",
+		Timestamp:  utils.GetTime().Now().UnixNano(),
+	}
+
+	// The zero counters are only in the upsert.
+	details := ordereddict.NewDict().
+		Set("client_id", record.ClientId).
+		Set("flow_id", record.FlowId).
+		Set("components", record.Components).
+		Set("doc_type", record.DocType).
+		Set("timestamp", record.Timestamp)
+
+	err = cvelo_services.UpdateIndex(ctx, config_obj.OrgId,
+		"persisted", subtreeDownloadId(flow_id),
+		json.Format(setSubtreeDownloadQuery, details, record))
+	if err != nil {
+		return "", err
+	}
+
+	return flow_id, nil
+}
+
+// Add the files uploaded by a collection to its progress. The
+// ingestor can not tell subtree downloads from other downloads so
+// every download collection gets a record.
+func UpdateSubtreeDownloadProgress(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	flow_id string, complete, failed int) error {
+
+	if complete == 0 && failed == 0 {
+		return nil
+	}
+
+	query := json.Format(updateSubtreeDownloadQuery,
+		updateSubtreeDownloadPainless, complete, failed,
+		&SubtreeDownloadRecord{
+			FlowId:   flow_id,
+			Complete: complete,
+			Failed:   failed,
+			DocType:  "subtree_download",
+		})
+	return cvelo_services.UpdateIndex(ctx, config_obj.OrgId,
+		"persisted", subtreeDownloadId(flow_id), query)
+}
+
+// Get the progress of a subtree download. Once the collection is no
+// longer running no more files will be uploaded.
+func SubtreeDownloadProgress(
+	ctx context.Context,
+	config_obj *config_proto.Config,
+	client_id, flow_id string) (*SubtreeDownloadStats, error) {
+
+	serialized, err := cvelo_services.GetElasticRecord(ctx,
+		config_obj.OrgId, "persisted", subtreeDownloadId(flow_id))
+	if err != nil {
+		return nil, err
+	}
+
+	record := &SubtreeDownloadRecord{}
+	err = json.Unmarshal(serialized, record)
+	if err != nil {
+		return nil, err
+	}
+
+	if record.ClientId != client_id {
+		return nil, os.ErrNotExist
+	}
+
+	launcher, err := services.GetLauncher(config_obj)
+	if err != nil {
+		return nil, err
+	}
+
+	details, err := launcher.GetFlowDetails(ctx, config_obj,
+		services.GetFlowOptions{}, client_id, flow_id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SubtreeDownloadStats{
+		Total:    record.Complete + record.Failed,
+		Complete: record.Complete,
+		Failed:   record.Failed,
+		InFlight: details.Context != nil &&
+			details.Context.State == flows_proto.ArtifactCollectorContext_RUNNING,
+	}, nil
+}
@@ -0,0 +1,93 @@
+package vfs_service_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/alecthomas/assert"
+	"github.com/stretchr/testify/suite"
+	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/vfs_service"
+	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/utils"
+	"www.velocidex.com/golang/velociraptor/vtesting"
+)
+
+type SubtreeTestSuite struct {
+	*testsuite.CloudTestSuite
+}
+
+func (self *SubtreeTestSuite) TestDownloadSubtree() {
+	config_obj := self.ConfigObj.VeloConf()
+	client_id := "C.1234"
+
+	closer := utils.SetFlowIdForTests("F.1234")
+	defer closer()
+
+	// The accessor is required.
+	_, err := vfs_service.DownloadSubtree(self.Ctx, config_obj,
+		"admin", client_id, nil)
+	assert.Error(self.T(), err)
+
+	// A connected client may upload a file before the collection's
+	// details are written.
+	err = vfs_service.UpdateSubtreeDownloadProgress(self.Ctx, config_obj,
+		"F.1234", 1, 0)
+	assert.NoError(self.T(), err)
+
+	flow_id, err := vfs_service.DownloadSubtree(self.Ctx, config_obj,
+		"admin", client_id, []string{"auto", "test"})
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), "F.1234", flow_id)
+
+	err = cvelo_services.FlushBulkIndexer()
+	assert.NoError(self.T(), err)
+
+	// Wait here for the async flow to be written.
+	var stats *vfs_service.SubtreeDownloadStats
+	vtesting.WaitUntil(5*time.Second, self.T(), func() bool {
+		stats, err = vfs_service.SubtreeDownloadProgress(self.Ctx,
+			config_obj, client_id, flow_id)
+		return err == nil
+	})
+	assert.Equal(self.T(), &vfs_service.SubtreeDownloadStats{
+		Total: 1, Complete: 1, InFlight: true}, stats)
+
+	// The ingestor adds the uploaded files.
+	err = vfs_service.UpdateSubtreeDownloadProgress(self.Ctx, config_obj,
+		flow_id, 2, 0)
+	assert.NoError(self.T(), err)
+
+	err = vfs_service.UpdateSubtreeDownloadProgress(self.Ctx, config_obj,
+		flow_id, 1, 1)
+	assert.NoError(self.T(), err)
+
+	stats, err = vfs_service.SubtreeDownloadProgress(self.Ctx,
+		config_obj, client_id, flow_id)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), &vfs_service.SubtreeDownloadStats{
+		Total: 5, Complete: 4, Failed: 1, InFlight: true}, stats)
+
+	// Other download collections do not belong to a subtree
+	// download.
+	err = vfs_service.UpdateSubtreeDownloadProgress(self.Ctx, config_obj,
+		"F.5678", 1, 0)
+	assert.NoError(self.T(), err)
+
+	_, err = vfs_service.SubtreeDownloadProgress(self.Ctx,
+		config_obj, client_id, "F.5678")
+	assert.Error(self.T(), err)
+
+	// The progress is only available for the client.
+	_, err = vfs_service.SubtreeDownloadProgress(self.Ctx,
+		config_obj, "C.5678", flow_id)
+	assert.Error(self.T(), err)
+}
+
+func TestSubtree(t *testing.T) {
+	suite.Run(t, &SubtreeTestSuite{
+		CloudTestSuite: &testsuite.CloudTestSuite{
+			Indexes: []string{"persisted", "transient"},
+		},
+	})
+}
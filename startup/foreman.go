@@ -5,7 +5,9 @@ import (
 
 	"www.velocidex.com/golang/cloudvelo/config"
 	"www.velocidex.com/golang/cloudvelo/foreman"
+	"www.velocidex.com/golang/cloudvelo/services/backup"
 	"www.velocidex.com/golang/cloudvelo/services/orgs"
+	"www.velocidex.com/golang/cloudvelo/services/server_monitoring"
 	"www.velocidex.com/golang/velociraptor/api"
 	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
 	"www.velocidex.com/golang/velociraptor/services"
@@ -40,5 +42,27 @@ func StartForeman(
 	}
 
 	err = foreman.StartForemanService(sm.Ctx, sm.Wg, config_obj)
+	if err != nil {
+		return sm, err
+	}
+
+	// Scheduled backups run on the foreman so each org is backed
+	// up only once.
+	err = backup.StartBackupScheduler(sm.Ctx, sm.Wg, config_obj)
+	if err != nil {
+		return sm, err
+	}
+
+	// Org teardowns interrupted by a restart are resumed by the
+	// foreman so they are not run by every frontend.
+	err = orgs.StartOrgTeardownService(sm.Ctx, sm.Wg, config_obj)
+	if err != nil {
+		return sm, err
+	}
+
+	// Server event artifacts run on the foreman because there is
+	// only one foreman in the deployment.
+	err = server_monitoring.StartServerMonitoringService(
+		sm.Ctx, sm.Wg, config_obj)
 	return sm, err
 }
@@ -0,0 +1,1163 @@
+package testsuite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"www.velocidex.com/golang/cloudvelo/services"
+	"www.velocidex.com/golang/cloudvelo/services/embedded"
+)
+
+// An in-process stand-in for OpenSearch which speaks the subset of
+// the REST API that cloudvelo uses, so the tests do not need a real
+// cluster. Documents are kept in memory and searched with the same
+// query engine as the embedded backend.
+//
+// Data streams are plain indexes here, all writes are visible
+// immediately and templates, mappings and retention policies are
+// stored but not applied.
+type OpenSearchServer struct {
+	mu sync.Mutex
+
+	listener net.Listener
+	server   *http.Server
+
+	indexes   map[string]map[string]*storedDocument
+	templates map[string]json.RawMessage
+	policies  map[string]*storedPolicy
+
+	// Point in time and scroll snapshots.
+	pits    map[string][]*embedded.Document
+	scrolls map[string]*scrollState
+
+	// Keeps searches in the order the documents were written.
+	seq int
+}
+
+type storedDocument struct {
+	*embedded.Document
+	seq int
+}
+
+type storedPolicy struct {
+	seq_no int
+	policy json.RawMessage
+}
+
+type scrollState struct {
+	remaining []*embedded.Document
+	size      int
+	with_sort bool
+}
+
+func (self *OpenSearchServer) URL() string {
+	return "http://" + self.listener.Addr().String() + "/"
+}
+
+func (self *OpenSearchServer) Close() error {
+	return self.server.Close()
+}
+
+func (self *OpenSearchServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	parts := splitPath(r.URL)
+	if len(parts) == 0 {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"name":         "cloudvelo",
+			"cluster_name": "cloudvelo",
+			"version": map[string]interface{}{
+				"distribution": "opensearch",
+				"number":       "2.11.0",
+			},
+		})
+		return
+	}
+
+	switch parts[0] {
+	case "_cluster":
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"cluster_name": "cloudvelo",
+			"status":       "green",
+		})
+
+	case "_cat":
+		self.catIndices(w)
+
+	case "_index_template":
+		self.indexTemplate(w, r.Method, parts, body)
+
+	case "_plugins":
+		self.ismPolicy(w, r, parts, body)
+
+	case "_data_stream":
+		if r.Method != "DELETE" || len(parts) != 2 {
+			unsupported(w, r)
+			return
+		}
+		self.deleteIndexes(w, parts[1])
+
+	case "_bulk":
+		self.bulk(w, "", body)
+
+	case "_reindex":
+		self.reindex(w, body)
+
+	case "_refresh":
+		acknowledge(w)
+
+	case "_search":
+		switch {
+		case len(parts) == 1:
+			self.search(w, r, "", body)
+		case parts[1] == "point_in_time" && r.Method == "DELETE":
+			self.deletePointInTime(w, body)
+		case parts[1] == "scroll" && r.Method == "DELETE":
+			for _, id := range strings.Split(strings.Join(parts[2:], ","), ",") {
+				delete(self.scrolls, id)
+			}
+			acknowledge(w)
+		case parts[1] == "scroll":
+			self.scroll(w, r.URL.Query().Get("scroll_id"))
+		default:
+			unsupported(w, r)
+		}
+
+	default:
+		self.indexRequest(w, r, parts, body)
+	}
+}
+
+// Requests on an index, e.g. /index/_doc/id
+func (self *OpenSearchServer) indexRequest(
+	w http.ResponseWriter, r *http.Request, parts []string, body []byte) {
+	index := parts[0]
+
+	if len(parts) == 1 {
+		switch r.Method {
+		case "DELETE":
+			self.deleteIndexes(w, index)
+		case "HEAD":
+			_, err := self.resolve(index)
+			if err != nil {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			unsupported(w, r)
+		}
+		return
+	}
+
+	id := ""
+	if len(parts) > 2 {
+		id = parts[2]
+	}
+
+	switch parts[1] {
+	case "_doc":
+		switch r.Method {
+		case "GET":
+			self.getDocument(w, index, id)
+		case "PUT", "POST":
+			self.indexDocument(w, index, id,
+				r.URL.Query().Get("op_type") == "create", body)
+		case "DELETE":
+			self.deleteDocument(w, index, id)
+		default:
+			unsupported(w, r)
+		}
+
+	case "_create":
+		self.indexDocument(w, index, id, true, body)
+
+	case "_update":
+		self.updateDocument(w, index, id, body)
+
+	case "_mget":
+		self.multiGet(w, index, body)
+
+	case "_search":
+		if len(parts) > 2 && parts[2] == "point_in_time" {
+			self.createPointInTime(w, index)
+			return
+		}
+		self.search(w, r, index, body)
+
+	case "_count":
+		self.count(w, index, body)
+
+	case "_delete_by_query":
+		self.deleteByQuery(w, index, body)
+
+	case "_bulk":
+		self.bulk(w, index, body)
+
+	case "_refresh":
+		acknowledge(w)
+
+	case "_mapping", "_rollover":
+		_, err := self.resolve(index)
+		if err != nil {
+			writeIndexNotFound(w, index)
+			return
+		}
+		acknowledge(w)
+
+	default:
+		unsupported(w, r)
+	}
+}
+
+// Expand a comma separated list of index names or patterns into the
+// existing indexes. Names which do not exist are an error but
+// patterns may match nothing.
+func (self *OpenSearchServer) resolve(pattern string) ([]string, error) {
+	seen := make(map[string]bool)
+	var result []string
+
+	for _, name := range strings.Split(pattern, ",") {
+		if name == "_all" {
+			name = "*"
+		}
+
+		if !strings.Contains(name, "*") {
+			_, pres := self.indexes[name]
+			if !pres {
+				return nil, fmt.Errorf("no such index [%v]", name)
+			}
+			if !seen[name] {
+				seen[name] = true
+				result = append(result, name)
+			}
+			continue
+		}
+
+		for index := range self.indexes {
+			matched, _ := path.Match(name, index)
+			if matched && !seen[index] {
+				seen[index] = true
+				result = append(result, index)
+			}
+		}
+	}
+
+	sort.Strings(result)
+	return result, nil
+}
+
+// The documents in the indexes in the order they were written. The
+// documents are copies so searches can not interfere with each other.
+func (self *OpenSearchServer) documents(indexes []string) []*embedded.Document {
+	var result []*embedded.Document
+	for _, index := range indexes {
+		var stored []*storedDocument
+		for _, doc := range self.indexes[index] {
+			stored = append(stored, doc)
+		}
+		sort.Slice(stored, func(i, j int) bool {
+			return stored[i].seq < stored[j].seq
+		})
+
+		for _, doc := range stored {
+			clone := *doc.Document
+			result = append(result, &clone)
+		}
+	}
+	return result
+}
+
+// Returns the id of the document, which is generated if not given.
+func (self *OpenSearchServer) put(
+	index, id, raw string, create bool) (string, int, error) {
+	if id == "" {
+		id = embedded.NewDocId()
+	}
+
+	document, err := embedded.NewDocument(index, id, raw)
+	if err != nil {
+		return id, http.StatusBadRequest, err
+	}
+
+	docs, pres := self.indexes[index]
+	if !pres {
+		docs = make(map[string]*storedDocument)
+		self.indexes[index] = docs
+	}
+
+	existing, pres := docs[id]
+	if pres && create {
+		return id, http.StatusConflict, fmt.Errorf(
+			"[%v]: version conflict, document already exists", id)
+	}
+
+	doc := &storedDocument{Document: document}
+
+	// Overwriting a document keeps its place.
+	if pres {
+		doc.seq = existing.seq
+		docs[id] = doc
+		return id, http.StatusOK, nil
+	}
+
+	self.seq++
+	doc.seq = self.seq
+	docs[id] = doc
+	return id, http.StatusCreated, nil
+}
+
+func (self *OpenSearchServer) update(index, id, query string) (int, error) {
+	existing, pres := self.indexes[index][id]
+	if !pres {
+		upsert, err := embedded.UpsertDocument(query)
+		if err != nil {
+			return http.StatusBadRequest, err
+		}
+		if upsert == "" {
+			return http.StatusNotFound, fmt.Errorf("[%v]: document missing", id)
+		}
+
+		_, status, err := self.put(index, id, upsert, false)
+		return status, err
+	}
+
+	// The update makes a fresh copy so snapshots are not changed.
+	raw, err := embedded.ApplyUpdate(existing.Raw, query)
+	if err != nil {
+		return http.StatusBadRequest, err
+	}
+
+	_, status, err := self.put(index, id, raw, false)
+	return status, err
+}
+
+func (self *OpenSearchServer) getDocument(
+	w http.ResponseWriter, index, id string) {
+	doc, pres := self.indexes[index][id]
+	if !pres {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"_index": index,
+			"_id":    id,
+			"found":  false,
+		})
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_index":  index,
+		"_id":     id,
+		"found":   true,
+		"_source": json.RawMessage(doc.Raw),
+	})
+}
+
+func (self *OpenSearchServer) indexDocument(w http.ResponseWriter,
+	index, id string, create bool, body []byte) {
+	id, status, err := self.put(index, id, string(body), create)
+	if err != nil {
+		writeDocumentError(w, status, index, err)
+		return
+	}
+
+	result := "created"
+	if status == http.StatusOK {
+		result = "updated"
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"_index": index,
+		"_id":    id,
+		"result": result,
+	})
+}
+
+func (self *OpenSearchServer) updateDocument(
+	w http.ResponseWriter, index, id string, body []byte) {
+	status, err := self.update(index, id, string(body))
+	if err != nil {
+		writeDocumentError(w, status, index, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_index": index,
+		"_id":    id,
+		"result": "updated",
+	})
+}
+
+func (self *OpenSearchServer) deleteDocument(
+	w http.ResponseWriter, index, id string) {
+	_, pres := self.indexes[index][id]
+	if !pres {
+		writeJSON(w, http.StatusNotFound, map[string]interface{}{
+			"_index": index,
+			"_id":    id,
+			"result": "not_found",
+		})
+		return
+	}
+
+	delete(self.indexes[index], id)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_index": index,
+		"_id":    id,
+		"result": "deleted",
+	})
+}
+
+func (self *OpenSearchServer) multiGet(
+	w http.ResponseWriter, index string, body []byte) {
+	request := &struct {
+		Docs []struct {
+			Id string `json:"_id"`
+		} `json:"docs"`
+		Ids []string `json:"ids"`
+	}{}
+	err := json.Unmarshal(body, request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+
+	ids := request.Ids
+	for _, doc := range request.Docs {
+		ids = append(ids, doc.Id)
+	}
+
+	docs := []interface{}{}
+	for _, id := range ids {
+		doc, pres := self.indexes[index][id]
+		if !pres {
+			docs = append(docs, map[string]interface{}{
+				"_index": index,
+				"_id":    id,
+				"found":  false,
+			})
+			continue
+		}
+
+		docs = append(docs, map[string]interface{}{
+			"_index":  index,
+			"_id":     id,
+			"found":   true,
+			"_source": json.RawMessage(doc.Raw),
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"docs": docs})
+}
+
+func (self *OpenSearchServer) search(w http.ResponseWriter,
+	r *http.Request, index string, body []byte) {
+	request, err := embedded.ParseSearch(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parsing_exception", err.Error(), "")
+		return
+	}
+
+	params := r.URL.Query()
+	if params.Get("size") != "" {
+		request.SetSize(int(services.ScriptInt(params.Get("size"))))
+	}
+	if params.Get("sort") != "" {
+		request.SetURLSort(params.Get("sort"))
+	}
+
+	// Searches through a point in time do not name the index.
+	var docs []*embedded.Document
+	pit_id := pointInTimeId(body)
+	if pit_id != "" {
+		snapshot, pres := self.pits[pit_id]
+		if !pres {
+			writeError(w, http.StatusNotFound, "search_context_missing_exception",
+				"No search context found for id ["+pit_id+"]", "")
+			return
+		}
+		for _, doc := range snapshot {
+			clone := *doc
+			docs = append(docs, &clone)
+		}
+
+	} else {
+		if index == "" {
+			index = "_all"
+		}
+		indexes, err := self.resolve(index)
+		if err != nil {
+			writeIndexNotFound(w, index)
+			return
+		}
+		docs = self.documents(indexes)
+	}
+
+	// Scrolls return all the matches one page at a time.
+	scroll_size := request.Size()
+	if params.Get("scroll") != "" {
+		request.SetSize(-1)
+	}
+
+	hits, total, aggregations, err := embedded.Search(docs, request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_shard_exception", err.Error(), "")
+		return
+	}
+
+	response := map[string]interface{}{
+		"took":      1,
+		"timed_out": false,
+	}
+
+	if pit_id != "" {
+		response["pit_id"] = pit_id
+	}
+
+	if params.Get("scroll") != "" {
+		scroll_id := embedded.NewDocId()
+		if scroll_size < 0 || scroll_size > len(hits) {
+			scroll_size = len(hits)
+		}
+		self.scrolls[scroll_id] = &scrollState{
+			remaining: hits[scroll_size:],
+			size:      scroll_size,
+			with_sort: request.Sorted(),
+		}
+		hits = hits[:scroll_size]
+		response["_scroll_id"] = scroll_id
+	}
+
+	response["hits"] = map[string]interface{}{
+		"total": map[string]interface{}{
+			"value":    total,
+			"relation": "eq",
+		},
+		"hits": formatHits(hits, request.Sorted()),
+	}
+
+	if request.Aggregation() != "" {
+		response["aggregations"] = map[string]interface{}{
+			embedded.AGGREGATION_NAME: formatAggregation(
+				request.Aggregation(), aggregations),
+		}
+	}
+
+	writeJSON(w, http.StatusOK, response)
+}
+
+func (self *OpenSearchServer) scroll(w http.ResponseWriter, scroll_id string) {
+	state, pres := self.scrolls[scroll_id]
+	if !pres {
+		writeError(w, http.StatusNotFound, "search_context_missing_exception",
+			"No search context found for id ["+scroll_id+"]", "")
+		return
+	}
+
+	size := state.size
+	if size > len(state.remaining) {
+		size = len(state.remaining)
+	}
+	hits := state.remaining[:size]
+	state.remaining = state.remaining[size:]
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"_scroll_id": scroll_id,
+		"hits": map[string]interface{}{
+			"hits": formatHits(hits, state.with_sort),
+		},
+	})
+}
+
+func (self *OpenSearchServer) createPointInTime(
+	w http.ResponseWriter, index string) {
+	indexes, err := self.resolve(index)
+	if err != nil {
+		writeIndexNotFound(w, index)
+		return
+	}
+
+	pit_id := embedded.NewDocId()
+	self.pits[pit_id] = self.documents(indexes)
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"pit_id":        pit_id,
+		"creation_time": 0,
+	})
+}
+
+func (self *OpenSearchServer) deletePointInTime(
+	w http.ResponseWriter, body []byte) {
+	request := &struct {
+		PitId []string `json:"pit_id"`
+	}{}
+	_ = json.Unmarshal(body, request)
+
+	pits := []interface{}{}
+	for _, id := range request.PitId {
+		_, pres := self.pits[id]
+		delete(self.pits, id)
+		pits = append(pits, map[string]interface{}{
+			"pit_id":     id,
+			"successful": pres,
+		})
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pits": pits})
+}
+
+func (self *OpenSearchServer) count(
+	w http.ResponseWriter, index string, body []byte) {
+	request, err := embedded.ParseSearch(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parsing_exception", err.Error(), "")
+		return
+	}
+
+	indexes, err := self.resolve(index)
+	if err != nil {
+		writeIndexNotFound(w, index)
+		return
+	}
+
+	request.SetSize(0)
+	_, total, _, err := embedded.Search(self.documents(indexes), request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_shard_exception", err.Error(), "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"count": total})
+}
+
+func (self *OpenSearchServer) deleteByQuery(
+	w http.ResponseWriter, index string, body []byte) {
+	request, err := embedded.ParseSearch(string(body))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parsing_exception", err.Error(), "")
+		return
+	}
+
+	indexes, err := self.resolve(index)
+	if err != nil {
+		writeIndexNotFound(w, index)
+		return
+	}
+
+	request.SetSize(-1)
+	hits, _, _, err := embedded.Search(self.documents(indexes), request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_shard_exception", err.Error(), "")
+		return
+	}
+
+	for _, hit := range hits {
+		delete(self.indexes[hit.Index], hit.Id)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"deleted":  len(hits),
+		"failures": []interface{}{},
+	})
+}
+
+func (self *OpenSearchServer) deleteIndexes(w http.ResponseWriter, pattern string) {
+	indexes, err := self.resolve(pattern)
+	if err != nil {
+		writeIndexNotFound(w, pattern)
+		return
+	}
+
+	for _, index := range indexes {
+		delete(self.indexes, index)
+	}
+	acknowledge(w)
+}
+
+func (self *OpenSearchServer) catIndices(w http.ResponseWriter) {
+	result := []interface{}{}
+	for index, docs := range self.indexes {
+		result = append(result, map[string]interface{}{
+			"health":     "green",
+			"status":     "open",
+			"index":      index,
+			"docs.count": fmt.Sprintf("%d", len(docs)),
+		})
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// The bulk body is a list of actions, each followed by the document
+// except for deletes.
+func (self *OpenSearchServer) bulk(
+	w http.ResponseWriter, default_index string, body []byte) {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	scanner.Buffer(make([]byte, 1024*1024), len(body)+1)
+
+	items := []interface{}{}
+	has_errors := false
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		actions := make(map[string]struct {
+			Index string `json:"_index"`
+			Id    string `json:"_id"`
+		})
+		err := json.Unmarshal([]byte(line), &actions)
+		if err != nil || len(actions) != 1 {
+			writeError(w, http.StatusBadRequest, "illegal_argument_exception",
+				"Malformed action/metadata line: "+line, "")
+			return
+		}
+
+		for action, meta := range actions {
+			index := meta.Index
+			if index == "" {
+				index = default_index
+			}
+
+			source := ""
+			if action != "delete" {
+				if !scanner.Scan() {
+					writeError(w, http.StatusBadRequest,
+						"illegal_argument_exception",
+						"Missing document for "+action, "")
+					return
+				}
+				source = scanner.Text()
+			}
+
+			var status int
+			switch action {
+			case "index", "create":
+				meta.Id, status, err = self.put(
+					index, meta.Id, source, action == "create")
+			case "update":
+				status, err = self.update(index, meta.Id, source)
+			case "delete":
+				status = http.StatusOK
+				_, pres := self.indexes[index][meta.Id]
+				if !pres {
+					status = http.StatusNotFound
+				}
+				delete(self.indexes[index], meta.Id)
+			default:
+				err = fmt.Errorf("Unknown bulk action %v", action)
+				status = http.StatusBadRequest
+			}
+
+			item := map[string]interface{}{
+				"_index": index,
+				"_id":    meta.Id,
+				"status": status,
+			}
+			if err != nil {
+				has_errors = true
+				item["error"] = errorDetails(status, index, err)
+			}
+			items = append(items, map[string]interface{}{action: item})
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"took":   1,
+		"errors": has_errors,
+		"items":  items,
+	})
+}
+
+func (self *OpenSearchServer) reindex(w http.ResponseWriter, body []byte) {
+	request := &struct {
+		Source struct {
+			Index string          `json:"index"`
+			Query json.RawMessage `json:"query"`
+		} `json:"source"`
+		Dest struct {
+			Index string `json:"index"`
+		} `json:"dest"`
+	}{}
+	err := json.Unmarshal(body, request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parse_exception", err.Error(), "")
+		return
+	}
+
+	query := ""
+	if len(request.Source.Query) > 0 {
+		query = `{"query": ` + string(request.Source.Query) + `}`
+	}
+	search_request, err := embedded.ParseSearch(query)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "parsing_exception", err.Error(), "")
+		return
+	}
+	search_request.SetSize(-1)
+
+	indexes, err := self.resolve(request.Source.Index)
+	if err != nil {
+		writeIndexNotFound(w, request.Source.Index)
+		return
+	}
+
+	hits, _, _, err := embedded.Search(self.documents(indexes), search_request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "query_shard_exception", err.Error(), "")
+		return
+	}
+
+	for _, hit := range hits {
+		_, _, err = self.put(request.Dest.Index, hit.Id, hit.Raw, false)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "exception", err.Error(), "")
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"total":    len(hits),
+		"created":  len(hits),
+		"failures": []interface{}{},
+	})
+}
+
+func (self *OpenSearchServer) indexTemplate(w http.ResponseWriter,
+	method string, parts []string, body []byte) {
+	if len(parts) != 2 {
+		writeError(w, http.StatusBadRequest, "illegal_argument_exception",
+			"Template name required", "")
+		return
+	}
+	name := parts[1]
+
+	switch method {
+	case "PUT", "POST":
+		if !json.Valid(body) {
+			writeError(w, http.StatusBadRequest, "parse_exception",
+				"Invalid template", "")
+			return
+		}
+		self.templates[name] = json.RawMessage(body)
+		acknowledge(w)
+
+	case "DELETE":
+		delete(self.templates, name)
+		acknowledge(w)
+
+	default:
+		template, pres := self.templates[name]
+		if !pres {
+			writeError(w, http.StatusNotFound, "resource_not_found_exception",
+				"index template matching ["+name+"] not found", "")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"index_templates": []interface{}{
+				map[string]interface{}{
+					"name":           name,
+					"index_template": template,
+				},
+			},
+		})
+	}
+}
+
+// Index State Management policies under /_plugins/_ism/policies and
+// /_plugins/_ism/change_policy
+func (self *OpenSearchServer) ismPolicy(w http.ResponseWriter,
+	r *http.Request, parts []string, body []byte) {
+	if len(parts) == 4 && parts[1] == "_ism" && parts[2] == "change_policy" {
+		self.changePolicy(w, body)
+		return
+	}
+
+	if len(parts) < 3 || parts[1] != "_ism" || parts[2] != "policies" {
+		unsupported(w, r)
+		return
+	}
+
+	if len(parts) == 3 {
+		var ids []string
+		for id := range self.policies {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		policies := []interface{}{}
+		for _, id := range ids {
+			policies = append(policies, formatPolicy(id, self.policies[id]))
+		}
+
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"policies":       policies,
+			"total_policies": len(policies),
+		})
+		return
+	}
+
+	id := parts[3]
+	existing, pres := self.policies[id]
+
+	switch r.Method {
+	case "DELETE":
+		if !pres {
+			writeError(w, http.StatusNotFound, "status_exception",
+				"Policy not found", "")
+			return
+		}
+		delete(self.policies, id)
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"_id": id, "result": "deleted"})
+
+	case "PUT":
+		seq_no := r.URL.Query().Get("if_seq_no")
+		if pres && seq_no != fmt.Sprintf("%d", existing.seq_no) {
+			writeError(w, http.StatusConflict,
+				"version_conflict_engine_exception",
+				"Policy "+id+" was changed", "")
+			return
+		}
+
+		request := &struct {
+			Policy json.RawMessage `json:"policy"`
+		}{}
+		err := json.Unmarshal(body, request)
+		if err != nil || len(request.Policy) == 0 {
+			writeError(w, http.StatusBadRequest, "parse_exception",
+				"Invalid policy", "")
+			return
+		}
+
+		policy := &storedPolicy{policy: request.Policy}
+		if pres {
+			policy.seq_no = existing.seq_no + 1
+		}
+		self.policies[id] = policy
+		writeJSON(w, http.StatusCreated, formatPolicy(id, policy))
+
+	default:
+		if !pres {
+			writeError(w, http.StatusNotFound, "status_exception",
+				"Policy not found", "")
+			return
+		}
+		writeJSON(w, http.StatusOK, formatPolicy(id, existing))
+	}
+}
+
+// Policies are not applied to indexes here so no index is updated.
+func (self *OpenSearchServer) changePolicy(w http.ResponseWriter, body []byte) {
+	request := &struct {
+		PolicyId string `json:"policy_id"`
+	}{}
+	err := json.Unmarshal(body, request)
+	if err != nil || request.PolicyId == "" {
+		writeError(w, http.StatusBadRequest, "parse_exception",
+			"Invalid change policy", "")
+		return
+	}
+
+	_, pres := self.policies[request.PolicyId]
+	if !pres {
+		writeError(w, http.StatusNotFound, "status_exception",
+			"Policy not found", "")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"updated_indices": 0,
+		"failures":        false,
+		"failed_indices":  []interface{}{},
+	})
+}
+
+func formatPolicy(id string, policy *storedPolicy) map[string]interface{} {
+	return map[string]interface{}{
+		"_id":           id,
+		"_seq_no":       policy.seq_no,
+		"_primary_term": 1,
+		"policy":        policy.policy,
+	}
+}
+
+func formatHits(hits []*embedded.Document, with_sort bool) []interface{} {
+	result := []interface{}{}
+	for _, hit := range hits {
+		item := map[string]interface{}{
+			"_index":  hit.Index,
+			"_id":     hit.Id,
+			"_score":  1,
+			"_source": json.RawMessage(hit.Raw),
+		}
+		if with_sort {
+			item["sort"] = hit.SortValues
+		}
+		result = append(result, item)
+	}
+	return result
+}
+
+// Aggregation values are reported as strings.
+func formatAggregation(kind string, values []string) interface{} {
+	if kind != "terms" {
+		var value interface{}
+		if len(values) > 0 {
+			value = values[0]
+		}
+		return map[string]interface{}{"value": value}
+	}
+
+	buckets := []interface{}{}
+	for _, value := range values {
+		buckets = append(buckets, map[string]interface{}{"key": value})
+	}
+	return map[string]interface{}{"buckets": buckets}
+}
+
+func pointInTimeId(body []byte) string {
+	request := &struct {
+		Pit struct {
+			Id string `json:"id"`
+		} `json:"pit"`
+	}{}
+	_ = json.Unmarshal(body, request)
+	return request.Pit.Id
+}
+
+// Path components are unescaped separately so document ids may
+// contain a /
+func splitPath(u *url.URL) []string {
+	var result []string
+	for _, part := range strings.Split(u.EscapedPath(), "/") {
+		if part == "" {
+			continue
+		}
+		unescaped, err := url.PathUnescape(part)
+		if err != nil {
+			unescaped = part
+		}
+		result = append(result, unescaped)
+	}
+	return result
+}
+
+func writeJSON(w http.ResponseWriter, status int, response interface{}) {
+	serialized, err := json.Marshal(response)
+	if err != nil {
+		status = http.StatusInternalServerError
+		serialized = []byte(`{}`)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, _ = w.Write(serialized)
+}
+
+func acknowledge(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"acknowledged": true})
+}
+
+func errorDetails(status int, index string, err error) map[string]interface{} {
+	kind := "illegal_argument_exception"
+	switch status {
+	case http.StatusNotFound:
+		kind = "document_missing_exception"
+	case http.StatusConflict:
+		kind = "version_conflict_engine_exception"
+	}
+
+	cause := map[string]interface{}{
+		"type":   kind,
+		"reason": err.Error(),
+		"index":  index,
+	}
+	return map[string]interface{}{
+		"root_cause": []interface{}{cause},
+		"type":       kind,
+		"reason":     err.Error(),
+		"index":      index,
+	}
+}
+
+func writeDocumentError(w http.ResponseWriter, status int, index string, err error) {
+	writeJSON(w, status, map[string]interface{}{
+		"error":  errorDetails(status, index, err),
+		"status": status,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, kind, reason, index string) {
+	cause := map[string]interface{}{
+		"type":   kind,
+		"reason": reason,
+	}
+	if index != "" {
+		cause["index"] = index
+	}
+
+	details := map[string]interface{}{
+		"root_cause": []interface{}{cause},
+	}
+	for k, v := range cause {
+		details[k] = v
+	}
+
+	writeJSON(w, status, map[string]interface{}{
+		"error":  details,
+		"status": status,
+	})
+}
+
+func writeIndexNotFound(w http.ResponseWriter, index string) {
+	writeError(w, http.StatusNotFound, "index_not_found_exception",
+		"no such index ["+index+"]", index)
+}
+
+func unsupported(w http.ResponseWriter, r *http.Request) {
+	writeError(w, http.StatusBadRequest, "illegal_argument_exception",
+		fmt.Sprintf("Unsupported request %v %v", r.Method, r.URL.Path), "")
+}
+
+// Start a server on a random local port.
+func NewOpenSearchServer() (*OpenSearchServer, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &OpenSearchServer{
+		listener:  listener,
+		indexes:   make(map[string]map[string]*storedDocument),
+		templates: make(map[string]json.RawMessage),
+		policies:  make(map[string]*storedPolicy),
+		pits:      make(map[string][]*embedded.Document),
+		scrolls:   make(map[string]*scrollState),
+	}
+	result.server = &http.Server{Handler: result}
+
+	go func() {
+		_ = result.server.Serve(listener)
+	}()
+
+	return result, nil
+}
@@ -0,0 +1,104 @@
+package testsuite
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/alecthomas/assert"
+	opensearch "github.com/opensearch-project/opensearch-go/v2"
+	"github.com/opensearch-project/opensearch-go/v2/opensearchapi"
+)
+
+func doRequest(t *testing.T, client *opensearch.Client,
+	req opensearchapi.Request) (int, string) {
+	res, err := req.Do(context.Background(), client)
+	assert.NoError(t, err)
+	defer res.Body.Close()
+
+	data, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	return res.StatusCode, string(data)
+}
+
+func TestOpenSearchServer(t *testing.T) {
+	server, err := NewOpenSearchServer()
+	assert.NoError(t, err)
+	defer server.Close()
+
+	client, err := opensearch.NewClient(opensearch.Config{
+		Addresses: []string{server.URL()},
+	})
+	assert.NoError(t, err)
+
+	for _, id := range []string{"C.2", "C.1"} {
+		status, _ := doRequest(t, client, opensearchapi.IndexRequest{
+			Index:      "test_persisted",
+			DocumentID: id,
+			Body:       strings.NewReader(`{"client_id": "` + id + `"}`),
+		})
+		assert.Equal(t, http.StatusCreated, status)
+	}
+
+	status, _ := doRequest(t, client, opensearchapi.UpdateRequest{
+		Index:      "test_persisted",
+		DocumentID: "C.1",
+		Body:       strings.NewReader(`{"doc": {"ping": 10}}`),
+	})
+	assert.Equal(t, http.StatusOK, status)
+
+	status, body := doRequest(t, client, opensearchapi.GetRequest{
+		Index:      "test_persisted",
+		DocumentID: "C.1",
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, `"_source":{"client_id":"C.1","ping":10}`)
+
+	// Without a sort, documents are returned in the order written.
+	status, body = doRequest(t, client, opensearchapi.SearchRequest{
+		Index: []string{"test_*"},
+		Body:  strings.NewReader(`{"query": {"match_all": {}}}`),
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, strings.Index(body, `"C.2"`) < strings.Index(body, `"C.1"`))
+
+	// The sort may also be given in the URL.
+	status, body = doRequest(t, client, opensearchapi.SearchRequest{
+		Index: []string{"test_*"},
+		Sort:  []string{"client_id:asc"},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.True(t, strings.Index(body, `"C.1"`) < strings.Index(body, `"C.2"`))
+	assert.Contains(t, body, `"sort":["C.1"]`)
+
+	// Missing indexes are only an error when named explicitly.
+	status, body = doRequest(t, client, opensearchapi.CountRequest{
+		Index: []string{"test_transient*"},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"count":0}`, body)
+
+	status, body = doRequest(t, client, opensearchapi.SearchRequest{
+		Index: []string{"test_transient"},
+	})
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Contains(t, body, "index_not_found_exception")
+
+	// Creating an existing document fails in a bulk request.
+	status, body = doRequest(t, client, opensearchapi.BulkRequest{
+		Body: strings.NewReader(`{"create": {"_index": "test_persisted", "_id": "C.1"}}
+{"client_id": "C.1"}
+{"delete": {"_index": "test_persisted", "_id": "C.2"}}
+`),
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Contains(t, body, "version_conflict_engine_exception")
+
+	status, body = doRequest(t, client, opensearchapi.CountRequest{
+		Index: []string{"test_persisted"},
+	})
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, `{"count":1}`, body)
+}
@@ -0,0 +1,504 @@
+package testsuite
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An in-process stand-in for S3 which supports the object, listing
+// and multipart upload calls the filestore uses. Requests must use
+// path style addressing and are not authenticated. Buckets are
+// created on first use.
+type S3Server struct {
+	mu sync.Mutex
+
+	listener net.Listener
+	server   *http.Server
+
+	// bucket -> key -> object
+	buckets map[string]map[string]*s3Object
+	uploads map[string]*s3Upload
+}
+
+type s3Object struct {
+	data     []byte
+	etag     string
+	modified time.Time
+}
+
+type s3Upload struct {
+	bucket, key string
+	parts       map[int][]byte
+}
+
+type s3ListEntry struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListResult struct {
+	XMLName               xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	Marker                string `xml:",omitempty"`
+	NextMarker            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3ListEntry
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3DeleteRequest struct {
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+	Quiet bool
+}
+
+type s3Deleted struct {
+	Key string
+}
+
+type s3DeleteResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ DeleteResult"`
+	Deleted []s3Deleted
+}
+
+type s3InitiateResult struct {
+	XMLName  xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ InitiateMultipartUploadResult"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompleteRequest struct {
+	Parts []struct {
+		PartNumber int
+	} `xml:"Part"`
+}
+
+type s3CompleteResult struct {
+	XMLName xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ CompleteMultipartUploadResult"`
+	Bucket  string
+	Key     string
+	ETag    string
+}
+
+type s3Error struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string
+	Message string
+}
+
+func (self *S3Server) URL() string {
+	return "http://" + self.listener.Addr().String() + "/"
+}
+
+func (self *S3Server) Close() error {
+	return self.server.Close()
+}
+
+func (self *S3Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+
+	self.mu.Lock()
+	defer self.mu.Unlock()
+
+	// Path style addressing: /bucket/key
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	bucket := parts[0]
+	if bucket == "" {
+		writeS3Error(w, http.StatusBadRequest, "InvalidRequest",
+			"Listing buckets is not supported")
+		return
+	}
+
+	objects, pres := self.buckets[bucket]
+	if !pres {
+		objects = make(map[string]*s3Object)
+		self.buckets[bucket] = objects
+	}
+
+	params := r.URL.Query()
+	if len(parts) == 1 || parts[1] == "" {
+		switch {
+		case r.Method == "POST" && params.Has("delete"):
+			self.deleteObjects(w, objects, body)
+		case r.Method == "GET":
+			self.listObjects(w, bucket, objects, params)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+		return
+	}
+
+	key := parts[1]
+	switch {
+	case r.Method == "POST" && params.Has("uploads"):
+		upload_id := newS3Id()
+		self.uploads[upload_id] = &s3Upload{
+			bucket: bucket,
+			key:    key,
+			parts:  make(map[int][]byte),
+		}
+		writeXML(w, http.StatusOK, &s3InitiateResult{
+			Bucket: bucket, Key: key, UploadId: upload_id})
+
+	case r.Method == "PUT" && params.Has("uploadId"):
+		upload, pres := self.uploads[params.Get("uploadId")]
+		if !pres {
+			writeS3Error(w, http.StatusNotFound, "NoSuchUpload",
+				"The specified upload does not exist")
+			return
+		}
+		part_number, _ := strconv.Atoi(params.Get("partNumber"))
+		upload.parts[part_number] = body
+		w.Header().Set("ETag", etag(body))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "POST" && params.Has("uploadId"):
+		self.completeUpload(w, objects, params.Get("uploadId"), body)
+
+	case r.Method == "DELETE" && params.Has("uploadId"):
+		delete(self.uploads, params.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "PUT":
+		object := newS3Object(body)
+		objects[key] = object
+		w.Header().Set("ETag", object.etag)
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "DELETE":
+		delete(objects, key)
+		w.WriteHeader(http.StatusNoContent)
+
+	case r.Method == "HEAD":
+		object, pres := objects[key]
+		if !pres {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		writeObjectHeaders(w, object, len(object.data))
+		w.WriteHeader(http.StatusOK)
+
+	case r.Method == "GET":
+		self.getObject(w, r, objects, key)
+
+	default:
+		writeS3Error(w, http.StatusMethodNotAllowed, "MethodNotAllowed",
+			"The specified method is not allowed")
+	}
+}
+
+func (self *S3Server) getObject(w http.ResponseWriter, r *http.Request,
+	objects map[string]*s3Object, key string) {
+	object, pres := objects[key]
+	if !pres {
+		writeS3Error(w, http.StatusNotFound, "NoSuchKey",
+			"The specified key does not exist.")
+		return
+	}
+
+	size := len(object.data)
+	range_header := r.Header.Get("Range")
+	if range_header == "" {
+		writeObjectHeaders(w, object, size)
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write(object.data)
+		return
+	}
+
+	start, end, ok := parseRange(range_header, size)
+	if !ok {
+		writeS3Error(w, http.StatusRequestedRangeNotSatisfiable,
+			"InvalidRange", "The requested range is not satisfiable")
+		return
+	}
+
+	writeObjectHeaders(w, object, end-start+1)
+	w.Header().Set("Content-Range",
+		fmt.Sprintf("bytes %d-%d/%d", start, end, size))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(object.data[start : end+1])
+}
+
+// Handles both versions of the list API. Keys are listed in order
+// and keys sharing a prefix up to the delimiter are rolled up into a
+// common prefix.
+func (self *S3Server) listObjects(w http.ResponseWriter, bucket string,
+	objects map[string]*s3Object, params url.Values) {
+	result := &s3ListResult{
+		Name:      bucket,
+		Prefix:    params.Get("prefix"),
+		Delimiter: params.Get("delimiter"),
+		MaxKeys:   1000,
+	}
+
+	max_keys, err := strconv.Atoi(params.Get("max-keys"))
+	if err == nil && max_keys > 0 && max_keys < result.MaxKeys {
+		result.MaxKeys = max_keys
+	}
+
+	v2 := params.Get("list-type") == "2"
+	start := params.Get("marker")
+	if v2 {
+		result.ContinuationToken = params.Get("continuation-token")
+		result.StartAfter = params.Get("start-after")
+		start = result.StartAfter
+		if result.ContinuationToken != "" {
+			start = result.ContinuationToken
+		}
+	} else {
+		result.Marker = start
+	}
+
+	keys := make([]string, 0, len(objects))
+	for key := range objects {
+		if strings.HasPrefix(key, result.Prefix) && key > start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	last := ""
+	for _, key := range keys {
+		common_prefix := ""
+		if result.Delimiter != "" {
+			idx := strings.Index(key[len(result.Prefix):], result.Delimiter)
+			if idx >= 0 {
+				common_prefix = key[:len(result.Prefix)+idx+len(result.Delimiter)]
+			}
+		}
+
+		// Already listed on this or an earlier page.
+		if common_prefix != "" && (common_prefix <= start || common_prefix == last) {
+			continue
+		}
+
+		if result.KeyCount >= result.MaxKeys {
+			result.IsTruncated = true
+			break
+		}
+
+		if common_prefix != "" {
+			result.CommonPrefixes = append(result.CommonPrefixes,
+				s3CommonPrefix{Prefix: common_prefix})
+			last = common_prefix
+		} else {
+			object := objects[key]
+			result.Contents = append(result.Contents, s3ListEntry{
+				Key:          key,
+				LastModified: object.modified.Format("2006-01-02T15:04:05.000Z"),
+				ETag:         object.etag,
+				Size:         len(object.data),
+				StorageClass: "STANDARD",
+			})
+			last = key
+		}
+		result.KeyCount++
+	}
+
+	if result.IsTruncated {
+		if v2 {
+			result.NextContinuationToken = last
+		} else {
+			result.NextMarker = last
+		}
+	}
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (self *S3Server) deleteObjects(w http.ResponseWriter,
+	objects map[string]*s3Object, body []byte) {
+	request := &s3DeleteRequest{}
+	err := xml.Unmarshal(body, request)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	result := &s3DeleteResult{}
+	for _, object := range request.Objects {
+		delete(objects, object.Key)
+		if !request.Quiet {
+			result.Deleted = append(result.Deleted, s3Deleted{Key: object.Key})
+		}
+	}
+
+	writeXML(w, http.StatusOK, result)
+}
+
+func (self *S3Server) completeUpload(w http.ResponseWriter,
+	objects map[string]*s3Object, upload_id string, body []byte) {
+	upload, pres := self.uploads[upload_id]
+	if !pres {
+		writeS3Error(w, http.StatusNotFound, "NoSuchUpload",
+			"The specified upload does not exist")
+		return
+	}
+
+	request := &s3CompleteRequest{}
+	err := xml.Unmarshal(body, request)
+	if err != nil {
+		writeS3Error(w, http.StatusBadRequest, "MalformedXML", err.Error())
+		return
+	}
+
+	var data []byte
+	for _, part := range request.Parts {
+		part_data, pres := upload.parts[part.PartNumber]
+		if !pres {
+			writeS3Error(w, http.StatusBadRequest, "InvalidPart",
+				fmt.Sprintf("Part %v was not uploaded", part.PartNumber))
+			return
+		}
+		data = append(data, part_data...)
+	}
+
+	object := newS3Object(data)
+	objects[upload.key] = object
+	delete(self.uploads, upload_id)
+
+	writeXML(w, http.StatusOK, &s3CompleteResult{
+		Bucket: upload.bucket,
+		Key:    upload.key,
+		ETag:   object.etag,
+	})
+}
+
+func newS3Object(data []byte) *s3Object {
+	return &s3Object{
+		data:     data,
+		etag:     etag(data),
+		modified: time.Now().UTC(),
+	}
+}
+
+func etag(data []byte) string {
+	hash := md5.Sum(data)
+	return `"` + hex.EncodeToString(hash[:]) + `"`
+}
+
+func newS3Id() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// Parse a single byte range. Ranges past the end of the object are
+// truncated.
+func parseRange(header string, size int) (start, end int, ok bool) {
+	spec := strings.TrimPrefix(header, "bytes=")
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, false
+	}
+
+	end = size - 1
+	if parts[0] == "" {
+		// The last n bytes.
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		start = size - n
+		if start < 0 {
+			start = 0
+		}
+	} else {
+		var err error
+		start, err = strconv.Atoi(parts[0])
+		if err != nil {
+			return 0, 0, false
+		}
+		if parts[1] != "" {
+			end, err = strconv.Atoi(parts[1])
+			if err != nil {
+				return 0, 0, false
+			}
+			if end > size-1 {
+				end = size - 1
+			}
+		}
+	}
+
+	if start >= size || start > end {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+func writeObjectHeaders(w http.ResponseWriter, object *s3Object, length int) {
+	w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	w.Header().Set("ETag", object.etag)
+	w.Header().Set("Last-Modified", object.modified.Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+}
+
+func writeXML(w http.ResponseWriter, status int, response interface{}) {
+	serialized, err := xml.Marshal(response)
+	if err != nil {
+		status = http.StatusInternalServerError
+		serialized = nil
+	}
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(xml.Header))
+	_, _ = w.Write(serialized)
+}
+
+func writeS3Error(w http.ResponseWriter, status int, code, message string) {
+	writeXML(w, status, &s3Error{Code: code, Message: message})
+}
+
+// Start a server on a random local port.
+func NewS3Server() (*S3Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &S3Server{
+		listener: listener,
+		buckets:  make(map[string]map[string]*s3Object),
+		uploads:  make(map[string]*s3Upload),
+	}
+	result.server = &http.Server{Handler: result}
+
+	go func() {
+		_ = result.server.Serve(listener)
+	}()
+
+	return result, nil
+}
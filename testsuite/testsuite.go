@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/stretchr/testify/require"
@@ -18,6 +19,13 @@ import (
 	"www.velocidex.com/golang/velociraptor/vtesting/assert"
 )
 
+var (
+	fakes_once      sync.Once
+	fake_s3         *S3Server
+	fake_opensearch *OpenSearchServer
+	fakes_err       error
+)
+
 type CloudTestSuite struct {
 	suite.Suite
 
@@ -58,9 +66,33 @@ func (self *CloudTestSuite) LoadConfig() *config.Config {
 	config_obj, err := loader.Load()
 	require.NoError(self.T(), err)
 
+	// Tests use in-process stand-ins for OpenSearch and S3 unless
+	// told to use the services in the config.
+	if os.Getenv("VELOCIRAPTOR_TEST_EXTERNAL_SERVICES") == "" {
+		self.useFakes(config_obj)
+	}
+
 	return config_obj
 }
 
+// The fakes are shared by all the tests in the package, like the
+// external services would be.
+func (self *CloudTestSuite) useFakes(config_obj *config.Config) {
+	fakes_once.Do(func() {
+		fake_opensearch, fakes_err = NewOpenSearchServer()
+		if fakes_err != nil {
+			return
+		}
+		fake_s3, fakes_err = NewS3Server()
+	})
+	require.NoError(self.T(), fakes_err)
+
+	config_obj.Cloud.Addresses = []string{fake_opensearch.URL()}
+	config_obj.Cloud.SecondaryAddresses = nil
+	config_obj.Cloud.Clusters = nil
+	config_obj.Cloud.Endpoint = fake_s3.URL()
+}
+
 func (self *CloudTestSuite) SetupSuite() {
 	if self.ConfigObj == nil {
 		self.ConfigObj = self.LoadConfig()
@@ -4,10 +4,7 @@ import (
 	"context"
 
 	"github.com/Velocidex/ordereddict"
-	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/velociraptor/acls"
-	config_proto "www.velocidex.com/golang/velociraptor/config/proto"
-	"www.velocidex.com/golang/velociraptor/json"
 	"www.velocidex.com/golang/velociraptor/services"
 	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
 	"www.velocidex.com/golang/vfilter"
@@ -16,18 +13,6 @@ import (
 	_ "www.velocidex.com/golang/velociraptor/vql/server/clients"
 )
 
-const (
-	all_client_items = `
-{"query": {
-    "bool": {
-        "must": [
-            {"match": {"client_id": %q}},
-            {"match": {"doc_type": "clients"}}
-        ]}
-}}
-`
-)
-
 type DeleteClientArgs struct {
 	ClientId   string `vfilter:"required,field=client_id"`
 	ReallyDoIt bool   `vfilter:"optional,field=really_do_it"`
@@ -64,17 +49,37 @@ func (self DeleteClientPlugin) Call(ctx context.Context,
 			return
 		}
 
-		indexes := []string{"transient", "persisted"}
-		for _, index := range indexes {
-			if arg.ReallyDoIt {
-				err = removeClientDocs(ctx, config_obj, index, arg.ClientId)
-				if err != nil {
-					scope.Log("client_delete: %s : %s", index, err)
-					return
-				}
+		client_info_manager, err := services.GetClientInfoManager(config_obj)
+		if err != nil {
+			scope.Log("client_delete: %s", err)
+			return
+		}
+
+		principal := vql_subsystem.GetPrincipal(scope)
+		progress := make(chan services.DeleteFlowResponse)
+
+		go func() {
+			defer close(progress)
+
+			err := client_info_manager.DeleteClient(
+				ctx, arg.ClientId, principal, progress, arg.ReallyDoIt)
+			if err != nil {
+				scope.Log("client_delete: %s", err)
+			}
+		}()
+
+		for item := range progress {
+			select {
+			case <-ctx.Done():
+				return
+			case output_chan <- item:
 			}
 		}
 
+		if !arg.ReallyDoIt {
+			return
+		}
+
 		// Send an event that the client was deleted.
 		journal, err := services.GetJournal(config_obj)
 		if err != nil {
@@ -85,7 +90,7 @@ func (self DeleteClientPlugin) Call(ctx context.Context,
 		err = journal.PushRowsToArtifact(ctx, config_obj,
 			[]*ordereddict.Dict{ordereddict.NewDict().
 				Set("ClientId", arg.ClientId).
-				Set("Principal", vql_subsystem.GetPrincipal(scope))},
+				Set("Principal", principal)},
 			"Server.Internal.ClientDelete", "server", "")
 		if err != nil {
 			scope.Log("client_delete: %s", err)
@@ -108,14 +113,6 @@ func (self DeleteClientPlugin) Call(ctx context.Context,
 	return output_chan
 }
 
-func removeClientDocs(ctx context.Context,
-	config_obj *config_proto.Config, index string, clientId string) error {
-
-	return cvelo_services.DeleteByQuery(
-		ctx, config_obj.OrgId, index,
-		json.Format(all_client_items, clientId))
-}
-
 func (self DeleteClientPlugin) Info(
 	scope vfilter.Scope, type_map *vfilter.TypeMap) *vfilter.PluginInfo {
 	return &vfilter.PluginInfo{
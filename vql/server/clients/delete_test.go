@@ -10,6 +10,8 @@ import (
 	"www.velocidex.com/golang/cloudvelo/schema/api"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
 	"www.velocidex.com/golang/cloudvelo/testsuite"
+	"www.velocidex.com/golang/velociraptor/file_store"
+	"www.velocidex.com/golang/velociraptor/file_store/path_specs"
 	"www.velocidex.com/golang/velociraptor/json"
 
 	"www.velocidex.com/golang/velociraptor/logging"
@@ -21,6 +23,18 @@ import (
 	"www.velocidex.com/golang/velociraptor/vtesting"
 )
 
+const (
+	all_client_items = `
+{"query": {
+    "bool": {
+        "must": [
+            {"match": {"client_id": %q}},
+            {"match": {"doc_type": "clients"}}
+        ]}
+}}
+`
+)
+
 type DeleteTestSuite struct {
 	*testsuite.CloudTestSuite
 	client_id string
@@ -80,6 +94,19 @@ func (self *DeleteTestSuite) TestDeleteClient() {
 		assert.NoError(self.T(), err)
 	}
 
+	// Add the client's key and a queued task.
+	err := cvelo_services.SetElasticIndex(
+		self.Ctx, config_obj.OrgId, "persisted", "C.WithLabelFoo_key",
+		ordereddict.NewDict().Set("pem", "").Set("enroll_time", 10))
+	assert.NoError(self.T(), err)
+
+	err = cvelo_services.SetElasticIndex(
+		self.Ctx, config_obj.OrgId, "persisted", cvelo_services.DocIdRandom,
+		ordereddict.NewDict().
+			Set("client_id", "C.WithLabelFoo").
+			Set("doc_type", "task"))
+	assert.NoError(self.T(), err)
+
 	client := self.getClientRecord("C.WithLabelFoo")
 	assert.NotNil(self.T(), client)
 	self.client_id = client.ClientId
@@ -99,6 +126,32 @@ func (self *DeleteTestSuite) TestDeleteClient() {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
 	defer cancel()
 
+	// Upload a file for the client.
+	file_store_factory := file_store.GetFileStore(config_obj)
+	collections_path := path_specs.NewUnsafeFilestorePath(
+		"clients", self.client_id, "collections")
+	writer, err := file_store_factory.WriteFile(
+		collections_path.AddChild("F.1234", "uploads", "file.txt"))
+	assert.NoError(self.T(), err)
+	_, err = writer.Write([]byte("hello"))
+	assert.NoError(self.T(), err)
+	assert.NoError(self.T(), writer.Close())
+
+	files, err := file_store_factory.ListDirectory(collections_path)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(files))
+
+	// A dry run reports the items but does not remove them.
+	rows := vtesting.RunPlugin(DeleteClientPlugin{}.Call(ctx, scope,
+		ordereddict.NewDict().
+			Set("client_id", self.client_id)))
+	assert.True(self.T(), len(rows) > 0)
+
+	assert.NotNil(self.T(), self.getClientRecord(self.client_id))
+	files, err = file_store_factory.ListDirectory(collections_path)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 1, len(files))
+
 	_ = vtesting.RunPlugin(DeleteClientPlugin{}.Call(ctx, scope,
 		ordereddict.NewDict().
 			Set("really_do_it", true).
@@ -110,8 +163,25 @@ func (self *DeleteTestSuite) TestDeleteClient() {
 	assert.Nil(self.T(), result)
 	assert.Equal(self.T(), err, nil)
 
-	// TODO - verify that files are deleted
-	// TODO - verify that this client is removed from other indexes
+	// The key and task are removed too.
+	_, err = cvelo_services.GetElasticRecord(
+		ctx, self.ConfigObj.OrgId, "persisted", self.client_id+"_key")
+	assert.Error(self.T(), err)
+
+	result, _, err = cvelo_services.QueryElasticRaw(
+		ctx, self.ConfigObj.OrgId,
+		"persisted", json.Format(`{"query": {"bool": {"must": [
+            {"match": {"client_id": %q}}]}}}`, self.client_id))
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(result))
+
+	// Other clients are not affected.
+	assert.NotNil(self.T(), self.getClientRecord("C.OfflineClient"))
+
+	// The client's files are removed from the bucket.
+	files, err = file_store_factory.ListDirectory(collections_path)
+	assert.NoError(self.T(), err)
+	assert.Equal(self.T(), 0, len(files))
 }
 
 func (self *DeleteTestSuite) getClientRecord(client_id string) *api.ClientRecord {
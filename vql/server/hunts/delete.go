@@ -5,8 +5,8 @@ import (
 
 	"github.com/Velocidex/ordereddict"
 	cvelo_services "www.velocidex.com/golang/cloudvelo/services"
+	cvelo_hunt_dispatcher "www.velocidex.com/golang/cloudvelo/services/hunt_dispatcher"
 	"www.velocidex.com/golang/velociraptor/acls"
-	"www.velocidex.com/golang/velociraptor/services"
 	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
 	"www.velocidex.com/golang/vfilter"
 	"www.velocidex.com/golang/vfilter/arg_parser"
@@ -63,19 +63,9 @@ func (self DeleteHuntPlugin) Call(ctx context.Context,
 			return
 		}
 
-		launcher, err := services.GetLauncher(config_obj)
-		if err != nil {
-			scope.Log("hunt_delete: %s", err)
-			return
-		}
-
-		// Now remove the hunt from the database immediately so the
-		// GUI reflects the changes. We can not really delete the hunt
-		// because we might get updates for it for collections that
-		// are still in flight, so we set the hunt to the archived
-		// state instead. It might take a little while to actually
-		// delete all the contents but the GUI should reflect the hunt
-		// is deleted immediately.
+		// Archive the hunt first so the GUI reflects the changes
+		// immediately. It might take a little while to actually
+		// delete all the collections launched by the hunt.
 		if arg.ReallyDoIt {
 			err := cvelo_services.UpdateIndex(
 				ctx, config_obj.OrgId, "persisted",
@@ -85,47 +75,24 @@ func (self DeleteHuntPlugin) Call(ctx context.Context,
 			}
 		}
 
-		hunt_dispatcher, err := services.GetHuntDispatcher(config_obj)
+		results, err := cvelo_hunt_dispatcher.DeleteHunt(
+			ctx, config_obj, arg.HuntId, principal,
+			cvelo_hunt_dispatcher.DeleteHuntOptions{
+				ReallyDoIt:        arg.ReallyDoIt,
+				DeleteCollections: true,
+			})
 		if err != nil {
-			scope.Log("hunt_delete: %s", err)
+			scope.Log("hunt_delete: %v", err)
 			return
 		}
 
-		opts := services.FlowSearchOptions{
-			BasicInformation: true,
-		}
-		opts.StartIdx = 0
-		opts.EndIdx = 100000
-
-		flow_chan, _, err := hunt_dispatcher.GetFlows(
-			ctx, config_obj, opts, scope, arg.HuntId, 0)
-		if err != nil {
-			scope.Log("hunt_delete: %s", err)
-			return
-		}
-
-		for flow_details := range flow_chan {
-
-			results, err := launcher.Storage().DeleteFlow(ctx, config_obj,
-				flow_details.Context.ClientId,
-				flow_details.Context.SessionId, principal,
-				services.DeleteFlowOptions{
-					ReallyDoIt: arg.ReallyDoIt,
-				})
-			if err != nil {
-				scope.Log("hunt_delete: %v", err)
+		for _, res := range results {
+			select {
+			case <-ctx.Done():
 				return
-			}
-
-			for _, res := range results {
-				select {
-				case <-ctx.Done():
-					return
-				case output_chan <- res:
-				}
+			case output_chan <- res:
 			}
 		}
-
 	}()
 
 	return output_chan
@@ -140,6 +107,14 @@ func (self DeleteHuntPlugin) Info(
 	}
 }
 
+// The Go equivalent of archiveHuntScript.
+func archiveHunt(doc, params map[string]interface{}) error {
+	doc["state"] = "ARCHIVED"
+	return nil
+}
+
 func init() {
 	vql_subsystem.OverridePlugin(&DeleteHuntPlugin{})
+	cvelo_services.RegisterUpdateScript(`ctx._source.state="ARCHIVED";`,
+		archiveHunt)
 }
@@ -62,11 +62,15 @@ func (self *DeleteNotebookPlugin) Call(ctx context.Context,
 		}
 
 		if arg.ReallyDoIt {
-			err := services.DeleteByQuery(
-				ctx, config_obj.OrgId, "persisted",
-				json.Format(all_notebook_items, arg.NotebookId))
-			if err != nil {
-				scope.Log("notebook_delete: %v", err)
+			// Timeline rows are kept in their own index.
+			for _, index := range []string{
+				services.PERSISTED, services.TIMELINES} {
+				err := services.DeleteByQuery(
+					ctx, config_obj.OrgId, index,
+					json.Format(all_notebook_items, arg.NotebookId))
+				if err != nil {
+					scope.Log("notebook_delete: %v", err)
+				}
 			}
 		}
 
@@ -0,0 +1,119 @@
+package vfs
+
+import (
+	"context"
+
+	"github.com/Velocidex/ordereddict"
+	"www.velocidex.com/golang/cloudvelo/services/vfs_service"
+	"www.velocidex.com/golang/velociraptor/acls"
+	"www.velocidex.com/golang/velociraptor/vql"
+	vql_subsystem "www.velocidex.com/golang/velociraptor/vql"
+	"www.velocidex.com/golang/vfilter"
+	"www.velocidex.com/golang/vfilter/arg_parser"
+)
+
+type DownloadSubtreeFunctionArgs struct {
+	ClientId   string   `vfilter:"required,field=client_id"`
+	Components []string `vfilter:"required,field=components,doc=The VFS path of the directory, starting with the accessor."`
+}
+
+type DownloadSubtreeFunction struct{}
+
+func (self *DownloadSubtreeFunction) Call(ctx context.Context,
+	scope vfilter.Scope,
+	args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.COLLECT_CLIENT)
+	if err != nil {
+		scope.Log("vfs_download_subtree: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &DownloadSubtreeFunctionArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("vfs_download_subtree: %v", err)
+		return vfilter.Null{}
+	}
+
+	config_obj, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("vfs_download_subtree: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	principal := vql_subsystem.GetPrincipal(scope)
+	flow_id, err := vfs_service.DownloadSubtree(ctx, config_obj,
+		principal, arg.ClientId, arg.Components)
+	if err != nil {
+		scope.Log("vfs_download_subtree: %v", err)
+		return vfilter.Null{}
+	}
+
+	return flow_id
+}
+
+func (self DownloadSubtreeFunction) Info(scope vfilter.Scope,
+	type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:     "vfs_download_subtree",
+		Doc:      "Download all the files below a VFS directory. Returns the flow id.",
+		ArgType:  type_map.AddType(scope, &DownloadSubtreeFunctionArgs{}),
+		Metadata: vql.VQLMetadata().Permissions(acls.COLLECT_CLIENT).Build(),
+	}
+}
+
+type DownloadProgressFunctionArgs struct {
+	ClientId string `vfilter:"required,field=client_id"`
+	FlowId   string `vfilter:"required,field=flow_id,doc=The flow id returned by vfs_download_subtree()."`
+}
+
+type DownloadProgressFunction struct{}
+
+func (self *DownloadProgressFunction) Call(ctx context.Context,
+	scope vfilter.Scope,
+	args *ordereddict.Dict) vfilter.Any {
+
+	err := vql_subsystem.CheckAccess(scope, acls.READ_RESULTS)
+	if err != nil {
+		scope.Log("vfs_download_progress: %v", err)
+		return vfilter.Null{}
+	}
+
+	arg := &DownloadProgressFunctionArgs{}
+	err = arg_parser.ExtractArgsWithContext(ctx, scope, args, arg)
+	if err != nil {
+		scope.Log("vfs_download_progress: %v", err)
+		return vfilter.Null{}
+	}
+
+	config_obj, ok := vql_subsystem.GetServerConfig(scope)
+	if !ok {
+		scope.Log("vfs_download_progress: Command can only run on the server")
+		return vfilter.Null{}
+	}
+
+	stats, err := vfs_service.SubtreeDownloadProgress(ctx, config_obj,
+		arg.ClientId, arg.FlowId)
+	if err != nil {
+		scope.Log("vfs_download_progress: %v", err)
+		return vfilter.Null{}
+	}
+
+	return stats
+}
+
+func (self DownloadProgressFunction) Info(scope vfilter.Scope,
+	type_map *vfilter.TypeMap) *vfilter.FunctionInfo {
+	return &vfilter.FunctionInfo{
+		Name:     "vfs_download_progress",
+		Doc:      "Count the files a subtree download uploaded or failed to upload.",
+		ArgType:  type_map.AddType(scope, &DownloadProgressFunctionArgs{}),
+		Metadata: vql.VQLMetadata().Permissions(acls.READ_RESULTS).Build(),
+	}
+}
+
+func init() {
+	vql_subsystem.RegisterFunction(&DownloadSubtreeFunction{})
+	vql_subsystem.RegisterFunction(&DownloadProgressFunction{})
+}
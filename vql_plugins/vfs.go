@@ -4,5 +4,6 @@ import (
 	_ "www.velocidex.com/golang/cloudvelo/vql/server/clients"
 	_ "www.velocidex.com/golang/cloudvelo/vql/server/hunts"
 	_ "www.velocidex.com/golang/cloudvelo/vql/server/notebook"
+	_ "www.velocidex.com/golang/cloudvelo/vql/server/vfs"
 	_ "www.velocidex.com/golang/cloudvelo/vql/uploads"
 )